@@ -18,13 +18,14 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"chainguard.dev/melange/pkg/cli"
 	"github.com/chainguard-dev/clog"
 )
 
 func main() {
-	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
 
 	if err := cli.New().ExecuteContext(ctx); err != nil {
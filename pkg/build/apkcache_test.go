@@ -0,0 +1,46 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedPackageCache(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	repo := filepath.Join(src, "https%3A%2F%2Fpackages.wolfi.dev%2Fos", "x86_64")
+	require.NoError(t, os.MkdirAll(repo, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "foo-1.0-r0.apk"), []byte("foo"), 0o644))
+
+	require.NoError(t, seedPackageCache(src, dst))
+
+	got, err := os.ReadFile(filepath.Join(dst, "https%3A%2F%2Fpackages.wolfi.dev%2Fos", "x86_64", "foo-1.0-r0.apk"))
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(got))
+
+	// Writing a new entry into the private cache must not leak into the shared one.
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "bar-1.0-r0.apk"), []byte("bar"), 0o644))
+	_, err = os.Stat(filepath.Join(src, "bar-1.0-r0.apk"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, seedPackageCache(filepath.Join(src, "missing"), t.TempDir()))
+	require.NoError(t, seedPackageCache("", t.TempDir()))
+}
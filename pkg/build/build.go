@@ -25,6 +25,7 @@ import (
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
@@ -94,6 +95,8 @@ type Build struct {
 	ConfigFileLicense string
 
 	SourceDateEpoch time.Time
+	// Whether SourceDateEpoch was set from a build date, see WithBuildDate.
+	buildDateSet    bool
 	WorkspaceDir    string
 	WorkspaceIgnore string
 	// Ordered directories where to find 'uses' pipelines.
@@ -116,6 +119,7 @@ type Build struct {
 	CreateBuildLog        bool
 	CacheDir              string
 	ApkCacheDir           string
+	IsolatedApkCache      bool
 	CacheSource           string
 	StripOriginName       bool
 	EnvFile               string
@@ -134,9 +138,160 @@ type Build struct {
 	DefaultTimeout        time.Duration
 	Auth                  map[string]options.Auth
 	IgnoreSignatures      bool
+	OnAssertionFailure    AssertionFailureFunc
+	StepObserver          StepObserver
 
 	EnabledBuildOptions []string
 
+	// If set, the packages installed into the build environment are recorded
+	// in an apko lockfile at this path, suffixed with the architecture.
+	LockFile string
+	// If set, the build environment is pinned to the package versions
+	// recorded in the apko lockfile at this path, suffixed with the
+	// architecture.
+	PinLockFile string
+
+	// Whether to scan packaged files for references to the build workspace
+	// path, and globs of packaged files for which such references are fine.
+	CheckBuildPath  bool
+	BuildPathIgnore []string
+
+	// Whether to export ScrubbedEnvironment to the pipelines.
+	ScrubEnvironment bool
+
+	// If set, the connections the steps attempt through the proxy are
+	// recorded, without being blocked, and reported in this file, suffixed
+	// with the architecture, see WithNetworkReport.
+	NetworkReport string
+
+	// If set, the duration of the build and of each of its phases is
+	// appended to this file, as a line of JSON.
+	MetricsFile string
+
+	// Whether the workspace is mounted read-only, except for the output
+	// dir, for the steps which do not write the source, see writesSource.
+	ReadOnlySource bool
+
+	// If set, the diagnostics of a failed build are written to this file,
+	// suffixed with the architecture, see BuildDiagnostics.
+	DiagnosticsFile string
+
+	// If set, each step reached by the build, and its outcome, is written
+	// to this file, suffixed with the architecture, see TracedStep.
+	TraceFile string
+
+	// If set, the output dir of the build environment is copied to this
+	// dir, in a dir named after the architecture, when a pipeline fails.
+	SalvageDir string
+
+	// The values of the secret inputs of the pipelines, gathered by Compile,
+	// which are redacted from the diagnostics.
+	secrets []string
+
+	// The shell running the scripts of the steps which do not set their own,
+	// or DefaultShell if unset.
+	Shell string
+
+	// Environment variables exported to every step, overriding the
+	// environment of the configuration but not that of the steps.
+	EnvOverride map[string]string
+
+	// If set, Compile writes the resolved substitutions of the package to
+	// this writer, see SubstitutionMap.Print.
+	PrintSubstitutions io.Writer
+
+	// Whether BuildPackage only logs the commands of the steps which would
+	// run, instead of running them, see WithDryRun.
+	DryRun bool
+
+	// The command run, in the workdir of the failed step, to debug it
+	// interactively, or /bin/sh if unset, see WithDebugShell.
+	DebugShell []string
+
+	// Whether to debug failed steps as with Interactive, but leave the
+	// signal handling of the build alone until one fails, see
+	// WithDebugOnFailure.
+	DebugOnFailure bool
+
+	// The names of the host environment variables available to the
+	// pipelines as ${{environ.<name>}}, see WithAllowedEnviron.
+	AllowedEnviron []string
+
+	// Whether Compile fails on ${{...}} references left in the scripts of
+	// the steps, see WithStrictSubstitutions.
+	StrictSubstitutions bool
+
+	// If set, the dir the output of the script of each step is written to,
+	// see WithStepLogDir.
+	StepLogDir string
+
+	// Whether the pipelines keep running past the failed ones, see
+	// WithKeepGoing.
+	KeepGoing bool
+
+	// If set, rewrites the uris fetch steps download from, see
+	// WithURIRewriter.
+	URIRewriter func(string) string
+
+	// Whether the pipeline dirs cannot override the embedded pipelines, see
+	// WithNoPipelineOverrides.
+	NoPipelineOverrides bool
+
+	// If set, the file recording how many of the pipelines of the package
+	// completed, see WithCheckpointFile, and the number of them to skip as
+	// completed, see WithResumeFrom.
+	CheckpointFile string
+	ResumeFrom     int
+
+	// The pipelines read from PipelineDirs, which Compile creates.
+	pipelineCache *pipelineCache
+
+	// Whether to check that the shared libraries the packages link against
+	// are provided by their runtime dependencies, see checkLinkage.
+	CheckLinkage bool
+	// The runtime dependencies of each emitted package, and the names of the
+	// packages of the build environment by what they provide, for
+	// checkLinkage.
+	emittedRuntime       map[string][]string
+	environmentProviders map[string][]string
+
+	// Whether to check that each emitted package installs cleanly, with its
+	// dependencies, into a fresh root, see checkInstall.
+	CheckInstall bool
+
+	// The Linux capabilities needed by the pipelines, gathered by Compile.
+	neededCapabilities []string
+
+	// Variables overriding those of the configuration, of its vars file and
+	// of its build options.
+	Vars map[string]string
+
+	// Overrides of the commit or tag checked out by git-checkout steps.
+	GitOverrides []GitOverride
+
+	// Globs of the subpackages for which to generate an SBOM, and of those
+	// for which not to.  If SBOMSubpackages is empty, all subpackages match.
+	SBOMSubpackages        []string
+	SBOMExcludeSubpackages []string
+
+	// If set, the packages and their SBOMs are also written to this
+	// content-addressable store, and StoredArtifacts maps them to their
+	// digests once the build is done.
+	ContentAddressableDir string
+	StoredArtifacts       []StoredArtifact
+
+	// If set, the build fails unless the SBOM of each package is the same as
+	// its golden SBOM in this directory, see goldenSBOMPath.
+	GoldenSBOMDir string
+
+	// Whether to treat warnings about the build configuration, and warnings
+	// from linters, as errors.
+	Strict bool
+
+	// Whether to fail the build if any subpackage ends up without a license,
+	// either its own or one inherited from the origin package.
+	RequireSubpackageLicense bool
+
 	// Initialized in New and mutated throughout the build process as we gain
 	// visibility into our packages' (including subpackages') composition. This is
 	// how we get "build-time" SBOMs!
@@ -206,23 +361,13 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 	if b.ConfigFileRepositoryCommit == "" {
 		return nil, fmt.Errorf("config file repository commit was not set")
 	}
-	if b.Runner == nil {
+	if b.Runner == nil && !b.DryRun {
 		return nil, fmt.Errorf("no runner was specified")
 	}
 
-	parsedCfg, err := config.ParseConfiguration(ctx,
-		b.ConfigFile,
-		config.WithEnvFileForParsing(b.EnvFile),
-		config.WithVarsFileForParsing(b.VarsFile),
-		config.WithDefaultCPU(b.DefaultCPU),
-		config.WithDefaultCPUModel(b.DefaultCPUModel),
-		config.WithDefaultDisk(b.DefaultDisk),
-		config.WithDefaultMemory(b.DefaultMemory),
-		config.WithDefaultTimeout(b.DefaultTimeout),
-		config.WithCommit(b.ConfigFileRepositoryCommit),
-	)
+	parsedCfg, err := b.parseConfiguration(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load configuration: %w", err)
+		return nil, err
 	}
 
 	b.Configuration = *parsedCfg
@@ -233,11 +378,17 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 
 	if len(b.Configuration.Package.TargetArchitecture) == 1 &&
 		b.Configuration.Package.TargetArchitecture[0] == "all" {
-		log.Warnf("target-architecture: ['all'] is deprecated and will become an error; remove this field to build for all available archs")
+		if err := b.warn(ctx, "target-architecture: ['all'] is deprecated and will become an error; remove this field to build for all available archs"); err != nil {
+			return nil, err
+		}
 	} else if len(b.Configuration.Package.TargetArchitecture) != 0 &&
 		!sets.NewString(b.Configuration.Package.TargetArchitecture...).Has(b.Arch.ToAPK()) {
 		return nil, ErrSkipThisArch
 	}
+	if b.Configuration.Package.ExcludesArch(b.Arch) {
+		log.Infof("%s is not built for %s, which it lists in exclude-archs", b.Configuration.Package.Name, b.Arch.ToAPK())
+		return nil, ErrSkipThisArch
+	}
 
 	// SOURCE_DATE_EPOCH will always overwrite the build flag
 	if _, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
@@ -249,8 +400,28 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 	}
 	b.SBOMGroup.SetCreatedTime(b.SourceDateEpoch)
 
+	var warnings []error
+	for _, ref := range b.Configuration.UndeclaredOptionReferences() {
+		warnings = append(warnings, b.warn(ctx, "step %q references undeclared option %q", ref.Step, ref.Option))
+	}
+	if err := errors.Join(warnings...); err != nil {
+		return nil, err
+	}
+
+	if b.RequireSubpackageLicense {
+		if err := checkSubpackageLicenses(&b.Configuration); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.Configuration.Package.Reproducible {
+		if err := b.enforceReproducible(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check that we actually can run things in containers.
-	if b.Runner != nil && !b.Runner.TestUsability(ctx) {
+	if b.Runner != nil && !b.DryRun && !b.Runner.TestUsability(ctx) {
 		return nil, fmt.Errorf("unable to run containers using %s, specify --runner and one of %s", b.Runner.Name(), GetAllRunners())
 	}
 
@@ -268,6 +439,114 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 	return &b, nil
 }
 
+// dryRun walks the pipelines of the package and its subpackages with pr,
+// which logs the commands of the steps instead of running them, so without
+// preparing a workspace or starting a build environment.
+func (b *Build) dryRun(ctx context.Context, pr *pipelineRunner) error {
+	log := clog.FromContext(ctx)
+	log.Infof("dry run: logging the commands of the steps instead of running them")
+
+	if b.isBuildLess() {
+		return nil
+	}
+
+	if err := pr.runPipelines(ctx, b.Configuration.Pipeline); err != nil {
+		return fmt.Errorf("unable to run package %s pipeline: %w", b.Configuration.Name(), err)
+	}
+
+	for _, sp := range b.Configuration.Subpackages {
+		log.Infof("running pipeline for subpackage %s", sp.Name)
+
+		ctx := clog.WithLogger(ctx, log.With("subpackage", sp.Name))
+		if err := pr.runPipelines(ctx, sp.Pipeline); err != nil {
+			return fmt.Errorf("unable to run subpackage %s pipeline: %w", sp.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// packageFiles returns the paths of the packages emitted by the build.
+func (b *Build) packageFiles() []string {
+	packageDir := filepath.Join(b.OutDir, b.Arch.ToAPK())
+	pkg := b.Configuration.Package
+
+	apkFiles := []string{filepath.Join(packageDir, fmt.Sprintf("%s-%s-r%d.apk", pkg.Name, pkg.Version, pkg.Epoch))}
+	for _, subpkg := range b.Configuration.Subpackages {
+		apkFiles = append(apkFiles, filepath.Join(packageDir, fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, pkg.Version, pkg.Epoch)))
+	}
+
+	return apkFiles
+}
+
+// packageDir returns the directory of the workspace the named package is
+// packaged from: the destdir of a subpackage which overrides it, or else the
+// directory named after the package.
+func (b *Build) packageDir(name string) string {
+	dir := name
+	for _, sp := range b.Configuration.Subpackages {
+		if sp.Name == name {
+			dir = sp.DestDirName()
+			break
+		}
+	}
+	return filepath.Join(b.WorkspaceDir, melangeOutputDirName, dir)
+}
+
+// parseConfiguration loads the build configuration from ConfigFile.
+func (b *Build) parseConfiguration(ctx context.Context) (*config.Configuration, error) {
+	cfg, err := config.ParseConfiguration(ctx,
+		b.ConfigFile,
+		config.WithEnvFileForParsing(b.EnvFile),
+		config.WithVarsFileForParsing(b.VarsFile),
+		config.WithVarsForParsing(b.Vars),
+		config.WithDefaultCPU(b.DefaultCPU),
+		config.WithDefaultCPUModel(b.DefaultCPUModel),
+		config.WithDefaultDisk(b.DefaultDisk),
+		config.WithDefaultMemory(b.DefaultMemory),
+		config.WithDefaultTimeout(b.DefaultTimeout),
+		config.WithCommit(b.ConfigFileRepositoryCommit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// checkSubpackageLicenses returns an error listing the subpackages of cfg
+// which carry no license metadata.
+func checkSubpackageLicenses(cfg *config.Configuration) error {
+	if cfg.Package.LicenseExpression() != "" {
+		return nil
+	}
+
+	var unlicensed []string
+	for _, sp := range cfg.Subpackages {
+		if sp.LicenseExpression() == "" {
+			unlicensed = append(unlicensed, sp.Name)
+		}
+	}
+
+	if len(unlicensed) != 0 {
+		return fmt.Errorf("subpackages without a declared license: %s", strings.Join(unlicensed, ", "))
+	}
+
+	return nil
+}
+
+// warn reports a problem with the build which does not prevent it from
+// succeeding.  Problems are logged as warnings, unless the build is strict,
+// in which case they are returned as errors.
+func (b *Build) warn(ctx context.Context, format string, args ...any) error {
+	if b.Strict {
+		return fmt.Errorf("strict: "+format, args...)
+	}
+
+	clog.FromContext(ctx).Warnf(format, args...)
+	return nil
+}
+
 func (b *Build) Close(ctx context.Context) error {
 	log := clog.FromContext(ctx)
 	errs := []error{}
@@ -307,13 +586,35 @@ func (b *Build) buildGuest(ctx context.Context, imgConfig apko_types.ImageConfig
 		}...)
 	}
 
+	// When isolated, each build gets a private apk cache seeded from the shared
+	// one, so concurrent builds never write into the same cache directory.
+	apkCacheDir := b.ApkCacheDir
+	if b.IsolatedApkCache {
+		apkCacheDir = filepath.Join(tmp, "apk-cache")
+		if err := seedPackageCache(b.ApkCacheDir, apkCacheDir); err != nil {
+			return "", err
+		}
+		log.Debugf("using isolated apk cache %s", apkCacheDir)
+	}
+
+	extraPackages := b.ExtraPackages
+	if b.PinLockFile != "" {
+		pinLockFile := fmt.Sprintf("%s.%s", b.PinLockFile, b.Arch.ToAPK())
+		pins, err := pinnedPackages(pinLockFile)
+		if err != nil {
+			return "", err
+		}
+		log.Infof("pinning %d packages from %s", len(pins), pinLockFile)
+		extraPackages = slices.Concat(extraPackages, pins)
+	}
+
 	bc, err := apko_build.New(ctx, guestFS,
 		apko_build.WithImageConfiguration(imgConfig),
 		apko_build.WithArch(b.Arch),
 		apko_build.WithExtraKeys(b.ExtraKeys),
 		apko_build.WithExtraBuildRepos(b.ExtraRepos),
-		apko_build.WithExtraPackages(b.ExtraPackages),
-		apko_build.WithCache(b.ApkCacheDir, false, apk.NewCache(true)),
+		apko_build.WithExtraPackages(extraPackages),
+		apko_build.WithCache(apkCacheDir, false, apk.NewCache(true)),
 		apko_build.WithTempDir(tmp),
 		apko_build.WithIgnoreSignatures(b.IgnoreSignatures))
 	if err != nil {
@@ -327,6 +628,24 @@ func (b *Build) buildGuest(ctx context.Context, imgConfig apko_types.ImageConfig
 	if err := bc.BuildImage(ctx); err != nil {
 		return "", fmt.Errorf("unable to generate image: %w", err)
 	}
+
+	if b.LockFile != "" || b.CheckLinkage {
+		installed, err := bc.InstalledPackages()
+		if err != nil {
+			return "", fmt.Errorf("listing installed packages: %w", err)
+		}
+		if b.CheckLinkage {
+			b.environmentProviders = environmentProviders(installed)
+		}
+		if b.LockFile != "" {
+			lockFile := fmt.Sprintf("%s.%s", b.LockFile, b.Arch.ToAPK())
+			l := guestLock(imgConfig, b.ExtraRepos, b.ExtraKeys, b.Arch, installed)
+			if err := l.SaveToFile(lockFile); err != nil {
+				return "", fmt.Errorf("writing lockfile %s: %w", lockFile, err)
+			}
+			log.Infof("recorded %d build environment packages in %s", len(installed), lockFile)
+		}
+	}
 	// if the runner needs an image, create an OCI image from the directory and load it.
 	loader := b.Runner.OCIImageLoader()
 	if loader == nil {
@@ -390,6 +709,10 @@ func (b *Build) applyBuildOption(bo config.BuildOption) error {
 	}
 
 	for k, v := range bo.Vars {
+		if _, ok := b.Vars[k]; ok {
+			// Variables given explicitly win over build options.
+			continue
+		}
 		b.Configuration.Vars[k] = v
 	}
 
@@ -689,7 +1012,7 @@ type linterTarget struct {
 	disabled []string // checks that are downgraded from required -> warn
 }
 
-func (b *Build) BuildPackage(ctx context.Context) error {
+func (b *Build) BuildPackage(ctx context.Context) (err error) {
 	log := clog.FromContext(ctx)
 	ctx, span := otel.Tracer("melange").Start(ctx, "BuildPackage")
 	defer span.End()
@@ -711,6 +1034,48 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	pkg := &b.Configuration.Package
 	arch := b.Arch.ToAPK()
 
+	start, phases, succeeded := time.Now(), &phaseTimes{}, false
+	if b.MetricsFile != "" && !b.DryRun {
+		defer func() {
+			m := phases.metrics(pkg, arch, "build", start, succeeded)
+			if err := appendMetrics(b.MetricsFile, m); err != nil {
+				log.Warnf("unable to write build metrics: %v", err)
+			}
+		}()
+	}
+
+	// The runner of the steps, once the build gets to running them.
+	var pr *pipelineRunner
+	if b.DiagnosticsFile != "" {
+		if err := b.removeDiagnostics(); err != nil {
+			return fmt.Errorf("removing previous diagnostics: %w", err)
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			var failure *StepFailure
+			if pr != nil {
+				failure = pr.failure
+			}
+			if err := b.writeDiagnostics(ctx, err, failure); err != nil {
+				log.Warnf("unable to write diagnostics: %v", err)
+			}
+		}()
+	}
+
+	if b.TraceFile != "" && !b.DryRun {
+		defer func() {
+			var trace *stepTrace
+			if pr != nil {
+				trace = pr.trace
+			}
+			if err := b.writeTrace(ctx, trace); err != nil {
+				log.Warnf("unable to write trace: %v", err)
+			}
+		}()
+	}
+
 	// Add the APK package(s) to their respective SBOMs. We do this early in the
 	// build process so that we can later add more kinds of packages that relate to
 	// these packages, as we learn more during the build.
@@ -718,11 +1083,16 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		sp := sp
 		spSBOM := b.SBOMGroup.Document(sp.Name)
 
+		license := sp.LicenseExpression()
+		if license == "" {
+			license = pkg.LicenseExpression()
+		}
+
 		apkSubPkg := &sbom.Package{
 			Name:            sp.Name,
 			Version:         pkg.FullVersion(),
 			Copyright:       pkg.FullCopyright(),
-			LicenseDeclared: pkg.LicenseExpression(),
+			LicenseDeclared: license,
 			Namespace:       namespace,
 			Arch:            arch,
 			PURL:            pkg.PackageURLForSubpackage(namespace, arch, sp.Name),
@@ -742,7 +1112,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	}
 	pSBOM.AddPackageAndSetDescribed(apkPkg)
 
-	if b.GuestDir == "" {
+	if b.GuestDir == "" && !b.DryRun {
 		guestDir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-guest-*")
 		if err != nil {
 			return fmt.Errorf("unable to make guest directory: %w", err)
@@ -754,6 +1124,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
+	log.Infof("using embedded pipelines %s", PipelinesVersion())
 	log.Infof("evaluating pipelines for package requirements")
 	if err := b.Compile(ctx); err != nil {
 		return fmt.Errorf("compiling build: %w", err)
@@ -773,15 +1144,75 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		return !result
 	})
 
+	// Check the provides and replaces of the packages before building any,
+	// as they are only used once the packages are emitted.
+	if err := b.Configuration.ValidateRelationships(); err != nil {
+		return fmt.Errorf("validating provides and replaces: %w", err)
+	}
+
 	if err := b.addSBOMPackageForBuildConfigFile(); err != nil {
 		return fmt.Errorf("adding SBOM package for build config file: %w", err)
 	}
 
-	pr := &pipelineRunner{
-		interactive: b.Interactive,
+	if (b.Interactive || b.DebugOnFailure) && b.KeepGoing {
+		log.Warnf("not debugging failed steps interactively while keeping going")
+	}
+	pr = &pipelineRunner{
+		interactive: b.Interactive && !b.KeepGoing,
+		debugShell:  b.DebugShell,
 		debug:       b.Debug,
 		config:      b.workspaceConfig(ctx),
 		runner:      b.Runner,
+
+		onAssertionFailure: b.OnAssertionFailure,
+		observer:           b.StepObserver,
+
+		phases: phases,
+		phase:  PhaseBuild,
+
+		readOnlySource: b.ReadOnlySource,
+		shell:          b.Shell,
+		env:            b.EnvOverride,
+
+		diagnose: b.DiagnosticsFile != "",
+		secrets:  b.secrets,
+
+		stepLogDir: b.StepLogDir,
+
+		dryRun:    b.DryRun,
+		keepGoing: b.KeepGoing,
+
+		debugOnFailure: b.DebugOnFailure && !b.KeepGoing,
+	}
+	if b.TraceFile != "" {
+		pr.trace = &stepTrace{}
+	}
+
+	if b.DryRun {
+		return b.dryRun(ctx, pr)
+	}
+
+	checkpoint, err := b.checkpointer()
+	if err != nil {
+		return err
+	}
+
+	if b.ReadOnlySource {
+		if prm, ok := b.Runner.(container.PerRunMounter); !ok || !prm.MountsPerRun() {
+			return fmt.Errorf("a read-only source is not supported by the %s runner", b.Runner.Name())
+		}
+	}
+
+	if b.NetworkReport != "" {
+		if !supportsStepProxy(b.Runner, pr.config) {
+			return fmt.Errorf("network monitoring is not supported by the %s runner", b.Runner.Name())
+		}
+		pr.network = &networkMonitor{}
+		defer func() {
+			if err := b.writeNetworkReport(ctx, pr.network); err != nil {
+				log.Warnf("unable to write network report: %v", err)
+			}
+		}()
 	}
 
 	if b.EmptyWorkspace {
@@ -798,7 +1229,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
-	if err := os.MkdirAll(filepath.Join(b.WorkspaceDir, melangeOutputDirName, b.Configuration.Package.Name), 0o755); err != nil {
+	if err := os.MkdirAll(b.packageDir(b.Configuration.Package.Name), 0o755); err != nil {
 		return err
 	}
 
@@ -806,6 +1237,10 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	cfg := b.workspaceConfig(ctx)
 
 	if !b.isBuildLess() {
+		if err := checkCapabilities(b.Runner, cfg); err != nil {
+			return err
+		}
+
 		// Prepare guest directory
 		if err := os.MkdirAll(b.GuestDir, 0o755); err != nil {
 			return fmt.Errorf("mkdir -p %s: %w", b.GuestDir, err)
@@ -846,9 +1281,12 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		// run the main pipeline
 		log.Debug("running the main pipeline")
 		pipelines := b.Configuration.Pipeline
+		pr.checkpoint = checkpoint
 		if err := pr.runPipelines(ctx, pipelines); err != nil {
+			b.salvage(ctx, cfg)
 			return fmt.Errorf("unable to run package %s pipeline: %w", b.Configuration.Name(), err)
 		}
+		pr.checkpoint = nil
 
 		for i, p := range pipelines {
 			uniqueID := strconv.Itoa(i)
@@ -876,7 +1314,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	// run any pipelines for subpackages
 	for _, sp := range b.Configuration.Subpackages {
 		sp := sp
-		if err := os.MkdirAll(filepath.Join(b.WorkspaceDir, melangeOutputDirName, sp.Name), 0o755); err != nil {
+		if err := os.MkdirAll(b.packageDir(sp.Name), 0o755); err != nil {
 			return err
 		}
 
@@ -886,6 +1324,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			ctx := clog.WithLogger(ctx, log.With("subpackage", sp.Name))
 
 			if err := pr.runPipelines(ctx, sp.Pipeline); err != nil {
+				b.salvage(ctx, cfg)
 				return fmt.Errorf("unable to run subpackage %s pipeline: %w", sp.Name, err)
 			}
 		}
@@ -899,6 +1338,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	}
 
 	// Retrieve the post build workspace from the runner
+	packageStart := time.Now()
 	log.Infof("retrieving workspace from builder: %s", cfg.PodID)
 	fsys := apkofs.DirFS(b.WorkspaceDir)
 	if err := b.retrieveWorkspace(ctx, fsys); err != nil {
@@ -909,19 +1349,39 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	// perform package linting
 	for _, lt := range linterQueue {
 		log.Infof("running package linters for %s", lt.pkgName)
-		path := filepath.Join(b.WorkspaceDir, melangeOutputDirName, lt.pkgName)
+		path := b.packageDir(lt.pkgName)
+
+		// In strict mode, every check is required unless explicitly disabled.
+		require, warn := b.LintRequire, b.LintWarn
+		if b.Strict {
+			require, warn = slices.Concat(b.LintRequire, b.LintWarn), nil
+		}
 
 		// Downgrade disabled checks from required to warn
-		require := slices.DeleteFunc(b.LintRequire, func(s string) bool {
+		require = slices.DeleteFunc(require, func(s string) bool {
 			return slices.Contains(lt.disabled, s)
 		})
-		warn := slices.CompactFunc(append(b.LintWarn, lt.disabled...), func(a, b string) bool {
+		warn = slices.CompactFunc(append(warn, lt.disabled...), func(a, b string) bool {
 			return a == b
 		})
 
 		if err := linter.LintBuild(ctx, lt.pkgName, path, require, warn); err != nil {
 			return fmt.Errorf("unable to lint package %s: %w", lt.pkgName, err)
 		}
+
+		if b.CheckBuildPath {
+			refs, err := buildPathReferences(os.DirFS(path), WorkDir, b.BuildPathIgnore)
+			if err != nil {
+				return fmt.Errorf("scanning package %s for build path references: %w", lt.pkgName, err)
+			}
+			if len(refs) != 0 && b.Configuration.Package.Reproducible {
+				return fmt.Errorf("package %s is not reproducible, it contains references to the build path %s: %s", lt.pkgName, WorkDir, strings.Join(refs, ", "))
+			} else if len(refs) != 0 {
+				if err := b.warn(ctx, "package %s contains references to the build path %s: %s", lt.pkgName, WorkDir, strings.Join(refs, ", ")); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	li, err := b.Configuration.Package.LicensingInfos(b.WorkspaceDir)
@@ -934,13 +1394,20 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	// write them to disk. We'll handle any subpackages first, and then the main
 	// package, but the order doesn't really matter.
 
+	sbomNames := []string{}
 	for _, sp := range b.Configuration.Subpackages {
+		if !b.wantSubpackageSBOM(sp.Name) {
+			log.Infof("skipping SBOM for subpackage %s", sp.Name)
+			continue
+		}
+
 		spSBOM := b.SBOMGroup.Document(sp.Name)
 		spdxDoc := spSBOM.ToSPDX(ctx)
 		log.Infof("writing SBOM for subpackage %s", sp.Name)
 		if err := b.writeSBOM(sp.Name, &spdxDoc); err != nil {
 			return fmt.Errorf("writing SBOM for %s: %w", sp.Name, err)
 		}
+		sbomNames = append(sbomNames, sp.Name)
 	}
 
 	spdxDoc := pSBOM.ToSPDX(ctx)
@@ -948,6 +1415,13 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	if err := b.writeSBOM(pkg.Name, &spdxDoc); err != nil {
 		return fmt.Errorf("writing SBOM for %s: %w", pkg.Name, err)
 	}
+	sbomNames = append(sbomNames, pkg.Name)
+
+	if b.GoldenSBOMDir != "" {
+		if err := b.compareGoldenSBOMs(sbomNames); err != nil {
+			return fmt.Errorf("comparing golden SBOMs: %w", err)
+		}
+	}
 
 	// emit main package
 	if err := b.Emit(ctx, pkg); err != nil {
@@ -963,6 +1437,31 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
+	phases.since(PhasePackage, packageStart)
+
+	testStart := time.Now()
+	if b.CheckLinkage {
+		if err := b.checkLinkage(ctx); err != nil {
+			return fmt.Errorf("checking linkage: %w", err)
+		}
+	}
+
+	if b.CheckInstall && !b.isBuildLess() {
+		if err := b.checkInstall(ctx); err != nil {
+			return fmt.Errorf("checking install: %w", err)
+		}
+	}
+	phases.since(PhaseTest, testStart)
+
+	// store the packages and SBOMs before the workspace is cleaned
+	if b.ContentAddressableDir != "" {
+		stored, err := b.storeContentAddressed(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to store packages by digest: %w", err)
+		}
+		b.StoredArtifacts = stored
+	}
+
 	// clean build environment
 	log.Debugf("cleaning workspacedir")
 	cleanEnv := map[string]string{}
@@ -986,19 +1485,8 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		packageDir := filepath.Join(b.OutDir, b.Arch.ToAPK())
 		log.Infof("generating apk index from packages in %s", packageDir)
 
-		var apkFiles []string
-		pkgFileName := fmt.Sprintf("%s-%s-r%d.apk", b.Configuration.Package.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-		apkFiles = append(apkFiles, filepath.Join(packageDir, pkgFileName))
-
-		for _, subpkg := range b.Configuration.Subpackages {
-			subpkg := subpkg
-
-			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-			apkFiles = append(apkFiles, filepath.Join(packageDir, subpkgFileName))
-		}
-
 		opts := []index.Option{
-			index.WithPackageFiles(apkFiles),
+			index.WithPackageFiles(b.packageFiles()),
 			index.WithSigningKey(b.SigningKey),
 			index.WithMergeIndexFileFlag(true),
 			index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
@@ -1014,14 +1502,32 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
+	succeeded = true
 	return nil
 }
 
+// wantSubpackageSBOM reports whether to generate an SBOM for the named
+// subpackage.
+func (b *Build) wantSubpackageSBOM(name string) bool {
+	matches := func(globs []string) bool {
+		return slices.ContainsFunc(globs, func(glob string) bool {
+			ok, _ := path.Match(glob, name)
+			return ok
+		})
+	}
+
+	if len(b.SBOMSubpackages) != 0 && !matches(b.SBOMSubpackages) {
+		return false
+	}
+
+	return !matches(b.SBOMExcludeSubpackages)
+}
+
 // writeSBOM encodes the given SPDX document to JSON and writes it to the
 // filesystem in the directory `/var/lib/db/sbom`. The pkgName parameter should
 // be set to the name of the origin package or subpackage.
 func (b Build) writeSBOM(pkgName string, doc *spdx.Document) error {
-	apkFSPath := filepath.Join(b.WorkspaceDir, melangeOutputDirName, pkgName)
+	apkFSPath := b.packageDir(pkgName)
 	sbomDirPath := filepath.Join(apkFSPath, "/var/lib/db/sbom")
 	if err := os.MkdirAll(sbomDirPath, os.FileMode(0o755)); err != nil {
 		return fmt.Errorf("creating SBOM directory: %w", err)
@@ -1095,6 +1601,16 @@ func (b *Build) buildFlavor() string {
 	return b.Libc
 }
 
+// ScrubbedEnvironment is the environment exported to the pipelines with
+// WithScrubEnvironment, which fixes the locale and timezone their output may
+// depend on.  The environment of the configuration, and of each step, can
+// override it.
+var ScrubbedEnvironment = map[string]string{
+	"LANG":   "C",
+	"LC_ALL": "C",
+	"TZ":     "UTC",
+}
+
 func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 	log := clog.FromContext(ctx)
 	if b.isBuildLess() {
@@ -1125,16 +1641,21 @@ func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 	// TODO(kaniini): Disable networking capability according to the pipeline requirements.
 	caps := container.Capabilities{
 		Networking: true,
+		Add:        b.neededCapabilities,
+	}
+
+	env := map[string]string{}
+	if b.ScrubEnvironment {
+		maps.Copy(env, ScrubbedEnvironment)
 	}
+	env["SOURCE_DATE_EPOCH"] = fmt.Sprintf("%d", b.SourceDateEpoch.Unix())
 
 	cfg := container.Config{
 		Arch:         b.Arch,
 		PackageName:  b.Configuration.Package.Name,
 		Mounts:       mounts,
 		Capabilities: caps,
-		Environment: map[string]string{
-			"SOURCE_DATE_EPOCH": fmt.Sprintf("%d", b.SourceDateEpoch.Unix()),
-		},
+		Environment:  env,
 		WorkspaceDir: b.WorkspaceDir,
 		Timeout:      b.Configuration.Package.Timeout,
 		RunAs:        b.Configuration.Environment.Accounts.RunAs,
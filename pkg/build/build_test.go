@@ -379,3 +379,165 @@ func TestSourceDateEpoch(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSubpackageLicenses(t *testing.T) {
+	cfg := &config.Configuration{
+		Package: config.Package{Name: "foo"},
+		Subpackages: []config.Subpackage{
+			{Name: "foo-dev"},
+			{Name: "foo-doc", Copyright: []config.Copyright{{License: "CC-BY-4.0"}}},
+			{Name: "foo-static"},
+		},
+	}
+	err := checkSubpackageLicenses(cfg)
+	require.ErrorContains(t, err, "subpackages without a declared license: foo-dev, foo-static")
+
+	cfg.Package.Copyright = []config.Copyright{{License: "Apache-2.0"}}
+	require.NoError(t, checkSubpackageLicenses(cfg))
+}
+
+func TestWarnStrict(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{}
+	require.NoError(t, b.warn(ctx, "step %q references undeclared option %q", "build", "typo"))
+
+	b.Strict = true
+	require.EqualError(t, b.warn(ctx, "step %q references undeclared option %q", "build", "typo"),
+		`strict: step "build" references undeclared option "typo"`)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "check.yaml")
+	if err := os.WriteFile(cfgFile, []byte(`
+package:
+  name: check
+  version: 1.0.0
+  epoch: 0
+
+pipeline:
+  - uses: git-checkout
+    with:
+      destination: src
+  - uses: does-not-exist
+  - if: ${{package.name}} == 'check' &&
+    runs: true
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Build{
+		ConfigFile: cfgFile,
+		Arch:       apko_types.Architecture("amd64"),
+	}
+	err := b.Check(ctx)
+
+	var report *CheckReport
+	require.ErrorAs(t, err, &report)
+	require.Len(t, report.Problems[CheckRunner], 1)
+	require.Empty(t, report.Problems[CheckConfiguration])
+	require.Len(t, report.Problems[CheckConditions], 1)
+	require.Len(t, report.Problems[CheckPipelines], 3)
+	require.ErrorContains(t, err, "repository")
+	require.ErrorContains(t, err, "does-not-exist")
+}
+
+func TestWantSubpackageSBOM(t *testing.T) {
+	for _, tc := range []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{want: []string{"foo-dev", "foo-doc", "foo-static"}},
+		{include: []string{"foo-dev", "foo-doc"}, want: []string{"foo-dev", "foo-doc"}},
+		{exclude: []string{"foo-d*"}, want: []string{"foo-static"}},
+		{include: []string{"foo-*"}, exclude: []string{"foo-doc"}, want: []string{"foo-dev", "foo-static"}},
+		{exclude: []string{"*"}},
+	} {
+		b := &Build{SBOMSubpackages: tc.include, SBOMExcludeSubpackages: tc.exclude}
+
+		var got []string
+		for _, name := range []string{"foo-dev", "foo-doc", "foo-static"} {
+			if b.wantSubpackageSBOM(name) {
+				got = append(got, name)
+			}
+		}
+		require.Equal(t, tc.want, got, "include %v, exclude %v", tc.include, tc.exclude)
+	}
+}
+
+func TestVars(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "vars.yaml")
+	if err := os.WriteFile(cfgFile, []byte(`
+package:
+  name: vars
+  version: 1.0.0
+  epoch: 0
+
+vars:
+  ref: main
+  flag: "off"
+  kept: config
+
+options:
+  flagged:
+    vars:
+      flag: option
+
+pipeline:
+  - runs: echo ${{vars.ref}} ${{vars.flag}} ${{vars.kept}} ${{vars.extra}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	varsFile := filepath.Join(dir, "vars-file.yaml")
+	if err := os.WriteFile(varsFile, []byte("ref: vars-file\nkept: vars-file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Build{ConfigFile: cfgFile, VarsFile: varsFile}
+	require.NoError(t, WithVars([]string{"ref=v1.2.3", "flag=on", "extra=a=b"})(b))
+
+	cfg, err := b.parseConfiguration(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "echo v1.2.3 on vars-file a=b", cfg.Pipeline[0].Runs)
+
+	b.Configuration = *cfg
+	require.NoError(t, b.applyBuildOption(cfg.Options["flagged"]))
+	require.Equal(t, "on", b.Configuration.Vars["flag"])
+
+	for _, bad := range []string{"novalue", "=empty", "vars.ref=x", "a b=c"} {
+		require.Error(t, WithVars([]string{bad})(&Build{}), bad)
+	}
+}
+
+func TestScrubEnvironment(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{
+		ScrubEnvironment: true,
+		SourceDateEpoch:  time.Unix(12345678, 0),
+		Configuration: config.Configuration{
+			Environment: apko_types.ImageConfiguration{
+				Environment: map[string]string{"TZ": "Europe/Paris"},
+			},
+			Pipeline: []config.Pipeline{{Runs: "date"}},
+		},
+	}
+	require.Equal(t, map[string]string{
+		"LANG":              "C",
+		"LC_ALL":            "C",
+		"TZ":                "Europe/Paris",
+		"SOURCE_DATE_EPOCH": "12345678",
+	}, b.buildWorkspaceConfig(ctx).Environment)
+
+	b.ScrubEnvironment = false
+	require.Equal(t, map[string]string{
+		"TZ":                "Europe/Paris",
+		"SOURCE_DATE_EPOCH": "12345678",
+	}, b.buildWorkspaceConfig(ctx).Environment)
+}
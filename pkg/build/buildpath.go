@@ -0,0 +1,90 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// buildPathReferences returns the regular files in fsys which contain the
+// string needle, skipping files whose path matches one of the ignore globs.
+// It is used to find packaged files which leak the build workspace path.
+func buildPathReferences(fsys fs.FS, needle string, ignore []string) ([]string, error) {
+	var refs []string
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		for _, pattern := range ignore {
+			if ok, err := path.Match(pattern, p); err != nil {
+				return fmt.Errorf("invalid build path ignore pattern %q: %w", pattern, err)
+			} else if ok {
+				return nil
+			}
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		found, err := readerContains(f, []byte(needle))
+		if err != nil {
+			return fmt.Errorf("scanning %s: %w", p, err)
+		}
+		if found {
+			refs = append(refs, p)
+		}
+
+		return nil
+	})
+
+	return refs, err
+}
+
+// readerContains reports whether r contains needle, reading r in chunks so
+// large files are never held in memory.
+func readerContains(r io.Reader, needle []byte) (bool, error) {
+	buf := make([]byte, 32*1024+len(needle))
+	carry := 0
+
+	for {
+		n, err := io.ReadFull(r, buf[carry:])
+		if bytes.Contains(buf[:carry+n], needle) {
+			return true, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// Keep the tail of this chunk in case the needle spans two reads.
+		carry = min(len(needle)-1, carry+n)
+		copy(buf, buf[len(buf)-carry:])
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPathReferences(t *testing.T) {
+	// Place a reference so that it straddles the chunk boundary.
+	straddle := strings.Repeat("x", 32*1024-4) + WorkDir + "/melange-out"
+
+	fsys := fstest.MapFS{
+		"usr/bin/foo":             {Data: []byte("\x7fELF...RPATH=/home/build/lib\x00")},
+		"usr/bin/bar":             {Data: []byte("\x7fELF...RPATH=/usr/lib\x00")},
+		"usr/lib/big.so":          {Data: []byte(straddle)},
+		"usr/share/doc/foo/BUILD": {Data: []byte("built in /home/build")},
+	}
+
+	refs, err := buildPathReferences(fsys, WorkDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/bin/foo", "usr/lib/big.so", "usr/share/doc/foo/BUILD"}, refs)
+
+	refs, err = buildPathReferences(fsys, WorkDir, []string{"usr/share/doc/*/*"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/bin/foo", "usr/lib/big.so"}, refs)
+
+	_, err = buildPathReferences(fsys, WorkDir, []string{"["})
+	require.ErrorContains(t, err, "invalid build path ignore pattern")
+}
+
+func TestReaderContains(t *testing.T) {
+	found, err := readerContains(bytes.NewReader(nil), []byte(WorkDir))
+	require.NoError(t, err)
+	require.False(t, found)
+
+	found, err = readerContains(strings.NewReader(strings.Repeat("a", 100000)+WorkDir), []byte(WorkDir))
+	require.NoError(t, err)
+	require.True(t, found)
+}
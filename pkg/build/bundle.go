@@ -0,0 +1,511 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"golang.org/x/crypto/blake2b"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// The directories of a source bundle, relative to the bundle.
+const (
+	bundleSourceDir   = "source"
+	bundlePipelineDir = "pipelines"
+	bundleCacheDir    = "cache"
+)
+
+// A SourceBundle describes the bundle of everything needed to rebuild a
+// package offline, as written by BundleSources: the configuration, its
+// source dir, the pipelines it uses and its external sources.
+type SourceBundle struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// The configuration, the files of its source dir and the pipelines it
+	// uses.
+	Files []BundledFile `json:"files"`
+	// The sources fetched or checked out by the pipelines.
+	Sources []BundledSource `json:"sources,omitempty"`
+}
+
+type BundledFile struct {
+	// The path of the file, relative to the bundle.
+	Path string `json:"path"`
+	// The digest of the file, as "sha256:<hex>".
+	Digest string `json:"digest"`
+}
+
+type BundledSource struct {
+	// The pipeline bringing the source into the build, either "fetch" or
+	// "git-checkout".
+	Uses string `json:"uses"`
+	// The URI fetched, or the repository checked out.
+	Source string `json:"source"`
+	// The path of the source, relative to the bundle: a file for fetch, a
+	// mirror of the repository for git-checkout.
+	Path string `json:"path"`
+	// The digest of a fetched file, as "<family>:<hex>" after the expected
+	// checksum it was verified against, or as "sha256:<hex>" when it is only
+	// verified by its signature.
+	Digest string `json:"digest,omitempty"`
+	// The path of the detached signature of a fetched file, relative to the
+	// bundle, when it is verified by its signature-url.
+	Signature string `json:"signature,omitempty"`
+	// The path of the keyring the signature of a fetched file is verified
+	// against, relative to the bundle.
+	Keyring string `json:"keyring,omitempty"`
+	// The commit checked out from a repository.
+	Commit string `json:"commit,omitempty"`
+}
+
+// BundleSources compiles the configuration and writes everything needed to
+// rebuild the package without network access to dir: the configuration, its
+// source dir under source/, the pipelines it uses under pipelines/, and the
+// sources of its fetch and git-checkout steps under cache/, laid out as the
+// cache dir those pipelines look them up in.  The bundle is described by
+// <arch>/manifest.json in dir.
+func (b *Build) BundleSources(ctx context.Context, dir string) (*SourceBundle, error) {
+	log := clog.FromContext(ctx)
+
+	if err := b.Compile(ctx); err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", b.Configuration.Package.Name, err)
+	}
+
+	bundle := &SourceBundle{
+		Package: b.Configuration.Package.Name,
+		Version: b.Configuration.Package.FullVersion(),
+		Arch:    b.Arch.ToAPK(),
+	}
+
+	add := func(path string) error {
+		digest, err := fileDigest(filepath.Join(dir, path))
+		if err != nil {
+			return err
+		}
+		bundle.Files = append(bundle.Files, BundledFile{Path: path, Digest: "sha256:" + hex.EncodeToString(digest)})
+		return nil
+	}
+
+	cfgPath := filepath.Base(b.ConfigFile)
+	if err := copyFile(filepath.Dir(b.ConfigFile), cfgPath, dir, 0o644); err != nil {
+		return nil, fmt.Errorf("bundling configuration: %w", err)
+	}
+	if err := add(cfgPath); err != nil {
+		return nil, err
+	}
+
+	sources, err := b.bundleSourceDir(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("bundling source dir: %w", err)
+	}
+	for _, path := range sources {
+		if err := add(path); err != nil {
+			return nil, err
+		}
+	}
+
+	pipelines := b.allPipelines()
+
+	c := &Compiled{PipelineDirs: b.PipelineDirs, noOverrides: b.NoPipelineOverrides}
+	for _, uses := range bundledUses(pipelines) {
+		data, err := c.readPipeline(ctx, uses)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(bundlePipelineDir, uses+".yaml")
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), data, 0o644); err != nil {
+			return nil, fmt.Errorf("bundling pipeline %s: %w", uses, err)
+		}
+		if err := add(path); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, p := range pipelines {
+		var source *BundledSource
+		switch p.UsesName() {
+		case "fetch":
+			if seen[p.With["uri"]] {
+				continue
+			}
+			source, err = bundleFetch(ctx, dir, p.With)
+			if err == nil && p.With["keyring"] != "" {
+				source.Keyring, err = b.bundleKeyring(dir, p.With["keyring"], sources)
+				if err == nil && !slices.Contains(sources, source.Keyring) {
+					sources = append(sources, source.Keyring)
+					err = add(source.Keyring)
+				}
+			}
+		case "git-checkout":
+			if seen[p.With["repository"]] {
+				continue
+			}
+			source, err = bundleGitCheckout(ctx, dir, p.With)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bundling the sources of step %q: %w", p.Identity(), err)
+		}
+
+		log.Infof("bundled %s as %s", source.Source, source.Path)
+		seen[source.Source] = true
+		bundle.Sources = append(bundle.Sources, *source)
+	}
+
+	manifest := filepath.Join(dir, bundle.Arch, "manifest.json")
+	if err := os.MkdirAll(filepath.Dir(manifest), 0o755); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(manifest, append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("writing bundle manifest: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// allPipelines returns every step of the compiled configuration, including
+// those of subpackages and tests, and the steps nested in them.
+func (b *Build) allPipelines() []*config.Pipeline {
+	cfg := &b.Configuration
+
+	var all []*config.Pipeline
+	var walk func(ps []config.Pipeline)
+	walk = func(ps []config.Pipeline) {
+		for i := range ps {
+			all = append(all, &ps[i])
+			walk(ps[i].Pipeline)
+		}
+	}
+
+	walk(cfg.Pipeline)
+	if cfg.Test != nil {
+		walk(cfg.Test.Pipeline)
+	}
+	for _, sp := range cfg.Subpackages {
+		walk(sp.Pipeline)
+		if sp.Test != nil {
+			walk(sp.Test.Pipeline)
+		}
+	}
+
+	return all
+}
+
+// bundledUses returns the sorted names of the pipelines used by ps.
+func bundledUses(ps []*config.Pipeline) []string {
+	var uses []string
+	for _, p := range ps {
+		if p.Uses != "" {
+			uses = append(uses, p.Uses)
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(uses)))
+}
+
+// bundleSourceDir copies the files of the source dir which would populate
+// the workspace to source/ in dir, and returns their paths relative to dir.
+func (b *Build) bundleSourceDir(ctx context.Context, dir string) ([]string, error) {
+	ignorePatterns, err := b.loadIgnoreRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bundle itself may be in the source dir.
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	err = fs.WalkDir(os.DirFS(b.SourceDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if abs, err := filepath.Abs(filepath.Join(b.SourceDir, path)); err == nil && abs == absDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := fi.Mode()
+		if !mode.IsRegular() {
+			return nil
+		}
+
+		for _, pat := range ignorePatterns {
+			if pat.Match(path) {
+				return nil
+			}
+		}
+
+		if err := copyFile(b.SourceDir, path, filepath.Join(dir, bundleSourceDir), mode.Perm()); err != nil {
+			return err
+		}
+		paths = append(paths, filepath.Join(bundleSourceDir, path))
+
+		return nil
+	})
+
+	return paths, err
+}
+
+// bundleFetch downloads the file fetched by a fetch step to the cache dir of
+// the bundle, from its uri or else its mirrors, where the fetch pipeline
+// looks it up: as <family>:<hex> after its strongest expected checksum,
+// which it is verified against, or, when it is only verified by its
+// signature-url, as url:<hex>, where <hex> is the SHA-256 of its uri.  The
+// signature is bundled alongside it in the same way.
+func bundleFetch(ctx context.Context, dir string, with map[string]string) (*BundledSource, error) {
+	uri := with["uri"]
+	uris := config.FetchURIs(with)
+
+	family, expected := "", ""
+	for _, c := range fetchChecksums {
+		if with[c.input] != "" {
+			family, expected = c.family, with[c.input]
+			break
+		}
+	}
+	if expected == "" && with["signature-url"] == "" {
+		return nil, fmt.Errorf("%s has no expected checksum or signature-url to verify it by", uri)
+	}
+
+	cacheDir := filepath.Join(dir, bundleCacheDir)
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// Without an expected checksum, the file is recorded by its SHA-256.
+	newHash := sha256.New
+	if family != "" {
+		newHash = fetchChecksumHash(family)
+	}
+
+	var tmp string
+	var sum string
+	var errs []error
+	for _, u := range uris {
+		var err error
+		if tmp, sum, err = bundleDownload(ctx, cacheDir, u, newHash()); err == nil {
+			break
+		}
+		errs = append(errs, err)
+	}
+	if tmp == "" {
+		return nil, errors.Join(errs...)
+	}
+	defer os.Remove(tmp)
+
+	name, digest := urlCacheName(uri), "sha256:"+sum
+	if family != "" {
+		if sum != expected {
+			return nil, fmt.Errorf("%s of %s is %s, expected %s", family, uri, sum, expected)
+		}
+		name = family + ":" + expected
+		digest = name
+	}
+
+	path := filepath.Join(bundleCacheDir, name)
+	if err := os.Rename(tmp, filepath.Join(dir, path)); err != nil {
+		return nil, err
+	}
+
+	source := &BundledSource{
+		Uses:   "fetch",
+		Source: uri,
+		Path:   path,
+		Digest: digest,
+	}
+
+	if sigURL := with["signature-url"]; sigURL != "" {
+		tmp, _, err := bundleDownload(ctx, cacheDir, sigURL, sha256.New())
+		if err != nil {
+			return nil, fmt.Errorf("fetching the signature of %s: %w", uri, err)
+		}
+		defer os.Remove(tmp)
+
+		source.Signature = filepath.Join(bundleCacheDir, urlCacheName(sigURL))
+		if err := os.Rename(tmp, filepath.Join(dir, source.Signature)); err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+// fetchChecksums are the expected checksums of the fetch pipeline, in the
+// order it verifies them in.
+var fetchChecksums = []struct{ input, family string }{
+	{"expected-sha256", "sha256"},
+	{"expected-sha512", "sha512"},
+	{"expected-blake2b-256", "blake2b-256"},
+	{"expected-sha1", "sha1"},
+}
+
+// fetchChecksumHash returns the constructor of the hash of a checksum family
+// of the fetch pipeline.
+func fetchChecksumHash(family string) func() hash.Hash {
+	switch family {
+	case "sha512":
+		return sha512.New
+	case "blake2b-256":
+		return func() hash.Hash {
+			// New256 only fails for keys longer than 64 bytes.
+			h, _ := blake2b.New256(nil)
+			return h
+		}
+	case "sha1":
+		return sha1.New
+	default:
+		return sha256.New
+	}
+}
+
+// urlCacheName returns the name in the cache dir of a file fetched from uri
+// which has no expected checksum to look it up by, as the fetch pipeline
+// computes it.
+func urlCacheName(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return "url:" + hex.EncodeToString(sum[:])
+}
+
+// bundleDownload downloads uri to a temporary file in dir, and returns its
+// name and its checksum with h.
+func bundleDownload(ctx context.Context, dir, uri string, h hash.Hash) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("got %s when fetching %s", resp.Status, uri)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("fetching %s: %w", uri, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+
+	return tmp.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bundleKeyring makes sure the keyring of a fetch step, which is relative to
+// the workspace, is bundled under source/ in dir even when it is ignored by
+// the workspace ignore rules, and returns its path relative to dir.
+func (b *Build) bundleKeyring(dir, keyring string, bundled []string) (string, error) {
+	path := filepath.Join(bundleSourceDir, keyring)
+	if !filepath.IsLocal(keyring) {
+		return "", fmt.Errorf("keyring %s is not in the workspace", keyring)
+	}
+	if slices.Contains(bundled, path) {
+		return path, nil
+	}
+	if err := copyFile(b.SourceDir, keyring, filepath.Join(dir, bundleSourceDir), 0o644); err != nil {
+		return "", fmt.Errorf("bundling keyring: %w", err)
+	}
+	return path, nil
+}
+
+// bundleGitCheckout mirrors the repository checked out by a git-checkout step
+// to git/<hex> in the cache dir of the bundle, where <hex> is the SHA-256 of
+// the repository, which is where the git-checkout pipeline looks it up, and
+// resolves the commit the step checks out.
+func bundleGitCheckout(ctx context.Context, dir string, with map[string]string) (*BundledSource, error) {
+	repo := with["repository"]
+
+	sum := sha256.Sum256([]byte(repo))
+	path := filepath.Join(bundleCacheDir, "git", hex.EncodeToString(sum[:]))
+	mirror := filepath.Join(dir, path)
+	if err := os.RemoveAll(mirror); err != nil {
+		return nil, err
+	}
+
+	if out, err := exec.CommandContext(ctx, "git", "clone", "--quiet", "--mirror", repo, mirror).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("mirroring %s: %w: %s", repo, err, out)
+	}
+
+	ref := "HEAD"
+	for _, r := range []string{with["expected-commit"], with["tag"], with["branch"]} {
+		if r != "" {
+			ref = r
+			break
+		}
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", mirror, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s in %s: %w", ref, repo, err)
+	}
+
+	return &BundledSource{
+		Uses:   "git-checkout",
+		Source: repo,
+		Path:   path,
+		Commit: strings.TrimSpace(string(out)),
+	}, nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestBundleSources(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	tarball := []byte("hello tarball")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(tarball)
+	tarballSHA256 := hex.EncodeToString(sum[:])
+
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "README"), []byte("hello"), 0o644))
+	git("add", "README")
+	git("commit", "--quiet", "-m", "hello")
+	git("tag", "v1.0")
+	commit := git("rev-parse", "HEAD")
+
+	sourceDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "fix.patch"), []byte("patch"), 0o644))
+	configFile := filepath.Join(sourceDir, "hello.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("package: {name: hello}"), 0o644))
+
+	// The bundle is in the source dir, and must not bundle itself.
+	dir := filepath.Join(sourceDir, "bundle")
+
+	b := &Build{
+		ConfigFile:      configFile,
+		SourceDir:       sourceDir,
+		WorkspaceIgnore: ".melangeignore",
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0"},
+			Pipeline: []config.Pipeline{{
+				Uses: "fetch",
+				With: map[string]string{"uri": srv.URL + "/hello-${{package.version}}.tar.gz", "expected-sha256": tarballSHA256},
+			}, {
+				Uses: "git-checkout",
+				With: map[string]string{"repository": repo, "tag": "v${{package.version}}", "expected-commit": commit},
+			}},
+		},
+	}
+
+	bundle, err := b.BundleSources(ctx, dir)
+	require.NoError(t, err)
+
+	var files []string
+	for _, f := range bundle.Files {
+		files = append(files, f.Path)
+		data, err := os.ReadFile(filepath.Join(dir, f.Path))
+		require.NoError(t, err)
+		sum := sha256.Sum256(data)
+		require.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), f.Digest)
+	}
+	require.Equal(t, []string{"hello.yaml", "source/fix.patch", "source/hello.yaml", "pipelines/fetch.yaml", "pipelines/git-checkout.yaml"}, files)
+
+	repoSum := sha256.Sum256([]byte(repo))
+	require.Equal(t, []BundledSource{{
+		Uses:   "fetch",
+		Source: srv.URL + "/hello-1.0.tar.gz",
+		Path:   "cache/sha256:" + tarballSHA256,
+		Digest: "sha256:" + tarballSHA256,
+	}, {
+		Uses:   "git-checkout",
+		Source: repo,
+		Path:   "cache/git/" + hex.EncodeToString(repoSum[:]),
+		Commit: commit,
+	}}, bundle.Sources)
+
+	data, err := os.ReadFile(filepath.Join(dir, bundle.Sources[0].Path))
+	require.NoError(t, err)
+	require.Equal(t, tarball, data)
+	require.DirExists(t, filepath.Join(dir, bundle.Sources[1].Path))
+
+	data, err = os.ReadFile(filepath.Join(dir, "x86_64", "manifest.json"))
+	require.NoError(t, err)
+	var manifest SourceBundle
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Equal(t, *bundle, manifest)
+
+	// A fetched source must match its expected checksum.
+	b.Configuration.Pipeline = []config.Pipeline{{
+		Uses: "fetch",
+		With: map[string]string{"uri": srv.URL + "/hello.tar.gz", "expected-sha256": strings.Repeat("0", 64)},
+	}}
+	_, err = b.BundleSources(ctx, t.TempDir())
+	require.ErrorContains(t, err, "sha256 of "+srv.URL+"/hello.tar.gz is "+tarballSHA256)
+
+	// A fetched source needs an expected checksum or a signature.
+	b.Configuration.Pipeline = []config.Pipeline{{
+		Uses: "fetch",
+		With: map[string]string{"uri": srv.URL + "/hello.tar.gz"},
+	}}
+	_, err = b.BundleSources(ctx, t.TempDir())
+	require.ErrorContains(t, err, "no expected checksum or signature-url")
+}
+
+func TestBundleSourcesFetch(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	tarball := []byte("hello tarball")
+	signature := []byte("hello signature")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/missing/"):
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, ".sig"):
+			w.Write(signature)
+		default:
+			w.Write(tarball)
+		}
+	}))
+	defer srv.Close()
+
+	sha256Sum := sha256.Sum256(tarball)
+	sha1Sum := sha1.Sum(tarball)
+	blake2bSum := blake2b.Sum256(tarball)
+	urlName := func(uri string) string {
+		sum := sha256.Sum256([]byte(uri))
+		return "url:" + hex.EncodeToString(sum[:])
+	}
+
+	for _, tc := range []struct {
+		name    string
+		with    map[string]string
+		keyring bool
+		want    BundledSource
+		wantErr string
+	}{{
+		name: "blake2b-256",
+		with: map[string]string{"uri": srv.URL + "/hello.tar.gz", "expected-blake2b-256": hex.EncodeToString(blake2bSum[:])},
+		want: BundledSource{
+			Uses:   "fetch",
+			Source: srv.URL + "/hello.tar.gz",
+			Path:   "cache/blake2b-256:" + hex.EncodeToString(blake2bSum[:]),
+			Digest: "blake2b-256:" + hex.EncodeToString(blake2bSum[:]),
+		},
+	}, {
+		name: "sha1",
+		with: map[string]string{"uri": srv.URL + "/hello.tar.gz", "expected-sha1": hex.EncodeToString(sha1Sum[:])},
+		want: BundledSource{
+			Uses:   "fetch",
+			Source: srv.URL + "/hello.tar.gz",
+			Path:   "cache/sha1:" + hex.EncodeToString(sha1Sum[:]),
+			Digest: "sha1:" + hex.EncodeToString(sha1Sum[:]),
+		},
+	}, {
+		name: "mirror",
+		with: map[string]string{
+			"uri":             srv.URL + "/missing/hello.tar.gz",
+			"uris":            srv.URL + "/missing/mirror/hello.tar.gz," + srv.URL + "/mirror/hello.tar.gz",
+			"expected-sha256": hex.EncodeToString(sha256Sum[:]),
+		},
+		want: BundledSource{
+			Uses:   "fetch",
+			Source: srv.URL + "/missing/hello.tar.gz",
+			Path:   "cache/sha256:" + hex.EncodeToString(sha256Sum[:]),
+			Digest: "sha256:" + hex.EncodeToString(sha256Sum[:]),
+		},
+	}, {
+		name:    "no mirror",
+		with:    map[string]string{"uri": srv.URL + "/missing/hello.tar.gz", "uris": srv.URL + "/missing/mirror/hello.tar.gz", "expected-sha256": hex.EncodeToString(sha256Sum[:])},
+		wantErr: "404 Not Found when fetching " + srv.URL + "/missing/mirror/hello.tar.gz",
+	}, {
+		name:    "signature",
+		with:    map[string]string{"uri": srv.URL + "/hello.tar.gz", "signature-url": srv.URL + "/hello.tar.gz.sig", "keyring": "keys/hello.asc"},
+		keyring: true,
+		want: BundledSource{
+			Uses:      "fetch",
+			Source:    srv.URL + "/hello.tar.gz",
+			Path:      "cache/" + urlName(srv.URL+"/hello.tar.gz"),
+			Digest:    "sha256:" + hex.EncodeToString(sha256Sum[:]),
+			Signature: "cache/" + urlName(srv.URL+"/hello.tar.gz.sig"),
+			Keyring:   "source/keys/hello.asc",
+		},
+	}, {
+		name:    "missing keyring",
+		with:    map[string]string{"uri": srv.URL + "/hello.tar.gz", "signature-url": srv.URL + "/hello.tar.gz.sig", "keyring": "keys/hello.asc"},
+		wantErr: "bundling keyring",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			sourceDir := t.TempDir()
+			configFile := filepath.Join(sourceDir, "hello.yaml")
+			require.NoError(t, os.WriteFile(configFile, []byte("package: {name: hello}"), 0o644))
+			if tc.keyring {
+				require.NoError(t, os.Mkdir(filepath.Join(sourceDir, "keys"), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "keys", "hello.asc"), []byte("keys"), 0o644))
+				// The keyring is bundled even when the workspace ignores it.
+				require.NoError(t, os.WriteFile(filepath.Join(sourceDir, ".melangeignore"), []byte("keys/\n"), 0o644))
+			}
+
+			b := &Build{
+				ConfigFile:      configFile,
+				SourceDir:       sourceDir,
+				WorkspaceIgnore: ".melangeignore",
+				Arch:            apko_types.ParseArchitecture("x86_64"),
+				Configuration: config.Configuration{
+					Package:  config.Package{Name: "hello", Version: "1.0"},
+					Pipeline: []config.Pipeline{{Uses: "fetch", With: tc.with}},
+				},
+			}
+
+			dir := t.TempDir()
+			bundle, err := b.BundleSources(ctx, dir)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []BundledSource{tc.want}, bundle.Sources)
+
+			data, err := os.ReadFile(filepath.Join(dir, tc.want.Path))
+			require.NoError(t, err)
+			require.Equal(t, tarball, data)
+
+			if tc.want.Signature != "" {
+				data, err := os.ReadFile(filepath.Join(dir, tc.want.Signature))
+				require.NoError(t, err)
+				require.Equal(t, signature, data)
+			}
+			if tc.want.Keyring != "" {
+				var files []string
+				for _, f := range bundle.Files {
+					files = append(files, f.Path)
+				}
+				require.Contains(t, files, tc.want.Keyring)
+			}
+		})
+	}
+}
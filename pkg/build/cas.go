@@ -0,0 +1,145 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// A StoredArtifact locates an artifact of the build in the content-addressable
+// store.
+type StoredArtifact struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// Either "apk" or "sbom".
+	Kind string `json:"kind"`
+	// The digest of the artifact, as "sha256:<hex>".
+	Digest string `json:"digest"`
+	// The path of the artifact, relative to the store.
+	Path string `json:"path"`
+}
+
+// storeContentAddressed copies the packages emitted by the build, and their
+// SBOMs, into the content-addressable store as blobs/sha256/<hex>, and writes
+// the mapping from package to blob to <arch>/<package>-<version>.json in the
+// store.
+func (b *Build) storeContentAddressed(ctx context.Context) ([]StoredArtifact, error) {
+	log := clog.FromContext(ctx)
+
+	version := b.Configuration.Package.FullVersion()
+	arch := b.Arch.ToAPK()
+
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	var stored []StoredArtifact
+	for i, apkFile := range b.packageFiles() {
+		name := names[i]
+		sbomFile := getPathForPackageSBOM(filepath.Join(b.packageDir(name), "var/lib/db/sbom"), name, version)
+
+		for _, a := range []struct{ kind, src string }{{"apk", apkFile}, {"sbom", sbomFile}} {
+			kind := a.kind
+			digest, p, err := storeBlob(b.ContentAddressableDir, a.src)
+			if errors.Is(err, fs.ErrNotExist) && kind == "sbom" {
+				// No SBOM was generated for this subpackage.
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("storing %s of %s: %w", kind, name, err)
+			}
+
+			log.Debugf("stored %s of %s as %s", kind, name, digest)
+			stored = append(stored, StoredArtifact{
+				Package: name,
+				Version: version,
+				Arch:    arch,
+				Kind:    kind,
+				Digest:  digest,
+				Path:    p,
+			})
+		}
+	}
+
+	manifest := filepath.Join(b.ContentAddressableDir, arch, fmt.Sprintf("%s-%s.json", b.Configuration.Package.Name, version))
+	if err := os.MkdirAll(filepath.Dir(manifest), 0o755); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(manifest, append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("writing content-addressable manifest: %w", err)
+	}
+
+	return stored, nil
+}
+
+// storeBlob copies the file at src to blobs/sha256/<hex> in the store dir,
+// unless a blob with the same digest is already there, and returns its digest
+// and path relative to dir.
+func storeBlob(dir, src string) (digest, rel string, err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0o755); err != nil {
+		return "", "", err
+	}
+
+	tmp, err := os.CreateTemp(blobs, ".tmp-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), f); err != nil {
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	rel = filepath.Join("blobs", "sha256", sum)
+	if _, err := os.Stat(filepath.Join(dir, rel)); err != nil {
+		if err := os.Rename(tmp.Name(), filepath.Join(dir, rel)); err != nil {
+			return "", "", err
+		}
+	}
+
+	return "sha256:" + sum, rel, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestStoreContentAddressed(t *testing.T) {
+	b := &Build{
+		OutDir:                t.TempDir(),
+		WorkspaceDir:          t.TempDir(),
+		ContentAddressableDir: t.TempDir(),
+		Arch:                  apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package:     config.Package{Name: "hello", Version: "1.0", Epoch: 2},
+			Subpackages: []config.Subpackage{{Name: "hello-doc"}, {Name: "hello-dev"}},
+		},
+	}
+
+	// hello and hello-doc are identical, and hello-doc has no SBOM.
+	apks := b.packageFiles()
+	require.NoError(t, os.MkdirAll(filepath.Dir(apks[0]), 0o755))
+	for i, contents := range []string{"same", "same", "dev"} {
+		require.NoError(t, os.WriteFile(apks[i], []byte(contents), 0o644))
+	}
+	for _, name := range []string{"hello", "hello-dev"} {
+		dir := filepath.Join(b.WorkspaceDir, melangeOutputDirName, name, "var/lib/db/sbom")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(getPathForPackageSBOM(dir, name, "1.0-r2"), []byte(name+" sbom"), 0o644))
+	}
+
+	stored, err := b.storeContentAddressed(slogtest.Context(t))
+	require.NoError(t, err)
+
+	var got []string
+	for _, a := range stored {
+		require.Equal(t, "1.0-r2", a.Version)
+		require.Equal(t, "x86_64", a.Arch)
+		require.Equal(t, filepath.Join("blobs", "sha256", a.Digest[len("sha256:"):]), a.Path)
+		require.FileExists(t, filepath.Join(b.ContentAddressableDir, a.Path))
+		got = append(got, a.Package+" "+a.Kind)
+	}
+	require.Equal(t, []string{"hello apk", "hello sbom", "hello-doc apk", "hello-dev apk", "hello-dev sbom"}, got)
+	require.Equal(t, stored[0].Digest, stored[2].Digest)
+
+	blobs, err := os.ReadDir(filepath.Join(b.ContentAddressableDir, "blobs", "sha256"))
+	require.NoError(t, err)
+	require.Len(t, blobs, 4)
+
+	data, err := os.ReadFile(filepath.Join(b.ContentAddressableDir, "x86_64", "hello-1.0-r2.json"))
+	require.NoError(t, err)
+	var manifest []StoredArtifact
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Equal(t, stored, manifest)
+}
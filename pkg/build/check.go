@@ -0,0 +1,187 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/melange/pkg/cond"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// The categories of problems reported by Check, in the order they are
+// checked.
+const (
+	CheckRunner        = "runner"
+	CheckConfiguration = "configuration"
+	CheckConditions    = "conditions"
+	CheckPipelines     = "pipelines"
+	CheckSources       = "sources"
+)
+
+var checkCategories = []string{CheckRunner, CheckConfiguration, CheckConditions, CheckPipelines, CheckSources}
+
+// CheckReport is the error returned by Check, grouping the problems found by
+// category.
+type CheckReport struct {
+	Problems map[string][]error
+}
+
+func (r *CheckReport) add(category string, err error) {
+	if r.Problems == nil {
+		r.Problems = map[string][]error{}
+	}
+	r.Problems[category] = append(r.Problems[category], err)
+}
+
+func (r *CheckReport) Error() string {
+	var sb strings.Builder
+	sb.WriteString("build check failed:")
+	for _, category := range checkCategories {
+		for _, err := range r.Problems[category] {
+			fmt.Fprintf(&sb, "\n  %s: %v", category, err)
+		}
+	}
+	return sb.String()
+}
+
+// Check is a fast preflight which reports whether the build can start,
+// without running any pipeline step.  It checks that the runner is usable,
+// then loads the configuration afresh and validates it: conditionals must
+// parse, every `uses` must resolve and receive valid inputs, and the upstream
+// sources must be describable in the SBOM.  All problems found are returned
+// together in a *CheckReport, or nil if there are none.
+func (b *Build) Check(ctx context.Context) error {
+	report := &CheckReport{}
+
+	if b.Runner == nil {
+		report.add(CheckRunner, fmt.Errorf("no runner was specified"))
+	} else if !b.Runner.TestUsability(ctx) {
+		report.add(CheckRunner, fmt.Errorf("unable to run containers using %s", b.Runner.Name()))
+	}
+
+	// Compilation mutates the configuration, so work on a fresh copy.
+	cfg, err := b.parseConfiguration(ctx)
+	if err != nil {
+		report.add(CheckConfiguration, err)
+		return report
+	}
+
+	for _, ref := range cfg.UndeclaredOptionReferences() {
+		report.add(CheckConfiguration, fmt.Errorf("step %q references undeclared option %q", ref.Step, ref.Option))
+	}
+	if b.RequireSubpackageLicense {
+		if err := checkSubpackageLicenses(cfg); err != nil {
+			report.add(CheckConfiguration, err)
+		}
+	}
+
+	for _, sp := range cfg.Subpackages {
+		if err := checkCondition(sp.If); err != nil {
+			report.add(CheckConditions, fmt.Errorf("subpackage %q: %w", sp.Name, err))
+		}
+	}
+	forEachPipeline(cfg, func(p *config.Pipeline) {
+		if err := checkCondition(p.If); err != nil {
+			report.add(CheckConditions, fmt.Errorf("step %q: %w", p.Identity(), err))
+		}
+	})
+
+	sm, err := NewSubstitutionMap(cfg, b.Arch, b.buildFlavor(), b.EnabledBuildOptions)
+	if err != nil {
+		report.add(CheckConfiguration, err)
+		return report
+	}
+	sm.AddEnviron(b.AllowedEnviron)
+
+	c := &Compiled{PipelineDirs: b.PipelineDirs, noOverrides: b.NoPipelineOverrides}
+	compile := func(what string, sm *SubstitutionMap, ps []config.Pipeline) {
+		for i := range ps {
+			step := ps[i].Identity()
+			if err := c.compilePipeline(ctx, sm, &ps[i], nil); err != nil {
+				report.add(CheckPipelines, fmt.Errorf("%s: step %q: %w", what, step, err))
+				continue
+			}
+			if err := c.gatherDeps(ctx, &ps[i]); err != nil {
+				report.add(CheckPipelines, fmt.Errorf("%s: step %q: %w", what, step, err))
+			}
+		}
+	}
+	compile("main pipelines", sm, cfg.Pipeline)
+	if cfg.Test != nil {
+		compile("main tests", sm, cfg.Test.Pipeline)
+	}
+	for _, sp := range cfg.Subpackages {
+		sm := sm.Subpackage(&sp)
+		compile(fmt.Sprintf("subpackage %q", sp.Name), sm, sp.Pipeline)
+		if sp.Test != nil {
+			compile(fmt.Sprintf("subpackage %q tests", sp.Name), sm, sp.Test.Pipeline)
+		}
+	}
+
+	var i int
+	forEachPipeline(cfg, func(p *config.Pipeline) {
+		if _, err := p.SBOMPackageForUpstreamSource(cfg.Package.LicenseExpression(), b.Namespace, strconv.Itoa(i)); err != nil {
+			report.add(CheckSources, fmt.Errorf("step %q: %w", p.Identity(), err))
+		}
+		i++
+	})
+
+	if len(report.Problems) != 0 {
+		return report
+	}
+
+	return nil
+}
+
+// checkCondition reports whether an if-conditional parses.  Variables are not
+// resolved, so only the syntax of the expression is checked.
+func checkCondition(ifs string) error {
+	if ifs == "" {
+		return nil
+	}
+
+	if _, err := cond.Evaluate(ifs); err != nil {
+		return fmt.Errorf("parsing if-conditional %q: %w", ifs, err)
+	}
+
+	return nil
+}
+
+// forEachPipeline calls fn for every pipeline step of the configuration,
+// including nested steps, subpackages and tests.
+func forEachPipeline(cfg *config.Configuration, fn func(p *config.Pipeline)) {
+	var walk func(ps []config.Pipeline)
+	walk = func(ps []config.Pipeline) {
+		for i := range ps {
+			fn(&ps[i])
+			walk(ps[i].Pipeline)
+		}
+	}
+
+	walk(cfg.Pipeline)
+	if cfg.Test != nil {
+		walk(cfg.Test.Pipeline)
+	}
+	for _, sp := range cfg.Subpackages {
+		walk(sp.Pipeline)
+		if sp.Test != nil {
+			walk(sp.Test.Pipeline)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// A checkpoint records the top-level pipelines of the package which
+// completed, in order, so that a build which failed later can be resumed
+// after them, see WithCheckpointFile and WithResumeFrom.
+type checkpoint struct {
+	Completed []completedPipeline `json:"completed"`
+}
+
+// A completedPipeline records a top-level pipeline of the package which
+// completed.
+type completedPipeline struct {
+	// The digest of the compiled pipeline, and of those before it, which
+	// that of the build resuming from the checkpoint must match, see
+	// pipelineHash.
+	Digest string `json:"digest"`
+	// The outcomes of the named steps reached once the pipeline completed,
+	// nested ones included, which the steps after it may refer to.
+	Outcomes map[string]checkpointOutcome `json:"outcomes,omitempty"`
+}
+
+// checkpointOutcome is the stepOutcome of a named step, as recorded in a
+// checkpoint.
+type checkpointOutcome struct {
+	Ran       bool `json:"ran"`
+	Succeeded bool `json:"succeeded"`
+	ExitCode  int  `json:"exitCode"`
+}
+
+// checkpointer records the checkpoints of a build to a file, and skips the
+// pipelines it resumes after.  A nil checkpointer does neither.
+type checkpointer struct {
+	file string
+	// The digests of the compiled top-level pipelines, see pipelineHash.
+	hashes     []string
+	resumeFrom int
+	// The pipelines completed, those of the checkpoint resumed from first.
+	completed []completedPipeline
+}
+
+// checkpointConfig is what, besides the pipelines themselves, affects what the
+// top-level pipelines of the package do once compiled.
+type checkpointConfig struct {
+	Arch        string                        `json:"arch"`
+	Package     config.Package                `json:"package"`
+	Environment apko_types.ImageConfiguration `json:"environment"`
+	Vars        map[string]string             `json:"vars,omitempty"`
+	Options     []string                      `json:"options,omitempty"`
+}
+
+// pipelineHash returns the digest of a compiled top-level pipeline of the
+// package, given the digest of the configuration of the build, or else of the
+// pipeline before it, so that it changes along with any of them.
+func pipelineHash(previous string, pipeline config.Pipeline) (string, error) {
+	return digest(struct {
+		Previous string          `json:"previous"`
+		Pipeline config.Pipeline `json:"pipeline"`
+	}{previous, pipeline})
+}
+
+// digest returns the digest of v marshalled as JSON.
+func digest(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// checkpointer returns the checkpointer of the build once it is compiled, or
+// nil if it neither records checkpoints nor resumes from one.  Resuming
+// checks that the checkpoint got that far, and that the pipelines skipped
+// have not changed since; those after them may have.
+func (b *Build) checkpointer() (*checkpointer, error) {
+	if b.CheckpointFile == "" {
+		if b.ResumeFrom != 0 {
+			return nil, fmt.Errorf("resuming from pipeline %d requires a checkpoint file", b.ResumeFrom)
+		}
+		return nil, nil
+	}
+	if b.ResumeFrom < 0 {
+		return nil, fmt.Errorf("the pipeline to resume from must not be negative, got %d", b.ResumeFrom)
+	}
+
+	// The pipelines are counted in the order they run.
+	pipelines, err := orderSteps(b.Configuration.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	pkg := b.Configuration.Package
+	// The commit is that of the build file, which fixing a later pipeline
+	// changes.
+	pkg.Commit = ""
+	hash, err := digest(checkpointConfig{
+		Arch:        b.Arch.ToAPK(),
+		Package:     pkg,
+		Environment: b.Configuration.Environment,
+		Vars:        b.Configuration.Vars,
+		Options:     slices.Sorted(slices.Values(b.EnabledBuildOptions)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("hashing the configuration: %w", err)
+	}
+	c := &checkpointer{file: b.CheckpointFile, resumeFrom: b.ResumeFrom}
+	for i, p := range pipelines {
+		hash, err = pipelineHash(hash, p)
+		if err != nil {
+			return nil, fmt.Errorf("hashing pipeline %q: %w", childIdentity(i, &p), err)
+		}
+		c.hashes = append(c.hashes, hash)
+	}
+	if c.resumeFrom == 0 {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %w", c.file, err)
+	}
+	if c.resumeFrom > len(cp.Completed) {
+		return nil, fmt.Errorf("unable to resume from pipeline %d: only %d completed as of checkpoint %s", c.resumeFrom, len(cp.Completed), c.file)
+	}
+	for i := range c.resumeFrom {
+		if i >= len(c.hashes) || cp.Completed[i].Digest != c.hashes[i] {
+			return nil, fmt.Errorf("refusing to resume from checkpoint %s: pipeline %d, or the configuration of the build, changed since it was recorded", c.file, i)
+		}
+	}
+	c.completed = cp.Completed[:c.resumeFrom]
+
+	return c, nil
+}
+
+// resumedOutcomes returns the outcomes of the named steps reached as of the
+// pipelines resumed after, if any.
+func (c *checkpointer) resumedOutcomes() map[string]stepOutcome {
+	if c == nil || c.resumeFrom == 0 {
+		return nil
+	}
+	outcomes := map[string]stepOutcome{}
+	for name, o := range c.completed[c.resumeFrom-1].Outcomes {
+		outcomes[name] = stepOutcome{ran: o.Ran, succeeded: o.Succeeded, exitCode: o.ExitCode}
+	}
+	return outcomes
+}
+
+// skips reports whether the i-th top-level pipeline completed before the
+// checkpoint resumed from.
+func (c *checkpointer) skips(i int) bool {
+	return c != nil && i < c.resumeFrom
+}
+
+// record writes the checkpoint after the first completed top-level pipelines,
+// with the outcomes of the named steps reached so far.
+func (c *checkpointer) record(completed int, outcomes map[string]stepOutcome) error {
+	if c == nil {
+		return nil
+	}
+
+	recorded := make(map[string]checkpointOutcome, len(outcomes))
+	for name, o := range outcomes {
+		recorded[name] = checkpointOutcome{Ran: o.ran, Succeeded: o.succeeded, ExitCode: o.exitCode}
+	}
+	c.completed = append(c.completed[:completed-1], completedPipeline{Digest: c.hashes[completed-1], Outcomes: recorded})
+
+	data, err := json.Marshal(checkpoint{Completed: c.completed})
+	if err != nil {
+		return err
+	}
+
+	// Replace the checkpoint at once, so that a build stopped while writing
+	// it leaves the previous one.
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".*")
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.file); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	file := filepath.Join(t.TempDir(), "checkpoint.json")
+	newBuild := func(resumeFrom int, compile, install string) *Build {
+		b := &Build{
+			Arch:           apko_types.ParseArchitecture("x86_64"),
+			CheckpointFile: file,
+			ResumeFrom:     resumeFrom,
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "hello", Version: "1.0"},
+				Pipeline: []config.Pipeline{
+					{Name: "configure", Runs: "echo configure"},
+					{Name: "compile", Runs: compile},
+					{Name: "install", Runs: install},
+				},
+			},
+		}
+		require.NoError(t, b.Compile(ctx))
+		return b
+	}
+	run := func(b *Build) ([]string, error) {
+		cp, err := b.checkpointer()
+		if err != nil {
+			return nil, err
+		}
+		runner := &echoRunner{}
+		pr := &pipelineRunner{config: &container.Config{}, runner: runner, checkpoint: cp}
+		err = pr.runPipelines(ctx, b.Configuration.Pipeline)
+		return runner.scripts, err
+	}
+	completed := func() int {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		var cp checkpoint
+		require.NoError(t, json.Unmarshal(data, &cp))
+		return len(cp.Completed)
+	}
+
+	// The install step fails, after the first two completed.
+	_, err := run(newBuild(0, "echo compile", "fail install"))
+	require.Error(t, err)
+	require.Equal(t, 2, completed())
+
+	// Resuming after a pipeline which changed is refused.
+	_, err = run(newBuild(2, "echo compile -O2", "echo install"))
+	require.ErrorContains(t, err, "pipeline 1, or the configuration of the build, changed since it was recorded")
+
+	// So is resuming once the configuration of the build changed, even
+	// though the pipelines did not.
+	for name, change := range map[string]func(*Build){
+		"version":     func(b *Build) { b.Configuration.Package.Version = "1.1" },
+		"vars":        func(b *Build) { b.Configuration.Vars = map[string]string{"opt": "-O2"} },
+		"environment": func(b *Build) { b.Configuration.Environment.Environment = map[string]string{"CFLAGS": "-O2"} },
+		"options":     func(b *Build) { b.EnabledBuildOptions = []string{"docs"} },
+	} {
+		b := newBuild(1, "echo compile", "echo install")
+		change(b)
+		_, err = run(b)
+		require.ErrorContains(t, err, "pipeline 0, or the configuration of the build, changed since it was recorded", name)
+	}
+
+	// Resuming past the completed pipelines is refused.
+	_, err = run(newBuild(3, "echo compile", "echo install"))
+	require.ErrorContains(t, err, "only 2 completed as of checkpoint")
+
+	// A resumed run skips the completed pipelines, and runs those after
+	// them, which may have changed.
+	scripts, err := run(newBuild(1, "echo compile", "echo install"))
+	require.NoError(t, err)
+	require.Len(t, scripts, 2)
+	require.Contains(t, scripts[0], "echo compile")
+	require.Contains(t, scripts[1], "echo install")
+	require.Equal(t, 3, completed())
+
+	// Resuming requires a checkpoint.
+	b := newBuild(1, "echo compile", "echo install")
+	b.CheckpointFile = ""
+	_, err = b.checkpointer()
+	require.ErrorContains(t, err, "requires a checkpoint file")
+}
+
+func TestCheckpointResumedOutcomes(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	file := filepath.Join(t.TempDir(), "checkpoint.json")
+	run := func(resumeFrom int, install string) ([]string, error) {
+		b := &Build{
+			Arch:           apko_types.ParseArchitecture("x86_64"),
+			CheckpointFile: file,
+			ResumeFrom:     resumeFrom,
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "hello", Version: "1.0"},
+				Pipeline: []config.Pipeline{
+					{Name: "configure", Pipeline: []config.Pipeline{{Name: "autoreconf", Runs: "echo autoreconf"}}},
+					{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+					{
+						Name: "install",
+						If:   "${{steps.autoreconf.succeeded}} == 'true' && ${{steps.docs.result}} == 'skipped'",
+						Runs: install,
+					},
+				},
+			},
+		}
+		require.NoError(t, b.Compile(ctx))
+		cp, err := b.checkpointer()
+		if err != nil {
+			return nil, err
+		}
+		runner := &fakeRunner{}
+		pr := &pipelineRunner{config: &container.Config{}, runner: runner, checkpoint: cp}
+		err = pr.runPipelines(ctx, b.Configuration.Pipeline)
+		return runner.scripts, err
+	}
+
+	_, err := run(0, "fail install")
+	require.Error(t, err)
+
+	// The resumed run knows the outcomes of the steps it skipped, nested
+	// ones included, and that the docs were skipped by their if rather than
+	// run.
+	scripts, err := run(2, "echo install")
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+	require.Contains(t, scripts[0], "echo install")
+}
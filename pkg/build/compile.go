@@ -17,21 +17,39 @@ package build
 import (
 	"context"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"maps"
-	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/util"
 	"github.com/chainguard-dev/clog"
 	"gopkg.in/yaml.v3"
 )
 
-const unidentifiablePipeline = "???"
+// transformPipeline is the built-in pipeline of the steps which only resolve
+// their with values for the steps after them, see compileTransform.
+const transformPipeline = "transform"
+
+// redactedInput replaces the value of secret inputs in logs.
+const redactedInput = "[REDACTED]"
 
 func (t *Test) Compile(ctx context.Context) error {
 	cfg := t.Configuration
+	if err := checkPipelinesVersion(cfg.Package); err != nil {
+		return err
+	}
+	if t.pipelineCache == nil {
+		t.pipelineCache = &pipelineCache{}
+	}
 
 	// TODO: Make this parameter go away when we revisit subtitutions.
 	flavor := "gnu"
@@ -40,10 +58,14 @@ func (t *Test) Compile(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// The subpackages of the package under test are not built by the test.
+	delete(sm.Substitutions, config.SubstitutionPackageSubpkgCount)
 
 	ignore := &Compiled{
 		PipelineDirs: t.PipelineDirs,
+		cache:        t.pipelineCache,
 	}
+	t.neededCapabilities = map[string][]string{}
 
 	// We want to evaluate this but not accumulate its deps.
 	if err := ignore.CompilePipelines(ctx, sm, cfg.Pipeline); err != nil {
@@ -70,6 +92,7 @@ func (t *Test) Compile(ctx context.Context) error {
 
 		test := &Compiled{
 			PipelineDirs: t.PipelineDirs,
+			cache:        t.pipelineCache,
 		}
 
 		te := &cfg.Subpackages[i].Test.Environment.Contents
@@ -83,11 +106,13 @@ func (t *Test) Compile(ctx context.Context) error {
 
 		// Append anything this subpackage test needs.
 		te.Packages = append(te.Packages, test.Needs...)
+		t.neededCapabilities[sp.Name] = neededCapabilities(test.Capabilities)
 	}
 
 	if cfg.Test != nil {
 		test := &Compiled{
 			PipelineDirs: t.PipelineDirs,
+			cache:        t.pipelineCache,
 		}
 
 		te := &t.Configuration.Test.Environment.Contents
@@ -105,6 +130,7 @@ func (t *Test) Compile(ctx context.Context) error {
 
 		// Append anything the main package test needs.
 		te.Packages = append(te.Packages, test.Needs...)
+		t.neededCapabilities[t.Configuration.Package.Name] = neededCapabilities(test.Capabilities)
 	}
 
 	return nil
@@ -113,13 +139,35 @@ func (t *Test) Compile(ctx context.Context) error {
 // Compile compiles all configuration, including tests, by loading any pipelines and substituting all variables.
 func (b *Build) Compile(ctx context.Context) error {
 	cfg := b.Configuration
+	if err := checkPipelinesVersion(cfg.Package); err != nil {
+		return err
+	}
+	if b.pipelineCache == nil {
+		b.pipelineCache = &pipelineCache{}
+	}
+
 	sm, err := NewSubstitutionMap(&cfg, b.Arch, b.buildFlavor(), b.EnabledBuildOptions)
 	if err != nil {
 		return err
 	}
+	sm.AddEnviron(b.AllowedEnviron)
+
+	if b.PrintSubstitutions != nil {
+		if err := sm.Print(b.PrintSubstitutions); err != nil {
+			return fmt.Errorf("printing substitutions: %w", err)
+		}
+	}
 
 	c := &Compiled{
 		PipelineDirs: b.PipelineDirs,
+		cache:        b.pipelineCache,
+		strict:       b.StrictSubstitutions,
+		rewriteURI:   b.URIRewriter,
+		noOverrides:  b.NoPipelineOverrides,
+	}
+
+	if err := applyGitOverrides(ctx, sm, cfg.Pipeline, b.GitOverrides); err != nil {
+		return err
 	}
 
 	if err := c.CompilePipelines(ctx, sm, cfg.Pipeline); err != nil {
@@ -129,6 +177,10 @@ func (b *Build) Compile(ctx context.Context) error {
 	for i, sp := range cfg.Subpackages {
 		sm := sm.Subpackage(&sp)
 
+		if err := applyGitOverrides(ctx, sm, sp.Pipeline, b.GitOverrides); err != nil {
+			return err
+		}
+
 		if sp.If != "" {
 			sp.If, err = util.MutateAndQuoteStringFromMap(sm.Substitutions, sp.If)
 			if err != nil {
@@ -146,6 +198,10 @@ func (b *Build) Compile(ctx context.Context) error {
 
 		tc := &Compiled{
 			PipelineDirs: b.PipelineDirs,
+			cache:        b.pipelineCache,
+			strict:       b.StrictSubstitutions,
+			rewriteURI:   b.URIRewriter,
+			noOverrides:  b.NoPipelineOverrides,
 		}
 		if err := tc.CompilePipelines(ctx, sm, sp.Test.Pipeline); err != nil {
 			return fmt.Errorf("compiling subpackage %q tests: %w", sp.Name, err)
@@ -163,9 +219,19 @@ func (b *Build) Compile(ctx context.Context) error {
 	ic := &b.Configuration.Environment.Contents
 	ic.Packages = append(ic.Packages, c.Needs...)
 
+	b.neededCapabilities = neededCapabilities(c.Capabilities)
+
+	// Redact the longest secrets first, in case one contains another.
+	b.secrets = slices.Compact(slices.Sorted(slices.Values(c.Secrets)))
+	slices.SortStableFunc(b.secrets, func(a, b string) int { return len(b) - len(a) })
+
 	if cfg.Test != nil {
 		tc := &Compiled{
 			PipelineDirs: b.PipelineDirs,
+			cache:        b.pipelineCache,
+			strict:       b.StrictSubstitutions,
+			rewriteURI:   b.URIRewriter,
+			noOverrides:  b.NoPipelineOverrides,
 		}
 
 		if err := tc.CompilePipelines(ctx, sm, cfg.Test.Pipeline); err != nil {
@@ -182,12 +248,35 @@ func (b *Build) Compile(ctx context.Context) error {
 	return nil
 }
 
+// neededCapabilities sorts the capabilities gathered by a Compiled and
+// removes duplicates.
+func neededCapabilities(capabilities []string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(capabilities)))
+}
+
 type Compiled struct {
 	PipelineDirs []string
-	Needs        []string
+	// If set, memoizes the pipelines read from PipelineDirs.
+	cache *pipelineCache
+	// If set, references left in the scripts and workdirs of the steps once
+	// their variables are substituted are an error.
+	strict bool
+	// If set, rewrites the uris fetch steps download from.
+	rewriteURI func(string) string
+	// If set, the pipeline dirs cannot override the embedded pipelines.
+	noOverrides bool
+	Needs       []string
+	// The Linux capabilities needed by the compiled pipelines.
+	Capabilities []string
+	// The values of the secret inputs of the compiled pipelines.
+	Secrets []string
 }
 
 func (c *Compiled) CompilePipelines(ctx context.Context, sm *SubstitutionMap, pipelines []config.Pipeline) error {
+	if _, err := orderSteps(pipelines); err != nil {
+		return err
+	}
+
 	for i := range pipelines {
 		if err := c.compilePipeline(ctx, sm, &pipelines[i], nil); err != nil {
 			return fmt.Errorf("compiling Pipeline[%d]: %w", i, err)
@@ -201,40 +290,110 @@ func (c *Compiled) CompilePipelines(ctx context.Context, sm *SubstitutionMap, pi
 	return nil
 }
 
+// readPipeline reads the definition of the 'uses' pipeline from the first of
+// the pipeline dirs that has it, or else from the embedded pipelines.  A
+// pipeline pinned to a version, as <name>@<version>, is read from
+// <name>@<version>.yaml.  Without overrides, embedded pipelines are always
+// read from the embedded pipelines.
+func (c *Compiled) readPipeline(ctx context.Context, uses string) ([]byte, error) {
+	log := clog.FromContext(ctx)
+
+	embedded, err := f.ReadFile("pipelines/" + uses + ".yaml")
+	if err == nil && c.noOverrides {
+		log.Debugf("loading pipeline %q from the embedded pipelines, overrides are disabled", uses)
+		return embedded, nil
+	}
+
+	for _, pd := range c.PipelineDirs {
+		log.Debugf("trying to load pipeline %q from %q", uses, pd)
+		data, err := c.cache.readFile(pd, uses)
+		if err == nil {
+			if embedded != nil {
+				log.Infof("pipeline %q from %q overrides the embedded pipeline", uses, pd)
+			}
+			log.Debugf("Found pipeline %s", string(data))
+			return data, nil
+		}
+	}
+
+	if err != nil {
+		searched := "the embedded pipelines"
+		if len(c.PipelineDirs) != 0 {
+			dirs := make([]string, 0, len(c.PipelineDirs))
+			for _, pd := range c.PipelineDirs {
+				dirs = append(dirs, strconv.Quote(pd))
+			}
+			searched = strings.Join(dirs, ", ") + " or " + searched
+		}
+		if name, version, ok := strings.Cut(uses, "@"); ok {
+			available := "none"
+			if versions := c.pipelineVersions(name); len(versions) != 0 {
+				available = strings.Join(versions, ", ")
+			}
+			return nil, fmt.Errorf("unable to load pipeline: could not find version %q of 'uses' pipeline %q in %s (available versions: %s)", version, name, searched, available)
+		}
+		return nil, fmt.Errorf("unable to load pipeline: could not find 'uses' pipeline %q in %s", uses, searched)
+	}
+
+	return embedded, nil
+}
+
+// pipelineVersions returns the versions the 'uses' pipeline name is available
+// in, in the pipeline dirs or the embedded pipelines, sorted.
+func (c *Compiled) pipelineVersions(name string) []string {
+	var files []string
+	for _, pd := range c.PipelineDirs {
+		matches, _ := filepath.Glob(filepath.Join(pd, name+"@*.yaml"))
+		files = append(files, matches...)
+	}
+	matches, _ := fs.Glob(f, "pipelines/"+name+"@*.yaml")
+	files = append(files, matches...)
+
+	var versions []string
+	for _, file := range files {
+		_, version, _ := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".yaml"), "@")
+		if !slices.Contains(versions, version) {
+			versions = append(versions, version)
+		}
+	}
+	slices.Sort(versions)
+	return versions
+}
+
 func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pipeline *config.Pipeline, parent map[string]string) error {
 	log := clog.FromContext(ctx)
 	name, uses, with := pipeline.Name, pipeline.Uses, maps.Clone(pipeline.With)
 
+	with, err := archWith(with, pipeline.ArchOverrides, sm.Substitutions[config.SubstitutionBuildArch])
+	if err != nil {
+		return err
+	}
+
+	if uses == transformPipeline {
+		return c.compileTransform(sm, pipeline, with, parent)
+	}
+
 	if uses != "" {
-		var data []byte
-		// Set this to fail up front in case there are no pipeline dirs specified
-		// and we can't find them.
-		err := fmt.Errorf("could not find 'uses' pipeline %q", uses)
-
-		for _, pd := range c.PipelineDirs {
-			log.Debugf("trying to load pipeline %q from %q", uses, pd)
-			data, err = os.ReadFile(filepath.Join(pd, uses+".yaml"))
-			if err == nil {
-				log.Debugf("Found pipeline %s", string(data))
-				break
-			}
-		}
+		data, err := c.readPipeline(ctx, uses)
 		if err != nil {
-			log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
-			data, err = f.ReadFile("pipelines/" + uses + ".yaml")
-			if err != nil {
-				return fmt.Errorf("unable to load pipeline: %w", err)
-			}
+			return err
+		}
+
+		// The steps this step needs are its own, not those of the pipeline.
+		var steps []string
+		if pipeline.Needs != nil {
+			steps = pipeline.Needs.Steps
 		}
 
 		if err := yaml.Unmarshal(data, pipeline); err != nil {
 			return fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
 		}
 
-		for k := range with {
-			if _, ok := pipeline.Inputs[k]; !ok {
-				return fmt.Errorf("undefined input %q to pipeline %q", k, pipeline.Uses)
+		if len(steps) != 0 {
+			if pipeline.Needs == nil {
+				pipeline.Needs = &config.Needs{}
 			}
+			pipeline.Needs.Steps = steps
 		}
 
 		// We want to keep the original name here because loading the pipeline will overwrite it.
@@ -245,7 +404,7 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 		with = util.RightJoinMap(parent, with)
 	}
 
-	validated, err := validateWith(with, pipeline.Inputs)
+	validated, err := validateWith(pipeline, with)
 	if err != nil {
 		return fmt.Errorf("unable to validate with: %w", err)
 	}
@@ -255,6 +414,23 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 		return fmt.Errorf("mutating with: %w", err)
 	}
 
+	for k, input := range pipeline.Inputs {
+		if v := mutated[fmt.Sprintf("${{inputs.%s}}", k)]; input.Secret && v != "" {
+			c.Secrets = append(c.Secrets, v)
+		}
+	}
+
+	if log.Enabled(ctx, slog.LevelDebug) && len(pipeline.Inputs) != 0 {
+		log.Debug(fmt.Sprintf("resolved inputs for pipeline %q", pipeline.Identity()), resolvedInputs(pipeline.Inputs, mutated)...)
+	}
+
+	// The step runs with the rewritten uris, but keeps those of the build
+	// file in its with, which the SBOM is made from.
+	run := mutated
+	if c.rewriteURI != nil && pipeline.UsesName() == "fetch" {
+		run = rewriteFetchURIs(ctx, mutated, c.rewriteURI)
+	}
+
 	// allow input mutations on needs.packages
 	if pipeline.Needs != nil {
 		for i := range pipeline.Needs.Packages {
@@ -270,29 +446,89 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 		if err != nil {
 			return fmt.Errorf("mutating workdir: %w", err)
 		}
+		if ref := unresolvedReference(pipeline.WorkDir); c.strict && ref != "" {
+			return fmt.Errorf("step %q: unresolved substitution %s in workdir", pipeline.Identity(), ref)
+		}
+		pipeline.WorkDir = unescapeReferences(pipeline.WorkDir)
+	}
+
+	for _, dirs := range [][]string{pipeline.PathPrepend, pipeline.PathAppend} {
+		for i := range dirs {
+			dirs[i], err = util.MutateStringFromMap(mutated, dirs[i])
+			if err != nil {
+				return fmt.Errorf("mutating path: %w", err)
+			}
+		}
 	}
 
-	pipeline.Runs, err = util.MutateStringFromMap(mutated, pipeline.Runs)
+	pipeline.Runs, err = util.MutateStringFromMap(run, pipeline.Runs)
 	if err != nil {
 		return fmt.Errorf("mutating runs: %w", err)
 	}
+	if ref := unresolvedReference(pipeline.Runs); c.strict && ref != "" {
+		return fmt.Errorf("step %q: unresolved substitution %s in runs", pipeline.Identity(), ref)
+	}
+	pipeline.Runs = unescapeReferences(pipeline.Runs)
+
+	pipeline.Post, err = util.MutateStringFromMap(run, pipeline.Post)
+	if err != nil {
+		return fmt.Errorf("mutating post: %w", err)
+	}
+	if ref := unresolvedReference(pipeline.Post); c.strict && ref != "" {
+		return fmt.Errorf("step %q: unresolved substitution %s in post", pipeline.Identity(), ref)
+	}
+	pipeline.Post = unescapeReferences(pipeline.Post)
 
 	if pipeline.If != "" {
-		pipeline.If, err = util.MutateAndQuoteStringFromMap(mutated, pipeline.If)
+		pipeline.If, err = mutateIf(mutated, pipeline.If)
 		if err != nil {
 			return fmt.Errorf("mutating if: %w", err)
 		}
 	}
 
+	if _, err := orderSteps(pipeline.Pipeline); err != nil {
+		return err
+	}
+
+	if pipeline.Shell != "" && !path.IsAbs(pipeline.Shell) {
+		return fmt.Errorf("step %q: shell %q is not an absolute path", pipeline.Identity(), pipeline.Shell)
+	}
+
+	pipeline.Environment, err = optionEnvironment(pipeline.Environment, pipeline.OptionEnvironment, sm)
+	if err != nil {
+		return fmt.Errorf("step %q: %w", pipeline.Identity(), err)
+	}
+	if pipeline.Environment, err = mutateEnvironment(pipeline.Environment, run, c.strict); err != nil {
+		return fmt.Errorf("step %q: %w", pipeline.Identity(), err)
+	}
+
 	for i := range pipeline.Pipeline {
 		p := &pipeline.Pipeline[i]
 
 		// Inherit workdir from parent pipeline unless overridden.
-		if p.WorkDir == "" {
-			p.WorkDir = pipeline.WorkDir
+		p.WorkDir = pipeline.ChildWorkDir(p.WorkDir)
+		if p.WorkDirCreate == nil {
+			p.WorkDirCreate = pipeline.WorkDirCreate
+		}
+		if p.Retries == 0 {
+			p.Retries = pipeline.Retries
+		}
+		if p.RetryDelay == 0 {
+			p.RetryDelay = pipeline.RetryDelay
+		}
+		p.PathPrepend = append(slices.Clone(p.PathPrepend), pipeline.PathPrepend...)
+		p.PathAppend = append(slices.Clone(pipeline.PathAppend), p.PathAppend...)
+
+		// Inherit the option environment, which is resolved for each
+		// pipeline so that it overrides the pipeline's own environment.
+		for opt, env := range pipeline.OptionEnvironment {
+			if p.OptionEnvironment == nil {
+				p.OptionEnvironment = map[string]map[string]string{}
+			}
+			p.OptionEnvironment[opt] = util.RightJoinMap(env, p.OptionEnvironment[opt])
 		}
 
-		if err := c.compilePipeline(ctx, sm, p, mutated); err != nil {
+		if err := c.compilePipeline(ctx, sm, p, run); err != nil {
 			return fmt.Errorf("compiling Pipeline[%d]: %w", i, err)
 		}
 	}
@@ -316,26 +552,224 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 	// We don't care about the documented inputs.
 	pipeline.Inputs = nil
 
+	// The overrides for this architecture have been merged into with.
+	pipeline.ArchOverrides = nil
+
+	// The environment of the enabled options has been merged into
+	// environment.
+	pipeline.OptionEnvironment = nil
+
+	return nil
+}
+
+// archWith merges the arguments overriding those of with when building for
+// arch into with.  An override for an architecture beats the argument in with,
+// which itself beats the argument inherited from a parent pipeline.
+func archWith(with map[string]string, overrides map[string]map[string]string, arch string) (map[string]string, error) {
+	for k, args := range overrides {
+		a := apko_types.ParseArchitecture(k)
+		if !slices.Contains(apko_types.AllArchs, a) {
+			return nil, fmt.Errorf("arch-overrides: unknown architecture %q", k)
+		}
+		if a.ToAPK() != arch {
+			continue
+		}
+
+		if with == nil {
+			with = map[string]string{}
+		}
+		maps.Copy(with, args)
+	}
+
+	return with, nil
+}
+
+// optionEnvironment returns env with the variables of the options enabled in
+// sm, per overrides, overriding its own.  Two enabled options may not set the
+// same variable to different values.
+func optionEnvironment(env map[string]string, overrides map[string]map[string]string, sm *SubstitutionMap) (map[string]string, error) {
+	setBy := map[string]string{}
+	for _, opt := range slices.Sorted(maps.Keys(overrides)) {
+		if sm.Substitutions[fmt.Sprintf("${{options.%s.enabled}}", opt)] != "true" {
+			continue
+		}
+
+		for _, k := range slices.Sorted(maps.Keys(overrides[opt])) {
+			v := overrides[opt][k]
+			if other, ok := setBy[k]; ok && env[k] != v {
+				return nil, fmt.Errorf("option-environment: enabled options %q and %q set %s to different values", other, opt, k)
+			}
+			if env == nil {
+				env = map[string]string{}
+			} else if len(setBy) == 0 {
+				env = maps.Clone(env)
+			}
+			env[k] = v
+			setBy[k] = opt
+		}
+	}
+
+	return env, nil
+}
+
+// mutateEnvironment returns a copy of env with the variables in its values,
+// but not its keys, substituted from mutated, as they are in runs.
+func mutateEnvironment(env, mutated map[string]string, strict bool) (map[string]string, error) {
+	if len(env) == 0 {
+		return env, nil
+	}
+
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		v, err := util.MutateStringFromMap(mutated, v)
+		if err != nil {
+			return nil, fmt.Errorf("mutating environment %s: %w", k, err)
+		}
+		if ref := unresolvedReference(v); strict && ref != "" {
+			return nil, fmt.Errorf("unresolved substitution %s in environment %s", ref, k)
+		}
+		out[k] = unescapeReferences(v)
+	}
+	return out, nil
+}
+
+// resolvedInputs returns the resolved value of each declared input as
+// key-value pairs suitable for structured logging, sorted by input name.
+// Inputs marked as secret are redacted.
+func resolvedInputs(inputs map[string]config.Input, mutated map[string]string) []any {
+	args := make([]any, 0, 2*len(inputs))
+	for _, k := range slices.Sorted(maps.Keys(inputs)) {
+		v := mutated[fmt.Sprintf("${{inputs.%s}}", k)]
+		if inputs[k].Secret {
+			v = redactedInput
+		}
+		args = append(args, k, v)
+	}
+	return args
+}
+
+// compileTransform resolves the with values of a transform step, which runs
+// nothing, and makes them available to the steps compiled after it as
+// ${{steps.<name>.<key>}}.  As those are substituted when compiled, the step
+// cannot be conditional.
+func (c *Compiled) compileTransform(sm *SubstitutionMap, pipeline *config.Pipeline, with, parent map[string]string) error {
+	switch {
+	case pipeline.Name == "":
+		return fmt.Errorf("a %s step must have a name", transformPipeline)
+	case pipeline.Runs != "" || pipeline.Post != "" || len(pipeline.Pipeline) != 0:
+		return fmt.Errorf("step %q: a %s step cannot run anything", pipeline.Name, transformPipeline)
+	case pipeline.If != "":
+		return fmt.Errorf("step %q: a %s step cannot have an if", pipeline.Name, transformPipeline)
+	}
+
+	mutated, err := sm.MutateWith(util.RightJoinMap(parent, with))
+	if err != nil {
+		return fmt.Errorf("step %q: mutating with: %w", pipeline.Name, err)
+	}
+
+	resolved := make(map[string]string, len(with))
+	for k := range with {
+		switch k {
+		case stepOutcomeRan, stepOutcomeSucceeded, stepOutcomeExitCode, stepOutcomeResult:
+			return fmt.Errorf("step %q: with %s is reserved for the outcome of the step", pipeline.Name, k)
+		}
+		v := mutated[fmt.Sprintf("${{inputs.%s}}", k)]
+		if ref := unresolvedReference(v); c.strict && ref != "" {
+			return fmt.Errorf("step %q: unresolved substitution %s in with %s", pipeline.Name, ref, k)
+		}
+		v = unescapeReferences(v)
+		resolved[k] = v
+		sm.Substitutions[fmt.Sprintf("${{steps.%s.%s}}", pipeline.Name, k)] = v
+	}
+	pipeline.With = resolved
+	pipeline.ArchOverrides = nil
+
 	return nil
 }
 
-func identity(p *config.Pipeline) string {
-	if p.Name != "" {
-		return p.Name
+// rewriteFetchURIs returns a copy of the mutated with values of a fetch step
+// with its uri and mirror uris rewritten.
+func rewriteFetchURIs(ctx context.Context, mutated map[string]string, rewrite func(string) string) map[string]string {
+	log := clog.FromContext(ctx)
+	run := maps.Clone(mutated)
+
+	if uri := run["${{inputs.uri}}"]; uri != "" {
+		run["${{inputs.uri}}"] = rewrite(uri)
+		log.Debugf("fetching %s from %s", uri, run["${{inputs.uri}}"])
 	}
-	if p.Uses != "" {
-		return p.Uses
+
+	if uris := run["${{inputs.uris}}"]; uris != "" {
+		var rewritten []string
+		for _, uri := range strings.FieldsFunc(uris, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if uri = strings.TrimSpace(uri); uri != "" {
+				rewritten = append(rewritten, rewrite(uri))
+			}
+		}
+		run["${{inputs.uris}}"] = strings.Join(rewritten, ",")
 	}
 
-	return unidentifiablePipeline
+	return run
+}
+
+// unresolvedReference returns the first ${{...}} reference in s, or "" if
+// there is none.  References escaped as $${{...}} are not unresolved.
+func unresolvedReference(s string) string {
+	for i := 0; ; {
+		j := strings.Index(s[i:], "${{")
+		if j < 0 {
+			return ""
+		}
+		j += i
+		if j > 0 && s[j-1] == '$' {
+			i = j + len("${{")
+			continue
+		}
+		if end := strings.Index(s[j:], "}}"); end >= 0 {
+			return s[j : j+end+len("}}")]
+		}
+		return s[j:]
+	}
+}
+
+// unescapeReferences turns the references escaped as $${{...}} in s into
+// literal ${{...}}.
+func unescapeReferences(s string) string {
+	return strings.ReplaceAll(s, "$${{", "${{")
+}
+
+// mutateIf substitutes the variables of an if-conditional, including the
+// values of transform steps.  Other references to steps are to their
+// outcomes, which are only known while running the pipeline, so they are left
+// for the pipeline runner to resolve.
+func mutateIf(with map[string]string, input string) (string, error) {
+	lookup := util.LookupFromMap(with)
+	return cond.SubstQuoted(input, func(key string) (string, error) {
+		if strings.HasPrefix(key, stepOutcomePrefix) {
+			if v, err := lookup(key); err == nil {
+				return v, nil
+			}
+			return "", cond.ErrUnresolved
+		}
+		return lookup(key)
+	})
 }
 
 func (c *Compiled) gatherDeps(ctx context.Context, pipeline *config.Pipeline) error {
 	log := clog.FromContext(ctx)
 
-	id := identity(pipeline)
+	id := pipeline.Identity()
 
-	if pipeline.If != "" {
+	if pipeline.Needs != nil {
+		for _, capability := range pipeline.Needs.Capabilities {
+			if !slices.Contains(container.LinuxCapabilities, capability) {
+				return fmt.Errorf("pipeline %q needs unknown capability %q", id, capability)
+			}
+		}
+	}
+
+	// Whether a step conditional on the outcome of other steps will run is
+	// only known at run time, so assume it might.
+	if pipeline.If != "" && !strings.Contains(pipeline.If, "${{"+stepOutcomePrefix) {
 		if result, err := cond.Evaluate(pipeline.If); err != nil {
 			return fmt.Errorf("evaluating conditional %q: %w", pipeline.If, err)
 		} else if !result {
@@ -349,7 +783,17 @@ func (c *Compiled) gatherDeps(ctx context.Context, pipeline *config.Pipeline) er
 		}
 		c.Needs = append(c.Needs, pipeline.Needs.Packages...)
 
-		pipeline.Needs = nil
+		for _, capability := range pipeline.Needs.Capabilities {
+			log.Debugf("  adding capability %q for pipeline %q", capability, id)
+		}
+		c.Capabilities = append(c.Capabilities, pipeline.Needs.Capabilities...)
+
+		// The steps it needs are only ordered when running it.
+		if steps := pipeline.Needs.Steps; len(steps) != 0 {
+			pipeline.Needs = &config.Needs{Steps: steps}
+		} else {
+			pipeline.Needs = nil
+		}
 	}
 
 	for _, p := range pipeline.Pipeline {
@@ -16,7 +16,11 @@ package build
 
 import (
 	"context"
+	"maps"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -115,3 +119,665 @@ func TestCompileTest(t *testing.T) {
 		t.Errorf("subpackage test packages: want %v, got %v", want, got)
 	}
 }
+
+func TestResolvedInputs(t *testing.T) {
+	inputs := map[string]config.Input{
+		"token":      {Secret: true},
+		"repository": {},
+	}
+	mutated := map[string]string{
+		"${{inputs.token}}":      "hunter2",
+		"${{inputs.repository}}": "https://example.com/repo",
+	}
+
+	got := resolvedInputs(inputs, mutated)
+	want := []any{"repository", "https://example.com/repo", "token", redactedInput}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolvedInputs: want %v, got %v", want, got)
+	}
+}
+
+func TestMutateIf(t *testing.T) {
+	got, err := mutateIf(map[string]string{"${{package.name}}": "foo"}, "${{package.name}} == 'foo' && ${{ steps.configure.ran }} == 'true'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"foo" == 'foo' && ${{steps.configure.ran}} == 'true'`; got != want {
+		t.Errorf("mutateIf: want %q, got %q", want, got)
+	}
+
+	got, err = mutateIf(map[string]string{"${{package.name}}": "foo"}, "${{upper(package.name)}} == 'FOO'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"FOO" == 'FOO'`; got != want {
+		t.Errorf("mutateIf: want %q, got %q", want, got)
+	}
+
+	// The value matched is substituted, the pattern kept as it is.
+	got, err = mutateIf(map[string]string{"${{package.version}}": "1.2.3"}, `${{package.version}} ~= '^1\.2\.'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"1.2.3" ~= '^1\.2\.'`; got != want {
+		t.Errorf("mutateIf: want %q, got %q", want, got)
+	}
+	if result, err := shouldRun(got); err != nil || !result {
+		t.Errorf("shouldRun(%q): want true, got %v, %v", got, result, err)
+	}
+
+	if _, err := mutateIf(nil, "${{vars.missing}} == 'true'"); err == nil {
+		t.Error("mutateIf: expected an error for an undefined variable")
+	}
+}
+
+func TestArchOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		arch apko_types.Architecture
+		want string
+	}{
+		{"amd64", "-O2 -march=x86-64-v2"},
+		{"arm64", "-O2 -mbranch-protection=standard"},
+		{"riscv64", "-O2"},
+	} {
+		t.Run(tc.arch.ToAPK(), func(t *testing.T) {
+			build := &Build{
+				Arch: tc.arch,
+				Configuration: config.Configuration{
+					Pipeline: []config.Pipeline{{
+						Uses: "autoconf/configure",
+						With: map[string]string{"opts": "-O2"},
+						ArchOverrides: map[string]map[string]string{
+							"x86_64":  {"opts": "-O2 -march=x86-64-v2"},
+							"aarch64": {"opts": "-O2 -mbranch-protection=standard"},
+						},
+					}},
+				},
+			}
+
+			if err := build.Compile(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			p := build.Configuration.Pipeline[0]
+			if got := p.With["opts"]; got != tc.want {
+				t.Errorf("opts: want %q, got %q", tc.want, got)
+			}
+			if p.ArchOverrides != nil {
+				t.Errorf("arch-overrides: want them merged, got %v", p.ArchOverrides)
+			}
+		})
+	}
+}
+
+func TestArchOverridesUnknownArch(t *testing.T) {
+	build := &Build{
+		Arch: "amd64",
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{{
+				Uses:          "autoconf/configure",
+				ArchOverrides: map[string]map[string]string{"pdp11": {"opts": "--enable-octal"}},
+			}},
+		},
+	}
+
+	if err := build.Compile(context.Background()); err == nil {
+		t.Error("expected an error for an unknown architecture")
+	}
+}
+
+func TestCompileSubpackageCount(t *testing.T) {
+	build := &Build{
+		Configuration: config.Configuration{
+			Pipeline:    []config.Pipeline{{Runs: "echo ${{package.subpackage-count}}"}},
+			Subpackages: []config.Subpackage{{Name: "foo-dev"}, {Name: "foo-doc"}},
+		},
+	}
+
+	if err := build.Compile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := build.Configuration.Pipeline[0].Runs, "echo 2"; want != got {
+		t.Errorf("runs: want %q, got %q", want, got)
+	}
+
+	// Tests do not build the subpackages, so do not know about them.
+	test := &Test{
+		Configuration: config.Configuration{
+			Test: &config.Test{
+				Pipeline: []config.Pipeline{{Runs: "echo ${{package.subpackage-count}}"}},
+			},
+			Subpackages: []config.Subpackage{{Name: "foo-dev"}},
+		},
+	}
+
+	if err := test.Compile(context.Background()); err == nil {
+		t.Errorf("expected ${{package.subpackage-count}} to be undefined in tests")
+	}
+}
+
+func TestCompileStepNeeds(t *testing.T) {
+	build := &Build{
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{{
+				Name:  "install",
+				Uses:  "autoconf/make-install",
+				Needs: &config.Needs{Packages: []string{"make"}, Steps: []string{"build"}},
+			}, {
+				Name: "build",
+				Runs: "make",
+			}},
+		},
+	}
+
+	if err := build.Compile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The packages are gathered into the environment, the steps are kept.
+	if got, want := build.Configuration.Pipeline[0].Needs, (&config.Needs{Steps: []string{"build"}}); got == nil || !slices.Equal(got.Steps, want.Steps) || len(got.Packages) != 0 {
+		t.Errorf("needs: want %v, got %v", want, got)
+	}
+	if !slices.Contains(build.Configuration.Environment.Contents.Packages, "make") {
+		t.Errorf("packages: want make in %v", build.Configuration.Environment.Contents.Packages)
+	}
+
+	build = &Build{
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{{
+				Pipeline: []config.Pipeline{
+					{Name: "a", Needs: &config.Needs{Steps: []string{"b"}}},
+					{Name: "b", Needs: &config.Needs{Steps: []string{"a"}}},
+				},
+			}},
+		},
+	}
+
+	if err := build.Compile(context.Background()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
+
+func TestCompilePipelinesVersion(t *testing.T) {
+	ctx := context.Background()
+
+	version := PipelinesVersion()
+	if !strings.HasPrefix(version, "sha256:") {
+		t.Fatalf("PipelinesVersion() = %q, expected a sha256 digest", version)
+	}
+
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{
+				Name:             "foo",
+				Version:          "1.0",
+				PipelinesVersion: version,
+			},
+			Pipeline: []config.Pipeline{{
+				Runs: "echo ${{build.pipelines-version}}",
+			}},
+		},
+	}
+	if err := b.Compile(ctx); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	if got, want := b.Configuration.Pipeline[0].Runs, "echo "+version; got != want {
+		t.Errorf("Runs = %q, want %q", got, want)
+	}
+
+	b.Configuration.Package.PipelinesVersion = "sha256:0000"
+	if err := b.Compile(ctx); err == nil || !strings.Contains(err.Error(), "requires embedded pipelines sha256:0000") {
+		t.Errorf("Compile() = %v, expected a pipelines version mismatch", err)
+	}
+}
+
+func TestCompileOptionEnvironment(t *testing.T) {
+	ctx := context.Background()
+
+	newBuild := func(options ...string) *Build {
+		return &Build{
+			EnabledBuildOptions: options,
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "foo", Version: "1.0"},
+				Options: map[string]config.BuildOption{"foo": {}, "bar": {}},
+				Pipeline: []config.Pipeline{{
+					Environment: map[string]string{"FOO": "0", "KEEP": "1"},
+					OptionEnvironment: map[string]map[string]string{
+						"foo": {"FOO": "1"},
+						"bar": {"BAR": "1"},
+					},
+					Pipeline: []config.Pipeline{{
+						Environment: map[string]string{"FOO": "0", "KEEP": "1"},
+						OptionEnvironment: map[string]map[string]string{
+							"bar": {"BAR": "child"},
+						},
+						Runs: "echo $FOO $BAR",
+					}},
+				}},
+			},
+		}
+	}
+
+	b := newBuild("foo", "bar")
+	if err := b.Compile(ctx); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	parent := b.Configuration.Pipeline[0]
+	if got, want := parent.Environment, map[string]string{"FOO": "1", "BAR": "1", "KEEP": "1"}; !maps.Equal(got, want) {
+		t.Errorf("parent environment = %v, want %v", got, want)
+	}
+	if got, want := parent.Pipeline[0].Environment, map[string]string{"FOO": "1", "BAR": "child", "KEEP": "1"}; !maps.Equal(got, want) {
+		t.Errorf("child environment = %v, want %v", got, want)
+	}
+	if parent.OptionEnvironment != nil || parent.Pipeline[0].OptionEnvironment != nil {
+		t.Errorf("option-environment was not resolved")
+	}
+
+	b = newBuild()
+	if err := b.Compile(ctx); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	if got, want := b.Configuration.Pipeline[0].Pipeline[0].Environment, map[string]string{"FOO": "0", "KEEP": "1"}; !maps.Equal(got, want) {
+		t.Errorf("environment without options = %v, want %v", got, want)
+	}
+
+	b = newBuild("foo", "bar")
+	b.Configuration.Pipeline[0].OptionEnvironment["bar"]["FOO"] = "2"
+	if err := b.Compile(ctx); err == nil || !strings.Contains(err.Error(), `enabled options "bar" and "foo" set FOO to different values`) {
+		t.Errorf("Compile() = %v, expected conflicting options", err)
+	}
+}
+
+func TestCompileCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	newBuild := func(capabilities ...string) *Build {
+		return &Build{
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "capabilities"},
+				Pipeline: []config.Pipeline{{
+					Needs: &config.Needs{Capabilities: []string{"CAP_SYS_ADMIN"}},
+					Runs:  "mount -t tmpfs tmpfs /mnt",
+				}, {
+					If:    "'a' == 'b'",
+					Needs: &config.Needs{Capabilities: []string{"CAP_SYS_TIME"}},
+					Runs:  "date -s @0",
+				}},
+				Subpackages: []config.Subpackage{{
+					Name: "capabilities-sub",
+					Pipeline: []config.Pipeline{{
+						Pipeline: []config.Pipeline{{
+							Needs: &config.Needs{Capabilities: capabilities},
+							Runs:  "true",
+						}},
+					}},
+				}},
+			},
+		}
+	}
+
+	b := newBuild("CAP_NET_ADMIN", "CAP_SYS_ADMIN")
+	if err := b.Compile(ctx); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	if got, want := b.neededCapabilities, []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"}; !slices.Equal(got, want) {
+		t.Errorf("needed capabilities = %v, want %v", got, want)
+	}
+	if got := b.workspaceConfig(ctx).Capabilities.Add; !slices.Equal(got, b.neededCapabilities) {
+		t.Errorf("granted capabilities = %v, want %v", got, b.neededCapabilities)
+	}
+
+	b = newBuild("CAP_SYS_MAGIC")
+	if err := b.Compile(ctx); err == nil || !strings.Contains(err.Error(), `needs unknown capability "CAP_SYS_MAGIC"`) {
+		t.Errorf("Compile() = %v, expected unknown capability", err)
+	}
+}
+
+func TestPrintSubstitutions(t *testing.T) {
+	var out strings.Builder
+	build := &Build{
+		Arch: apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.2.3", Epoch: 4},
+			Vars: map[string]string{
+				"greeting": "hello",
+				"target":   "world",
+			},
+			Options: map[string]config.BuildOption{
+				"docs": {},
+			},
+		},
+		EnabledBuildOptions: []string{"docs"},
+		PrintSubstitutions:  &out,
+	}
+
+	if err := build.Compile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `${{build.arch}}=x86_64
+${{build.goarch}}=amd64
+${{build.pipelines-version}}=` + PipelinesVersion() + `
+${{cross.sysroot}}=/usr/x86_64-pc-linux-gnu
+${{cross.triplet.gnu.glibc}}=x86_64-pc-linux-gnu
+${{cross.triplet.gnu.musl}}=x86_64-pc-linux-musl
+${{cross.triplet.rust.glibc}}=x86_64-unknown-linux-gnu
+${{cross.triplet.rust.musl}}=x86_64-unknown-linux-musl
+${{host.triplet.gnu}}=x86_64-pc-linux-gnu
+${{host.triplet.rust}}=x86_64-unknown-linux-gnu
+${{options.docs.enabled}}=true
+${{package.epoch}}=4
+${{package.full-version}}=1.2.3-r4
+${{package.name}}=hello
+${{package.subpackage-count}}=0
+${{package.version}}=1.2.3
+${{subpkg.license}}=
+${{targets.contextdir}}=/home/build/melange-out/hello
+${{targets.destdir}}=/home/build/melange-out/hello
+${{targets.outdir}}=/home/build/melange-out
+${{targets.package.hello}}=/home/build/melange-out/hello
+${{vars.greeting}}=hello
+${{vars.target}}=world
+`
+	if got := out.String(); got != want {
+		t.Errorf("substitutions: want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+	ctx := context.Background()
+
+	write := func(dir, uses, content string) {
+		t.Helper()
+		path := filepath.Join(dir, uses+".yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := t.TempDir(), t.TempDir()
+	write(first, "shared/build", "runs: first")
+	write(second, "shared/build", "runs: second")
+	write(second, "shared/test", "runs: second")
+	write(second, "fetch", "runs: overridden")
+
+	embedded, err := f.ReadFile("pipelines/git-checkout.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Compiled{PipelineDirs: []string{first, second}}
+	for _, tc := range []struct {
+		uses, want string
+	}{
+		// The first dir with the pipeline wins.
+		{"shared/build", "runs: first"},
+		{"shared/test", "runs: second"},
+		// The pipeline dirs take precedence over the embedded pipelines.
+		{"fetch", "runs: overridden"},
+		{"git-checkout", string(embedded)},
+	} {
+		data, err := c.readPipeline(ctx, tc.uses)
+		if err != nil {
+			t.Errorf("readPipeline(%q): unexpected error: %v", tc.uses, err)
+			continue
+		}
+		if got := string(data); got != tc.want {
+			t.Errorf("readPipeline(%q): want %q, got %q", tc.uses, tc.want, got)
+		}
+	}
+
+	_, err = c.readPipeline(ctx, "shared/missing")
+	if err == nil {
+		t.Fatal("readPipeline: expected an error for a missing pipeline")
+	}
+	want := `could not find 'uses' pipeline "shared/missing" in "` + first + `", "` + second + `" or the embedded pipelines`
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("readPipeline: want an error containing %q, got %q", want, err)
+	}
+}
+
+func TestReadPipelineNoOverrides(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	for uses, content := range map[string]string{
+		"fetch":        "runs: overridden",
+		"shared/build": "runs: shared",
+	} {
+		path := filepath.Join(dir, uses+".yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	embedded, err := f.ReadFile("pipelines/fetch.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		noOverrides   bool
+		fetch, shared string
+	}{
+		{false, "runs: overridden", "runs: shared"},
+		// The embedded pipelines win, other pipelines still load from the dirs.
+		{true, string(embedded), "runs: shared"},
+	} {
+		c := &Compiled{PipelineDirs: []string{dir}, noOverrides: tc.noOverrides}
+		for uses, want := range map[string]string{"fetch": tc.fetch, "shared/build": tc.shared} {
+			data, err := c.readPipeline(ctx, uses)
+			if err != nil {
+				t.Errorf("readPipeline(%q), noOverrides=%t: unexpected error: %v", uses, tc.noOverrides, err)
+				continue
+			}
+			if got := string(data); got != want {
+				t.Errorf("readPipeline(%q), noOverrides=%t: want %q, got %q", uses, tc.noOverrides, want, got)
+			}
+		}
+	}
+
+	b := &Build{}
+	if err := WithNoPipelineOverrides(true)(b); err != nil {
+		t.Fatal(err)
+	}
+	if !b.NoPipelineOverrides {
+		t.Error("WithNoPipelineOverrides(true): want NoPipelineOverrides set")
+	}
+}
+
+func TestReadPipelineVersion(t *testing.T) {
+	ctx := context.Background()
+
+	first, second := t.TempDir(), t.TempDir()
+	for dir, files := range map[string]map[string]string{
+		first: {
+			"shared/build.yaml":    "runs: unpinned",
+			"shared/build@v1.yaml": "runs: v1",
+		},
+		second: {
+			"shared/build@v2.yaml": "runs: v2",
+			"shared/build@v1.yaml": "runs: shadowed",
+		},
+	} {
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := &Compiled{PipelineDirs: []string{first, second}}
+	for _, tc := range []struct {
+		uses, want string
+	}{
+		{"shared/build", "runs: unpinned"},
+		{"shared/build@v1", "runs: v1"},
+		{"shared/build@v2", "runs: v2"},
+	} {
+		data, err := c.readPipeline(ctx, tc.uses)
+		if err != nil {
+			t.Errorf("readPipeline(%q): unexpected error: %v", tc.uses, err)
+			continue
+		}
+		if got := string(data); got != tc.want {
+			t.Errorf("readPipeline(%q): want %q, got %q", tc.uses, tc.want, got)
+		}
+	}
+
+	_, err := c.readPipeline(ctx, "shared/build@v3")
+	if err == nil {
+		t.Fatal("readPipeline: expected an error for a missing version")
+	}
+	want := `could not find version "v3" of 'uses' pipeline "shared/build" in "` + first + `", "` + second + `" or the embedded pipelines (available versions: v1, v2)`
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("readPipeline: want an error containing %q, got %q", want, err)
+	}
+
+	_, err = c.readPipeline(ctx, "fetch@v9")
+	if want := "(available versions: none)"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("readPipeline: want an error containing %q, got %v", want, err)
+	}
+}
+
+func TestCompileEnviron(t *testing.T) {
+	t.Setenv("MELANGE_TEST_TOKEN", "s3cr3t")
+	t.Setenv("MELANGE_TEST_HIDDEN", "hidden")
+
+	compile := func(runs string) (string, error) {
+		build := &Build{
+			Configuration: config.Configuration{
+				Pipeline: []config.Pipeline{{Runs: runs}},
+			},
+			AllowedEnviron: []string{"MELANGE_TEST_TOKEN", "MELANGE_TEST_UNSET"},
+		}
+		if err := build.Compile(context.Background()); err != nil {
+			return "", err
+		}
+		return build.Configuration.Pipeline[0].Runs, nil
+	}
+
+	if got, err := compile("login ${{environ.MELANGE_TEST_TOKEN}}"); err != nil {
+		t.Errorf("allowed variable: unexpected error: %v", err)
+	} else if want := "login s3cr3t"; got != want {
+		t.Errorf("allowed variable: want %q, got %q", want, got)
+	}
+
+	if _, err := compile("echo ${{environ.MELANGE_TEST_HIDDEN}}"); err == nil {
+		t.Error("disallowed variable: expected an error")
+	}
+
+	if _, err := compile("echo ${{environ.MELANGE_TEST_UNSET}}"); err == nil {
+		t.Error("unset variable: expected an error")
+	}
+}
+
+func TestCompileStrictSubstitutions(t *testing.T) {
+	compile := func(strict bool, runs string) (string, error) {
+		build := &Build{
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "hello"},
+				Pipeline: []config.Pipeline{{
+					Name: "greet",
+					// The value of each of these inputs is a reference
+					// to the other, which is left once substituted.
+					With: map[string]string{"a": "${{inputs.b}}", "b": "${{inputs.a}}"},
+					Runs: runs,
+				}},
+			},
+			StrictSubstitutions: strict,
+		}
+		if err := build.Compile(context.Background()); err != nil {
+			return "", err
+		}
+		return build.Configuration.Pipeline[0].Runs, nil
+	}
+
+	if got, err := compile(false, "echo ${{inputs.a}}"); err != nil {
+		t.Errorf("lenient: unexpected error: %v", err)
+	} else if !strings.Contains(got, "${{inputs.") {
+		t.Errorf("lenient: want the reference left in %q", got)
+	}
+
+	_, err := compile(true, "echo ${{inputs.a}}")
+	if err == nil {
+		t.Fatal("strict: expected an error")
+	}
+	if want := `step "greet": unresolved substitution ${{inputs.`; !strings.Contains(err.Error(), want) {
+		t.Errorf("strict: want an error containing %q, got %v", want, err)
+	}
+
+	if got, err := compile(true, "echo ${{package.name}} $${{ github.sha }}"); err != nil {
+		t.Errorf("escaped: unexpected error: %v", err)
+	} else if want := "echo hello ${{ github.sha }}"; got != want {
+		t.Errorf("escaped: want %q, got %q", want, got)
+	}
+}
+
+func TestCompileURIRewriter(t *testing.T) {
+	ctx := context.Background()
+
+	const (
+		uri    = "https://example.com/foo-1.0.tar.gz"
+		mirror = "https://mirror.example.com/foo-1.0.tar.gz"
+	)
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "foo", Version: "1.0"},
+			Pipeline: []config.Pipeline{{
+				Uses: "fetch",
+				With: map[string]string{
+					"uri":             uri,
+					"uris":            "https://a.example.com/foo-1.0.tar.gz",
+					"expected-sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				},
+			}},
+		},
+	}
+	if err := WithURIRewriter(func(s string) string {
+		return strings.Replace(s, "://", "://mirror.", 1)
+	})(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Compile(ctx); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+
+	// The fetch downloads from the mirror.
+	var runs strings.Builder
+	for _, p := range b.Configuration.Pipeline[0].Pipeline {
+		runs.WriteString(p.Runs)
+	}
+	if !strings.Contains(runs.String(), "'"+mirror+"'") {
+		t.Errorf("want the fetch to download %s, got runs:\n%s", mirror, runs.String())
+	}
+	if !strings.Contains(runs.String(), "https://mirror.a.example.com/foo-1.0.tar.gz") {
+		t.Errorf("want the mirror uris rewritten, got runs:\n%s", runs.String())
+	}
+	if strings.Contains(runs.String(), "'"+uri+"'") {
+		t.Errorf("want the fetch not to download %s, got runs:\n%s", uri, runs.String())
+	}
+
+	// The SBOM records the upstream uri.
+	pkg, err := b.Configuration.Pipeline[0].SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pkg.PURL.Qualifiers.Map()["download_url"]; got != uri {
+		t.Errorf("want the PURL to record %s, got %s", uri, got)
+	}
+	if got := pkg.AlternatePURLs[0].Qualifiers.Map()["download_url"]; got != "https://a.example.com/foo-1.0.tar.gz" {
+		t.Errorf("want the alternate PURL to record the upstream mirror, got %s", got)
+	}
+}
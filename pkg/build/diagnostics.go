@@ -0,0 +1,187 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// diagnosticsOutputLines is the number of the last lines of output of the
+// failed step kept in the diagnostics of a build.
+const diagnosticsOutputLines = 50
+
+// BuildDiagnostics describes why a build failed, as written to the
+// diagnostics file.
+type BuildDiagnostics struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// The error the build failed with.
+	Error string `json:"error"`
+	// The first step whose script failed, unless the build failed
+	// otherwise.
+	Step *StepFailure `json:"step,omitempty"`
+}
+
+// A StepFailure describes a step whose script failed.  The values of secret
+// inputs are redacted throughout.
+type StepFailure struct {
+	// The name of the step, or the pipeline it uses.
+	Step string `json:"step"`
+	// The exit code of the script, or -1 if it is unknown.
+	ExitCode int `json:"exit-code"`
+	// The command run, including the resolved script.
+	Command []string `json:"command"`
+	// The inputs of the step, and the environment it overrides for its
+	// script.
+	With        map[string]string `json:"with,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	// The last lines of output of the script.
+	Output []string `json:"output"`
+}
+
+// outputTail keeps the last lines logged by a runner.
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > diagnosticsOutputLines {
+		t.lines = t.lines[len(t.lines)-diagnosticsOutputLines:]
+	}
+}
+
+func (t *outputTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.lines...)
+}
+
+// tailHandler records the messages a runner logs, which are the lines of
+// output of what it runs, whether or not they are logged.
+type tailHandler struct {
+	slog.Handler
+	tail *outputTail
+}
+
+func (h *tailHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.Handler.Enabled(ctx, level)
+}
+
+func (h *tailHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		h.tail.add(r.Message)
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *tailHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &tailHandler{Handler: h.Handler.WithAttrs(attrs), tail: h.tail}
+}
+
+func (h *tailHandler) WithGroup(name string) slog.Handler {
+	return &tailHandler{Handler: h.Handler.WithGroup(name), tail: h.tail}
+}
+
+// withOutputTail returns a context whose logger also records the last lines
+// logged into tail.
+func withOutputTail(ctx context.Context, tail *outputTail) context.Context {
+	h := clog.FromContext(ctx).Handler()
+	return clog.WithLogger(ctx, clog.New(&tailHandler{Handler: h, tail: tail}))
+}
+
+// redact replaces the secrets in s.
+func redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactedInput)
+	}
+	return s
+}
+
+func redactAll(ss []string, secrets []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = redact(s, secrets)
+	}
+	return out
+}
+
+func redactMap(m map[string]string, secrets []string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := maps.Clone(m)
+	for k, v := range out {
+		out[k] = redact(v, secrets)
+	}
+	return out
+}
+
+// diagnosticsPath returns the path of the diagnostics file of the build,
+// suffixed with the architecture.
+func (b *Build) diagnosticsPath() string {
+	return fmt.Sprintf("%s.%s", b.DiagnosticsFile, b.Arch.ToAPK())
+}
+
+// writeDiagnostics writes the diagnostics of the build, which failed with
+// buildErr, to the diagnostics file, along with the failed step, if any.
+func (b *Build) writeDiagnostics(ctx context.Context, buildErr error, failure *StepFailure) error {
+	d := BuildDiagnostics{
+		Package: b.Configuration.Package.Name,
+		Version: b.Configuration.Package.FullVersion(),
+		Arch:    b.Arch.ToAPK(),
+		Error:   redact(buildErr.Error(), b.secrets),
+		Step:    failure,
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := b.diagnosticsPath()
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing diagnostics: %w", err)
+	}
+	clog.FromContext(ctx).Infof("wrote the diagnostics of the failed build to %s", path)
+
+	return nil
+}
+
+// removeDiagnostics removes the diagnostics of a previous build, so that
+// they are not mistaken for those of this one.
+func (b *Build) removeDiagnostics() error {
+	if err := os.Remove(b.diagnosticsPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+// outputRunner logs many lines of output for each script, as runners log
+// the output of what they run, before running it as a fakeRunner.
+type outputRunner struct {
+	fakeRunner
+}
+
+func (r *outputRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	log := clog.FromContext(ctx)
+	word := "step"
+	if strings.Contains(cmd[len(cmd)-1], "hunter2") {
+		word = "hunter2"
+	}
+	for i := range 2 * diagnosticsOutputLines {
+		log.Infof("output line %d of %s", i, word)
+	}
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestDiagnostics(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pr := &pipelineRunner{
+		config:   &container.Config{},
+		runner:   &outputRunner{},
+		diagnose: true,
+		secrets:  []string{"hunter2"},
+	}
+	err := pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "compile", With: map[string]string{"token": "hunter2"}, Runs: "echo hunter2 && fail"},
+		{Name: "install", Runs: "echo fail again"},
+	})
+	require.Error(t, err)
+
+	f := pr.failure
+	require.NotNil(t, f)
+	require.Equal(t, "compile", f.Step)
+	require.Equal(t, -1, f.ExitCode)
+	require.Equal(t, map[string]string{"token": redactedInput}, f.With)
+	require.Contains(t, f.Command[len(f.Command)-1], "echo "+redactedInput+" && fail")
+	require.NotContains(t, strings.Join(f.Command, " "), "hunter2")
+	require.Len(t, f.Output, diagnosticsOutputLines)
+	require.Equal(t, fmt.Sprintf("output line %d of %s", 2*diagnosticsOutputLines-1, redactedInput), f.Output[len(f.Output)-1])
+
+	b := &Build{
+		DiagnosticsFile: filepath.Join(t.TempDir(), "diagnostics.json"),
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		Configuration:   config.Configuration{Package: config.Package{Name: "hello", Version: "1.0"}},
+		secrets:         pr.secrets,
+	}
+	require.NoError(t, b.writeDiagnostics(ctx, errors.New("unable to run pipeline: token hunter2 rejected"), f))
+
+	data, err := os.ReadFile(b.DiagnosticsFile + ".x86_64")
+	require.NoError(t, err)
+	var got BuildDiagnostics
+	require.NoError(t, json.Unmarshal(data, &got))
+	require.Equal(t, BuildDiagnostics{
+		Package: "hello",
+		Version: "1.0-r0",
+		Arch:    "x86_64",
+		Error:   "unable to run pipeline: token " + redactedInput + " rejected",
+		Step:    f,
+	}, got)
+
+	require.NoError(t, b.removeDiagnostics())
+	require.NoFileExists(t, b.DiagnosticsFile+".x86_64")
+	require.NoError(t, b.removeDiagnostics())
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineInfo describes a reusable pipeline and the inputs it accepts.
+type PipelineInfo struct {
+	// The name to refer to the pipeline by in `uses`.
+	Uses string `json:"uses"`
+	// The human-readable name of the pipeline.
+	Name string `json:"name,omitempty"`
+	// The inputs the pipeline accepts in `with`.
+	Inputs map[string]config.Input `json:"inputs,omitempty"`
+}
+
+// EmbeddedPipelines returns the pipelines built into melange, sorted by their
+// `uses` name.
+func EmbeddedPipelines() ([]PipelineInfo, error) {
+	var infos []PipelineInfo
+
+	if err := fs.WalkDir(f, "pipelines", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(p) != ".yaml" {
+			return nil
+		}
+
+		data, err := f.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		var pipeline config.Pipeline
+		if err := yaml.Unmarshal(data, &pipeline); err != nil {
+			return fmt.Errorf("unable to parse pipeline %s: %w", p, err)
+		}
+
+		for k, in := range pipeline.Inputs {
+			in.Description = strings.TrimSpace(in.Description)
+			pipeline.Inputs[k] = in
+		}
+
+		infos = append(infos, PipelineInfo{
+			Uses:   strings.TrimSuffix(strings.TrimPrefix(p, "pipelines/"), ".yaml"),
+			Name:   pipeline.Name,
+			Inputs: pipeline.Inputs,
+		})
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(infos, func(a, b PipelineInfo) int {
+		return strings.Compare(a.Uses, b.Uses)
+	})
+
+	return infos, nil
+}
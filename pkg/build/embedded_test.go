@@ -0,0 +1,42 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedPipelines(t *testing.T) {
+	infos, err := EmbeddedPipelines()
+	require.NoError(t, err)
+
+	require.True(t, slices.IsSortedFunc(infos, func(a, b PipelineInfo) int {
+		return strings.Compare(a.Uses, b.Uses)
+	}), "pipelines are not sorted")
+
+	i := slices.IndexFunc(infos, func(info PipelineInfo) bool { return info.Uses == "git-checkout" })
+	require.NotEqual(t, -1, i, "git-checkout is missing")
+
+	gc := infos[i]
+	require.Equal(t, "Check out sources from git", gc.Name)
+	require.True(t, gc.Inputs["repository"].Required)
+	require.Equal(t, ".", gc.Inputs["destination"].Default)
+
+	require.True(t, slices.ContainsFunc(infos, func(info PipelineInfo) bool { return info.Uses == "autoconf/configure" }))
+}
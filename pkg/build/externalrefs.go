@@ -0,0 +1,77 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"chainguard.dev/melange/pkg/config"
+	purl "github.com/package-url/packageurl-go"
+)
+
+// ExternalRefs compiles the build configuration and returns the PURLs of the
+// upstream sources its steps, those of its subpackages and their nested
+// steps included, would record in the SBOM, without running anything.  Each
+// PURL is listed once, in the order its step is found.
+func (b *Build) ExternalRefs(ctx context.Context) ([]purl.PackageURL, error) {
+	if err := b.Compile(ctx); err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", b.Configuration.Package.Name, err)
+	}
+
+	cfg := &b.Configuration
+	var (
+		refs []purl.PackageURL
+		seen = map[string]bool{}
+		i    int
+	)
+	var walk func(ps []config.Pipeline) error
+	walk = func(ps []config.Pipeline) error {
+		for _, p := range ps {
+			pkg, err := p.SBOMPackageForUpstreamSource(cfg.Package.LicenseExpression(), b.Namespace, strconv.Itoa(i))
+			if err != nil {
+				return fmt.Errorf("step %q: %w", p.Identity(), err)
+			}
+			i++
+
+			if pkg != nil {
+				for _, pu := range append([]*purl.PackageURL{pkg.PURL}, pkg.AlternatePURLs...) {
+					if pu == nil || seen[pu.String()] {
+						continue
+					}
+					seen[pu.String()] = true
+					refs = append(refs, *pu)
+				}
+			}
+
+			if err := walk(p.Pipeline); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(cfg.Pipeline); err != nil {
+		return nil, err
+	}
+	for _, sp := range cfg.Subpackages {
+		if err := walk(sp.Pipeline); err != nil {
+			return nil, fmt.Errorf("subpackage %q: %w", sp.Name, err)
+		}
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalRefs(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "refs.yaml")
+	if err := os.WriteFile(cfgFile, []byte(`
+package:
+  name: refs
+  version: 1.2.3
+  epoch: 0
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/refs-${{package.version}}.tar.gz
+      expected-sha256: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+  - name: sources
+    pipeline:
+      - uses: git-checkout
+        with:
+          repository: https://github.com/example/refs
+          tag: v${{package.version}}
+          expected-commit: 0123456789abcdef0123456789abcdef01234567
+
+subpackages:
+  - name: refs-doc
+    pipeline:
+      - uses: fetch
+        with:
+          uri: https://example.com/refs-${{package.version}}.tar.gz
+          expected-sha256: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Build{
+		ConfigFile: cfgFile,
+		Arch:       apko_types.ParseArchitecture("x86_64"),
+	}
+	cfg, err := b.parseConfiguration(ctx)
+	require.NoError(t, err)
+	b.Configuration = *cfg
+
+	refs, err := b.ExternalRefs(ctx)
+	require.NoError(t, err)
+
+	var got []string
+	for _, ref := range refs {
+		got = append(got, ref.String())
+	}
+	require.Equal(t, []string{
+		"pkg:generic/refs@1.2.3?checksum=sha256%3A0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef&download_url=https%3A%2F%2Fexample.com%2Frefs-1.2.3.tar.gz",
+		"pkg:github/example/refs@v1.2.3",
+	}, got)
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/util"
+	"github.com/chainguard-dev/clog"
+)
+
+// GitOverride points the git-checkout steps matching Match, either by step
+// name or by repository, at a different commit or tag than configured.
+type GitOverride struct {
+	Match string
+
+	// Exactly one of Commit or Tag is set.
+	Commit string
+	Tag    string
+}
+
+var commitRegex = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// ParseGitOverride parses an override of the form <step-or-repository>=<ref>.
+// A full commit hash is used as the expected commit, anything else as a tag.
+func ParseGitOverride(s string) (GitOverride, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return GitOverride{}, fmt.Errorf("invalid git override %q, expected <step-or-repository>=<ref>", s)
+	}
+
+	o := GitOverride{Match: s[:i]}
+	if ref := s[i+1:]; commitRegex.MatchString(ref) {
+		o.Commit = ref
+	} else {
+		o.Tag = ref
+	}
+
+	return o, nil
+}
+
+func (o GitOverride) String() string {
+	if o.Commit != "" {
+		return "commit " + o.Commit
+	}
+	return "tag " + o.Tag
+}
+
+// applyGitOverrides rewrites the inputs of the git-checkout steps in ps which
+// match one of the overrides.  This happens before compilation, so that the
+// overridden ref is used both to check out and in the SBOM.
+func applyGitOverrides(ctx context.Context, sm *SubstitutionMap, ps []config.Pipeline, overrides []GitOverride) error {
+	log := clog.FromContext(ctx)
+
+	for i := range ps {
+		p := &ps[i]
+
+		if err := applyGitOverrides(ctx, sm, p.Pipeline, overrides); err != nil {
+			return err
+		}
+
+		if p.UsesName() != "git-checkout" {
+			continue
+		}
+
+		repo, err := util.MutateStringFromMap(sm.Substitutions, p.With["repository"])
+		if err != nil {
+			return fmt.Errorf("mutating repository: %w", err)
+		}
+
+		for _, o := range overrides {
+			if o.Match != p.Name && o.Match != repo {
+				continue
+			}
+
+			log.Warnf("overriding git-checkout of %s to %s", repo, o)
+
+			with := maps.Clone(p.With)
+			delete(with, "tag")
+			delete(with, "expected-commit")
+			if o.Commit != "" {
+				// The commit may be anywhere in the history, so clone
+				// all of it to be able to reset to the commit.
+				with["expected-commit"] = o.Commit
+				with["depth"] = "-1"
+			} else {
+				delete(with, "branch")
+				with["tag"] = o.Tag
+			}
+			p.With = with
+
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGitOverride(t *testing.T) {
+	o, err := ParseGitOverride("https://github.com/foo/bar=0123456789abcdef0123456789abcdef01234567")
+	require.NoError(t, err)
+	require.Equal(t, GitOverride{Match: "https://github.com/foo/bar", Commit: "0123456789abcdef0123456789abcdef01234567"}, o)
+
+	o, err = ParseGitOverride("checkout=v1.2.3")
+	require.NoError(t, err)
+	require.Equal(t, GitOverride{Match: "checkout", Tag: "v1.2.3"}, o)
+
+	for _, s := range []string{"checkout", "=v1.2.3", "checkout="} {
+		_, err := ParseGitOverride(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestApplyGitOverrides(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	cfg := &config.Configuration{
+		Package: config.Package{Name: "bar", Version: "1.2.3"},
+		Pipeline: []config.Pipeline{{
+			Uses: "git-checkout",
+			With: map[string]string{
+				"repository":      "https://github.com/foo/bar",
+				"tag":             "v${{package.version}}",
+				"expected-commit": "0123456789abcdef0123456789abcdef01234567",
+			},
+		}, {
+			Name: "other",
+			Uses: "git-checkout",
+			With: map[string]string{
+				"repository": "https://github.com/foo/baz",
+				"branch":     "main",
+			},
+		}},
+	}
+	sm, err := NewSubstitutionMap(cfg, "amd64", "gnu", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, applyGitOverrides(ctx, sm, cfg.Pipeline, []GitOverride{
+		{Match: "https://github.com/foo/bar", Commit: "89abcdef0123456789abcdef0123456789abcdef"},
+		{Match: "other", Tag: "v2.0.0"},
+	}))
+
+	require.Equal(t, map[string]string{
+		"repository":      "https://github.com/foo/bar",
+		"expected-commit": "89abcdef0123456789abcdef0123456789abcdef",
+		"depth":           "-1",
+	}, cfg.Pipeline[0].With)
+	require.Equal(t, map[string]string{
+		"repository": "https://github.com/foo/baz",
+		"tag":        "v2.0.0",
+	}, cfg.Pipeline[1].With)
+
+	pkg, err := cfg.Pipeline[0].SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Contains(t, pkg.PURL.ToString(), "89abcdef0123456789abcdef0123456789abcdef")
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// goldenSBOMPath returns the path of the golden SBOM of the package pkgName,
+// <GoldenSBOMDir>/<arch>/<package>-<version>.spdx.json.
+func (b *Build) goldenSBOMPath(pkgName string) string {
+	return getPathForPackageSBOM(filepath.Join(b.GoldenSBOMDir, b.Arch.ToAPK()), pkgName, b.Configuration.Package.FullVersion())
+}
+
+// compareGoldenSBOMs compares the SBOMs written for the packages pkgNames to
+// their golden SBOMs, and returns an error showing how each one differs.
+func (b *Build) compareGoldenSBOMs(pkgNames []string) error {
+	var errs []error
+	for _, pkgName := range pkgNames {
+		golden := b.goldenSBOMPath(pkgName)
+		expected, err := os.ReadFile(golden)
+		if errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("no golden SBOM for %s at %s", pkgName, golden))
+			continue
+		} else if err != nil {
+			return fmt.Errorf("reading golden SBOM: %w", err)
+		}
+
+		generated := getPathForPackageSBOM(filepath.Join(b.packageDir(pkgName), "var/lib/db/sbom"), pkgName, b.Configuration.Package.FullVersion())
+		actual, err := os.ReadFile(generated)
+		if err != nil {
+			return fmt.Errorf("reading generated SBOM: %w", err)
+		}
+
+		if diff := sbomDiff(golden, expected, actual); diff != "" {
+			errs = append(errs, fmt.Errorf("SBOM of %s differs from its golden SBOM:\n%s", pkgName, diff))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sbomDiff returns a unified diff from the golden SBOM to the generated one,
+// or "" if they are the same.
+func sbomDiff(golden string, expected, actual []byte) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(expected)),
+		B:        difflib.SplitLines(string(actual)),
+		FromFile: golden,
+		ToFile:   "generated",
+		Context:  3,
+	})
+	if err != nil {
+		// Writing to a string cannot fail.
+		return err.Error()
+	}
+	return diff
+}
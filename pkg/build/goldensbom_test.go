@@ -0,0 +1,55 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestCompareGoldenSBOMs(t *testing.T) {
+	b := &Build{
+		Arch:          apko_types.ParseArchitecture("x86_64"),
+		WorkspaceDir:  t.TempDir(),
+		GoldenSBOMDir: t.TempDir(),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "foo", Version: "1.2.3", Epoch: 1},
+		},
+	}
+
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	sbom := "{\n  \"name\": \"apk-foo-1.2.3-r1\",\n  \"version\": \"SPDX-2.3\"\n}\n"
+	write(filepath.Join(b.WorkspaceDir, melangeOutputDirName, "foo", "var/lib/db/sbom", "foo-1.2.3-r1.spdx.json"), sbom)
+
+	err := b.compareGoldenSBOMs([]string{"foo"})
+	require.ErrorContains(t, err, "no golden SBOM for foo at "+filepath.Join(b.GoldenSBOMDir, "x86_64", "foo-1.2.3-r1.spdx.json"))
+
+	write(filepath.Join(b.GoldenSBOMDir, "x86_64", "foo-1.2.3-r1.spdx.json"), sbom)
+	require.NoError(t, b.compareGoldenSBOMs([]string{"foo"}))
+
+	write(filepath.Join(b.GoldenSBOMDir, "x86_64", "foo-1.2.3-r1.spdx.json"), "{\n  \"name\": \"apk-foo-1.2.3-r0\",\n  \"version\": \"SPDX-2.3\"\n}\n")
+	err = b.compareGoldenSBOMs([]string{"foo"})
+	require.ErrorContains(t, err, "SBOM of foo differs")
+	require.ErrorContains(t, err, "\n-  \"name\": \"apk-foo-1.2.3-r0\",\n+  \"name\": \"apk-foo-1.2.3-r1\",\n")
+}
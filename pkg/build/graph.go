@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// WriteDOT renders the pipeline hierarchy of cfg, including its subpackages,
+// as a Graphviz DOT graph.  Steps and subpackages gated by an if-conditional
+// are drawn dashed, with the condition on the incoming edge.  Nothing is run:
+// pass a compiled configuration to also see the steps of `uses` pipelines.
+func WriteDOT(w io.Writer, cfg *config.Configuration) error {
+	g := &dotGraph{w: bufio.NewWriter(w)}
+
+	fmt.Fprintf(g.w, "digraph %s {\n", dotQuote(cfg.Package.Name))
+	fmt.Fprintf(g.w, "  node [shape=box];\n")
+
+	root := g.node(cfg.Package.Name, "", ", shape=folder")
+	g.pipelines(root, cfg.Pipeline)
+
+	for _, sp := range cfg.Subpackages {
+		n := g.node(sp.Name, sp.If, ", shape=folder")
+		g.edge(root, n, sp.If)
+		g.pipelines(n, sp.Pipeline)
+	}
+
+	fmt.Fprintf(g.w, "}\n")
+
+	return g.w.Flush()
+}
+
+type dotGraph struct {
+	w     *bufio.Writer
+	nodes int
+}
+
+// node declares a new node and returns its ID.
+func (g *dotGraph) node(label, ifs, attrs string) string {
+	id := fmt.Sprintf("n%d", g.nodes)
+	g.nodes++
+
+	attrs = fmt.Sprintf("label=%s%s", dotQuote(label), attrs)
+	if ifs != "" {
+		attrs += ", style=dashed"
+	}
+	fmt.Fprintf(g.w, "  %s [%s];\n", id, attrs)
+
+	return id
+}
+
+func (g *dotGraph) edge(from, to, ifs string) {
+	if ifs != "" {
+		fmt.Fprintf(g.w, "  %s -> %s [label=%s, style=dashed];\n", from, to, dotQuote(ifs))
+		return
+	}
+	fmt.Fprintf(g.w, "  %s -> %s;\n", from, to)
+}
+
+// pipelines adds the steps of ps, and recursively their nested steps, as
+// children of parent.  Sibling steps are chained in execution order.
+func (g *dotGraph) pipelines(parent string, ps []config.Pipeline) {
+	prev := ""
+	for i := range ps {
+		p := &ps[i]
+
+		label := p.Identity()
+		if p.Uses != "" && label != p.Uses {
+			label += "\nuses: " + p.Uses
+		}
+
+		n := g.node(label, p.If, "")
+		g.edge(parent, n, p.If)
+		if prev != "" {
+			fmt.Fprintf(g.w, "  %s -> %s [style=dotted, arrowhead=none, constraint=false];\n", prev, n)
+		}
+		prev = n
+
+		g.pipelines(n, p.Pipeline)
+	}
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
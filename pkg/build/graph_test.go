@@ -0,0 +1,68 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteDOT(t *testing.T) {
+	cfg := &config.Configuration{
+		Package: config.Package{Name: "foo"},
+		Pipeline: []config.Pipeline{
+			{Uses: "git-checkout"},
+			{Name: "build", Pipeline: []config.Pipeline{
+				{Runs: "make"},
+				{Name: "docs", If: `${{options.docs.enabled}} == "true"`, Runs: "make docs"},
+			}},
+		},
+		Subpackages: []config.Subpackage{{
+			Name:     "foo-dev",
+			Pipeline: []config.Pipeline{{Name: "headers", Uses: "split/dev"}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `digraph "foo" {
+  node [shape=box];
+  n0 [label="foo", shape=folder];
+  n1 [label="git-checkout"];
+  n0 -> n1;
+  n2 [label="build"];
+  n0 -> n2;
+  n1 -> n2 [style=dotted, arrowhead=none, constraint=false];
+  n3 [label="runs-d05aa2a1"];
+  n2 -> n3;
+  n4 [label="docs", style=dashed];
+  n2 -> n4 [label="${{options.docs.enabled}} == \"true\"", style=dashed];
+  n3 -> n4 [style=dotted, arrowhead=none, constraint=false];
+  n5 [label="foo-dev", shape=folder];
+  n0 -> n5;
+  n6 [label="headers\nuses: split/dev"];
+  n5 -> n6;
+}
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("WriteDOT() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	apkofs "chainguard.dev/apko/pkg/apk/fs"
+	apko_build "chainguard.dev/apko/pkg/build"
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// installCheckPackages are the packages of the root the emitted packages are
+// installed into by checkInstall: only what it takes to install them.
+var installCheckPackages = []string{"apk-tools", "busybox"}
+
+// The directory of the local repository of the emitted packages, in the
+// workspace of the install check.
+const installCheckRepo = "packages"
+
+// checkInstall installs each emitted package, with its dependencies, into a
+// fresh root using the runner, which fails if any of its dependencies cannot
+// be resolved or any of its install scripts fails.  The packages are served
+// from a local repository, so that they can depend on each other, and their
+// other dependencies from the repositories of the build environment.
+func (b *Build) checkInstall(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	tmp, err := os.MkdirTemp(b.Runner.TempDir(), "melange-install-check-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	workspaceDir := filepath.Join(tmp, "workspace")
+	repoDir := filepath.Join(workspaceDir, installCheckRepo, b.Arch.ToAPK())
+	if err := os.MkdirAll(repoDir, 0o755); err != nil {
+		return err
+	}
+
+	version := b.Configuration.Package.FullVersion()
+
+	var names, apkFiles []string
+	for _, src := range b.packageFiles() {
+		name := filepath.Base(src)
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			// This subpackage was not emitted.
+			continue
+		}
+		if err := copyFile(filepath.Dir(src), name, repoDir, 0o644); err != nil {
+			return err
+		}
+		names = append(names, name[:len(name)-len("-"+version+".apk")])
+		apkFiles = append(apkFiles, filepath.Join(repoDir, name))
+	}
+
+	idx, err := index.New(
+		index.WithPackageFiles(apkFiles),
+		index.WithIndexFile(filepath.Join(repoDir, "APKINDEX.tar.gz")),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create index: %w", err)
+	}
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("unable to generate index: %w", err)
+	}
+
+	imgRef, err := b.installCheckGuest(ctx, filepath.Join(tmp, "guest"))
+	if err != nil {
+		return fmt.Errorf("unable to build install check guest: %w", err)
+	}
+
+	cfg := &container.Config{
+		Arch:        b.Arch,
+		PackageName: b.Configuration.Package.Name,
+		ImgRef:      imgRef,
+		Mounts: []container.BindMount{
+			{Source: workspaceDir, Destination: container.DefaultWorkspaceDir},
+			{Source: "/etc/resolv.conf", Destination: container.DefaultResolvConfPath},
+		},
+		Capabilities: container.Capabilities{Networking: true},
+		WorkspaceDir: workspaceDir,
+		Environment:  map[string]string{},
+	}
+	// Bubblewrap runs as the build user unless told otherwise, the others as
+	// root, which installing packages needs.
+	if b.Runner.Name() == container.BubblewrapName {
+		cfg.RunAs = "0"
+	}
+
+	if err := b.Runner.StartPod(ctx, cfg); err != nil {
+		return fmt.Errorf("unable to start install check pod: %w", err)
+	}
+	defer func() {
+		if err := b.Runner.TerminatePod(context.WithoutCancel(ctx), cfg); err != nil {
+			log.Warnf("unable to terminate install check pod: %s", err)
+		}
+		if err := b.Runner.OCIImageLoader().RemoveImage(context.WithoutCancel(ctx), imgRef); err != nil {
+			log.Warnf("unable to remove install check image: %s", err)
+		}
+	}()
+
+	// The packages are installed one after the other into the same root, so
+	// each is checked whatever happened to the previous one.
+	var errs []error
+	for _, name := range names {
+		log.Infof("checking that %s installs cleanly", name)
+		script := fmt.Sprintf("apk add --update-cache --allow-untrusted --repository %s %s=%s",
+			filepath.Join(container.DefaultWorkspaceDir, installCheckRepo), name, version)
+		if err := b.Runner.Run(ctx, cfg, nil, "/bin/sh", "-c", script); err != nil {
+			errs = append(errs, fmt.Errorf("%s does not install cleanly: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// installCheckGuest builds the image of the fresh root of checkInstall in dir,
+// with the repositories and keys of the build environment, and loads it into
+// the runner.
+func (b *Build) installCheckGuest(ctx context.Context, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	env := b.Configuration.Environment.Contents
+	imgConfig := apko_types.ImageConfiguration{
+		Contents: apko_types.ImageContents{
+			RuntimeRepositories: slices.Concat(env.BuildRepositories, env.RuntimeRepositories, b.ExtraRepos),
+			Keyring:             slices.Concat(env.Keyring, b.ExtraKeys),
+			Packages:            installCheckPackages,
+		},
+	}
+
+	tmp, err := os.MkdirTemp(os.TempDir(), "apko-temp-*")
+	if err != nil {
+		return "", fmt.Errorf("creating apko tempdir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bc, err := apko_build.New(ctx, apkofs.DirFS(dir, apkofs.WithCreateDir()),
+		apko_build.WithImageConfiguration(imgConfig),
+		apko_build.WithArch(b.Arch),
+		apko_build.WithCache(b.ApkCacheDir, false, apk.NewCache(true)),
+		apko_build.WithTempDir(tmp),
+		apko_build.WithIgnoreSignatures(b.IgnoreSignatures))
+	if err != nil {
+		return "", fmt.Errorf("unable to create build context: %w", err)
+	}
+
+	if err := bc.BuildImage(ctx); err != nil {
+		return "", fmt.Errorf("unable to generate image: %w", err)
+	}
+
+	loader := b.Runner.OCIImageLoader()
+	if loader == nil {
+		return "", fmt.Errorf("runner %s does not support OCI image loading", b.Runner.Name())
+	}
+	layerTarGZ, layer, err := bc.ImageLayoutToLayer(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(layerTarGZ)
+
+	return loader.LoadImage(ctx, layer, b.Arch, bc)
+}
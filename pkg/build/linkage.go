@@ -0,0 +1,192 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"github.com/chainguard-dev/clog"
+)
+
+// The shared libraries a package links against, and those it ships, by
+// soname.
+type packageLinkage struct {
+	needs    []string
+	provides []string
+}
+
+// checkLinkage checks that the shared libraries each package of the build
+// links against are shipped by the package itself, or provided by one of its
+// runtime dependencies: either a sibling package, or a package of the build
+// environment, which the libraries were linked with.  It reports missing
+// dependencies as warnings, or errors with Strict.
+func (b *Build) checkLinkage(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	pkgs := map[string]packageLinkage{}
+	for _, name := range names {
+		l, err := scanLinkage(os.DirFS(b.packageDir(name)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("scanning the linkage of %s: %w", name, err)
+		}
+		pkgs[name] = l
+	}
+
+	if b.environmentProviders == nil {
+		log.Warnf("the packages of the build environment are unknown, only checking linkage against the packages of the build")
+	}
+
+	for _, name := range names {
+		for _, problem := range missingLinkage(name, b.emittedRuntime[name], pkgs, b.environmentProviders) {
+			if err := b.warn(ctx, "%s", problem); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// scanLinkage returns the sonames of the shared libraries the ELF files in
+// fsys need, and of those they are.
+func scanLinkage(fsys fs.FS) (packageLinkage, error) {
+	var l packageLinkage
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return nil
+		}
+		ef, err := elf.NewFile(ra)
+		if err != nil {
+			// Not an ELF file.
+			return nil
+		}
+		defer ef.Close()
+
+		libs, err := ef.ImportedLibraries()
+		if err != nil {
+			return nil
+		}
+		for _, lib := range libs {
+			// Cuda is a dangling library, which must come from the host.
+			if strings.Contains(lib, ".so") && lib != "libcuda.so.1" {
+				l.needs = append(l.needs, lib)
+			}
+		}
+
+		sonames, err := ef.DynString(elf.DT_SONAME)
+		if err == nil {
+			l.provides = append(l.provides, sonames...)
+		}
+
+		return nil
+	})
+
+	slices.Sort(l.needs)
+	l.needs = slices.Compact(l.needs)
+	return l, err
+}
+
+// missingLinkage describes each shared library the package name needs which
+// is neither shipped by the package nor provided by one of its runtime
+// dependencies.  Runtime dependencies are resolved against the other packages
+// of the build, then against environment, which maps what the packages of the
+// build environment provide to their names.  A nil environment is unknown, so
+// so: dependencies on it are trusted.
+func missingLinkage(name string, runtime []string, pkgs map[string]packageLinkage, environment map[string][]string) []string {
+	var problems []string
+
+	deps := make([]string, 0, len(runtime))
+	for _, dep := range runtime {
+		deps = append(deps, dependencyName(dep))
+	}
+
+	for _, lib := range pkgs[name].needs {
+		if slices.Contains(pkgs[name].provides, lib) {
+			continue
+		}
+
+		// The packages which provide the library, siblings first.
+		var providers []string
+		for _, sibling := range slices.Sorted(maps.Keys(pkgs)) {
+			if sibling != name && slices.Contains(pkgs[sibling].provides, lib) {
+				providers = append(providers, sibling)
+			}
+		}
+		providers = append(providers, environment["so:"+lib]...)
+
+		switch {
+		case slices.ContainsFunc(providers, func(p string) bool { return slices.Contains(deps, p) }):
+			// It depends on a package providing the library.
+		case slices.Contains(deps, "so:"+lib):
+			if environment != nil && len(providers) == 0 {
+				problems = append(problems, fmt.Sprintf("package %s depends on so:%s, which no package of the build or of its build environment provides", name, lib))
+			}
+		case len(providers) == 0:
+			problems = append(problems, fmt.Sprintf("package %s links against %s, which none of its runtime dependencies provide, and no package of the build or of its build environment does either", name, lib))
+		default:
+			problems = append(problems, fmt.Sprintf("package %s links against %s, which none of its runtime dependencies provide; add a runtime dependency on %s", name, lib, providers[0]))
+		}
+	}
+
+	return problems
+}
+
+// environmentProviders maps what the installed packages provide, without
+// versions, to the names of the packages which provide it.
+func environmentProviders(installed []*apk.InstalledPackage) map[string][]string {
+	providers := map[string][]string{}
+	for _, pkg := range installed {
+		for _, p := range pkg.Provides {
+			p = dependencyName(p)
+			providers[p] = append(providers[p], pkg.Name)
+		}
+	}
+	return providers
+}
+
+// dependencyName strips the version constraint from a dependency.
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "=<>~"); i >= 0 {
+		return dep[:i]
+	}
+	return dep
+}
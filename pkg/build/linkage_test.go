@@ -0,0 +1,71 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingLinkage(t *testing.T) {
+	pkgs := map[string]packageLinkage{
+		"foo": {
+			needs:    []string{"libc.so.6", "libfoo.so.1", "libmissing.so.2", "libssl.so.3", "libz.so.1"},
+			provides: []string{"libfoo.so.1"},
+		},
+		"foo-libs": {
+			provides: []string{"libz.so.1"},
+		},
+	}
+	environment := environmentProviders([]*apk.InstalledPackage{
+		{Package: apk.Package{Name: "glibc", Provides: []string{"so:libc.so.6=6"}}},
+		{Package: apk.Package{Name: "libssl3", Provides: []string{"so:libssl.so.3=3"}}},
+	})
+
+	for _, tt := range []struct {
+		name    string
+		runtime []string
+		env     map[string][]string
+		want    []string
+	}{{
+		name:    "all declared",
+		runtime: []string{"so:libc.so.6", "libssl3>=3.0", "foo-libs=1.0-r0", "so:libmissing.so.2"},
+		env:     environment,
+		want: []string{
+			"package foo depends on so:libmissing.so.2, which no package of the build or of its build environment provides",
+		},
+	}, {
+		name:    "nothing declared",
+		runtime: nil,
+		env:     environment,
+		want: []string{
+			"package foo links against libc.so.6, which none of its runtime dependencies provide; add a runtime dependency on glibc",
+			"package foo links against libmissing.so.2, which none of its runtime dependencies provide, and no package of the build or of its build environment does either",
+			"package foo links against libssl.so.3, which none of its runtime dependencies provide; add a runtime dependency on libssl3",
+			"package foo links against libz.so.1, which none of its runtime dependencies provide; add a runtime dependency on foo-libs",
+		},
+	}, {
+		name:    "unknown environment",
+		runtime: []string{"so:libc.so.6", "so:libssl.so.3", "so:libmissing.so.2", "foo-libs"},
+		env:     nil,
+		want:    nil,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, missingLinkage("foo", tt.runtime, pkgs, tt.env))
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/lock"
+)
+
+// lockFileVersion is the version of the apko lockfile format we emit.
+const lockFileVersion = "v1"
+
+// guestLock records the repositories, keys and installed packages of a build
+// environment in the apko lockfile format.
+func guestLock(imgConfig apko_types.ImageConfiguration, extraRepos, extraKeys []string, arch apko_types.Architecture, installed []*apk.InstalledPackage) lock.Lock {
+	l := lock.Lock{Version: lockFileVersion}
+
+	for _, key := range slices.Concat(imgConfig.Contents.Keyring, extraKeys) {
+		l.Contents.Keyrings = append(l.Contents.Keyrings, lock.LockKeyring{Name: path.Base(key), URL: key})
+	}
+
+	for _, repo := range slices.Concat(imgConfig.Contents.BuildRepositories, extraRepos) {
+		l.Contents.BuildRepositories = append(l.Contents.BuildRepositories, lock.LockRepo{Name: repo, URL: repo, Architecture: arch.ToAPK()})
+	}
+	for _, repo := range imgConfig.Contents.RuntimeRepositories {
+		l.Contents.RuntimeRepositories = append(l.Contents.RuntimeRepositories, lock.LockRepo{Name: repo, URL: repo, Architecture: arch.ToAPK()})
+	}
+
+	for _, pkg := range installed {
+		l.Contents.Packages = append(l.Contents.Packages, lock.LockPkg{
+			Name:         pkg.Name,
+			Version:      pkg.Version,
+			Architecture: pkg.Arch,
+			Checksum:     pkg.ChecksumString(),
+		})
+	}
+
+	return l
+}
+
+// pinnedPackages returns `name=version` constraints for every package
+// recorded in the lockfile at lockFile.
+func pinnedPackages(lockFile string) ([]string, error) {
+	l, err := lock.FromFile(lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading lockfile %s: %w", lockFile, err)
+	}
+
+	pins := make([]string, 0, len(l.Contents.Packages))
+	for _, pkg := range l.Contents.Packages {
+		pins = append(pins, fmt.Sprintf("%s=%s", pkg.Name, pkg.Version))
+	}
+
+	return pins, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuestLockRoundTrip(t *testing.T) {
+	imgConfig := apko_types.ImageConfiguration{
+		Contents: apko_types.ImageContents{
+			Keyring:             []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+			RuntimeRepositories: []string{"https://packages.wolfi.dev/os"},
+		},
+	}
+	installed := []*apk.InstalledPackage{
+		{Package: apk.Package{Name: "busybox", Version: "1.36.1-r7", Arch: "x86_64", Checksum: []byte{0x01, 0x02}}},
+		{Package: apk.Package{Name: "wolfi-baselayout", Version: "20230201-r15", Arch: "x86_64"}},
+	}
+
+	l := guestLock(imgConfig, []string{"./packages"}, nil, apko_types.ParseArchitecture("amd64"), installed)
+	require.Equal(t, "v1", l.Version)
+	require.Len(t, l.Contents.Keyrings, 1)
+	require.Equal(t, "wolfi-signing.rsa.pub", l.Contents.Keyrings[0].Name)
+	require.Equal(t, "./packages", l.Contents.BuildRepositories[0].URL)
+	require.Equal(t, "x86_64", l.Contents.RuntimeRepositories[0].Architecture)
+	require.Equal(t, "Q1AQI=", l.Contents.Packages[0].Checksum)
+
+	lockFile := filepath.Join(t.TempDir(), "melange.lock.x86_64")
+	require.NoError(t, l.SaveToFile(lockFile))
+
+	pins, err := pinnedPackages(lockFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox=1.36.1-r7", "wolfi-baselayout=20230201-r15"}, pins)
+
+	_, err = pinnedPackages(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// The phases the duration of a build or test is broken down into in its
+// metrics.  The setup phase is whatever the others leave out: compiling the
+// configuration, building and starting the guest, and cleaning up.
+const (
+	PhaseSetup   = "setup"
+	PhaseFetch   = "fetch"
+	PhaseBuild   = "build"
+	PhasePackage = "package"
+	PhaseTest    = "test"
+)
+
+// BuildMetrics records how long building or testing a package took, as one
+// line of a metrics file.
+type BuildMetrics struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// Either "build" or "test".
+	Command   string    `json:"command"`
+	Start     time.Time `json:"start"`
+	Succeeded bool      `json:"succeeded"`
+	// The total duration, in seconds.
+	Seconds float64 `json:"seconds"`
+	// The duration of each phase, in seconds.
+	Phases map[string]float64 `json:"phases"`
+}
+
+// phaseTimes accumulates the time spent in each phase.  A nil phaseTimes
+// records nothing.
+type phaseTimes struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+func (p *phaseTimes) add(phase string, d time.Duration) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.durations == nil {
+		p.durations = map[string]time.Duration{}
+	}
+	p.durations[phase] += d
+}
+
+// since adds the time elapsed since start to phase.
+func (p *phaseTimes) since(phase string, start time.Time) {
+	p.add(phase, time.Since(start))
+}
+
+// metrics returns the metrics of a build or test of pkg which started at
+// start, attributing the time not spent in any phase to the setup phase.
+func (p *phaseTimes) metrics(pkg *config.Package, arch, command string, start time.Time, succeeded bool) *BuildMetrics {
+	total := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	setup := total
+	phases := map[string]float64{}
+	for phase, d := range p.durations {
+		phases[phase] = d.Seconds()
+		setup -= d
+	}
+	phases[PhaseSetup] = max(setup, 0).Seconds()
+
+	return &BuildMetrics{
+		Package:   pkg.Name,
+		Version:   pkg.FullVersion(),
+		Arch:      arch,
+		Command:   command,
+		Start:     start.UTC(),
+		Succeeded: succeeded,
+		Seconds:   total.Seconds(),
+		Phases:    phases,
+	}
+}
+
+// stepPhase returns the phase a top-level step run in phase counts towards:
+// fetching sources counts as fetching wherever it happens.
+func stepPhase(p *config.Pipeline, phase string) string {
+	switch p.UsesName() {
+	case "fetch", "git-checkout":
+		return PhaseFetch
+	}
+	return phase
+}
+
+// Builds of several architectures may append to the same metrics file at
+// once.
+var metricsFileMu sync.Mutex
+
+// appendMetrics appends m to the metrics file at path, as one line of JSON,
+// creating it if needed.
+func appendMetrics(path string, m *BuildMetrics) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	metricsFileMu.Lock()
+	defer metricsFileMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+func TestBuildMetrics(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	start := time.Now()
+	phases := &phaseTimes{}
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: &fakeRunner{},
+		phases: phases,
+		phase:  PhaseBuild,
+	}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Uses: "fetch", Runs: "echo fetching"},
+		{Runs: "echo building"},
+	}))
+	phases.add(PhasePackage, time.Second)
+
+	pkg := &config.Package{Name: "hello", Version: "1.0", Epoch: 2}
+	m := phases.metrics(pkg, "x86_64", "build", start, true)
+	require.Equal(t, "hello", m.Package)
+	require.Equal(t, "1.0-r2", m.Version)
+	require.True(t, m.Succeeded)
+	require.Equal(t, []string{PhaseBuild, PhaseFetch, PhasePackage, PhaseSetup}, slices.Sorted(maps.Keys(m.Phases)))
+	require.Positive(t, m.Phases[PhaseFetch])
+	require.Positive(t, m.Phases[PhaseBuild])
+	// The package phase took longer than the build, as far as the metrics
+	// know, so none of the total is left for the setup phase.
+	require.Zero(t, m.Phases[PhaseSetup])
+
+	// Each record is appended as a line.
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	require.NoError(t, appendMetrics(path, m))
+	require.NoError(t, appendMetrics(path, phases.metrics(pkg, "aarch64", "build", start, false)))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var archs []string
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var got BuildMetrics
+		require.NoError(t, json.Unmarshal(s.Bytes(), &got))
+		archs = append(archs, got.Arch)
+	}
+	require.Equal(t, []string{"x86_64", "aarch64"}, archs)
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// A NetworkConnection is a connection the steps of a build attempted, as
+// recorded in its network report.
+type NetworkConnection struct {
+	// The step which attempted the connection, or its closest named parent.
+	Step string `json:"step"`
+	Host string `json:"host"`
+	Port string `json:"port"`
+	// Whether proxy-allow-hosts refused the connection.
+	Refused bool `json:"refused,omitempty"`
+	// The number of times the step attempted the connection.
+	Count int `json:"count"`
+}
+
+// networkMonitor records the connections steps attempt through their step
+// proxies, without blocking any.  Connections which bypass the proxies are not
+// seen.
+type networkMonitor struct {
+	mu          sync.Mutex
+	connections []NetworkConnection
+}
+
+func (m *networkMonitor) record(step, host, port string, allowed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := NetworkConnection{Step: step, Host: host, Port: port, Refused: !allowed}
+	i := slices.IndexFunc(m.connections, func(o NetworkConnection) bool {
+		o.Count = 0
+		return o == c
+	})
+	if i < 0 {
+		i = len(m.connections)
+		m.connections = append(m.connections, c)
+	}
+	m.connections[i].Count++
+}
+
+// Connections returns the connections recorded so far, in the order they
+// were first attempted.
+func (m *networkMonitor) Connections() []NetworkConnection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.connections)
+}
+
+// writeNetworkReport logs the connections recorded by m and writes them to
+// the network report of the build, as JSON.
+func (b *Build) writeNetworkReport(ctx context.Context, m *networkMonitor) error {
+	log := clog.FromContext(ctx)
+
+	connections := m.Connections()
+	for _, c := range connections {
+		if c.Refused {
+			log.Infof("step %q was refused connecting to %s:%s (%d times)", c.Step, c.Host, c.Port, c.Count)
+		} else {
+			log.Infof("step %q connected to %s:%s (%d times)", c.Step, c.Host, c.Port, c.Count)
+		}
+	}
+
+	if connections == nil {
+		connections = []NetworkConnection{}
+	}
+	data, err := json.MarshalIndent(connections, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	report := fmt.Sprintf("%s.%s", b.NetworkReport, b.Arch.ToAPK())
+	if err := os.WriteFile(report, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing network report: %w", err)
+	}
+	log.Infof("recorded %d network connections made through the proxy in %s; connections of clients ignoring the proxy are not recorded", len(connections), report)
+
+	return nil
+}
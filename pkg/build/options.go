@@ -16,7 +16,13 @@ package build
 
 import (
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -89,6 +95,7 @@ func WithBuildDate(s string) Option {
 		}
 
 		bc.SourceDateEpoch = t
+		bc.buildDateSet = true
 		return nil
 	}
 }
@@ -264,6 +271,31 @@ func WithVarsFile(varsFile string) Option {
 	}
 }
 
+// varNameRegex matches the names of variables, as referenced by
+// ${{vars.<name>}}.
+var varNameRegex = regexp.MustCompile(`^[a-zA-Z\d_-]+$`)
+
+// WithVars sets variables, each given as name=value, which override the
+// variables of the configuration, of its vars file and of its build options.
+func WithVars(vars []string) Option {
+	return func(b *Build) error {
+		for _, s := range vars {
+			name, value, ok := strings.Cut(s, "=")
+			if !ok {
+				return fmt.Errorf("invalid variable %q, expected name=value", s)
+			}
+			if !varNameRegex.MatchString(name) {
+				return fmt.Errorf("invalid variable name %q, expected letters, digits, '_' and '-'", name)
+			}
+			if b.Vars == nil {
+				b.Vars = map[string]string{}
+			}
+			b.Vars[name] = value
+		}
+		return nil
+	}
+}
+
 // WithNamespace takes a string to be used as the namespace in PackageURLs
 // identifying the built apk in the generated SBOM. If no namespace is provided
 // "unknown" will be listed as namespace.
@@ -319,6 +351,27 @@ func WithInteractive(interactive bool) Option {
 	}
 }
 
+// WithDebugShell sets the command run in the workdir of a failed step to debug
+// it interactively, instead of /bin/sh, e.g. a richer shell or a REPL.  If
+// the command does not exist in the build environment, /bin/sh is run.
+func WithDebugShell(cmd []string) Option {
+	return func(b *Build) error {
+		b.DebugShell = cmd
+		return nil
+	}
+}
+
+// WithDebugOnFailure debugs failed steps interactively, as WithInteractive
+// does, without handling interrupts around every step: the build keeps its
+// own signal handling until a step fails and the debugger opens, and goes on
+// with the next step once it is exited with 'exit 0'.
+func WithDebugOnFailure(debugOnFailure bool) Option {
+	return func(b *Build) error {
+		b.DebugOnFailure = debugOnFailure
+		return nil
+	}
+}
+
 // WithRemove indicates whether the the build will clean up after itself.
 // This includes deleting any intermediate artifacts like container images and temp workspace and guest dirs.
 func WithRemove(remove bool) Option {
@@ -344,6 +397,347 @@ func WithPackageCacheDir(apkCacheDir string) Option {
 	}
 }
 
+// WithIsolatedPackageCache gives the build a private apk cache, seeded from
+// the directory set with WithPackageCacheDir, instead of writing into the
+// shared cache.  This is useful when several builds run concurrently.
+func WithIsolatedPackageCache(isolated bool) Option {
+	return func(b *Build) error {
+		b.IsolatedApkCache = isolated
+		return nil
+	}
+}
+
+// WithRequireSubpackageLicense fails the build if any subpackage lacks a
+// license, either declared on the subpackage or inherited from the origin
+// package.
+func WithRequireSubpackageLicense(require bool) Option {
+	return func(b *Build) error {
+		b.RequireSubpackageLicense = require
+		return nil
+	}
+}
+
+// WithLockFile records the packages installed into the build environment in
+// an apko lockfile at the given path.
+func WithLockFile(lockFile string) Option {
+	return func(b *Build) error {
+		b.LockFile = lockFile
+		return nil
+	}
+}
+
+// WithPinLockFile pins the build environment to the package versions recorded
+// in the apko lockfile at the given path, as written by WithLockFile.
+func WithPinLockFile(lockFile string) Option {
+	return func(b *Build) error {
+		b.PinLockFile = lockFile
+		return nil
+	}
+}
+
+// WithBuildPathCheck scans the packaged files for references to the build
+// workspace path, which break relocatability and reproducibility.  Files
+// matching one of the ignore globs, relative to the package root, are
+// skipped.
+func WithBuildPathCheck(check bool, ignore []string) Option {
+	return func(b *Build) error {
+		b.CheckBuildPath = check
+		b.BuildPathIgnore = ignore
+		return nil
+	}
+}
+
+// WithScrubEnvironment exports ScrubbedEnvironment to the pipelines, so that
+// their output does not depend on the locale or timezone of the build
+// environment.
+func WithScrubEnvironment(scrub bool) Option {
+	return func(b *Build) error {
+		b.ScrubEnvironment = scrub
+		return nil
+	}
+}
+
+// WithLinkageCheck checks that the shared libraries each package links against
+// are shipped by the package, or provided by its runtime dependencies, and
+// reports the dependencies missing.
+func WithLinkageCheck(check bool) Option {
+	return func(b *Build) error {
+		b.CheckLinkage = check
+		return nil
+	}
+}
+
+// WithInstallCheck installs each package into a fresh root once it is
+// emitted, and fails the build if any does not install cleanly.
+func WithInstallCheck(check bool) Option {
+	return func(b *Build) error {
+		b.CheckInstall = check
+		return nil
+	}
+}
+
+// WithGoldenSBOMDir fails the build unless the SBOM of each package is the
+// same as its golden SBOM in dir, at <arch>/<package>-<version>.spdx.json.
+func WithGoldenSBOMDir(dir string) Option {
+	return func(b *Build) error {
+		b.GoldenSBOMDir = dir
+		return nil
+	}
+}
+
+// WithNetworkReport records the connections each step of the build attempts
+// through the HTTP proxy melange provides, without blocking any, and writes
+// them as JSON to a file at the given path, suffixed with the architecture.
+// The report is partial: the connections of clients which ignore the proxy
+// environment variables bypass the proxy, so are not recorded.
+func WithNetworkReport(path string) Option {
+	return func(b *Build) error {
+		b.NetworkReport = path
+		return nil
+	}
+}
+
+// WithMetricsFile appends the duration of the build, in total and of each of
+// its phases, to a file at the given path as a line of JSON, see BuildMetrics.
+func WithMetricsFile(path string) Option {
+	return func(b *Build) error {
+		b.MetricsFile = path
+		return nil
+	}
+}
+
+// WithReadOnlySource mounts the workspace read-only for the steps of the
+// build, except for the output dir, so that steps cannot modify the source.
+// Steps which fetch, check out or patch the source, or are marked
+// writable-source, still may.
+func WithReadOnlySource(readOnly bool) Option {
+	return func(b *Build) error {
+		b.ReadOnlySource = readOnly
+		return nil
+	}
+}
+
+// WithShell sets the absolute path of the shell running the scripts of the
+// steps which do not set their own shell, instead of DefaultShell.
+func WithShell(shell string) Option {
+	return func(b *Build) error {
+		if shell != "" && !path.IsAbs(shell) {
+			return fmt.Errorf("shell %q is not an absolute path", shell)
+		}
+		b.Shell = shell
+		return nil
+	}
+}
+
+// WithEnvOverride exports the given environment variables to every step,
+// overriding the environment of the configuration.  The environment of a
+// step still takes precedence.
+func WithEnvOverride(env map[string]string) Option {
+	return func(b *Build) error {
+		if len(env) == 0 {
+			return nil
+		}
+		if b.EnvOverride == nil {
+			b.EnvOverride = map[string]string{}
+		}
+		maps.Copy(b.EnvOverride, env)
+		return nil
+	}
+}
+
+// WithAllowedEnviron makes the given host environment variables available to
+// the pipelines as ${{environ.<name>}}, e.g. for with values coming from CI.
+// None are by default, and references to the others, or to those which are
+// not set, fail to resolve.
+func WithAllowedEnviron(names []string) Option {
+	return func(b *Build) error {
+		b.AllowedEnviron = append(b.AllowedEnviron, names...)
+		return nil
+	}
+}
+
+// WithStrictSubstitutions fails the build when it is compiled if a ${{...}}
+// reference is left in the script or workdir of a step once its variables are
+// substituted, as happens when the value of a variable itself holds a
+// reference, rather than running the reference as a literal.  References
+// escaped as $${{...}} are intentionally literal, and are unescaped to
+// ${{...}}.
+func WithStrictSubstitutions(strict bool) Option {
+	return func(b *Build) error {
+		b.StrictSubstitutions = strict
+		return nil
+	}
+}
+
+// WithStepLogDir also writes the output of the script of each step to its own
+// file in dir, named after the step, e.g. fetch.log, for analysing the output
+// of the steps apart from each other after the build.  The output is still
+// logged as usual.
+func WithStepLogDir(dir string) Option {
+	return func(b *Build) error {
+		b.StepLogDir = dir
+		return nil
+	}
+}
+
+// WithKeepGoing runs all the top-level pipelines, even past those which fail,
+// and fails with the errors of all of them, each naming its pipeline, to see
+// every failure in one pass.  Failed steps are not debugged interactively in
+// this mode.
+func WithKeepGoing(keepGoing bool) Option {
+	return func(b *Build) error {
+		b.KeepGoing = keepGoing
+		return nil
+	}
+}
+
+// WithURIRewriter rewrites the uri, and mirror uris, of each fetch step with
+// rewrite before it runs, e.g. to download everything through an internal
+// mirror.  The SBOM still records the uris of the build file.
+func WithURIRewriter(rewrite func(string) string) Option {
+	return func(b *Build) error {
+		b.URIRewriter = rewrite
+		return nil
+	}
+}
+
+// WithNoPipelineOverrides always loads the pipelines embedded in melange,
+// e.g. fetch, from the embedded pipelines, rather than from a pipeline dir
+// which has a pipeline of the same name, so that the pipeline dirs cannot
+// change what the embedded pipelines do.  Other pipelines are still loaded
+// from the pipeline dirs.
+func WithNoPipelineOverrides(noOverrides bool) Option {
+	return func(b *Build) error {
+		b.NoPipelineOverrides = noOverrides
+		return nil
+	}
+}
+
+// WithCheckpointFile records, after each of the pipelines of the package which
+// completes, how many have, with a digest of the compiled pipelines, to the
+// file at path, which WithResumeFrom resumes from.
+func WithCheckpointFile(path string) Option {
+	return func(b *Build) error {
+		b.CheckpointFile = path
+		return nil
+	}
+}
+
+// WithResumeFrom skips the first n pipelines of the package as completed by a
+// previous build, whose workspace is reused, per the checkpoint file.  The
+// build fails if the checkpoint is of different pipelines, or records fewer
+// completed.  The steps of subpackages are all run.
+func WithResumeFrom(n int) Option {
+	return func(b *Build) error {
+		b.ResumeFrom = n
+		return nil
+	}
+}
+
+// WithTraceFile writes each step reached by the build, nested steps and those
+// skipped by their if-conditional included, as a JSON array to a file at the
+// given path, suffixed with the architecture, once the build finishes,
+// whether or not it succeeds, see TracedStep.
+func WithTraceFile(path string) Option {
+	return func(b *Build) error {
+		b.TraceFile = path
+		return nil
+	}
+}
+
+// WithSalvageDir copies the output dir of the build environment,
+// /home/build/melange-out, to a dir named after the architecture in dir when
+// a pipeline fails, before the environment is torn down, with runners which
+// are container.OutCopiers.  Other runners only log a warning.
+func WithSalvageDir(dir string) Option {
+	return func(b *Build) error {
+		b.SalvageDir = dir
+		return nil
+	}
+}
+
+// WithDiagnosticsFile writes the diagnostics of a failed build as JSON to a
+// file at the given path, suffixed with the architecture: the error, and the
+// step which failed with its exit code, command, inputs and last lines of
+// output, see BuildDiagnostics.
+func WithDiagnosticsFile(path string) Option {
+	return func(b *Build) error {
+		b.DiagnosticsFile = path
+		return nil
+	}
+}
+
+// WithPrintSubstitutions writes the resolved substitutions of the package,
+// including its vars and build options, to w when the build is compiled,
+// before any pipeline runs.
+func WithPrintSubstitutions(w io.Writer) Option {
+	return func(b *Build) error {
+		b.PrintSubstitutions = w
+		return nil
+	}
+}
+
+// WithDryRun makes BuildPackage log the command of each step which would run,
+// with the result of its if-conditional, instead of running it.  The steps
+// are walked as in a real build, so the assertions of the steps still hold,
+// but no build environment is started, so no runner is needed.
+func WithDryRun(dryRun bool) Option {
+	return func(b *Build) error {
+		b.DryRun = dryRun
+		return nil
+	}
+}
+
+// WithGitOverrides points git-checkout steps at a different commit or tag than
+// configured, without editing the build configuration.  Each override is of
+// the form <step-or-repository>=<ref>, see ParseGitOverride.
+func WithGitOverrides(overrides []string) Option {
+	return func(b *Build) error {
+		for _, s := range overrides {
+			o, err := ParseGitOverride(s)
+			if err != nil {
+				return err
+			}
+			b.GitOverrides = append(b.GitOverrides, o)
+		}
+		return nil
+	}
+}
+
+// WithSubpackageSBOMs limits the subpackages for which an SBOM is generated to
+// those matching one of the include globs, or all if there are none, and not
+// matching any of the exclude globs.  The main package always gets an SBOM.
+func WithSubpackageSBOMs(include, exclude []string) Option {
+	return func(b *Build) error {
+		for _, glob := range slices.Concat(include, exclude) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid subpackage glob %q: %w", glob, err)
+			}
+		}
+		b.SBOMSubpackages = include
+		b.SBOMExcludeSubpackages = exclude
+		return nil
+	}
+}
+
+// WithContentAddressableDir also writes the packages emitted by the build, and
+// their SBOMs, to a content-addressable store in dir, keyed by digest.
+func WithContentAddressableDir(dir string) Option {
+	return func(b *Build) error {
+		b.ContentAddressableDir = dir
+		return nil
+	}
+}
+
+// WithStrict promotes warnings about the build configuration, and linter
+// warnings, to errors which fail the build.
+func WithStrict(strict bool) Option {
+	return func(b *Build) error {
+		b.Strict = strict
+		return nil
+	}
+}
+
 func WithCPU(cpu string) Option {
 	return func(b *Build) error {
 		b.DefaultCPU = cpu
@@ -412,3 +806,21 @@ func WithIgnoreSignatures(ignore bool) Option {
 		return nil
 	}
 }
+
+// WithAssertionFailureCallback registers a function that is called with the
+// details of any pipeline assertion that fails. The build still fails.
+func WithAssertionFailureCallback(fn AssertionFailureFunc) Option {
+	return func(b *Build) error {
+		b.OnAssertionFailure = fn
+		return nil
+	}
+}
+
+// WithStepObserver registers an observer which is notified when each step of
+// the pipelines starts and finishes, e.g. to report progress.
+func WithStepObserver(o StepObserver) Option {
+	return func(b *Build) error {
+		b.StepObserver = o
+		return nil
+	}
+}
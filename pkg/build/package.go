@@ -77,6 +77,10 @@ type PackageBuild struct {
 	Description   string
 	URL           string
 	Commit        string
+	Copyright     []config.Copyright
+
+	// The version of the embedded pipelines the package was built with.
+	PipelinesVersion string
 }
 
 func pkgFromSub(sub *config.Subpackage) *config.Package {
@@ -88,6 +92,7 @@ func pkgFromSub(sub *config.Subpackage) *config.Package {
 		Description:  sub.Description,
 		URL:          sub.URL,
 		Commit:       sub.Commit,
+		Copyright:    sub.Copyright,
 	}
 }
 
@@ -105,6 +110,15 @@ func (b *Build) Emit(ctx context.Context, pkg *config.Package) error {
 		Description:  pkg.Description,
 		URL:          pkg.URL,
 		Commit:       pkg.Commit,
+		Copyright:    pkg.Copyright,
+
+		PipelinesVersion: PipelinesVersion(),
+	}
+
+	// Subpackages inherit the license of the origin package unless they
+	// declare their own.
+	if len(pc.Copyright) == 0 {
+		pc.Copyright = pc.Origin.Copyright
 	}
 
 	if !b.StripOriginName {
@@ -141,7 +155,7 @@ func (pc *PackageBuild) Filename() string {
 }
 
 func (pc *PackageBuild) WorkspaceSubdir() string {
-	return filepath.Join(pc.Build.WorkspaceDir, melangeOutputDirName, pc.PackageName)
+	return pc.Build.packageDir(pc.PackageName)
 }
 
 var controlTemplate = `# Generated by melange
@@ -156,7 +170,7 @@ commit = {{.Commit}}
 {{- if ne .Build.SourceDateEpoch.Unix 0 }}
 builddate = {{ .Build.SourceDateEpoch.Unix }}
 {{- end}}
-{{- range $copyright := .Origin.Copyright }}
+{{- range $copyright := .Copyright }}
 license = {{ $copyright.License }}
 {{- end }}
 {{- range $dep := .Dependencies.Runtime }}
@@ -168,6 +182,9 @@ provides = {{ $dep }}
 {{- range $dep := .Dependencies.Replaces }}
 replaces = {{ $dep }}
 {{- end }}
+{{- if .PipelinesVersion }}
+# pipelines = {{ .PipelinesVersion }}
+{{- end }}
 {{- range $dep := .Dependencies.Vendored }}
 # vendored = {{ $dep }}
 {{- end }}
@@ -444,6 +461,13 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 		return fmt.Errorf("unable to build final dependencies set: %w", err)
 	}
 
+	if pc.Build.CheckLinkage {
+		if pc.Build.emittedRuntime == nil {
+			pc.Build.emittedRuntime = map[string][]string{}
+		}
+		pc.Build.emittedRuntime[pc.PackageName] = pc.Dependencies.Runtime
+	}
+
 	// walk the filesystem to calculate the installed-size
 	if err := pc.calculateInstalledSize(fsys); err != nil {
 		return err
@@ -119,6 +119,64 @@ url = https://chainguard.dev
 commit = deadbeef
 builddate = 12345678
 datahash = baadf00d
+`,
+	}, {
+		name: "license",
+		pb: &PackageBuild{
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+			},
+			Origin:        pkg,
+			PackageName:   "glibc-doc",
+			Arch:          "aarch64",
+			InstalledSize: 666,
+			OriginName:    "bigbang",
+			Description:   "I'm a unit test",
+			URL:           "https://chainguard.dev",
+			Commit:        "deadbeef",
+			DataHash:      "baadf00d",
+			Copyright:     []config.Copyright{{License: "GFDL-1.3-or-later"}},
+		},
+		want: `# Generated by melange
+pkgname = glibc-doc
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+url = https://chainguard.dev
+commit = deadbeef
+license = GFDL-1.3-or-later
+datahash = baadf00d
+`,
+	}, {
+		name: "pipelines version",
+		pb: &PackageBuild{
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+			},
+			Origin:           pkg,
+			PackageName:      "glibc",
+			Arch:             "aarch64",
+			InstalledSize:    666,
+			OriginName:       "bigbang",
+			Description:      "I'm a unit test",
+			URL:              "https://chainguard.dev",
+			Commit:           "deadbeef",
+			DataHash:         "baadf00d",
+			PipelinesVersion: "sha256:cafe",
+		},
+		want: `# Generated by melange
+pkgname = glibc
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+url = https://chainguard.dev
+commit = deadbeef
+# pipelines = sha256:cafe
+datahash = baadf00d
 `,
 	}}
 
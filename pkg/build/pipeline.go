@@ -16,26 +16,47 @@ package build
 
 import (
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"maps"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
-	"chainguard.dev/melange/pkg/util"
 	"github.com/chainguard-dev/clog"
 )
 
 const WorkDir = "/home/build"
 
+// DefaultShell is the shell running the scripts of the steps, unless the
+// build or the step sets another.
+const DefaultShell = "/bin/sh"
+
+// interruptSignals cancel the step being run, so that the runner tears down
+// the build environment: ctrl+C, and the termination requested by container
+// orchestrators.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// MutateWith returns the substitutions of sm with the inputs in with, as
+// ${{inputs.<name>}}, and their values substituted.  A value referring to
+// another, such as an input referring to ${{build.arch}} through another
+// input, resolves to the other's substituted value, whatever the order of the
+// map.  References looping back to a value being substituted are left as they
+// are.
 func (sm *SubstitutionMap) MutateWith(with map[string]string) (map[string]string, error) {
 	nw := maps.Clone(sm.Substitutions)
 
@@ -50,15 +71,42 @@ func (sm *SubstitutionMap) MutateWith(with map[string]string) (map[string]string
 	}
 
 	// do the actual mutations
-	for k, v := range nw {
-		nval, err := util.MutateStringFromMap(nw, v)
+	mutated := make(map[string]string, len(nw))
+	mutating := map[string]bool{}
+	var mutate func(k string) (string, error)
+	lookup := func(key string) (string, error) {
+		for _, k := range []string{key, fmt.Sprintf("${{%s}}", key)} {
+			if _, ok := nw[k]; ok {
+				return mutate(k)
+			}
+		}
+		return "", fmt.Errorf("variable %s not defined", key)
+	}
+	mutate = func(k string) (string, error) {
+		if v, ok := mutated[k]; ok {
+			return v, nil
+		}
+		if mutating[k] {
+			return nw[k], nil
+		}
+		mutating[k] = true
+		defer delete(mutating, k)
+
+		v, err := cond.Subst(nw[k], lookup)
 		if err != nil {
+			return "", err
+		}
+		mutated[k] = v
+		return v, nil
+	}
+
+	for k := range nw {
+		if _, err := mutate(k); err != nil {
 			return nil, err
 		}
-		nw[k] = nval
 	}
 
-	return nw, nil
+	return mutated, nil
 }
 
 type SubstitutionMap struct {
@@ -67,8 +115,11 @@ type SubstitutionMap struct {
 
 func (sm *SubstitutionMap) Subpackage(subpkg *config.Subpackage) *SubstitutionMap {
 	nw := maps.Clone(sm.Substitutions)
-	nw[config.SubstitutionSubPkgDir] = fmt.Sprintf("/home/build/melange-out/%s", subpkg.Name)
+	nw[config.SubstitutionSubPkgDir] = fmt.Sprintf("/home/build/melange-out/%s", subpkg.DestDirName())
 	nw[config.SubstitutionTargetsContextdir] = nw[config.SubstitutionSubPkgDir]
+	if license := subpkg.LicenseExpression(); license != "" {
+		nw[config.SubstitutionSubPkgLicense] = license
+	}
 
 	return &SubstitutionMap{nw}
 }
@@ -84,16 +135,22 @@ func NewSubstitutionMap(cfg *config.Configuration, arch apko_types.Architecture,
 		config.SubstitutionTargetsOutdir:      "/home/build/melange-out",
 		config.SubstitutionTargetsDestdir:     fmt.Sprintf("/home/build/melange-out/%s", pkg.Name),
 		config.SubstitutionTargetsContextdir:  fmt.Sprintf("/home/build/melange-out/%s", pkg.Name),
+		config.SubstitutionSubPkgLicense:      pkg.LicenseExpression(),
 	}
 
 	nw[config.SubstitutionHostTripletGnu] = arch.ToTriplet(flavor)
 	nw[config.SubstitutionHostTripletRust] = arch.ToRustTriplet(flavor)
-	nw[config.SubstitutionCrossTripletGnuGlibc] = arch.ToTriplet("gnu")
-	nw[config.SubstitutionCrossTripletGnuMusl] = arch.ToTriplet("musl")
-	nw[config.SubstitutionCrossTripletRustGlibc] = arch.ToRustTriplet("gnu")
-	nw[config.SubstitutionCrossTripletRustMusl] = arch.ToRustTriplet("musl")
+	triplets := config.Triplets(arch)
+	nw[config.SubstitutionCrossTripletGnuGlibc] = triplets.GnuGlibc
+	nw[config.SubstitutionCrossTripletGnuMusl] = triplets.GnuMusl
+	nw[config.SubstitutionCrossTripletRustGlibc] = triplets.RustGlibc
+	nw[config.SubstitutionCrossTripletRustMusl] = triplets.RustMusl
+	// Cross toolchains conventionally look for the target sysroot under
+	// /usr/<triplet>.
+	nw[config.SubstitutionCrossSysroot] = path.Join("/usr", arch.ToTriplet(flavor))
 	nw[config.SubstitutionBuildArch] = arch.ToAPK()
 	nw[config.SubstitutionBuildGoArch] = arch.String()
+	nw[config.SubstitutionBuildPipelinesVersion] = PipelinesVersion()
 
 	// Retrieve vars from config
 	subst_nw, err := cfg.GetVarsFromConfig()
@@ -110,37 +167,95 @@ func NewSubstitutionMap(cfg *config.Configuration, arch apko_types.Architecture,
 		return nil, err
 	}
 
-	packageNames := []string{pkg.Name}
+	nw[fmt.Sprintf("${{targets.package.%s}}", pkg.Name)] = fmt.Sprintf("/home/build/melange-out/%s", pkg.Name)
 	for _, sp := range cfg.Subpackages {
-		packageNames = append(packageNames, sp.Name)
-	}
-
-	for _, pn := range packageNames {
-		k := fmt.Sprintf("${{targets.package.%s}}", pn)
-		nw[k] = fmt.Sprintf("/home/build/melange-out/%s", pn)
+		k := fmt.Sprintf("${{targets.package.%s}}", sp.Name)
+		nw[k] = fmt.Sprintf("/home/build/melange-out/%s", sp.DestDirName())
 	}
+	nw[config.SubstitutionPackageSubpkgCount] = strconv.Itoa(len(cfg.Subpackages))
 
-	for k := range cfg.Options {
-		nk := fmt.Sprintf("${{options.%s.enabled}}", k)
-		nw[nk] = "false"
+	// Every option is disabled unless it is enabled for the build, whether
+	// or not the configuration declares it, independently of the order in
+	// which either is listed.
+	enabled := make(map[string]bool, len(cfg.Options)+len(buildOpts))
+	for opt := range cfg.Options {
+		enabled[opt] = false
 	}
-
 	for _, opt := range buildOpts {
+		enabled[opt] = true
+	}
+	for _, opt := range slices.Sorted(maps.Keys(enabled)) {
 		nk := fmt.Sprintf("${{options.%s.enabled}}", opt)
-		nw[nk] = "true"
+		nw[nk] = strconv.FormatBool(enabled[opt])
 	}
 
 	return &SubstitutionMap{nw}, nil
 }
 
-func validateWith(data map[string]string, inputs map[string]config.Input) (map[string]string, error) {
+// AddEnviron makes each of names which is set in the host environment
+// available as ${{environ.<name>}}.  Other references to the host environment
+// are left undefined, so that they fail to resolve rather than resolve to an
+// empty string.
+func (sm *SubstitutionMap) AddEnviron(names []string) {
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			sm.Substitutions[fmt.Sprintf("${{environ.%s}}", name)] = value
+		}
+	}
+}
+
+// Print writes the substitutions of sm to w, resolved as they are for the
+// pipelines, one "<variable>=<value>" per line, sorted by variable.
+func (sm *SubstitutionMap) Print(w io.Writer) error {
+	resolved, err := sm.MutateWith(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(resolved)) {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", k, resolved[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateWith fills in the defaults of the inputs of the pipeline missing
+// from data, its with, and checks that its required inputs are set and that
+// data only sets its inputs.  The inputs inherited from a parent pipeline, as
+// ${{inputs.<name>}}, are not checked, nor is data if the pipeline declares no
+// inputs and runs its own script instead of using a pipeline.
+func validateWith(pipeline *config.Pipeline, data map[string]string) (map[string]string, error) {
+	inputs := pipeline.Inputs
+
 	if data == nil {
 		data = make(map[string]string)
 	}
 
+	if len(inputs) != 0 || pipeline.Uses != "" {
+		var undefined []string
+		for k := range data {
+			if _, ok := inputs[k]; !ok && !strings.HasPrefix(k, "${{") {
+				undefined = append(undefined, strconv.Quote(k))
+			}
+		}
+		if len(undefined) != 0 {
+			slices.Sort(undefined)
+			if pipeline.Uses != "" {
+				return data, fmt.Errorf("step %q: undefined inputs %s to pipeline %q", pipeline.Identity(), strings.Join(undefined, ", "), pipeline.Uses)
+			}
+			return data, fmt.Errorf("step %q: undefined inputs %s", pipeline.Identity(), strings.Join(undefined, ", "))
+		}
+	}
+
 	for k, v := range inputs {
 		if data[k] == "" {
-			data[k] = v.Default
+			d, err := resolveDefault(inputs, data, k, nil)
+			if err != nil {
+				return data, fmt.Errorf("step %q: %w", pipeline.Identity(), err)
+			}
+			data[k] = d
 		}
 
 		if v.Required && data[k] == "" {
@@ -151,30 +266,459 @@ func validateWith(data map[string]string, inputs map[string]config.Input) (map[s
 	return data, nil
 }
 
-// Build a script to run as part of evalRun
-func buildEvalRunCommand(pipeline *config.Pipeline, debugOption rune, workdir string, fragment string) []string {
+// resolveDefault returns the default of the input name with its references to
+// the other inputs of the pipeline resolved, following their own defaults
+// when they are not set, and fails if defaults refer to each other in a
+// cycle.  resolving holds the inputs whose defaults are being resolved.  Other
+// references are left for MutateWith to resolve.
+func resolveDefault(inputs map[string]config.Input, data map[string]string, name string, resolving []string) (string, error) {
+	if i := slices.Index(resolving, name); i >= 0 {
+		return "", fmt.Errorf("defaults of inputs refer to each other: %s -> %s", strings.Join(resolving[i:], " -> "), name)
+	}
+	resolving = append(resolving, name)
+
+	return cond.Subst(inputs[name].Default, func(key string) (string, error) {
+		input, ok := strings.CutPrefix(key, "inputs.")
+		if !ok {
+			return "", cond.ErrUnresolved
+		}
+		if v := data[input]; v != "" {
+			return v, nil
+		}
+		if _, ok := inputs[input]; ok {
+			return resolveDefault(inputs, data, input, resolving)
+		}
+		return "", cond.ErrUnresolved
+	})
+}
+
+// defaultRetryDelay is the delay before the first retry of a step which sets
+// no retry-delay.
+const defaultRetryDelay = time.Second
+
+// runWithRetries runs command, and runs it again up to the retries of the
+// pipeline while it fails, waiting the retry delay of the pipeline, doubled
+// after each attempt, in between.  It does not retry once ctx is done, as when
+// the step times out or the build is cancelled.
+func (r *pipelineRunner) runWithRetries(ctx context.Context, pipeline *config.Pipeline, cfg *container.Config, envOverride map[string]string, command []string) error {
+	delay := pipeline.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	attempts := pipeline.Retries + 1
+	for attempt := 1; ; attempt++ {
+		err := r.runner.Run(ctx, cfg, envOverride, command...)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt == attempts {
+			if attempts == 1 {
+				return err
+			}
+			return fmt.Errorf("step %q failed after %d attempts: %w", pipeline.Identity(), attempts, err)
+		}
+
+		clog.FromContext(ctx).Warnf("step %q failed, retrying in %s (attempt %d of %d): %v", pipeline.Identity(), delay, attempt+1, attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// pipelinePath returns path with the path-prepend dirs of the pipeline before
+// it and its path-append dirs after it.
+func pipelinePath(pipeline *config.Pipeline, path string) string {
+	if len(pipeline.PathPrepend) == 0 && len(pipeline.PathAppend) == 0 {
+		return path
+	}
+	dirs := slices.Concat(pipeline.PathPrepend, []string{path}, pipeline.PathAppend)
+	return strings.Join(slices.DeleteFunc(dirs, func(dir string) bool { return dir == "" }), ":")
+}
+
+// Build a script to run as part of evalRun, with the given shell, or
+// DefaultShell if unset.  Unless createWorkdir, the script fails if workdir
+// does not exist.
+func buildEvalRunCommand(pipeline *config.Pipeline, shell string, debugOption rune, workdir string, createWorkdir bool, fragment string) []string {
+	mkdir := ""
+	if createWorkdir {
+		mkdir = fmt.Sprintf("[ -d '%s' ] || mkdir -p '%s'\n", workdir, workdir)
+	}
 	script := fmt.Sprintf(`set -e%c
-[ -d '%s' ] || mkdir -p '%s'
-cd '%s'
+%scd '%s'
 %s
-exit 0`, debugOption, workdir, workdir, workdir, fragment)
-	return []string{"/bin/sh", "-c", script}
+exit 0`, debugOption, mkdir, workdir, fragment)
+	if shell == "" {
+		shell = DefaultShell
+	}
+	return []string{shell, "-c", script}
+}
+
+// scriptChecksum returns the hex SHA-256 of the script of command, as built by
+// buildEvalRunCommand, which is what the shell runs once the variables of the
+// step are substituted.
+func scriptChecksum(command []string) string {
+	sum := sha256.Sum256([]byte(command[len(command)-1]))
+	return hex.EncodeToString(sum[:])
+}
+
+// AssertionFailure describes a pipeline assertion that did not hold.
+type AssertionFailure struct {
+	// The identity of the pipeline whose assertion failed.
+	Step string
+	// The name of the assertion that failed, e.g. "required-steps".
+	Assertion string
+	// The value the assertion expected.
+	Expected any
+	// The value that was observed instead.
+	Actual any
+	// For the step count assertions, the identities of the child steps
+	// which ran, and of those skipped by their if-conditional.
+	Ran, Skipped []string
+}
+
+func (f *AssertionFailure) Error() string {
+	switch f.Assertion {
+	case "required-steps":
+		return fmt.Sprintf("pipeline did not run the required %v steps, only %v (ran: %s; skipped: %s)", f.Expected, f.Actual, quoteSteps(f.Ran), quoteSteps(f.Skipped))
+	case "max-steps":
+		return fmt.Sprintf("pipeline ran %v steps, more than the maximum of %v (ran: %s)", f.Actual, f.Expected, quoteSteps(f.Ran))
+	case "forbidden-steps":
+		ran, _ := f.Actual.([]string)
+		return fmt.Sprintf("pipeline ran forbidden steps %s", quoteSteps(ran))
+	default:
+		return fmt.Sprintf("pipeline assertion %s failed: expected %v, got %v", f.Assertion, f.Expected, f.Actual)
+	}
+}
+
+// logSkipped logs that the step was skipped because its if evaluated false.
+// Steps without an if are skipped silently.
+func logSkipped(ctx context.Context, pipeline *config.Pipeline) {
+	if pipeline.If == "" {
+		return
+	}
+	log := clog.FromContext(ctx)
+	if id := pipeline.Identity(); id != config.UnidentifiablePipeline {
+		log.Infof("skipping step %q (if %q evaluated false)", id, pipeline.If)
+	} else {
+		log.Infof("skipping step (if %q evaluated false)", pipeline.If)
+	}
+}
+
+// childIdentity returns the name or uses of p, the i-th child step of a step
+// in the order they run, or its position, as #<n>, if it has neither.
+func childIdentity(i int, p *config.Pipeline) string {
+	if p.Name != "" || p.Uses != "" {
+		return p.Identity()
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// quoteSteps lists the identities of steps for an error message.
+func quoteSteps(steps []string) string {
+	if len(steps) == 0 {
+		return "none"
+	}
+	quoted := make([]string, 0, len(steps))
+	for _, s := range steps {
+		quoted = append(quoted, strconv.Quote(s))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// AssertionFailureFunc is called whenever a pipeline assertion fails, before
+// the failure is returned as an error. It is purely informational: the
+// pipeline fails regardless of what the callback does.
+type AssertionFailureFunc func(ctx context.Context, failure *AssertionFailure)
+
+// StepObserver is notified when each step of the pipelines starts and
+// finishes, nested steps included, without parsing the logs.  A step is
+// identified as in the logs, by its name, or else the pipeline it uses.
+type StepObserver interface {
+	// OnStart is called before the if-conditional of the step is evaluated.
+	OnStart(ctx context.Context, id string)
+	// OnFinish is called once the step, and its nested steps, are done, or
+	// were skipped, in which case ran is false, with the error, if any, and
+	// the time spent since OnStart.
+	OnFinish(ctx context.Context, id string, ran bool, err error, dur time.Duration)
 }
 
 type pipelineRunner struct {
-	debug       bool
-	interactive bool
-	config      *container.Config
-	runner      container.Runner
+	debug              bool
+	interactive        bool
+	debugShell         []string
+	config             *container.Config
+	runner             container.Runner
+	onAssertionFailure AssertionFailureFunc
+	observer           StepObserver
+
+	// The outcomes of the named steps run so far, keyed by step name.
+	outcomes map[string]stepOutcome
+
+	// The proxy the step being run, and the steps it uses, are routed to,
+	// which forwards only the requests of its proxy-allow-hosts.
+	proxy *stepProxy
+
+	// If set, records the connections of each step.
+	network *networkMonitor
+
+	// Whether the workspace is mounted read-only, except for the output dir,
+	// for the step being run.
+	readOnlySource bool
+
+	// The shell running the script of the step being run, which its child
+	// steps inherit unless they set their own, or DefaultShell if unset.
+	shell string
+
+	// Environment variables exported to every step, which the environment
+	// of each step overrides.
+	env map[string]string
+
+	// Whether to record the first step whose script fails in failure, with
+	// these secrets redacted.
+	diagnose bool
+	secrets  []string
+	failure  *StepFailure
+
+	// If set, the output of the script of each step is also written to a
+	// file in this dir named after the step, see createStepLog.  stepLogs
+	// counts the steps logged under each name.
+	stepLogDir string
+	stepLogs   map[string]int
+
+	// If set, accumulates the time spent running top-level steps, which
+	// count towards phase unless they fetch sources.
+	phases *phaseTimes
+	phase  string
+
+	// Whether to log the commands of the steps instead of running them.
+	dryRun bool
+
+	// Whether runPipelines runs all the pipelines, joining the errors of
+	// those which fail, instead of stopping at the first one which fails.
+	keepGoing bool
+
+	// Whether to debug failed steps, as when interactive, and whether a
+	// debugger has been opened, since which interrupts are handled around
+	// every step as when interactive.
+	debugOnFailure bool
+	debugged       bool
+
+	// If set, records a checkpoint after each top-level pipeline which
+	// completes, and skips those completed before the one resumed from.
+	checkpoint *checkpointer
+
+	// If set, records each step reached, nested steps included.
+	trace *stepTrace
+
+	// The working directory of the step being run, which the relative ones
+	// of its child steps are resolved against, or WorkDir if unset.
+	workdir string
+}
+
+// Named steps record their outcome, which the `if` conditions of later steps
+// can reference as ${{steps.<name>.ran}} and ${{steps.<name>.succeeded}}.
+// Both resolve to 'true' or 'false'.  ${{steps.<name>.exit-code}} resolves
+// to the exit code of the script of a step which ran.
+// ${{steps.<name>.result}} resolves to 'success', 'failure' or 'skipped'.
+const (
+	stepOutcomePrefix    = "steps."
+	stepOutcomeRan       = "ran"
+	stepOutcomeSucceeded = "succeeded"
+	stepOutcomeExitCode  = "exit-code"
+	stepOutcomeResult    = "result"
+
+	stepResultSuccess = "success"
+	stepResultFailure = "failure"
+	stepResultSkipped = "skipped"
+)
+
+type stepOutcome struct {
+	ran       bool
+	succeeded bool
+	// The exit code of the script of the step, or -1 if it is unknown.
+	exitCode int
 }
 
-func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipeline) (bool, error) {
+func (r *pipelineRunner) recordOutcome(pipeline *config.Pipeline, ran bool, exitCode int, err error) {
+	if pipeline.Name == "" {
+		return
+	}
+	if r.outcomes == nil {
+		r.outcomes = map[string]stepOutcome{}
+	}
+	r.outcomes[pipeline.Name] = stepOutcome{ran: ran, succeeded: ran && err == nil, exitCode: exitCode}
+}
+
+// exitCode returns the exit code of the script whose run failed with err, or
+// -1 if it is unknown, e.g. because the script could not be started.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var code interface{ ExitCode() int }
+	if errors.As(err, &code) {
+		return code.ExitCode()
+	}
+	// As returned by SSH sessions, e.g. those of the QEMU runner.
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus()
+	}
+	return -1
+}
+
+// lookupOutcome resolves a steps.<name>.<outcome> variable.
+func (r *pipelineRunner) lookupOutcome(key string) (string, error) {
+	ref, ok := strings.CutPrefix(key, stepOutcomePrefix)
+	if !ok {
+		return "", fmt.Errorf("variable %s not defined", key)
+	}
+
+	i := strings.LastIndex(ref, ".")
+	if i < 0 {
+		return "", fmt.Errorf("invalid step reference %s, expected %s<name>.%s, %s<name>.%s, %s<name>.%s or %s<name>.%s", key, stepOutcomePrefix, stepOutcomeRan, stepOutcomePrefix, stepOutcomeSucceeded, stepOutcomePrefix, stepOutcomeExitCode, stepOutcomePrefix, stepOutcomeResult)
+	}
+	name, field := ref[:i], ref[i+1:]
+
+	outcome, ok := r.outcomes[name]
+	if !ok {
+		return "", fmt.Errorf("step %q has not been reached yet or does not exist", name)
+	}
+
+	switch field {
+	case stepOutcomeRan:
+		return strconv.FormatBool(outcome.ran), nil
+	case stepOutcomeSucceeded:
+		return strconv.FormatBool(outcome.succeeded), nil
+	case stepOutcomeExitCode:
+		if !outcome.ran {
+			return "", fmt.Errorf("step %q did not run, so has no exit code", name)
+		}
+		if outcome.exitCode < 0 {
+			return "", fmt.Errorf("the exit code of step %q is unknown", name)
+		}
+		return strconv.Itoa(outcome.exitCode), nil
+	case stepOutcomeResult:
+		switch {
+		case !outcome.ran:
+			return stepResultSkipped, nil
+		case outcome.succeeded:
+			return stepResultSuccess, nil
+		default:
+			return stepResultFailure, nil
+		}
+	default:
+		return "", fmt.Errorf("unknown outcome %q of step %q, expected %q, %q, %q or %q", field, name, stepOutcomeRan, stepOutcomeSucceeded, stepOutcomeExitCode, stepOutcomeResult)
+	}
+}
+
+func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipeline) (ran bool, err error) {
 	log := clog.FromContext(ctx)
 
-	if result, err := shouldRun(pipeline.If); !result {
+	if r.observer != nil {
+		id, start := pipeline.Identity(), time.Now()
+		r.observer.OnStart(ctx, id)
+		defer func() {
+			r.observer.OnFinish(ctx, id, ran, err, time.Since(start))
+		}()
+	}
+
+	if r.trace != nil {
+		i, start := r.trace.start(pipeline), time.Now()
+		defer func() {
+			r.trace.finish(i, ran, err, time.Since(start), r.secrets)
+		}()
+	}
+
+	// cond.Evaluate ignores lookup errors, so capture them to report why a
+	// step reference could not be resolved.
+	var lookupErr error
+	result, err := shouldRun(pipeline.If, func(key string) (string, error) {
+		v, err := r.lookupOutcome(key)
+		if err != nil && lookupErr == nil {
+			lookupErr = err
+		}
+		return v, err
+	})
+	if lookupErr != nil {
+		return false, fmt.Errorf("evaluating if-conditional %q: %w", pipeline.If, lookupErr)
+	}
+	if r.dryRun && pipeline.If != "" && result {
+		if id := pipeline.Identity(); id != config.UnidentifiablePipeline {
+			log.Infof("step %q: if %q is true", id, pipeline.If)
+		} else {
+			log.Infof("if %q is true", pipeline.If)
+		}
+	}
+	if !result {
+		if err == nil {
+			logSkipped(ctx, pipeline)
+			r.recordOutcome(pipeline, false, -1, nil)
+		}
 		return result, err
 	}
 
+	// Registered first to run last, once the failure is recorded.
+	if pipeline.ContinueOnError {
+		defer func() {
+			if err != nil {
+				log.Warnf("step %q failed, continuing: %v", pipeline.Identity(), err)
+				ran, err = true, nil
+			}
+		}()
+	}
+
+	// The exit code of the script, once it has run.
+	code := -1
+	defer func() {
+		r.recordOutcome(pipeline, true, code, err)
+	}()
+
+	// The with values of a transform step were resolved when it was
+	// compiled, so there is nothing to run.
+	if pipeline.Uses == transformPipeline {
+		log.Debugf("step %q only transforms its with values", pipeline.Identity())
+		code = 0
+		return true, nil
+	}
+
+	if (len(pipeline.ProxyAllowHosts) != 0 || r.network != nil) && !r.dryRun {
+		proxy, perr := r.proxyStep(pipeline)
+		if perr != nil {
+			return false, fmt.Errorf("step %q: %w", pipeline.Identity(), perr)
+		}
+
+		parent := r.proxy
+		r.proxy = proxy
+		defer func() {
+			r.proxy = parent
+			proxy.Close()
+			if refused := proxy.Refused(); len(refused) != 0 {
+				err = errors.Join(err, fmt.Errorf("step %q: %w: %s", pipeline.Identity(), errRefusedHosts, strings.Join(refused, ", ")))
+			}
+		}()
+	}
+
+	if r.readOnlySource && writesSource(pipeline) {
+		r.readOnlySource = false
+		defer func() {
+			r.readOnlySource = true
+		}()
+	}
+
+	if pipeline.Shell != "" {
+		parent := r.shell
+		r.shell = pipeline.Shell
+		defer func() {
+			r.shell = parent
+		}()
+	}
+
 	debugOption := ' '
 	if r.debug {
 		debugOption = 'x'
@@ -185,24 +729,43 @@ func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipel
 		"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
 	}
 
+	maps.Copy(envOverride, r.env)
+
 	for k, v := range pipeline.Environment {
 		envOverride[k] = v
 	}
+	envOverride["PATH"] = pipelinePath(pipeline, envOverride["PATH"])
 
-	workdir := WorkDir
-	if pipeline.WorkDir != "" {
+	if r.proxy != nil {
+		maps.Copy(envOverride, r.proxy.env())
+	}
+
+	// A relative working directory is resolved against that of the parent
+	// step, which the child steps run in unless they set their own.
+	workdir := r.workdir
+	if workdir == "" {
+		workdir = WorkDir
+	}
+	if path.IsAbs(pipeline.WorkDir) {
 		workdir = pipeline.WorkDir
+	} else if pipeline.WorkDir != "" {
+		workdir = path.Join(workdir, pipeline.WorkDir)
 	}
+	parentWorkdir := r.workdir
+	r.workdir = workdir
+	defer func() {
+		r.workdir = parentWorkdir
+	}()
 
-	// We might have called signal.Ignore(os.Interrupt) as part of a previous debug step,
+	// We might have called signal.Ignore(interruptSignals...) as part of a previous debug step,
 	// so create a new context to make it possible to cancel the Run.
-	if r.interactive {
+	if r.interactive || r.debugged {
 		var stop context.CancelFunc
-		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		ctx, stop = signal.NotifyContext(ctx, interruptSignals...)
 		defer stop()
 	}
 
-	if id := identity(pipeline); id != unidentifiablePipeline {
+	if id := pipeline.Identity(); id != config.UnidentifiablePipeline {
 		log.Infof("running step %q", id)
 	}
 
@@ -217,34 +780,309 @@ func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipel
 		ctx = clog.WithLogger(ctx, log.With(slogs...))
 	}
 
-	command := buildEvalRunCommand(pipeline, debugOption, workdir, pipeline.Runs)
-	if err := r.runner.Run(ctx, r.config, envOverride, command...); err != nil {
-		if err := r.maybeDebug(ctx, pipeline.Runs, envOverride, command, workdir, err); err != nil {
+	if pipeline.Timeout < 0 {
+		return false, fmt.Errorf("step %q: timeout must not be negative, got %s", pipeline.Identity(), pipeline.Timeout)
+	}
+	if pipeline.Retries < 0 {
+		return false, fmt.Errorf("step %q: retries must not be negative, got %d", pipeline.Identity(), pipeline.Retries)
+	}
+	if pipeline.Repeat < 0 {
+		return false, fmt.Errorf("step %q: repeat must not be negative, got %d", pipeline.Identity(), pipeline.Repeat)
+	}
+
+	// Registered after continue-on-error, so that a failed post script is
+	// also tolerated.
+	if pipeline.Post != "" {
+		defer func() {
+			if postErr := r.runPost(ctx, pipeline, debugOption, workdir, envOverride); postErr != nil {
+				ran, err = false, errors.Join(err, postErr)
+			}
+		}()
+	}
+
+	if pipeline.Repeat <= 1 {
+		code, err = r.runStep(ctx, pipeline, debugOption, workdir, envOverride)
+		if err != nil {
 			return false, err
 		}
+		return true, nil
+	}
+
+	passed := 0
+	errs := []error{}
+	for i := range pipeline.Repeat {
+		code, err = r.runStep(ctx, pipeline, debugOption, workdir, envOverride)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("repetition %d: %w", i+1, err))
+			continue
+		}
+		passed++
+	}
+
+	log.Infof("step %q passed %d of %d repetitions (%d%%)", pipeline.Identity(), passed, pipeline.Repeat, passed*100/pipeline.Repeat)
+	if passed != pipeline.Repeat {
+		return false, fmt.Errorf("step %q passed %d of %d repetitions: %w", pipeline.Identity(), passed, pipeline.Repeat, errors.Join(errs...))
+	}
+
+	return true, nil
+}
+
+// runPost runs the post script of a step, once its script and its child
+// steps are done, whether or not they succeeded.
+func (r *pipelineRunner) runPost(ctx context.Context, pipeline *config.Pipeline, debugOption rune, workdir string, envOverride map[string]string) error {
+	command := buildEvalRunCommand(pipeline, r.shell, debugOption, workdir, pipeline.CreatesWorkDir(), pipeline.Post)
+	if r.dryRun {
+		clog.FromContext(ctx).Infof("would run post %s -c:\n%s", command[0], command[2])
+		return nil
+	}
+
+	cfg := r.config
+	if r.readOnlySource {
+		cfg = readOnlySourceConfig(cfg)
+	}
+	if err := r.runner.Run(ctx, cfg, envOverride, command...); err != nil {
+		return fmt.Errorf("step %q: post script failed: %w", pipeline.Identity(), err)
+	}
+	return nil
+}
+
+// runStep runs the script of a step, then its child steps, and evaluates its
+// assertions.  It returns the exit code of the script, see exitCode.
+func (r *pipelineRunner) runStep(ctx context.Context, pipeline *config.Pipeline, debugOption rune, workdir string, envOverride map[string]string) (int, error) {
+	command := buildEvalRunCommand(pipeline, r.shell, debugOption, workdir, pipeline.CreatesWorkDir(), pipeline.Runs)
+	checksum := scriptChecksum(command)
+	clog.FromContext(ctx).Debugf("step %q: script sha256 %s", pipeline.Identity(), checksum)
+	if r.trace != nil {
+		r.trace.script(checksum)
+	}
+	cfg := r.config
+	if r.readOnlySource {
+		cfg = readOnlySourceConfig(cfg)
+	}
+	runCtx, tail := ctx, &outputTail{}
+	if r.diagnose {
+		runCtx = withOutputTail(ctx, tail)
+	}
+	if r.stepLogDir != "" && !r.dryRun && pipeline.Runs != "" {
+		f, err := r.createStepLog(pipeline)
+		if err != nil {
+			return -1, err
+		}
+		defer f.Close()
+		runCtx = withStepLog(runCtx, f, r.secrets)
+	}
+	// The timeout only covers the script, not debugging it, nor the child
+	// steps, which have their own.
+	var timedOut error
+	if pipeline.Timeout > 0 {
+		timedOut = fmt.Errorf("step %q timed out after %s", pipeline.Identity(), pipeline.Timeout)
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeoutCause(runCtx, pipeline.Timeout, timedOut)
+		defer cancel()
+	}
+	var runErr error
+	if r.dryRun {
+		clog.FromContext(ctx).Infof("would run %s -c:\n%s", command[0], command[2])
+	} else {
+		runErr = r.runWithRetries(runCtx, pipeline, cfg, envOverride, command)
+	}
+	if runErr != nil && timedOut != nil && context.Cause(runCtx) == timedOut {
+		runErr = fmt.Errorf("%w: %w", timedOut, runErr)
+	}
+	code := exitCode(runErr)
+	if runErr != nil && r.diagnose && r.failure == nil && !pipeline.ContinueOnError {
+		r.failure = &StepFailure{
+			Step:        pipeline.Identity(),
+			ExitCode:    code,
+			Command:     redactAll(command, r.secrets),
+			With:        redactMap(pipeline.With, r.secrets),
+			Environment: redactMap(envOverride, r.secrets),
+			Output:      redactAll(tail.Lines(), r.secrets),
+		}
+	}
+	if runErr != nil && pipeline.ContinueOnError {
+		return code, runErr
+	}
+	if runErr != nil {
+		if err := r.maybeDebug(ctx, pipeline.Runs, envOverride, command, workdir, runErr); err != nil {
+			return code, err
+		}
+	}
+
+	children, err := orderSteps(pipeline.Pipeline)
+	if err != nil {
+		return code, fmt.Errorf("step %q: %w", pipeline.Identity(), err)
 	}
 
 	steps := 0
+	errs := []error{}
+	// The identities of the child steps which ran and were skipped, to
+	// check the assertions of the step against, see childIdentity.
+	var ranSteps, skippedSteps []string
 
-	for _, p := range pipeline.Pipeline {
+	for i, p := range children {
 		if ran, err := r.runPipeline(ctx, &p); err != nil {
-			return false, fmt.Errorf("unable to run pipeline: %w", err)
+			err = fmt.Errorf("unable to run pipeline: %w", err)
+			if pipeline.FailsFast() {
+				return code, err
+			}
+			errs = append(errs, err)
 		} else if ran {
 			steps++
+			ranSteps = append(ranSteps, childIdentity(i, &p))
+		} else {
+			skippedSteps = append(skippedSteps, childIdentity(i, &p))
 		}
 	}
 
 	if assert := pipeline.Assertions; assert != nil {
-		if want := assert.RequiredSteps; want != steps {
-			return false, fmt.Errorf("pipeline did not run the required %d steps, only %d", want, steps)
+		// Assertions which only set the other checks do not require
+		// that no step runs.
+		checkRequired := assert.RequiredSteps != 0 || (assert.MaxSteps == 0 && len(assert.ForbiddenSteps) == 0)
+		if want := assert.RequiredSteps; checkRequired && want != steps {
+			errs = append(errs, r.assertionFailed(ctx, &AssertionFailure{
+				Step:      pipeline.Identity(),
+				Assertion: "required-steps",
+				Expected:  want,
+				Actual:    steps,
+				Ran:       ranSteps,
+				Skipped:   skippedSteps,
+			}))
+		}
+		if limit := assert.MaxSteps; limit != 0 && steps > limit {
+			errs = append(errs, r.assertionFailed(ctx, &AssertionFailure{
+				Step:      pipeline.Identity(),
+				Assertion: "max-steps",
+				Expected:  limit,
+				Actual:    steps,
+				Ran:       ranSteps,
+				Skipped:   skippedSteps,
+			}))
+		}
+		var forbidden []string
+		for _, id := range ranSteps {
+			if slices.Contains(assert.ForbiddenSteps, id) {
+				forbidden = append(forbidden, id)
+			}
+		}
+		if len(forbidden) != 0 {
+			errs = append(errs, r.assertionFailed(ctx, &AssertionFailure{
+				Step:      pipeline.Identity(),
+				Assertion: "forbidden-steps",
+				Expected:  assert.ForbiddenSteps,
+				Actual:    forbidden,
+				Ran:       ranSteps,
+				Skipped:   skippedSteps,
+			}))
 		}
 	}
 
-	return true, nil
+	return code, errors.Join(errs...)
+}
+
+// proxyStep starts the proxy a step is routed to, which forwards the requests
+// of the proxy-allow-hosts of the step, if any, which are also forwarded by
+// the proxy of the step being run, if any.  The proxy reports connections to
+// the network monitor, if any, attributed to the step, or to the step being
+// run if the step has no name.
+func (r *pipelineRunner) proxyStep(pipeline *config.Pipeline) (*stepProxy, error) {
+	if !supportsStepProxy(r.runner, r.config) {
+		if len(pipeline.ProxyAllowHosts) != 0 {
+			return nil, fmt.Errorf("proxy-allow-hosts is not supported by the %s runner", r.runner.Name())
+		}
+		return nil, fmt.Errorf("network monitoring is not supported by the %s runner", r.runner.Name())
+	}
+
+	parent := r.proxy
+	step := pipeline.Identity()
+	if pipeline.Name == "" && pipeline.Uses == "" && parent != nil {
+		step = parent.step
+	}
+
+	var onConnect func(host, port string, allowed bool)
+	if r.network != nil {
+		onConnect = func(host, port string, allowed bool) {
+			r.network.record(step, host, port, allowed)
+		}
+	}
+
+	// The proxies the step would use without one are connected through.
+	env := maps.Clone(r.env)
+	if env == nil {
+		env = map[string]string{}
+	}
+	maps.Copy(env, pipeline.Environment)
+
+	hosts := pipeline.ProxyAllowHosts
+	p, err := startStepProxy(func(host string) bool {
+		return (len(hosts) == 0 || allowsHost(hosts, host)) && (parent == nil || parent.allow(host))
+	}, onConnect, upstreamProxy(env))
+	if err != nil {
+		return nil, err
+	}
+	p.step = step
+	return p, nil
+}
+
+// supportsStepProxy reports whether steps run by runner with cfg can reach
+// an stepProxy listening on the loopback interface of the host.
+func supportsStepProxy(runner container.Runner, cfg *container.Config) bool {
+	hn, ok := runner.(container.HostNetworker)
+	return ok && hn.SharesHostNetwork() && cfg.Capabilities.Networking
+}
+
+// sourceWritingPipelines are the pipelines which bring the source into the
+// workspace, or modify it on purpose, so may always write it.
+var sourceWritingPipelines = []string{"fetch", "git-checkout", "patch"}
+
+// writesSource reports whether a step may modify the source in the workspace
+// when the build mounts it read-only.
+func writesSource(p *config.Pipeline) bool {
+	return p.WritableSource || slices.Contains(sourceWritingPipelines, p.UsesName())
+}
+
+// readOnlySourceConfig returns a copy of cfg which mounts the workspace
+// read-only, except for the output dir, on runners that are PerRunMounters.
+func readOnlySourceConfig(cfg *container.Config) *container.Config {
+	ro := *cfg
+	ro.Mounts = nil
+	for _, m := range cfg.Mounts {
+		if m.Destination != container.DefaultWorkspaceDir {
+			ro.Mounts = append(ro.Mounts, m)
+			continue
+		}
+		ro.Mounts = append(ro.Mounts,
+			container.BindMount{Source: m.Source, Destination: m.Destination, ReadOnly: true},
+			container.BindMount{Source: filepath.Join(m.Source, melangeOutputDirName), Destination: path.Join(m.Destination, melangeOutputDirName)},
+		)
+	}
+	return &ro
+}
+
+// checkCapabilities returns an error if runner cannot grant the capabilities
+// needed by the pipelines, so that the build fails before running any step
+// rather than when a step is denied one of them.
+func checkCapabilities(runner container.Runner, cfg *container.Config) error {
+	cg, ok := runner.(container.CapabilityGranter)
+	for _, c := range cfg.Capabilities.Add {
+		if !ok || !cg.GrantsCapability(cfg, c) {
+			return fmt.Errorf("pipelines need capability %s, which the %s runner cannot grant", c, runner.Name())
+		}
+	}
+	return nil
+}
+
+// assertionFailed notifies the registered callback, if any, of an assertion
+// failure and returns the failure as an error.
+func (r *pipelineRunner) assertionFailed(ctx context.Context, failure *AssertionFailure) error {
+	if r.onAssertionFailure != nil {
+		r.onAssertionFailure(ctx, failure)
+	}
+	return failure
 }
 
 func (r *pipelineRunner) maybeDebug(ctx context.Context, fragment string, envOverride map[string]string, cmd []string, workdir string, runErr error) error {
-	if !r.interactive {
+	if !r.interactive && !r.debugOnFailure {
 		return runErr
 	}
 
@@ -274,40 +1112,128 @@ func (r *pipelineRunner) maybeDebug(ctx context.Context, fragment string, envOve
 	}
 
 	// Don't cancel the context if we hit ctrl+C while debugging.
-	signal.Ignore(os.Interrupt)
+	signal.Ignore(interruptSignals...)
+	r.debugged = true
 
 	// Populate $HOME/.ash_history with the current command so you can hit up arrow to repeat it.
 	if err := os.WriteFile(filepath.Join(r.config.WorkspaceDir, ".ash_history"), []byte(fragment), 0644); err != nil {
 		return fmt.Errorf("failed to write history file: %w", err)
 	}
 
-	if dbgErr := dbg.Debug(ctx, r.config, envOverride, []string{"/bin/sh", "-c", fmt.Sprintf("cd %s && exec /bin/sh", workdir)}...); dbgErr != nil {
+	if dbgErr := dbg.Debug(ctx, r.config, envOverride, r.debugCommand(ctx, envOverride, workdir)...); dbgErr != nil {
 		return fmt.Errorf("failed to debug: %w; original error: %w", dbgErr, runErr)
 	}
 
 	// Reset to the default signal handling.
-	signal.Reset(os.Interrupt)
+	signal.Reset(interruptSignals...)
 
 	// If Debug() returns succesfully (via exit 0), it is a signal to continue execution.
 	return nil
 }
 
+// debugCommand returns the command debugging a failed step interactively in
+// workdir: the debug shell, if it exists in the build environment, or else
+// /bin/sh.
+func (r *pipelineRunner) debugCommand(ctx context.Context, envOverride map[string]string, workdir string) []string {
+	shell := []string{"/bin/sh"}
+	if len(r.debugShell) != 0 {
+		if err := r.runner.Run(ctx, r.config, envOverride, "/bin/sh", "-c", `command -v "$1" > /dev/null`, "sh", r.debugShell[0]); err != nil {
+			clog.FromContext(ctx).Warnf("debug shell %q not found, running /bin/sh instead", r.debugShell[0])
+		} else {
+			shell = r.debugShell
+		}
+	}
+
+	// The command is passed as arguments so it needs no quoting.
+	return append([]string{"/bin/sh", "-c", fmt.Sprintf("cd %s && exec \"$@\"", workdir), "sh"}, shell...)
+}
+
 func (r *pipelineRunner) runPipelines(ctx context.Context, pipelines []config.Pipeline) error {
-	for _, p := range pipelines {
-		if _, err := r.runPipeline(ctx, &p); err != nil {
-			return fmt.Errorf("unable to run pipeline: %w", err)
+	pipelines, err := orderSteps(pipelines)
+	if err != nil {
+		return err
+	}
+
+	// The steps after those resumed after may refer to their outcomes.
+	if outcomes := r.checkpoint.resumedOutcomes(); len(outcomes) != 0 {
+		if r.outcomes == nil {
+			r.outcomes = map[string]stepOutcome{}
 		}
+		maps.Copy(r.outcomes, outcomes)
 	}
 
-	return nil
+	var errs []error
+	for i, p := range pipelines {
+		if r.checkpoint.skips(i) {
+			clog.FromContext(ctx).Infof("skipping step %q, completed as of the checkpoint", childIdentity(i, &p))
+			continue
+		}
+
+		restore, err := r.overrideResources(ctx, &p)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		_, err = r.runPipeline(ctx, &p)
+		r.phases.since(stepPhase(&p, r.phase), start)
+		if rerr := restore(); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		if err != nil {
+			if !r.keepGoing {
+				return fmt.Errorf("unable to run pipeline: %w", err)
+			}
+			errs = append(errs, fmt.Errorf("unable to run pipeline %q: %w", childIdentity(i, &p), err))
+		} else if len(errs) == 0 {
+			if err := r.checkpoint.record(i+1, r.outcomes); err != nil {
+				return err
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// overrideResources applies the resources of a top-level pipeline, if any, to
+// the build environment, and returns the function restoring those of the
+// build.  Runners which cannot change them only log a warning.
+func (r *pipelineRunner) overrideResources(ctx context.Context, p *config.Pipeline) (func() error, error) {
+	noop := func() error { return nil }
+	if p.Resources == nil || r.dryRun {
+		return noop, nil
+	}
+
+	updater, ok := r.runner.(container.ResourceUpdater)
+	if !ok {
+		clog.FromContext(ctx).Warnf("not limiting the resources of step %q: the %s runner cannot change them", p.Identity(), r.runner.Name())
+		return noop, nil
+	}
+
+	cfg := *r.config
+	if p.Resources.CPU != "" {
+		cfg.CPU = p.Resources.CPU
+	}
+	if p.Resources.Memory != "" {
+		cfg.Memory = p.Resources.Memory
+	}
+	if err := updater.UpdateResources(ctx, &cfg); err != nil {
+		return nil, fmt.Errorf("step %q: limiting resources: %w", p.Identity(), err)
+	}
+
+	return func() error {
+		if err := updater.UpdateResources(context.WithoutCancel(ctx), r.config); err != nil {
+			return fmt.Errorf("step %q: restoring the resources of the build: %w", p.Identity(), err)
+		}
+		return nil
+	}, nil
 }
 
-func shouldRun(ifs string) (bool, error) {
+func shouldRun(ifs string, lookupFns ...cond.VariableLookupFunction) (bool, error) {
 	if ifs == "" {
 		return true, nil
 	}
 
-	result, err := cond.Evaluate(ifs)
+	result, err := cond.Evaluate(ifs, lookupFns...)
 	if err != nil {
 		return false, fmt.Errorf("evaluating if-conditional %q: %w", ifs, err)
 	}
@@ -15,18 +15,56 @@
 package build
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/util"
 	"gopkg.in/yaml.v3"
 
+	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/clog/slogtest"
 	"github.com/stretchr/testify/require"
 )
 
+// fakeRunner records the scripts it is asked to run, failing any script that
+// contains the string "fail".
+type fakeRunner struct {
+	container.Runner
+	scripts []string
+}
+
+func (r *fakeRunner) Run(_ context.Context, _ *container.Config, _ map[string]string, cmd ...string) error {
+	script := cmd[len(cmd)-1]
+	r.scripts = append(r.scripts, script)
+	if strings.Contains(script, "fail") {
+		return fmt.Errorf("script failed")
+	}
+	return nil
+}
+
+func (r *fakeRunner) Name() string { return "fake" }
+
+func (r *fakeRunner) WorkspaceTar(context.Context, *container.Config) (io.ReadCloser, error) {
+	return nil, nil
+}
+
 func Test_mutateStringFromMap(t *testing.T) {
 	keys := map[string]string{
 		"${{inputs.foo}}": "foo",
@@ -73,6 +111,90 @@ func Test_substitutionMap(t *testing.T) {
 	}
 }
 
+func Test_substitutionMapSubpackageLicense(t *testing.T) {
+	cfg := config.Configuration{
+		Package: config.Package{
+			Name:      "foo",
+			Version:   "1.0.0",
+			Copyright: []config.Copyright{{License: "Apache-2.0"}},
+		},
+	}
+	m, err := NewSubstitutionMap(&cfg, "", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Apache-2.0", m.Substitutions[config.SubstitutionSubPkgLicense])
+
+	inherited := m.Subpackage(&config.Subpackage{Name: "foo-dev"})
+	require.Equal(t, "Apache-2.0", inherited.Substitutions[config.SubstitutionSubPkgLicense])
+
+	declared := m.Subpackage(&config.Subpackage{
+		Name:      "foo-doc",
+		Copyright: []config.Copyright{{License: "CC-BY-4.0"}, {License: "MIT"}},
+	})
+	require.Equal(t, "CC-BY-4.0 OR MIT", declared.Substitutions[config.SubstitutionSubPkgLicense])
+}
+
+func Test_substitutionMapSubpackageDestDir(t *testing.T) {
+	cfg := config.Configuration{
+		Package: config.Package{Name: "foo", Version: "1.0.0"},
+		Subpackages: []config.Subpackage{
+			{Name: "foo-dev"},
+			{Name: "foo-doc", DestDir: "docs"},
+		},
+	}
+	m, err := NewSubstitutionMap(&cfg, "", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "/home/build/melange-out/foo-dev", m.Substitutions["${{targets.package.foo-dev}}"])
+	require.Equal(t, "/home/build/melange-out/docs", m.Substitutions["${{targets.package.foo-doc}}"])
+
+	sm := m.Subpackage(&cfg.Subpackages[0])
+	require.Equal(t, "/home/build/melange-out/foo-dev", sm.Substitutions[config.SubstitutionSubPkgDir])
+
+	sm = m.Subpackage(&cfg.Subpackages[1])
+	require.Equal(t, "/home/build/melange-out/docs", sm.Substitutions[config.SubstitutionSubPkgDir])
+	require.Equal(t, "/home/build/melange-out/docs", sm.Substitutions[config.SubstitutionTargetsContextdir])
+
+	b := &Build{WorkspaceDir: "/workspace", Configuration: cfg}
+	require.Equal(t, "/workspace/melange-out/foo", b.packageDir("foo"))
+	require.Equal(t, "/workspace/melange-out/foo-dev", b.packageDir("foo-dev"))
+	require.Equal(t, "/workspace/melange-out/docs", b.packageDir("foo-doc"))
+}
+
+func Test_substitutionMapOptions(t *testing.T) {
+	cfg := config.Configuration{
+		Package: config.Package{Name: "foo", Version: "1.0.0"},
+		Options: map[string]config.BuildOption{
+			"docs":  {},
+			"tests": {},
+			"extra": {},
+			"debug": {},
+		},
+	}
+
+	// The options are declared in a map, so repeat to exercise orders in
+	// which an option both declared and enabled is seen.
+	for range 20 {
+		m, err := NewSubstitutionMap(&cfg, "", "", []string{"docs", "debug", "undeclared"})
+		require.NoError(t, err)
+		require.Equal(t, "true", m.Substitutions["${{options.docs.enabled}}"])
+		require.Equal(t, "true", m.Substitutions["${{options.debug.enabled}}"])
+		require.Equal(t, "true", m.Substitutions["${{options.undeclared.enabled}}"])
+		require.Equal(t, "false", m.Substitutions["${{options.tests.enabled}}"])
+		require.Equal(t, "false", m.Substitutions["${{options.extra.enabled}}"])
+	}
+}
+
+func Test_substitutionMapCrossSysroot(t *testing.T) {
+	cfg := config.Configuration{Package: config.Package{Name: "foo", Version: "1.0.0"}}
+	for arch, want := range map[string]string{
+		"x86_64":  "/usr/x86_64-pc-linux-gnu",
+		"aarch64": "/usr/aarch64-unknown-linux-gnu",
+	} {
+		m, err := NewSubstitutionMap(&cfg, apko_types.ParseArchitecture(arch), "gnu", nil)
+		require.NoError(t, err)
+		require.Equal(t, want, m.Substitutions[config.SubstitutionCrossSysroot])
+	}
+}
+
 func Test_MutateWith(t *testing.T) {
 	for _, tc := range []struct {
 		version string
@@ -105,6 +227,115 @@ func Test_MutateWith(t *testing.T) {
 	}
 }
 
+func Test_MutateWithBuildArch(t *testing.T) {
+	cfg := config.Configuration{Package: config.Package{Name: "foo", Version: "1.0.0"}}
+	sm, err := NewSubstitutionMap(&cfg, apko_types.ParseArchitecture("arm64"), "gnu", nil)
+	require.NoError(t, err)
+
+	// The values referring to other inputs resolve regardless of the order
+	// in which the map is walked.
+	for range 20 {
+		got, err := sm.MutateWith(map[string]string{
+			"asset":   "asset-${{build.arch}}.tar.gz",
+			"arch":    "${{build.arch}}",
+			"uri":     "https://example.com/${{inputs.asset}}",
+			"release": "${{inputs.uri}}?arch=${{inputs.arch}}",
+		})
+		require.NoError(t, err)
+		require.Equal(t, "asset-aarch64.tar.gz", got["${{inputs.asset}}"])
+		require.Equal(t, "https://example.com/asset-aarch64.tar.gz", got["${{inputs.uri}}"])
+		require.Equal(t, "https://example.com/asset-aarch64.tar.gz?arch=aarch64", got["${{inputs.release}}"])
+	}
+
+	_, err = sm.MutateWith(map[string]string{"asset": "asset-${{build.typo}}.tar.gz"})
+	require.ErrorContains(t, err, "variable build.typo not defined")
+}
+
+func Test_validateWith(t *testing.T) {
+	inputs := map[string]config.Input{
+		"repository":  {Required: true},
+		"destination": {Default: "."},
+	}
+
+	got, err := validateWith(&config.Pipeline{Uses: "git-checkout", Inputs: inputs}, map[string]string{
+		"repository":         "https://github.com/chainguard-dev/melange",
+		"${{inputs.parent}}": "inherited",
+	})
+	require.NoError(t, err)
+	require.Equal(t, ".", got["destination"])
+
+	_, err = validateWith(&config.Pipeline{Name: "checkout", Uses: "git-checkout", Inputs: inputs}, map[string]string{
+		"respository": "https://github.com/chainguard-dev/melange",
+	})
+	require.ErrorContains(t, err, `step "checkout": undefined inputs "respository" to pipeline "git-checkout"`)
+
+	// A step running its own script declares no inputs, so its with is not
+	// checked.
+	_, err = validateWith(&config.Pipeline{Runs: "echo ${{inputs.greeting}}"}, map[string]string{"greeting": "hello"})
+	require.NoError(t, err)
+
+	// A pipeline declaring no inputs takes none.
+	_, err = validateWith(&config.Pipeline{Uses: "python/build"}, map[string]string{"greeting": "hello"})
+	require.ErrorContains(t, err, `undefined inputs "greeting" to pipeline "python/build"`)
+}
+
+func Test_validateWithDefaultReferences(t *testing.T) {
+	inputs := map[string]config.Input{
+		"version":      {Default: "${{package.version}}"},
+		"purl-version": {Default: "v${{inputs.version}}"},
+		"purl-name":    {Default: "${{package.name}}@${{inputs.purl-version}}"},
+		"tag":          {Default: "${{inputs.purl-version}}"},
+	}
+
+	got, err := validateWith(&config.Pipeline{Uses: "sbom", Inputs: inputs}, map[string]string{
+		"version": "1.2.3",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "v1.2.3", got["purl-version"])
+	require.Equal(t, "${{package.name}}@v1.2.3", got["purl-name"])
+	require.Equal(t, "v1.2.3", got["tag"])
+
+	got, err = validateWith(&config.Pipeline{Uses: "sbom", Inputs: inputs}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "${{package.name}}@v${{package.version}}", got["purl-name"])
+
+	sm := &SubstitutionMap{Substitutions: map[string]string{
+		config.SubstitutionPackageName:    "hello",
+		config.SubstitutionPackageVersion: "2.0.0",
+	}}
+	mutated, err := sm.MutateWith(got)
+	require.NoError(t, err)
+	require.Equal(t, "hello@v2.0.0", mutated["${{inputs.purl-name}}"])
+
+	_, err = validateWith(&config.Pipeline{Name: "sbom", Uses: "sbom", Inputs: map[string]config.Input{
+		"a": {Default: "${{inputs.b}}"},
+		"b": {Default: "x-${{inputs.a}}"},
+	}}, nil)
+	require.ErrorContains(t, err, `step "sbom": defaults of inputs refer to each other: `)
+
+	_, err = validateWith(&config.Pipeline{Uses: "sbom", Inputs: map[string]config.Input{
+		"a": {Default: "${{inputs.a}}"},
+	}}, nil)
+	require.ErrorContains(t, err, "defaults of inputs refer to each other: a -> a")
+}
+
+func TestCompileUndefinedInput(t *testing.T) {
+	b := &Build{
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{{
+				Uses: "git-checkout",
+				With: map[string]string{
+					"respository":     "https://github.com/chainguard-dev/melange",
+					"expected-commit": "deadbeef",
+				},
+			}},
+		},
+	}
+
+	err := b.Compile(slogtest.Context(t))
+	require.ErrorContains(t, err, `step "git-checkout": undefined inputs "respository" to pipeline "git-checkout"`)
+}
+
 func Test_substitutionNeedPackages(t *testing.T) {
 	ctx := slogtest.Context(t)
 	pkg := config.Package{
@@ -144,13 +375,380 @@ func Test_buildEvalRunCommand(t *testing.T) {
 	debugOption := 'x'
 	workdir := "/bar"
 	fragment := "baz"
-	command := buildEvalRunCommand(p, debugOption, workdir, fragment)
+	command := buildEvalRunCommand(p, "", debugOption, workdir, true, fragment)
 	expected := []string{"/bin/sh", "-c", `set -ex
 [ -d '/bar' ] || mkdir -p '/bar'
 cd '/bar'
 baz
 exit 0`}
 	require.Equal(t, command, expected)
+
+	// Without creating the workdir, cd fails if it does not exist.
+	command = buildEvalRunCommand(p, "", debugOption, workdir, false, fragment)
+	expected = []string{"/bin/sh", "-c", `set -ex
+cd '/bar'
+baz
+exit 0`}
+	require.Equal(t, command, expected)
+}
+
+func TestRunPipelinesWorkDirCreate(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	noCreate := false
+	b := &Build{
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{
+				{Runs: "echo created", WorkDir: "/home/build/out"},
+				{Uses: "autoconf/make", WorkDir: "/home/build/out", WorkDirCreate: &noCreate},
+			},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	const mkdir = "mkdir -p '/home/build/out'"
+	require.Contains(t, runner.scripts[0], mkdir)
+	// The pipelines used by the step inherit it.
+	require.Greater(t, len(runner.scripts), 2)
+	for _, script := range runner.scripts[1:] {
+		require.NotContains(t, script, mkdir)
+		require.Contains(t, script, "cd '/home/build/out'")
+	}
+}
+
+func TestRunPipelinesRelativeWorkDir(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello"},
+			Pipeline: []config.Pipeline{
+				{
+					WorkDir: "src",
+					Runs:    "echo src",
+					Pipeline: []config.Pipeline{
+						{Runs: "echo inherited"},
+						{WorkDir: "build", Runs: "echo relative"},
+						{
+							WorkDir:  "/opt/toolchain",
+							Runs:     "echo absolute",
+							Pipeline: []config.Pipeline{{WorkDir: "bin", Runs: "echo nested"}},
+						},
+					},
+				},
+				{
+					WorkDir:  "${{targets.destdir}}",
+					Pipeline: []config.Pipeline{{WorkDir: "usr/share", Runs: "echo destdir"}},
+				},
+				{Runs: "echo default"},
+			},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	var workdirs []string
+	for _, script := range runner.scripts {
+		if strings.Contains(script, "echo ") {
+			_, cd, _ := strings.Cut(script, "\ncd '")
+			workdir, _, _ := strings.Cut(cd, "'")
+			workdirs = append(workdirs, workdir)
+		}
+	}
+	require.Equal(t, []string{
+		"/home/build/src",
+		"/home/build/src",
+		"/home/build/src/build",
+		"/opt/toolchain",
+		"/opt/toolchain/bin",
+		"/home/build/melange-out/hello/usr/share",
+		"/home/build",
+	}, workdirs)
+}
+
+// resourceRunner records the resources it is asked to limit the build
+// environment to, as "cpu=<cpu> memory=<memory>".
+type resourceRunner struct {
+	fakeRunner
+	updates []string
+}
+
+func (r *resourceRunner) UpdateResources(_ context.Context, cfg *container.Config) error {
+	r.updates = append(r.updates, fmt.Sprintf("cpu=%s memory=%s", cfg.CPU, cfg.Memory))
+	return nil
+}
+
+func TestRunPipelinesResources(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	runner := &resourceRunner{}
+	cfg := &container.Config{CPU: "4", Memory: "8Gi"}
+	pr := &pipelineRunner{config: cfg, runner: runner}
+	err := pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "link", Runs: "echo link", Resources: &config.PipelineResources{Memory: "32Gi"}},
+		{Name: "test", Runs: "fail test", Resources: &config.PipelineResources{CPU: "1"}},
+	})
+	require.ErrorContains(t, err, "script failed")
+
+	// The limits of the build are restored after each pipeline which
+	// overrides them, even if it fails.
+	require.Equal(t, []string{
+		"cpu=4 memory=32Gi",
+		"cpu=4 memory=8Gi",
+		"cpu=1 memory=8Gi",
+		"cpu=4 memory=8Gi",
+	}, runner.updates)
+	require.Equal(t, &container.Config{CPU: "4", Memory: "8Gi"}, cfg)
+
+	// Runners which cannot change them run the pipelines as usual.
+	pr = &pipelineRunner{config: cfg, runner: &fakeRunner{}}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "link", Runs: "echo link", Resources: &config.PipelineResources{Memory: "32Gi"}},
+	}))
+}
+
+func TestRunPipelinesPost(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	run := func(p config.Pipeline) ([]string, error) {
+		b := &Build{Configuration: config.Configuration{
+			Package:  config.Package{Name: "hello"},
+			Pipeline: []config.Pipeline{p},
+		}}
+		require.NoError(t, b.Compile(ctx))
+		runner := &fakeRunner{}
+		pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+		err := pr.runPipelines(ctx, b.Configuration.Pipeline)
+		return runner.scripts, err
+	}
+
+	// The post script runs after the script and the nested steps.
+	scripts, err := run(config.Pipeline{
+		Name:     "mount",
+		Runs:     "echo mount",
+		Pipeline: []config.Pipeline{{Runs: "echo build"}},
+		Post:     "echo umount ${{targets.destdir}}",
+	})
+	require.NoError(t, err)
+	require.Len(t, scripts, 3)
+	require.Contains(t, scripts[0], "echo mount")
+	require.Contains(t, scripts[1], "echo build")
+	require.Contains(t, scripts[2], "echo umount /home/build/melange-out/hello")
+
+	// It also runs when the step fails.
+	scripts, err = run(config.Pipeline{Name: "mount", Runs: "fail mount", Post: "echo umount"})
+	require.ErrorContains(t, err, "script failed")
+	require.Len(t, scripts, 2)
+	require.Contains(t, scripts[1], "echo umount")
+
+	// Its failure fails the step, along with that of the step, if any.
+	_, err = run(config.Pipeline{Name: "mount", Runs: "echo mount", Post: "fail umount"})
+	require.ErrorContains(t, err, `step "mount": post script failed`)
+	_, err = run(config.Pipeline{Name: "mount", Pipeline: []config.Pipeline{{Runs: "fail build"}}, Post: "fail umount"})
+	require.ErrorContains(t, err, "unable to run pipeline: script failed")
+	require.ErrorContains(t, err, "post script failed")
+
+	// Unless the step continues on error.
+	_, err = run(config.Pipeline{Name: "mount", Runs: "echo mount", Post: "fail umount", ContinueOnError: true})
+	require.NoError(t, err)
+}
+
+func TestRunPipelinesPath(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello"},
+			Pipeline: []config.Pipeline{
+				{Runs: "echo default"},
+				{Runs: "echo prepend", PathPrepend: []string{"/home/build/.local/bin", "/opt/toolchain/bin"}},
+				{Runs: "echo append", PathAppend: []string{"${{targets.destdir}}/usr/bin"}},
+				{
+					Runs:        "echo both",
+					PathPrepend: []string{"/opt/toolchain/bin"},
+					PathAppend:  []string{"/opt/extra/bin"},
+					Pipeline: []config.Pipeline{{
+						Runs:        "echo nested",
+						PathPrepend: []string{"/opt/nested/bin"},
+						PathAppend:  []string{"/opt/nested/sbin"},
+					}},
+				},
+			},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &envRecordingRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	var paths []string
+	for _, env := range runner.envs {
+		paths = append(paths, env["PATH"])
+	}
+	require.Equal(t, []string{
+		defaultPath,
+		"/home/build/.local/bin:/opt/toolchain/bin:" + defaultPath,
+		defaultPath + ":/home/build/melange-out/hello/usr/bin",
+		"/opt/toolchain/bin:" + defaultPath + ":/opt/extra/bin",
+		// The nested step inherits the dirs, after those it prepends and
+		// before those it appends.
+		"/opt/nested/bin:/opt/toolchain/bin:" + defaultPath + ":/opt/extra/bin:/opt/nested/sbin",
+	}, paths)
+}
+
+func TestRunPipelinesTransform(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{
+		Arch: apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "2.12.1"},
+			Pipeline: []config.Pipeline{{
+				Name: "unpack",
+				Pipeline: []config.Pipeline{
+					{
+						Name: "names",
+						Uses: "transform",
+						With: map[string]string{
+							"tarball": "${{package.name}}-${{package.version}}.tar.gz",
+							"dir":     "${{package.name}}-${{build.arch}}",
+						},
+					},
+					{Runs: "mkdir ${{steps.names.dir}} && tar xf ${{steps.names.tarball}} -C ${{steps.names.dir}}"},
+				},
+				Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+			}},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	// The transform step runs nothing, unlike its parent and the step after
+	// it, yet counts as a step which ran.
+	require.Len(t, runner.scripts, 2)
+	require.Contains(t, runner.scripts[1], "mkdir hello-x86_64 && tar xf hello-2.12.1.tar.gz -C hello-x86_64")
+	require.Equal(t, stepOutcome{ran: true, succeeded: true}, pr.outcomes["names"])
+
+	b.Configuration.Pipeline = []config.Pipeline{{Name: "names", Uses: "transform", If: "'a' == 'a'"}}
+	require.ErrorContains(t, b.Compile(ctx), `step "names": a transform step cannot have an if`)
+
+	b.Configuration.Pipeline = []config.Pipeline{{Name: "names", Uses: "transform", With: map[string]string{"result": "x"}}}
+	require.ErrorContains(t, b.Compile(ctx), `step "names": with result is reserved for the outcome of the step`)
+}
+
+func TestRunPipelinesTransformIf(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{
+		Arch: apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello"},
+			Pipeline: []config.Pipeline{{
+				Pipeline: []config.Pipeline{
+					{Name: "names", Uses: "transform", With: map[string]string{"flavor": "${{build.arch}}"}},
+					{Name: "x86", If: "${{steps.names.flavor}} == 'x86_64'", Runs: "echo x86"},
+					{Name: "arm", If: "${{steps.names.flavor}} == 'aarch64'", Runs: "echo arm"},
+					// The values of transform steps mix with the outcomes of
+					// steps.
+					{If: "${{steps.names.flavor}} == 'x86_64' && ${{steps.x86.result}} == 'success'", Runs: "echo after x86"},
+				},
+			}},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	require.Len(t, runner.scripts, 3)
+	require.Contains(t, runner.scripts[1], "echo x86")
+	require.Contains(t, runner.scripts[2], "echo after x86")
+	require.Equal(t, stepOutcome{exitCode: -1}, pr.outcomes["arm"])
+}
+
+func TestRunPipelinesEnvironmentSubstitutions(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{
+		Arch: apko_types.ParseArchitecture("x86_64"),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello"},
+			Vars:    map[string]string{"opt": "-O2"},
+			Pipeline: []config.Pipeline{{
+				Runs: "echo env",
+				Environment: map[string]string{
+					"CGO_CFLAGS":           "-march=${{build.arch}} ${{vars.opt}}",
+					"GREETING":             "it's ${{package.name}}, isn't it?",
+					"KEEP_${{build.arch}}": "the key is literal",
+				},
+			}},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+
+	runner := &envRecordingRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+	require.Len(t, runner.envs, 1)
+	require.Equal(t, "-march=x86_64 -O2", runner.envs[0]["CGO_CFLAGS"])
+	// The value is passed as is, not through the script, so quotes in it
+	// need no escaping.
+	require.Equal(t, "it's hello, isn't it?", runner.envs[0]["GREETING"])
+	require.Equal(t, "the key is literal", runner.envs[0]["KEEP_${{build.arch}}"])
+}
+
+func TestRunPipelineScriptChecksum(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	checksums := func(greeting string) []string {
+		b := &Build{
+			Arch: apko_types.ParseArchitecture("x86_64"),
+			Configuration: config.Configuration{
+				Package: config.Package{Name: "hello"},
+				Vars:    map[string]string{"greeting": greeting},
+				Pipeline: []config.Pipeline{
+					{Name: "first", Runs: "echo ${{vars.greeting}}"},
+					{Name: "second", Runs: "echo ${{vars.greeting}}"},
+				},
+			},
+		}
+		require.NoError(t, b.Compile(ctx))
+
+		runner := &fakeRunner{}
+		pr := &pipelineRunner{config: &container.Config{}, runner: runner, trace: &stepTrace{}}
+		require.NoError(t, pr.runPipelines(ctx, b.Configuration.Pipeline))
+
+		require.Len(t, pr.trace.steps, 2)
+		var sums []string
+		for i, step := range pr.trace.steps {
+			// The checksum is of the script as run, with the variables
+			// substituted.
+			want := sha256.Sum256([]byte(runner.scripts[i]))
+			require.Equal(t, hex.EncodeToString(want[:]), step.ScriptSHA256)
+			sums = append(sums, step.ScriptSHA256)
+		}
+		return sums
+	}
+
+	hello := checksums("hello")
+	require.Equal(t, hello[0], hello[1], "identical steps")
+	require.Equal(t, hello, checksums("hello"))
+	require.NotEqual(t, hello[0], checksums("goodbye")[0], "a changed var")
 }
 
 func TestAllPipelines(t *testing.T) {
@@ -172,3 +770,912 @@ func TestAllPipelines(t *testing.T) {
 		})
 	}
 }
+
+func TestRunPipelineFailFast(t *testing.T) {
+	ctx := slogtest.Context(t)
+	noFailFast := false
+
+	for _, tc := range []struct {
+		name     string
+		failFast *bool
+		wantRuns int
+	}{
+		{name: "default", failFast: nil, wantRuns: 2},
+		{name: "disabled", failFast: &noFailFast, wantRuns: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &fakeRunner{}
+			pr := &pipelineRunner{config: &container.Config{}, runner: r}
+			p := &config.Pipeline{
+				FailFast: tc.failFast,
+				Pipeline: []config.Pipeline{
+					{Runs: "echo one"},
+					{Runs: "fail two"},
+					{Runs: "echo three"},
+				},
+				Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+			}
+
+			_, err := pr.runPipeline(ctx, p)
+			require.Error(t, err)
+			// The parent pipeline's (empty) script runs too.
+			require.Len(t, r.scripts, tc.wantRuns+1)
+		})
+	}
+}
+
+func TestRunPipelineDryRun(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	// No runner: the steps must not be run.
+	pr := &pipelineRunner{config: &container.Config{}, dryRun: true}
+	p := &config.Pipeline{
+		Name: "parent",
+		Pipeline: []config.Pipeline{
+			{Name: "fetch", Runs: "fail fetch", ProxyAllowHosts: []string{"example.com"}},
+			{Name: "optional", If: "'a' == 'b'", Runs: "echo optional"},
+			{Name: "compile", If: "${{steps.fetch.succeeded}} == 'true'", Pipeline: []config.Pipeline{{Runs: "make"}}},
+		},
+		Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+	}
+
+	ran, err := pr.runPipeline(ctx, p)
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Equal(t, map[string]stepOutcome{
+		"parent":   {ran: true, succeeded: true},
+		"fetch":    {ran: true, succeeded: true},
+		"optional": {ran: false, succeeded: false, exitCode: -1},
+		"compile":  {ran: true, succeeded: true},
+	}, pr.outcomes)
+
+	// Assertions hold against the steps which would run.
+	p.Assertions.RequiredSteps = 3
+	_, err = pr.runPipeline(ctx, p)
+	require.ErrorContains(t, err, "pipeline did not run the required 3 steps, only 2")
+}
+
+func TestRunPipelineLogsSkippedSteps(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := clog.WithLogger(context.Background(), clog.New(slog.NewTextHandler(&buf, nil)))
+
+	pr := &pipelineRunner{config: &container.Config{}, runner: &fakeRunner{}}
+	p := &config.Pipeline{
+		Name: "parent",
+		Pipeline: []config.Pipeline{
+			{Name: "build", Runs: "echo build"},
+			{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+			{Name: "test", If: "'a' == 'a'", Runs: "echo test"},
+		},
+	}
+
+	_, err := pr.runPipeline(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(buf.String(), "skipping step"), buf.String())
+	require.Contains(t, buf.String(), `skipping step \"docs\" (if \"'a' == 'b'\" evaluated false)`)
+}
+
+func TestRunPipelineAssertionFailureSteps(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pr := &pipelineRunner{config: &container.Config{}, runner: &fakeRunner{}}
+	p := &config.Pipeline{
+		Name: "parent",
+		Pipeline: []config.Pipeline{
+			{Name: "configure", Runs: "echo configure"},
+			{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+			{Runs: "echo install"},
+		},
+		Assertions: &config.PipelineAssertions{RequiredSteps: 3},
+	}
+
+	_, err := pr.runPipeline(ctx, p)
+	require.ErrorContains(t, err, `pipeline did not run the required 3 steps, only 2 (ran: "configure", "#3"; skipped: "docs")`)
+}
+
+func TestRunPipelineAssertionMaxSteps(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pr := &pipelineRunner{config: &container.Config{}, runner: &fakeRunner{}}
+	steps := []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+		{Name: "install", Runs: "echo install"},
+	}
+
+	// Only the maximum is checked when no steps are required.
+	_, err := pr.runPipeline(ctx, &config.Pipeline{Name: "parent", Pipeline: steps, Assertions: &config.PipelineAssertions{MaxSteps: 2}})
+	require.NoError(t, err)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Name: "parent", Pipeline: steps, Assertions: &config.PipelineAssertions{MaxSteps: 1}})
+	require.EqualError(t, err, `pipeline ran 2 steps, more than the maximum of 1 (ran: "configure", "install")`)
+}
+
+func TestRunPipelineAssertionRequiredAndMaxSteps(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	var got []string
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: &fakeRunner{},
+		onAssertionFailure: func(_ context.Context, f *AssertionFailure) {
+			got = append(got, f.Assertion)
+		},
+	}
+	steps := []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "install", Runs: "echo install"},
+	}
+
+	_, err := pr.runPipeline(ctx, &config.Pipeline{Pipeline: steps, Assertions: &config.PipelineAssertions{RequiredSteps: 2, MaxSteps: 2}})
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	// Both assertions fail, and both are reported.
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Pipeline: steps, Assertions: &config.PipelineAssertions{RequiredSteps: 1, MaxSteps: 1}})
+	require.ErrorContains(t, err, "pipeline did not run the required 1 steps, only 2")
+	require.ErrorContains(t, err, "pipeline ran 2 steps, more than the maximum of 1")
+	require.Equal(t, []string{"required-steps", "max-steps"}, got)
+}
+
+func TestRunPipelineAssertionForbiddenSteps(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pr := &pipelineRunner{config: &container.Config{}, runner: &fakeRunner{}}
+	steps := []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+		{Name: "docs-fallback", If: "'a' == 'a'", Runs: "echo fallback"},
+		{Uses: "strip", Pipeline: []config.Pipeline{{Runs: "echo strip"}}},
+	}
+
+	// A forbidden step which was skipped passes.
+	_, err := pr.runPipeline(ctx, &config.Pipeline{Pipeline: steps, Assertions: &config.PipelineAssertions{ForbiddenSteps: []string{"docs"}}})
+	require.NoError(t, err)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Pipeline: steps, Assertions: &config.PipelineAssertions{ForbiddenSteps: []string{"docs", "docs-fallback", "strip"}}})
+	require.EqualError(t, err, `pipeline ran forbidden steps "docs-fallback", "strip"`)
+}
+
+func TestRunPipelineAssertionFailureCallback(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	var got []*AssertionFailure
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: &fakeRunner{},
+		onAssertionFailure: func(_ context.Context, f *AssertionFailure) {
+			got = append(got, f)
+		},
+	}
+	p := &config.Pipeline{
+		Name:       "parent",
+		Pipeline:   []config.Pipeline{{Runs: "echo one"}},
+		Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+	}
+
+	_, err := pr.runPipeline(ctx, p)
+	require.ErrorContains(t, err, "pipeline did not run the required 2 steps, only 1")
+	require.Equal(t, []*AssertionFailure{{
+		Step:      "parent",
+		Assertion: "required-steps",
+		Expected:  2,
+		Actual:    1,
+		Ran:       []string{"#1"},
+	}}, got)
+}
+
+func TestRunPipelineStepOutcomes(t *testing.T) {
+	ctx := slogtest.Context(t)
+	noFailFast := false
+
+	r := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+	p := &config.Pipeline{
+		FailFast: &noFailFast,
+		Pipeline: []config.Pipeline{
+			{Name: "configure", Runs: "echo configure"},
+			{Name: "optional", If: "'a' == 'b'", Runs: "echo optional"},
+			{Name: "compile", Runs: "fail compile"},
+			{Name: "cleanup", If: "${{steps.compile.succeeded}} == 'false'", Runs: "echo cleanup"},
+			{Name: "report", If: "${{steps.configure.ran}} == 'true' && ${{steps.optional.ran}} == 'false'", Runs: "echo report"},
+			{Name: "never", If: "${{steps.compile.succeeded}} == 'true'", Runs: "echo never"},
+		},
+	}
+
+	_, err := pr.runPipeline(ctx, p)
+	require.ErrorContains(t, err, "script failed")
+
+	ran := strings.Join(r.scripts, "\n")
+	require.Contains(t, ran, "echo cleanup")
+	require.Contains(t, ran, "echo report")
+	require.NotContains(t, ran, "echo optional")
+	require.NotContains(t, ran, "echo never")
+
+	for _, tc := range []struct {
+		cond    string
+		wantErr string
+	}{
+		{cond: "${{steps.missing.ran}} == 'true'", wantErr: `step "missing" has not been reached yet or does not exist`},
+		{cond: "${{steps.missing.result}} == 'success'", wantErr: `step "missing" has not been reached yet or does not exist`},
+		{cond: "${{steps.configure.bogus}} == 'true'", wantErr: `unknown outcome "bogus" of step "configure"`},
+		{cond: "${{steps.configure}} == 'true'", wantErr: "invalid step reference steps.configure"},
+	} {
+		_, err := pr.runPipeline(ctx, &config.Pipeline{If: tc.cond, Runs: "echo"})
+		require.ErrorContains(t, err, tc.wantErr)
+	}
+}
+
+func TestRunPipelineStepResults(t *testing.T) {
+	ctx := slogtest.Context(t)
+	noFailFast := false
+
+	r := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		FailFast: &noFailFast,
+		Pipeline: []config.Pipeline{
+			{Name: "build", Runs: "echo build"},
+			{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+			{Name: "check", Runs: "fail check"},
+			{Name: "package", If: "${{steps.build.result}} == 'success'", Runs: "echo package"},
+			{Name: "placeholder-docs", If: "${{steps.docs.result}} == 'skipped'", Runs: "echo placeholder-docs"},
+			{Name: "report", If: "${{steps.check.result}} == 'failure'", Runs: "echo report"},
+			{Name: "never", If: "${{steps.build.result}} != 'success' || ${{steps.docs.result}} == 'success'", Runs: "echo never"},
+			// A later sibling, not yet reached.
+			{Name: "early", If: "${{steps.late.result}} == 'success'", Runs: "echo early"},
+			{Name: "late", Runs: "echo late"},
+		},
+	})
+	require.ErrorContains(t, err, "script failed")
+	require.ErrorContains(t, err, `step "late" has not been reached yet or does not exist`)
+	require.NotContains(t, err.Error(), "steps.docs.result")
+
+	ran := strings.Join(r.scripts, "\n")
+	require.Contains(t, ran, "echo package")
+	require.Contains(t, ran, "echo placeholder-docs")
+	require.Contains(t, ran, "echo report")
+	require.NotContains(t, ran, "echo docs")
+	require.NotContains(t, ran, "echo never")
+	require.NotContains(t, ran, "echo early")
+
+	for name, want := range map[string]string{"build": "success", "docs": "skipped", "check": "failure"} {
+		got, err := pr.lookupOutcome("steps." + name + ".result")
+		require.NoError(t, err)
+		require.Equal(t, want, got, name)
+	}
+}
+
+// flakyRunner fails every other script containing the string "flaky".
+type flakyRunner struct {
+	fakeRunner
+	calls int
+}
+
+func (r *flakyRunner) Run(_ context.Context, _ *container.Config, _ map[string]string, cmd ...string) error {
+	script := cmd[len(cmd)-1]
+	r.scripts = append(r.scripts, script)
+	if strings.Contains(script, "flaky") {
+		r.calls++
+		if r.calls%2 == 0 {
+			return fmt.Errorf("script failed")
+		}
+	}
+	return nil
+}
+
+func TestRunPipelineRepeat(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	r := &flakyRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+
+	// A repeated step counts once towards the required steps of its parent,
+	// and its own assertions are evaluated for each repetition.
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		Pipeline: []config.Pipeline{{
+			Name:       "stable",
+			Repeat:     3,
+			Pipeline:   []config.Pipeline{{Runs: "echo one"}, {Runs: "echo two"}},
+			Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+		}},
+		Assertions: &config.PipelineAssertions{RequiredSteps: 1},
+	})
+	require.NoError(t, err)
+	require.Len(t, r.scripts, 1+3*3)
+
+	// All repetitions run, even after a failure.
+	r.scripts = nil
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Name: "test", Repeat: 4, Runs: "flaky"})
+	require.ErrorContains(t, err, `step "test" passed 2 of 4 repetitions`)
+	require.ErrorContains(t, err, "repetition 2: script failed")
+	require.ErrorContains(t, err, "repetition 4: script failed")
+	require.Len(t, r.scripts, 4)
+	succeeded, err := pr.lookupOutcome("steps.test.succeeded")
+	require.NoError(t, err)
+	require.Equal(t, "false", succeeded)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Repeat: -1, Runs: "echo"})
+	require.ErrorContains(t, err, "repeat must not be negative")
+}
+
+// exitRunner exits scripts containing the string "probe" with code 3.
+// failingRunner fails the first failures scripts it is asked to run, then
+// runs them as a fakeRunner.
+type failingRunner struct {
+	fakeRunner
+	failures int
+}
+
+func (r *failingRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	if r.failures > 0 {
+		r.failures--
+		r.scripts = append(r.scripts, cmd[len(cmd)-1])
+		return fmt.Errorf("connection reset")
+	}
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestRunPipelinesKeepGoing(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pipelines := []config.Pipeline{
+		{Name: "unit", Runs: "fail unit"},
+		{Name: "lint", Runs: "echo lint"},
+		{Runs: "fail integration"},
+	}
+
+	runner := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+	require.Error(t, pr.runPipelines(ctx, pipelines))
+	require.Len(t, runner.scripts, 1)
+
+	runner = &fakeRunner{}
+	pr = &pipelineRunner{config: &container.Config{}, runner: runner, keepGoing: true}
+	err := pr.runPipelines(ctx, pipelines)
+	require.Len(t, runner.scripts, 3)
+	require.ErrorContains(t, err, `unable to run pipeline "unit": `)
+	require.ErrorContains(t, err, `unable to run pipeline "#3": `)
+	require.NotContains(t, err.Error(), "lint")
+	require.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 2)
+}
+
+func TestRunPipelineRetries(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	step := &config.Pipeline{Name: "fetch", Runs: "wget example.com", Retries: 2, RetryDelay: time.Millisecond}
+
+	r := &failingRunner{failures: 2}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+	ran, err := pr.runPipeline(ctx, step)
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Len(t, r.scripts, 3)
+
+	r = &failingRunner{failures: 3}
+	pr = &pipelineRunner{config: &container.Config{}, runner: r}
+	_, err = pr.runPipeline(ctx, step)
+	require.ErrorContains(t, err, `step "fetch" failed after 3 attempts: connection reset`)
+	require.Len(t, r.scripts, 3)
+
+	// A cancelled step is not retried.
+	r = &failingRunner{failures: 1}
+	pr = &pipelineRunner{config: &container.Config{}, runner: r}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = pr.runPipeline(cancelled, step)
+	require.ErrorContains(t, err, "connection reset")
+	require.NotContains(t, err.Error(), "attempts")
+	require.Len(t, r.scripts, 1)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Runs: "true", Retries: -1})
+	require.ErrorContains(t, err, "retries must not be negative")
+
+	// The script of a pipeline which is used is retried.
+	b := &Build{
+		Configuration: config.Configuration{
+			Pipeline: []config.Pipeline{{
+				Uses:    "fetch",
+				With:    map[string]string{"uri": "https://example.com/hello.tar.gz", "expected-sha256": "abc"},
+				Retries: 2,
+			}},
+		},
+	}
+	require.NoError(t, b.Compile(ctx))
+	require.NotEmpty(t, b.Configuration.Pipeline[0].Pipeline)
+	for _, p := range b.Configuration.Pipeline[0].Pipeline {
+		require.Equal(t, 2, p.Retries)
+	}
+}
+
+type exitRunner struct {
+	fakeRunner
+}
+
+func (r *exitRunner) Run(_ context.Context, _ *container.Config, _ map[string]string, cmd ...string) error {
+	script := cmd[len(cmd)-1]
+	r.scripts = append(r.scripts, script)
+	if strings.Contains(script, "probe") {
+		return &container.ExitError{Code: 3}
+	}
+	return nil
+}
+
+func TestRunPipelineExitCode(t *testing.T) {
+	ctx := slogtest.Context(t)
+	noFailFast := false
+
+	r := &exitRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		FailFast: &noFailFast,
+		Pipeline: []config.Pipeline{
+			{Name: "probe", Runs: "probe"},
+			{Name: "ok", Runs: "echo ok"},
+			{Name: "skipped", If: "'a' == 'b'", Runs: "echo skipped"},
+			{Name: "handle", If: "${{steps.probe.exit-code}} == '3' && ${{steps.ok.exit-code}} == '0'", Runs: "echo handle"},
+		},
+	})
+	require.ErrorContains(t, err, "task exited with code 3")
+	require.Contains(t, strings.Join(r.scripts, "\n"), "echo handle")
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{If: "${{steps.skipped.exit-code}} == '0'", Runs: "echo"})
+	require.ErrorContains(t, err, `step "skipped" did not run, so has no exit code`)
+
+	require.Equal(t, 0, exitCode(nil))
+	require.Equal(t, -1, exitCode(fmt.Errorf("could not start")))
+	require.Equal(t, 4, exitCode(fmt.Errorf("wrapped: %w", exec.Command("/bin/sh", "-c", "exit 4").Run())))
+}
+
+// grantingRunner grants the capabilities it is configured with.
+type grantingRunner struct {
+	fakeRunner
+	grants []string
+}
+
+func (r *grantingRunner) GrantsCapability(_ *container.Config, capability string) bool {
+	return slices.Contains(r.grants, capability)
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	cfg := &container.Config{Capabilities: container.Capabilities{Add: []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"}}}
+
+	require.NoError(t, checkCapabilities(&fakeRunner{}, &container.Config{}))
+	require.ErrorContains(t, checkCapabilities(&fakeRunner{}, cfg), "pipelines need capability CAP_NET_ADMIN, which the fake runner cannot grant")
+	require.ErrorContains(t, checkCapabilities(&grantingRunner{grants: []string{"CAP_NET_ADMIN"}}, cfg), "capability CAP_SYS_ADMIN")
+	require.NoError(t, checkCapabilities(&grantingRunner{grants: []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"}}, cfg))
+}
+
+// mountRecordingRunner records whether the workspace was read-only for each
+// script it is asked to run, in the same order as scripts.
+type mountRecordingRunner struct {
+	fakeRunner
+	readOnly []bool
+}
+
+func (r *mountRecordingRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	readOnly := false
+	for _, m := range cfg.Mounts {
+		if m.Destination == container.DefaultWorkspaceDir {
+			readOnly = m.ReadOnly
+		}
+	}
+	r.readOnly = append(r.readOnly, readOnly)
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestRunPipelinesReadOnlySource(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	runner := &mountRecordingRunner{}
+	pr := &pipelineRunner{
+		config: &container.Config{Mounts: []container.BindMount{
+			{Source: "/workspace", Destination: container.DefaultWorkspaceDir},
+			{Source: "/cache", Destination: container.DefaultCacheDir},
+		}},
+		runner:         runner,
+		readOnlySource: true,
+	}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Uses: "fetch", Pipeline: []config.Pipeline{{Runs: "echo fetching"}}},
+		{Runs: "echo building"},
+		{WritableSource: true, Runs: "echo regenerating", Pipeline: []config.Pipeline{{Runs: "echo nested"}}},
+		{Runs: "echo installing"},
+	}))
+
+	want := map[string]bool{
+		"echo fetching":     false,
+		"echo building":     true,
+		"echo regenerating": false,
+		"echo nested":       false,
+		"echo installing":   true,
+	}
+	got := map[string]bool{}
+	for i, script := range runner.scripts {
+		for marker := range want {
+			if strings.Contains(script, marker) {
+				got[marker] = runner.readOnly[i]
+			}
+		}
+	}
+	require.Equal(t, want, got)
+
+	// The output dir stays writable, and the other mounts are untouched.
+	require.Equal(t, []container.BindMount{
+		{Source: "/workspace", Destination: container.DefaultWorkspaceDir, ReadOnly: true},
+		{Source: "/workspace/melange-out", Destination: "/home/build/melange-out"},
+		{Source: "/cache", Destination: container.DefaultCacheDir},
+	}, readOnlySourceConfig(pr.config).Mounts)
+}
+
+// shellRecordingRunner records the shell of each script it is asked to run,
+// in the same order as scripts.
+type shellRecordingRunner struct {
+	fakeRunner
+	shells []string
+}
+
+func (r *shellRecordingRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	r.shells = append(r.shells, cmd[0])
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestRunPipelinesShell(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	for _, tc := range []struct {
+		name         string
+		defaultShell string
+		want         map[string]string
+	}{{
+		name: "default",
+		want: map[string]string{
+			"echo first":     "/bin/sh",
+			"echo bash":      "/bin/bash",
+			"echo inherited": "/bin/bash",
+			"echo zsh":       "/bin/zsh",
+			"echo last":      "/bin/sh",
+		},
+	}, {
+		name:         "build-wide",
+		defaultShell: "/bin/ash",
+		want: map[string]string{
+			"echo first":     "/bin/ash",
+			"echo bash":      "/bin/bash",
+			"echo inherited": "/bin/bash",
+			"echo zsh":       "/bin/zsh",
+			"echo last":      "/bin/ash",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &shellRecordingRunner{}
+			pr := &pipelineRunner{
+				config: &container.Config{},
+				runner: runner,
+				shell:  tc.defaultShell,
+			}
+			require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+				{Runs: "echo first"},
+				{Shell: "/bin/bash", Runs: "echo bash", Pipeline: []config.Pipeline{
+					{Runs: "echo inherited"},
+					{Shell: "/bin/zsh", Runs: "echo zsh"},
+				}},
+				{Runs: "echo last"},
+			}))
+
+			got := map[string]string{}
+			for i, script := range runner.scripts {
+				for marker := range tc.want {
+					if strings.Contains(script, marker) {
+						got[marker] = runner.shells[i]
+					}
+				}
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCompileShell(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{Configuration: config.Configuration{
+		Pipeline: []config.Pipeline{{Pipeline: []config.Pipeline{{Shell: "bash", Runs: "echo"}}}},
+	}}
+	require.ErrorContains(t, b.Compile(ctx), `shell "bash" is not an absolute path`)
+
+	require.ErrorContains(t, WithShell("bash")(&Build{}), `shell "bash" is not an absolute path`)
+	require.NoError(t, WithShell("/bin/bash")(b))
+	require.Equal(t, "/bin/bash", b.Shell)
+}
+
+// hangingRunner runs scripts as a fakeRunner, except for those containing
+// the string "hang", which run until they are cancelled.
+type hangingRunner struct {
+	fakeRunner
+}
+
+func (r *hangingRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	if strings.Contains(cmd[len(cmd)-1], "hang") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestRunPipelinesTimeout(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: &hangingRunner{},
+	}
+
+	// Each step has its own timeout: the parent's does not cover its
+	// children, which would otherwise exceed it.
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{{
+		Name:    "parent",
+		Timeout: time.Hour,
+		Runs:    "echo parent",
+		Pipeline: []config.Pipeline{
+			{Name: "quick", Timeout: time.Millisecond, Runs: "echo quick"},
+			{Name: "untimed", Runs: "echo untimed"},
+		},
+	}}))
+
+	err := pr.runPipelines(ctx, []config.Pipeline{{
+		Name:    "parent",
+		Timeout: time.Hour,
+		Pipeline: []config.Pipeline{
+			{Name: "stuck", Timeout: 10 * time.Millisecond, Runs: "hang"},
+		},
+	}})
+	require.ErrorContains(t, err, `step "stuck" timed out after 10ms`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = pr.runPipelines(ctx, []config.Pipeline{{Name: "negative", Timeout: -time.Second, Runs: "echo"}})
+	require.ErrorContains(t, err, `step "negative": timeout must not be negative`)
+}
+
+// envRecordingRunner records the environment of each script it is asked to
+// run, in the same order as scripts.
+type envRecordingRunner struct {
+	fakeRunner
+	envs []map[string]string
+}
+
+func (r *envRecordingRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	r.envs = append(r.envs, maps.Clone(env))
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestRunPipelinesEnvOverride(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{}
+	require.NoError(t, WithEnvOverride(map[string]string{"HTTP_PROXY": "http://proxy:3128", "NO_PROXY": "localhost"})(b))
+	require.NoError(t, WithEnvOverride(map[string]string{"NO_PROXY": "example.com"})(b))
+
+	runner := &envRecordingRunner{}
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: runner,
+		env:    b.EnvOverride,
+	}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Runs: "echo global"},
+		{Runs: "echo local", Environment: map[string]string{"HTTP_PROXY": "http://local:8080"}},
+	}))
+
+	require.Len(t, runner.envs, 2)
+	require.Equal(t, "http://proxy:3128", runner.envs[0]["HTTP_PROXY"])
+	require.Equal(t, "example.com", runner.envs[0]["NO_PROXY"])
+	require.NotEmpty(t, runner.envs[0]["PATH"])
+
+	// The environment of the step wins.
+	require.Equal(t, "http://local:8080", runner.envs[1]["HTTP_PROXY"])
+	require.Equal(t, "example.com", runner.envs[1]["NO_PROXY"])
+}
+
+// debugRecordingRunner records the commands it is asked to debug with, which
+// return successfully to continue the build.
+type debugRecordingRunner struct {
+	fakeRunner
+	debugged [][]string
+}
+
+func (r *debugRecordingRunner) Debug(_ context.Context, _ *container.Config, _ map[string]string, cmd ...string) error {
+	r.debugged = append(r.debugged, cmd)
+	return nil
+}
+
+func TestRunPipelinesDebugShell(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	for _, tc := range []struct {
+		name       string
+		debugShell []string
+		want       []string
+	}{
+		{name: "default", want: []string{"/bin/sh"}},
+		{name: "custom", debugShell: []string{"bash", "-l"}, want: []string{"bash", "-l"}},
+		// The fake runner fails to find the command, as it contains "fail".
+		{name: "missing", debugShell: []string{"failing-repl"}, want: []string{"/bin/sh"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &debugRecordingRunner{}
+			pr := &pipelineRunner{
+				interactive: true,
+				debugShell:  tc.debugShell,
+				config:      &container.Config{WorkspaceDir: t.TempDir()},
+				runner:      runner,
+			}
+			require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{{Runs: "fail build", WorkDir: "/home/build/src"}}))
+
+			require.Equal(t, [][]string{
+				append([]string{"/bin/sh", "-c", `cd /home/build/src && exec "$@"`, "sh"}, tc.want...),
+			}, runner.debugged)
+		})
+	}
+}
+
+// blockingRunner runs scripts until their context is cancelled, closing
+// started once the first one runs.
+type blockingRunner struct {
+	container.Runner
+	started chan struct{}
+}
+
+func (r *blockingRunner) Run(ctx context.Context, _ *container.Config, _ map[string]string, _ ...string) error {
+	close(r.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRunPipelinesInteractiveSIGTERM(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	runner := &blockingRunner{started: make(chan struct{})}
+	pr := &pipelineRunner{interactive: true, config: &container.Config{}, runner: runner}
+
+	done := make(chan error)
+	go func() {
+		done <- pr.runPipelines(ctx, []config.Pipeline{{Name: "compile", Runs: "make"}})
+	}()
+
+	// The step is run once its context handles the signal.
+	<-runner.started
+	self, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, self.Signal(syscall.SIGTERM))
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("SIGTERM did not cancel the step")
+	}
+}
+
+func TestRunPipelinesDebugOnFailure(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	runner := &debugRecordingRunner{}
+	pr := &pipelineRunner{
+		debugOnFailure: true,
+		config:         &container.Config{WorkspaceDir: t.TempDir()},
+		runner:         runner,
+	}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "configure", Runs: "echo configure"},
+		{Name: "compile", Runs: "fail compile", WorkDir: "/home/build/src"},
+		{Name: "install", Runs: "echo install"},
+	}))
+
+	// Only the failing step is debugged, and the build goes on past it.
+	require.Equal(t, [][]string{
+		{"/bin/sh", "-c", `cd /home/build/src && exec "$@"`, "sh", "/bin/sh"},
+	}, runner.debugged)
+	require.True(t, pr.debugged)
+	require.Equal(t, stepOutcome{ran: true, succeeded: true}, pr.outcomes["install"])
+
+	// Without it, the failure fails the build.
+	runner = &debugRecordingRunner{}
+	pr = &pipelineRunner{config: &container.Config{WorkspaceDir: t.TempDir()}, runner: runner}
+	require.ErrorContains(t, pr.runPipelines(ctx, []config.Pipeline{{Runs: "fail compile"}}), "script failed")
+	require.Empty(t, runner.debugged)
+}
+
+func TestRunPipelinesContinueOnError(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	runner := &debugRecordingRunner{}
+	pr := &pipelineRunner{
+		interactive: true,
+		config:      &container.Config{WorkspaceDir: t.TempDir()},
+		runner:      runner,
+	}
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{{
+		Name: "parent",
+		Pipeline: []config.Pipeline{
+			{Name: "cleanup", ContinueOnError: true, Runs: "fail cleanup"},
+			{Name: "report", If: "${{steps.cleanup.succeeded}} == 'false'", Runs: "echo report"},
+		},
+		Assertions: &config.PipelineAssertions{RequiredSteps: 2},
+	}}))
+
+	// The best-effort step is not debugged, and its failure is recorded.
+	require.Empty(t, runner.debugged)
+	require.Equal(t, stepOutcome{ran: true, succeeded: false, exitCode: -1}, pr.outcomes["cleanup"])
+	require.Equal(t, stepOutcome{ran: true, succeeded: true}, pr.outcomes["report"])
+
+	// Other steps still fail the run.
+	pr = &pipelineRunner{config: &container.Config{}, runner: &fakeRunner{}}
+	err := pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "compile", Pipeline: []config.Pipeline{{ContinueOnError: true, Runs: "fail child"}, {Runs: "fail compile"}}},
+	})
+	require.ErrorContains(t, err, "script failed")
+	require.Equal(t, stepOutcome{ran: true, succeeded: false, exitCode: 0}, pr.outcomes["compile"])
+}
+
+// recordingObserver records the steps it is notified of, as "start <id>" and
+// "finish <id> ran=<ran> err=<err>".
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnStart(_ context.Context, id string) {
+	o.events = append(o.events, "start "+id)
+}
+
+func (o *recordingObserver) OnFinish(_ context.Context, id string, ran bool, err error, dur time.Duration) {
+	if dur < 0 {
+		panic("negative duration")
+	}
+	o.events = append(o.events, fmt.Sprintf("finish %s ran=%t err=%v", id, ran, err))
+}
+
+func TestRunPipelinesStepObserver(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{}
+	observer := &recordingObserver{}
+	require.NoError(t, WithStepObserver(observer)(b))
+
+	pr := &pipelineRunner{
+		config:   &container.Config{},
+		runner:   &fakeRunner{},
+		observer: b.StepObserver,
+	}
+	err := pr.runPipelines(ctx, []config.Pipeline{
+		{
+			Name: "build",
+			Pipeline: []config.Pipeline{
+				{Name: "configure", Runs: "echo configure"},
+				{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+				{Uses: "autoconf/make", Pipeline: []config.Pipeline{{Runs: "make"}}},
+			},
+		},
+		{Name: "check", Runs: "fail check"},
+	})
+	require.Error(t, err)
+
+	require.Equal(t, []string{
+		"start build",
+		"start configure",
+		"finish configure ran=true err=<nil>",
+		"start docs",
+		"finish docs ran=false err=<nil>",
+		"start autoconf/make",
+		"start runs-d05aa2a1",
+		"finish runs-d05aa2a1 ran=true err=<nil>",
+		"finish autoconf/make ran=true err=<nil>",
+		"finish build ran=true err=<nil>",
+		"start check",
+		"finish check ran=false err=script failed",
+	}, observer.events)
+
+	// Without an observer, steps run as usual.
+	pr.observer = nil
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{{Name: "build", Runs: "echo build"}}))
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// pipelineCache memoizes the 'uses' pipelines read from the pipeline dirs
+// during a build, so that a pipeline used by many steps, e.g. split/dev in
+// every subpackage, is read once.  Each build has its own, so that changes to
+// the pipeline dirs are seen by the next build.  It is safe for concurrent
+// use.
+type pipelineCache struct {
+	mu    sync.Mutex
+	files map[pipelineCacheKey]*pipelineCacheEntry
+
+	// The number of files read, rather than served from the cache.
+	reads atomic.Int64
+}
+
+type pipelineCacheKey struct {
+	dir, uses string
+}
+
+type pipelineCacheEntry struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// readFile reads the 'uses' pipeline from dir, at most once for each dir and
+// pipeline, whether it is found or not.  A nil cache reads it every time.
+func (pc *pipelineCache) readFile(dir, uses string) ([]byte, error) {
+	path := filepath.Join(dir, uses+".yaml")
+	if pc == nil {
+		return os.ReadFile(path)
+	}
+
+	key := pipelineCacheKey{dir: dir, uses: uses}
+	pc.mu.Lock()
+	if pc.files == nil {
+		pc.files = map[pipelineCacheKey]*pipelineCacheEntry{}
+	}
+	e, ok := pc.files[key]
+	if !ok {
+		e = &pipelineCacheEntry{}
+		pc.files[key] = e
+	}
+	pc.mu.Unlock()
+
+	// Read outside of the lock, so that reading one pipeline does not block
+	// reading others.
+	e.once.Do(func() {
+		pc.reads.Add(1)
+		e.data, e.err = os.ReadFile(path)
+	})
+	return e.data, e.err
+}
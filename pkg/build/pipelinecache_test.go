@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePipeline writes a 'uses' pipeline to dir.
+func writePipeline(t testing.TB, dir, uses, content string) {
+	t.Helper()
+	path := filepath.Join(dir, uses+".yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestPipelineCache(t *testing.T) {
+	ctx := context.Background()
+
+	first, second := t.TempDir(), t.TempDir()
+	writePipeline(t, second, "shared/build", "runs: second")
+
+	c := &Compiled{PipelineDirs: []string{first, second}, cache: &pipelineCache{}}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.readPipeline(ctx, "shared/build")
+			assert.NoError(t, err)
+			assert.Equal(t, "runs: second", string(data))
+		}()
+	}
+	wg.Wait()
+
+	// The pipeline is missing from the first dir, and found in the second,
+	// each of which is read once.
+	require.EqualValues(t, 2, c.cache.reads.Load())
+
+	// Changes are only seen by another build.
+	writePipeline(t, first, "shared/build", "runs: first")
+	data, err := c.readPipeline(ctx, "shared/build")
+	require.NoError(t, err)
+	require.Equal(t, "runs: second", string(data))
+
+	c.cache = &pipelineCache{}
+	data, err = c.readPipeline(ctx, "shared/build")
+	require.NoError(t, err)
+	require.Equal(t, "runs: first", string(data))
+}
+
+func BenchmarkReadPipeline(b *testing.B) {
+	ctx := context.Background()
+
+	dir := b.TempDir()
+	writePipeline(b, dir, "shared/split", "runs: mv usr/include ${{targets.subpkgdir}}")
+
+	for _, tc := range []struct {
+		name  string
+		cache func() *pipelineCache
+	}{
+		{"uncached", func() *pipelineCache { return nil }},
+		{"cached", func() *pipelineCache { return &pipelineCache{} }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			reads := int64(0)
+			for range b.N {
+				// A build using the pipeline in 1000 steps.
+				c := &Compiled{PipelineDirs: []string{dir}, cache: tc.cache()}
+				for range 1000 {
+					if _, err := c.readPipeline(ctx, "shared/split"); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				if c.cache == nil {
+					reads += 1000
+				} else {
+					reads += c.cache.reads.Load()
+				}
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// PipelinesVersion returns the version of the set of pipelines embedded in
+// this melange, as "sha256:<hex>" of their names and contents. It changes
+// whenever an embedded pipeline is added, removed or modified, but not when
+// only their documentation does.
+func PipelinesVersion() string {
+	return pipelinesVersion()
+}
+
+var pipelinesVersion = sync.OnceValue(func() string {
+	h := sha256.New()
+	// WalkDir visits files in lexical order, so the hash is stable.
+	if err := fs.WalkDir(f, "pipelines", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(p) != ".yaml" {
+			return err
+		}
+		data, err := fs.ReadFile(f, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d\n", strings.TrimPrefix(p, "pipelines/"), len(data))
+		h.Write(data)
+		return nil
+	}); err != nil {
+		// The pipelines are embedded at compile time, so this cannot happen.
+		panic(fmt.Sprintf("hashing embedded pipelines: %v", err))
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+})
+
+// checkPipelinesVersion fails if the package requires a version of the
+// embedded pipelines other than the one in this melange.
+func checkPipelinesVersion(pkg config.Package) error {
+	if pkg.PipelinesVersion == "" || pkg.PipelinesVersion == PipelinesVersion() {
+		return nil
+	}
+	return fmt.Errorf("package %s requires embedded pipelines %s, but this melange embeds %s", pkg.Name, pkg.PipelinesVersion, PipelinesVersion())
+}
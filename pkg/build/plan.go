@@ -0,0 +1,216 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// PlanVersion is the version of the format of Plan. It changes whenever a
+// field is renamed or removed, or changes meaning, but not when a field is
+// added.
+const PlanVersion = 1
+
+// The formats a Plan can be written in.
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+	PlanFormatYAML = "yaml"
+)
+
+// PlanFormats lists the formats a Plan can be written in.
+var PlanFormats = []string{PlanFormatText, PlanFormatJSON, PlanFormatYAML}
+
+// A Plan is the execution plan of a build: the steps it would run, once
+// compiled, with their conditions and resolved commands.
+type Plan struct {
+	Version     int              `json:"version" yaml:"version"`
+	Package     PlanPackage      `json:"package" yaml:"package"`
+	Pipeline    []PlanStep       `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Subpackages []PlanSubpackage `json:"subpackages,omitempty" yaml:"subpackages,omitempty"`
+	Test        []PlanStep       `json:"test,omitempty" yaml:"test,omitempty"`
+}
+
+type PlanPackage struct {
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+	Arch    string `json:"arch" yaml:"arch"`
+}
+
+type PlanSubpackage struct {
+	Name     string     `json:"name" yaml:"name"`
+	If       string     `json:"if,omitempty" yaml:"if,omitempty"`
+	Pipeline []PlanStep `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Test     []PlanStep `json:"test,omitempty" yaml:"test,omitempty"`
+}
+
+type PlanStep struct {
+	Name        string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Uses        string            `json:"uses,omitempty" yaml:"uses,omitempty"`
+	If          string            `json:"if,omitempty" yaml:"if,omitempty"`
+	WorkDir     string            `json:"working-directory,omitempty" yaml:"working-directory,omitempty"`
+	Environment map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Runs        string            `json:"runs,omitempty" yaml:"runs,omitempty"`
+	Pipeline    []PlanStep        `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Post        string            `json:"post,omitempty" yaml:"post,omitempty"`
+}
+
+// Plan compiles the build configuration and returns the resulting execution
+// plan, without running anything.
+func (b *Build) Plan(ctx context.Context) (*Plan, error) {
+	if err := b.Compile(ctx); err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", b.Configuration.Package.Name, err)
+	}
+
+	cfg := &b.Configuration
+	plan := &Plan{
+		Version: PlanVersion,
+		Package: PlanPackage{
+			Name:    cfg.Package.Name,
+			Version: cfg.Package.FullVersion(),
+			Arch:    b.Arch.ToAPK(),
+		},
+		Pipeline: planSteps(cfg.Pipeline),
+	}
+	if cfg.Test != nil {
+		plan.Test = planSteps(cfg.Test.Pipeline)
+	}
+
+	for _, sp := range cfg.Subpackages {
+		psp := PlanSubpackage{
+			Name:     sp.Name,
+			If:       sp.If,
+			Pipeline: planSteps(sp.Pipeline),
+		}
+		if sp.Test != nil {
+			psp.Test = planSteps(sp.Test.Pipeline)
+		}
+		plan.Subpackages = append(plan.Subpackages, psp)
+	}
+
+	return plan, nil
+}
+
+func planSteps(pipelines []config.Pipeline) []PlanStep {
+	var steps []PlanStep
+	for _, p := range pipelines {
+		steps = append(steps, PlanStep{
+			Name:        p.Name,
+			Uses:        p.Uses,
+			If:          p.If,
+			WorkDir:     p.WorkDir,
+			Environment: p.Environment,
+			Runs:        p.Runs,
+			Pipeline:    planSteps(p.Pipeline),
+			Post:        p.Post,
+		})
+	}
+	return steps
+}
+
+// Write writes the plan to w in the given format, one of PlanFormats.
+func (p *Plan) Write(w io.Writer, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+
+	case PlanFormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	case PlanFormatText:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s %s (%s)\n", p.Package.Name, p.Package.Version, p.Package.Arch)
+		writeTextSteps(&sb, "pipeline", p.Pipeline, "")
+		writeTextSteps(&sb, "test", p.Test, "")
+		for _, sp := range p.Subpackages {
+			fmt.Fprintf(&sb, "subpackage %s\n", sp.Name)
+			if sp.If != "" {
+				fmt.Fprintf(&sb, "  if: %s\n", sp.If)
+			}
+			writeTextSteps(&sb, "pipeline", sp.Pipeline, "  ")
+			writeTextSteps(&sb, "test", sp.Test, "  ")
+		}
+		_, err := io.WriteString(w, sb.String())
+		return err
+
+	default:
+		return fmt.Errorf("unknown plan format %q, expected one of %s", format, strings.Join(PlanFormats, ", "))
+	}
+}
+
+// writeTextSteps writes steps as an indented, human readable list.
+func writeTextSteps(sb *strings.Builder, title string, steps []PlanStep, indent string) {
+	if len(steps) == 0 {
+		return
+	}
+
+	fmt.Fprintf(sb, "%s%s:\n", indent, title)
+	for _, s := range steps {
+		fmt.Fprintf(sb, "%s- step %s\n", indent, stepLabel(s))
+		if s.If != "" {
+			fmt.Fprintf(sb, "%s    if: %s\n", indent, s.If)
+		}
+		if s.WorkDir != "" {
+			fmt.Fprintf(sb, "%s    working-directory: %s\n", indent, s.WorkDir)
+		}
+		for _, k := range slices.Sorted(maps.Keys(s.Environment)) {
+			fmt.Fprintf(sb, "%s    env %s=%s\n", indent, k, s.Environment[k])
+		}
+		if runs := strings.TrimRight(s.Runs, "\n"); runs != "" {
+			fmt.Fprintf(sb, "%s    runs:\n", indent)
+			for _, line := range strings.Split(runs, "\n") {
+				fmt.Fprintf(sb, "%s      %s\n", indent, line)
+			}
+		}
+		writeTextSteps(sb, "pipeline", s.Pipeline, indent+"    ")
+		if post := strings.TrimRight(s.Post, "\n"); post != "" {
+			fmt.Fprintf(sb, "%s    post:\n", indent)
+			for _, line := range strings.Split(post, "\n") {
+				fmt.Fprintf(sb, "%s      %s\n", indent, line)
+			}
+		}
+	}
+}
+
+// stepLabel describes a step by its name and the pipeline it uses.
+func stepLabel(s PlanStep) string {
+	switch {
+	case s.Name != "" && s.Uses != "":
+		return fmt.Sprintf("%q (uses %s)", s.Name, s.Uses)
+	case s.Name != "":
+		return fmt.Sprintf("%q", s.Name)
+	case s.Uses != "":
+		return fmt.Sprintf("(uses %s)", s.Uses)
+	default:
+		return "(unnamed)"
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestPlan(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "greet.yaml"), []byte(`
+inputs:
+  who:
+    default: world
+pipeline:
+  - runs: echo hello ${{inputs.who}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(dir, "plan.yaml")
+	if err := os.WriteFile(cfgFile, []byte(`
+package:
+  name: plan
+  version: 1.0.0
+  epoch: 2
+
+pipeline:
+  - name: build
+    runs: |
+      make
+      make install DESTDIR=${{targets.destdir}}
+  - name: greet
+    uses: greet
+    with:
+      who: ${{package.name}}
+    if: ${{build.arch}} == 'x86_64'
+    environment:
+      B: "2"
+      A: "1"
+
+subpackages:
+  - name: plan-doc
+    pipeline:
+      - runs: mv docs ${{targets.subpkgdir}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Build{
+		ConfigFile:   cfgFile,
+		PipelineDirs: []string{dir},
+		Arch:         apko_types.ParseArchitecture("x86_64"),
+	}
+	cfg, err := b.parseConfiguration(ctx)
+	require.NoError(t, err)
+	b.Configuration = *cfg
+
+	plan, err := b.Plan(ctx)
+	require.NoError(t, err)
+
+	var text bytes.Buffer
+	require.NoError(t, plan.Write(&text, PlanFormatText))
+	require.Equal(t, `plan 1.0.0-r2 (x86_64)
+pipeline:
+- step "build"
+    runs:
+      make
+      make install DESTDIR=/home/build/melange-out/plan
+- step "greet" (uses greet)
+    if: "x86_64" == 'x86_64'
+    env A=1
+    env B=2
+    pipeline:
+    - step (unnamed)
+        runs:
+          echo hello plan
+subpackage plan-doc
+  pipeline:
+  - step (unnamed)
+      runs:
+        mv docs /home/build/melange-out/plan-doc
+`, text.String())
+
+	// The structured formats are stable, and round trip.
+	for format, unmarshal := range map[string]func([]byte, any) error{
+		PlanFormatJSON: json.Unmarshal,
+		PlanFormatYAML: yaml.Unmarshal,
+	} {
+		var first, second bytes.Buffer
+		require.NoError(t, plan.Write(&first, format))
+		require.NoError(t, plan.Write(&second, format))
+		require.Equal(t, first.String(), second.String())
+
+		var got Plan
+		require.NoError(t, unmarshal(first.Bytes(), &got), format)
+		require.Equal(t, *plan, got, format)
+		require.Equal(t, PlanVersion, got.Version)
+	}
+
+	require.ErrorContains(t, plan.Write(&text, "xml"), `unknown plan format "xml"`)
+}
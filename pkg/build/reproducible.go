@@ -0,0 +1,177 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// enforceReproducible turns on the checks of a package declared reproducible:
+// packaged files are scanned for build path references, and the pipelines get
+// the scrubbed environment.  It returns an error if the build has no build
+// date, so that the timestamps of the packages would be those of the epoch
+// rather than of the source, or is set up so that VerifyReproducible could not
+// compare it to a second build.
+func (b *Build) enforceReproducible() error {
+	b.CheckBuildPath = true
+	b.ScrubEnvironment = true
+
+	var errs []error
+	if !b.buildDateSet && os.Getenv("SOURCE_DATE_EPOCH") == "" {
+		errs = append(errs, errors.New("it needs a build date, set SOURCE_DATE_EPOCH or --build-date"))
+	}
+	if b.KeepGoing {
+		errs = append(errs, errors.New("it cannot keep going past failed pipelines"))
+	}
+	if b.ResumeFrom != 0 {
+		errs = append(errs, errors.New("it cannot be resumed from a checkpoint"))
+	}
+	if a, ok := b.Runner.(container.Attacher); ok && a.Attached() {
+		errs = append(errs, errors.New("it cannot be built in an existing container"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("package %s is declared reproducible: %w", b.Configuration.Package.Name, err)
+	}
+
+	return nil
+}
+
+// VerifyReproducible builds the package of first, which must have been built
+// already, a second time and compares the packages emitted by both builds.
+// The second build is set up with opts, which should be the options of the
+// first build, but uses its own output, workspace and guest directories.
+// An error is returned if any of the packages differ.
+func VerifyReproducible(ctx context.Context, first *Build, opts ...Option) error {
+	log := clog.FromContext(ctx)
+
+	outDir, err := os.MkdirTemp("", "melange-rebuild-*")
+	if err != nil {
+		return fmt.Errorf("creating output directory for the second build: %w", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	second, err := New(ctx, secondBuildOptions(first, outDir, opts)...)
+	if err != nil {
+		return fmt.Errorf("setting up the second build: %w", err)
+	}
+	defer second.Close(ctx)
+
+	log.Infof("building %s a second time to verify it is reproducible", first.Configuration.Package.Name)
+	if err := second.BuildPackage(ctx); err != nil {
+		return fmt.Errorf("second build: %w", err)
+	}
+
+	return comparePackageFiles(first.packageFiles(), second.packageFiles())
+}
+
+// secondBuildOptions returns opts, the options of first, followed by those
+// making the second build of VerifyReproducible its own: it emits to outDir,
+// builds from scratch in a fresh workspace, rather than resuming the first
+// from a checkpoint, and leaves the files the first wrote alone.
+func secondBuildOptions(first *Build, outDir string, opts []Option) []Option {
+	return append(slices.Clone(opts),
+		WithArch(first.Arch),
+		WithOutDir(outDir),
+		WithWorkspaceDir(""),
+		WithGuestDir(""),
+		WithGenerateIndex(false),
+		WithCreateBuildLog(false),
+		WithContentAddressableDir(""),
+		WithGoldenSBOMDir(""),
+		WithNetworkReport(""),
+		WithMetricsFile(""),
+		WithDiagnosticsFile(""),
+		WithTraceFile(""),
+		WithSalvageDir(""),
+		WithPrintSubstitutions(nil),
+		WithCheckpointFile(""),
+		WithResumeFrom(0),
+		WithStepLogDir(""),
+	)
+}
+
+// comparePackageFiles compares the packages at the corresponding paths of
+// want and got, and returns an error naming those which differ.
+func comparePackageFiles(want, got []string) error {
+	if len(want) != len(got) {
+		return fmt.Errorf("builds emitted %d and %d packages", len(want), len(got))
+	}
+
+	var differ []string
+	for i := range want {
+		same, err := sameContents(want[i], got[i])
+		if err != nil {
+			return err
+		}
+		if !same {
+			differ = append(differ, filepath.Base(want[i]))
+		}
+	}
+
+	if len(differ) != 0 {
+		return fmt.Errorf("package is not reproducible, builds differ in: %s", strings.Join(differ, ", "))
+	}
+
+	return nil
+}
+
+// sameContents reports whether the files at a and b have the same contents,
+// or both don't exist.
+func sameContents(a, b string) (bool, error) {
+	sa, erra := fileDigest(a)
+	sb, errb := fileDigest(b)
+
+	switch {
+	case errors.Is(erra, fs.ErrNotExist) && errors.Is(errb, fs.ErrNotExist):
+		return true, nil
+	case errors.Is(erra, fs.ErrNotExist) || errors.Is(errb, fs.ErrNotExist):
+		return false, nil
+	case erra != nil:
+		return false, erra
+	case errb != nil:
+		return false, errb
+	}
+
+	return bytes.Equal(sa, sb), nil
+}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestComparePackageFiles(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+
+	write := func(dir, name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	want := []string{
+		write(first, "foo-1.0.0-r0.apk", "foo"),
+		write(first, "foo-dev-1.0.0-r0.apk", "foo-dev"),
+		filepath.Join(first, "foo-doc-1.0.0-r0.apk"),
+	}
+	got := []string{
+		write(second, "foo-1.0.0-r0.apk", "foo"),
+		write(second, "foo-dev-1.0.0-r0.apk", "foo-dev"),
+		filepath.Join(second, "foo-doc-1.0.0-r0.apk"),
+	}
+	require.NoError(t, comparePackageFiles(want, got))
+
+	write(second, "foo-dev-1.0.0-r0.apk", "foo-dev, built at another time")
+	write(second, "foo-doc-1.0.0-r0.apk", "foo-doc")
+	require.EqualError(t, comparePackageFiles(want, got),
+		"package is not reproducible, builds differ in: foo-dev-1.0.0-r0.apk, foo-doc-1.0.0-r0.apk")
+}
+
+func TestSecondBuildOptions(t *testing.T) {
+	first := &Build{Arch: apko_types.ParseArchitecture("x86_64")}
+	opts := []Option{
+		WithCheckpointFile("checkpoint.json"),
+		WithResumeFrom(3),
+		WithStepLogDir("steps"),
+		WithOutDir("packages"),
+	}
+
+	// The second build runs every pipeline, in a fresh workspace, and does
+	// not overwrite the checkpoint or step logs of the first.
+	var second Build
+	for _, opt := range secondBuildOptions(first, "rebuild", opts) {
+		require.NoError(t, opt(&second))
+	}
+	require.Empty(t, second.CheckpointFile)
+	require.Zero(t, second.ResumeFrom)
+	require.Empty(t, second.StepLogDir)
+	require.Equal(t, "rebuild", second.OutDir)
+	require.Empty(t, second.WorkspaceDir)
+
+	// The options of the first build are left as they are.
+	require.Len(t, opts, 4)
+}
+
+// attachedRunner is a Runner running the pipelines in an existing container.
+type attachedRunner struct{ fakeRunner }
+
+func (attachedRunner) Attached() bool { return true }
+
+func TestEnforceReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+
+	newBuild := func(opts ...Option) *Build {
+		b := &Build{Configuration: config.Configuration{Package: config.Package{Name: "hello", Reproducible: true}}}
+		for _, opt := range opts {
+			require.NoError(t, opt(b))
+		}
+		return b
+	}
+
+	// The checks of reproducible packages are turned on.
+	b := newBuild(WithBuildDate("2024-01-02T03:04:05Z"))
+	require.NoError(t, b.enforceReproducible())
+	require.True(t, b.CheckBuildPath)
+	require.True(t, b.ScrubEnvironment)
+
+	// The build date may come from the environment instead.
+	t.Setenv("SOURCE_DATE_EPOCH", "1704164645")
+	require.NoError(t, newBuild(WithBuildDate("")).enforceReproducible())
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{{
+		name: "no build date",
+		opts: []Option{WithBuildDate("")},
+		want: "package hello is declared reproducible: it needs a build date, set SOURCE_DATE_EPOCH or --build-date",
+	}, {
+		name: "keep going",
+		opts: []Option{WithBuildDate("2024-01-02T03:04:05Z"), WithKeepGoing(true)},
+		want: "package hello is declared reproducible: it cannot keep going past failed pipelines",
+	}, {
+		name: "resumed",
+		opts: []Option{WithBuildDate("2024-01-02T03:04:05Z"), WithCheckpointFile("checkpoint.json"), WithResumeFrom(2)},
+		want: "package hello is declared reproducible: it cannot be resumed from a checkpoint",
+	}, {
+		name: "attached",
+		opts: []Option{WithBuildDate("2024-01-02T03:04:05Z"), WithRunner(&attachedRunner{})},
+		want: "package hello is declared reproducible: it cannot be built in an existing container",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.EqualError(t, newBuild(tc.opts...).enforceReproducible(), tc.want)
+		})
+	}
+}
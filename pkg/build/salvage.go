@@ -0,0 +1,49 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog"
+)
+
+// salvage copies the output dir of the build environment of a build whose
+// pipelines failed to the salvage dir, if any, in a directory named after the
+// architecture, before the environment is torn down.  Failing to is only
+// logged, so as not to hide why the build failed.
+func (b *Build) salvage(ctx context.Context, cfg *container.Config) {
+	if b.SalvageDir == "" {
+		return
+	}
+	log := clog.FromContext(ctx)
+
+	copier, ok := b.Runner.(container.OutCopier)
+	if !ok {
+		log.Warnf("not salvaging the output of the failed build: the %s runner cannot copy files out", b.Runner.Name())
+		return
+	}
+
+	src := path.Join(WorkDir, melangeOutputDirName)
+	dst := filepath.Join(b.SalvageDir, b.Arch.ToAPK())
+	if err := copier.CopyOut(context.WithoutCancel(ctx), cfg, src, dst); err != nil {
+		log.Warnf("unable to salvage the output of the failed build: %v", err)
+		return
+	}
+	log.Infof("salvaged %s of the failed build to %s", src, dst)
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+// copyingRunner records the directories it is asked to copy out, as
+// "<src> -> <dst>".
+type copyingRunner struct {
+	fakeRunner
+	copied []string
+}
+
+func (r *copyingRunner) CopyOut(_ context.Context, _ *container.Config, src, dst string) error {
+	r.copied = append(r.copied, src+" -> "+dst)
+	return nil
+}
+
+func TestSalvage(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	dir := t.TempDir()
+	runner := &copyingRunner{}
+	b := &Build{Arch: apko_types.ParseArchitecture("aarch64"), Runner: runner}
+	require.NoError(t, WithSalvageDir(dir)(b))
+
+	cfg := &container.Config{}
+	pr := &pipelineRunner{config: cfg, runner: runner}
+	err := pr.runPipelines(ctx, []config.Pipeline{{Name: "compile", Runs: "fail compile"}})
+	require.Error(t, err)
+	b.salvage(ctx, cfg)
+	require.Equal(t, []string{"/home/build/melange-out -> " + filepath.Join(dir, "aarch64")}, runner.copied)
+
+	// Without a salvage dir, nothing is copied.
+	runner.copied = nil
+	b.SalvageDir = ""
+	b.salvage(ctx, cfg)
+	require.Empty(t, runner.copied)
+
+	// Runners which cannot copy files out are skipped.
+	b = &Build{Arch: apko_types.ParseArchitecture("aarch64"), Runner: &fakeRunner{}, SalvageDir: dir}
+	b.salvage(ctx, cfg)
+}
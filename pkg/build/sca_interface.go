@@ -16,7 +16,6 @@ package build
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/sca"
@@ -54,7 +53,7 @@ func (scabi *SCABuildInterface) Version() string {
 // FilesystemForRelative implements an abstract filesystem for any of the packages being
 // built.
 func (scabi *SCABuildInterface) FilesystemForRelative(pkgName string) (sca.SCAFS, error) {
-	pkgDir := filepath.Join(scabi.PackageBuild.Build.WorkspaceDir, melangeOutputDirName, pkgName)
+	pkgDir := scabi.PackageBuild.Build.packageDir(pkgName)
 	rlFS := readlinkFS(pkgDir)
 	scaFS, ok := rlFS.(sca.SCAFS)
 	if !ok {
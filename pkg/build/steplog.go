@@ -0,0 +1,119 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/clog"
+)
+
+// stepLogName returns the name of the log file of a step with the given
+// identity, without the characters which are not safe in a file name.
+func stepLogName(id string) string {
+	if id == config.UnidentifiablePipeline {
+		return "step"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+}
+
+// createStepLog creates the log file of the step in the step log dir.  Steps
+// sharing an identity, such as two uses of the same pipeline, are told apart
+// by a suffix counting them.
+func (r *pipelineRunner) createStepLog(pipeline *config.Pipeline) (*os.File, error) {
+	name := stepLogName(pipeline.Identity())
+	if r.stepLogs == nil {
+		r.stepLogs = map[string]int{}
+	}
+	r.stepLogs[name]++
+	if n := r.stepLogs[name]; n > 1 {
+		name = fmt.Sprintf("%s-%d", name, n)
+	}
+
+	if err := os.MkdirAll(r.stepLogDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating step log dir: %w", err)
+	}
+	f, err := os.Create(filepath.Join(r.stepLogDir, name+".log"))
+	if err != nil {
+		return nil, fmt.Errorf("creating log of step %q: %w", pipeline.Identity(), err)
+	}
+	return f, nil
+}
+
+// stepLog is the log file of a step, which the runner writes its standard
+// output and error to concurrently.
+type stepLog struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets []string
+}
+
+func (l *stepLog) add(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.w, redact(line, l.secrets))
+}
+
+// stepLogHandler writes the messages a runner logs, which are the lines of
+// output of what it runs, to the log of the step, whether or not they are
+// logged.
+type stepLogHandler struct {
+	slog.Handler
+	log *stepLog
+}
+
+func (h *stepLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.Handler.Enabled(ctx, level)
+}
+
+func (h *stepLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		h.log.add(r.Message)
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *stepLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stepLogHandler{Handler: h.Handler.WithAttrs(attrs), log: h.log}
+}
+
+func (h *stepLogHandler) WithGroup(name string) slog.Handler {
+	return &stepLogHandler{Handler: h.Handler.WithGroup(name), log: h.log}
+}
+
+// withStepLog returns a context whose logger also writes the lines logged
+// to w, with the secrets redacted.
+func withStepLog(ctx context.Context, w io.Writer, secrets []string) context.Context {
+	h := clog.FromContext(ctx).Handler()
+	return clog.WithLogger(ctx, clog.New(&stepLogHandler{Handler: h, log: &stepLog{w: w, secrets: secrets}}))
+}
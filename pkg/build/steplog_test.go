@@ -0,0 +1,91 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+// echoRunner logs the line of each script following "echo " as its standard
+// output, and a warning as its standard error, as runners log the output of
+// what they run.
+type echoRunner struct {
+	fakeRunner
+}
+
+func (r *echoRunner) Run(ctx context.Context, cfg *container.Config, env map[string]string, cmd ...string) error {
+	log := clog.FromContext(ctx)
+	for _, line := range strings.Split(cmd[len(cmd)-1], "\n") {
+		if out, ok := strings.CutPrefix(line, "echo "); ok {
+			log.Info(out)
+		}
+	}
+	log.Warn("warning")
+	return r.fakeRunner.Run(ctx, cfg, env, cmd...)
+}
+
+func TestStepLogDir(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dir := filepath.Join(t.TempDir(), "logs")
+
+	pr := &pipelineRunner{
+		config:     &container.Config{},
+		runner:     &echoRunner{},
+		secrets:    []string{"hunter2"},
+		stepLogDir: dir,
+	}
+	p := &config.Pipeline{
+		Name: "parent",
+		Pipeline: []config.Pipeline{
+			{Name: "configure", Runs: "echo configuring"},
+			{Name: "make install", Runs: "echo installing with hunter2"},
+			{Uses: "go/build", Runs: "echo building"},
+			{Uses: "go/build", Runs: "echo building again"},
+		},
+	}
+
+	_, err := pr.runPipeline(ctx, p)
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// The parent runs no script of its own, so it has no log.
+	require.ElementsMatch(t, []string{"configure.log", "make_install.log", "go_build.log", "go_build-2.log"}, names)
+
+	for name, want := range map[string]string{
+		"configure.log":    "configuring\nwarning\n",
+		"make_install.log": "installing with " + redactedInput + "\nwarning\n",
+		"go_build.log":     "building\nwarning\n",
+		"go_build-2.log":   "building again\nwarning\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, want, string(got), name)
+	}
+}
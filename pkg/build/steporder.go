@@ -0,0 +1,97 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// orderSteps orders sibling steps so that each one runs after the steps named
+// in its needs.steps.  Otherwise, steps keep their order in the list.
+func orderSteps(steps []config.Pipeline) ([]config.Pipeline, error) {
+	// The number of steps with each name, which must all run first.
+	pending := map[string]int{}
+	hasNeeds := false
+	for _, s := range steps {
+		if s.Name != "" {
+			pending[s.Name]++
+		}
+		if s.Needs != nil && len(s.Needs.Steps) != 0 {
+			hasNeeds = true
+		}
+	}
+	if !hasNeeds {
+		return steps, nil
+	}
+
+	for _, s := range steps {
+		for _, need := range stepNeeds(s) {
+			if _, ok := pending[need]; !ok {
+				return nil, fmt.Errorf("step %q needs step %q, which is not one of its siblings", s.Identity(), need)
+			}
+		}
+	}
+
+	ordered := make([]config.Pipeline, 0, len(steps))
+	remaining := slices.Clone(steps)
+	for len(remaining) != 0 {
+		i := slices.IndexFunc(remaining, func(s config.Pipeline) bool {
+			return !slices.ContainsFunc(stepNeeds(s), func(need string) bool {
+				return pending[need] != 0
+			})
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("steps need each other in a cycle: %s", stepCycle(remaining, pending))
+		}
+
+		s := remaining[i]
+		ordered = append(ordered, s)
+		remaining = slices.Delete(remaining, i, i+1)
+		if s.Name != "" {
+			pending[s.Name]--
+		}
+	}
+
+	return ordered, nil
+}
+
+// stepCycle describes a cycle among the remaining steps, each of which needs
+// another one of them, by following their needs until a step repeats.
+func stepCycle(remaining []config.Pipeline, pending map[string]int) string {
+	seen := map[int]int{}
+	path := []string{}
+	for i := 0; ; {
+		if start, ok := seen[i]; ok {
+			return strings.Join(append(path[start:], path[start]), " -> ")
+		}
+		seen[i] = len(path)
+		path = append(path, fmt.Sprintf("%q", remaining[i].Identity()))
+
+		needs := stepNeeds(remaining[i])
+		need := needs[slices.IndexFunc(needs, func(need string) bool { return pending[need] != 0 })]
+		i = slices.IndexFunc(remaining, func(s config.Pipeline) bool { return s.Name == need })
+	}
+}
+
+func stepNeeds(s config.Pipeline) []string {
+	if s.Needs == nil {
+		return nil
+	}
+	return s.Needs.Steps
+}
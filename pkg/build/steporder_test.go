@@ -0,0 +1,110 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+func TestOrderSteps(t *testing.T) {
+	step := func(name string, needs ...string) config.Pipeline {
+		p := config.Pipeline{Name: name, Runs: "echo " + name}
+		if len(needs) != 0 {
+			p.Needs = &config.Needs{Steps: needs}
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		name    string
+		steps   []config.Pipeline
+		want    string
+		wantErr string
+	}{{
+		name:  "no needs",
+		steps: []config.Pipeline{step("a"), step("b"), step("c")},
+		want:  "a b c",
+	}, {
+		name:  "reordered",
+		steps: []config.Pipeline{step("install", "build"), step("build", "configure"), step("configure"), step("lint")},
+		want:  "configure build install lint",
+	}, {
+		name:  "stable",
+		steps: []config.Pipeline{step("c", "a"), step("b"), step("a"), step("d", "b")},
+		want:  "b a c d",
+	}, {
+		name:  "all steps of a name",
+		steps: []config.Pipeline{step("report", "test"), step("test"), step("test")},
+		want:  "test test report",
+	}, {
+		name:    "unknown",
+		steps:   []config.Pipeline{step("a", "typo"), step("b")},
+		wantErr: `step "a" needs step "typo", which is not one of its siblings`,
+	}, {
+		name:    "cycle",
+		steps:   []config.Pipeline{step("x", "a"), step("a", "b"), step("b", "c"), step("c", "a")},
+		wantErr: `steps need each other in a cycle: "a" -> "b" -> "c" -> "a"`,
+	}, {
+		name:    "self",
+		steps:   []config.Pipeline{step("a", "a")},
+		wantErr: `steps need each other in a cycle: "a" -> "a"`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := orderSteps(tc.steps)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for _, s := range got {
+				names = append(names, s.Name)
+			}
+			require.Equal(t, tc.want, strings.Join(names, " "))
+		})
+	}
+}
+
+func TestRunPipelineStepNeeds(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	r := &fakeRunner{}
+	pr := &pipelineRunner{config: &container.Config{}, runner: r}
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		Pipeline: []config.Pipeline{
+			{Name: "install", Runs: "echo install", Needs: &config.Needs{Steps: []string{"build"}}},
+			{Name: "build", Runs: "echo build"},
+		},
+	})
+	require.NoError(t, err)
+
+	ran := strings.Join(r.scripts, "\n")
+	require.Less(t, strings.Index(ran, "echo build"), strings.Index(ran, "echo install"))
+
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{
+		{Name: "second", Runs: "echo second", Needs: &config.Needs{Steps: []string{"first"}}},
+		{Name: "first", Runs: "echo first"},
+	}))
+	ran = strings.Join(r.scripts, "\n")
+	require.Less(t, strings.Index(ran, "echo first"), strings.Index(ran, "echo second"))
+}
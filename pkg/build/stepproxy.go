@@ -0,0 +1,315 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// allowsHost reports whether host matches one of the patterns of an
+// proxy-allow-hosts list. A pattern is either a host name, which must match
+// exactly, or a host name prefixed with "*.", which matches its subdomains.
+func allowsHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		pattern = strings.ToLower(pattern)
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			return strings.HasSuffix(host, "."+domain)
+		}
+		return host == pattern
+	})
+}
+
+// stepProxy is the HTTP proxy the proxy environment variables of a step are
+// routed to.  It only forwards the requests of the hosts it allows, through
+// the upstream proxy, if any, and records the hosts it refused to forward.
+//
+// Routing through it is best effort: only clients which honor the proxy
+// environment variables do, so it restricts nothing.  Other connections,
+// e.g. over SSH or raw sockets, never reach it.
+type stepProxy struct {
+	allow func(host string) bool
+	// Returns the proxy to connect to the URL through, or nil to connect
+	// directly.
+	upstream func(*url.URL) (*url.URL, error)
+	// If set, called with every connection a client asks for, whether it is
+	// allowed or not.
+	onConnect func(host, port string, allowed bool)
+	// The identity of the step the proxy is for.
+	step string
+
+	listener net.Listener
+	server   *http.Server
+	client   *http.Transport
+
+	mu      sync.Mutex
+	refused []string
+}
+
+// startStepProxy starts a stepProxy listening on the loopback interface,
+// connecting through upstream, if set.
+func startStepProxy(allow func(host string) bool, onConnect func(host, port string, allowed bool), upstream func(*url.URL) (*url.URL, error)) (*stepProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting step proxy: %w", err)
+	}
+
+	if upstream == nil {
+		upstream = func(*url.URL) (*url.URL, error) { return nil, nil }
+	}
+	p := &stepProxy{
+		allow:     allow,
+		upstream:  upstream,
+		onConnect: onConnect,
+		listener:  l,
+		client: &http.Transport{Proxy: func(req *http.Request) (*url.URL, error) {
+			return upstream(req.URL)
+		}},
+	}
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go p.server.Serve(l) //nolint:errcheck
+
+	return p, nil
+}
+
+// upstreamProxy returns the function choosing the proxy to connect to a URL
+// through, from the proxy environment variables of env, or else of the host,
+// as a client honoring them would.
+func upstreamProxy(env map[string]string) func(*url.URL) (*url.URL, error) {
+	get := func(names ...string) string {
+		for _, name := range names {
+			if v, ok := env[name]; ok {
+				return v
+			}
+		}
+		for _, name := range names {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	cfg := &httpproxy.Config{
+		HTTPProxy:  get("HTTP_PROXY", "http_proxy"),
+		HTTPSProxy: get("HTTPS_PROXY", "https_proxy"),
+		NoProxy:    get("NO_PROXY", "no_proxy"),
+	}
+	return cfg.ProxyFunc()
+}
+
+// env returns the environment variables directing clients to the proxy.  They
+// replace those directing them to another proxy, which the proxy connects
+// through instead, see upstreamProxy.
+func (p *stepProxy) env() map[string]string {
+	u := "http://" + p.listener.Addr().String()
+	return map[string]string{
+		"http_proxy":  u,
+		"https_proxy": u,
+		"HTTP_PROXY":  u,
+		"HTTPS_PROXY": u,
+		"no_proxy":    "",
+		"NO_PROXY":    "",
+	}
+}
+
+// Refused returns the hosts the proxy refused to connect to, in the order
+// they were first refused.
+func (p *stepProxy) Refused() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.refused)
+}
+
+func (p *stepProxy) Close() error {
+	p.client.CloseIdleConnections()
+	return p.server.Close()
+}
+
+func (p *stepProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if req.Method == http.MethodConnect {
+		host, port, _ = net.SplitHostPort(req.Host)
+	} else if port == "" && req.URL.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+
+	allowed := p.allow(host)
+	if p.onConnect != nil {
+		p.onConnect(host, port, allowed)
+	}
+
+	if !allowed {
+		p.mu.Lock()
+		if !slices.Contains(p.refused, host) {
+			p.refused = append(p.refused, host)
+		}
+		p.mu.Unlock()
+
+		http.Error(w, fmt.Sprintf("melange: %s is not in the proxy-allow-hosts of this step", host), http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		p.tunnel(w, req)
+		return
+	}
+
+	if !req.URL.IsAbs() {
+		http.Error(w, "melange: not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+
+	resp, err := p.client.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body) //nolint:errcheck
+}
+
+// tunnel connects the client to the host of a CONNECT request, as used for
+// HTTPS.
+func (p *stepProxy) tunnel(w http.ResponseWriter, req *http.Request) {
+	upstream, err := p.dialTunnel(req.Context(), req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "melange: unable to tunnel", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Anything the client sent after the CONNECT request is buffered.
+		io.Copy(upstream, buf) //nolint:errcheck
+		cancel()
+	}()
+	go func() {
+		io.Copy(conn, upstream) //nolint:errcheck
+		cancel()
+	}()
+	<-ctx.Done()
+}
+
+// dialTunnel connects to host, a host:port, directly, or through a CONNECT
+// request to the upstream proxy, if any.
+func (p *stepProxy) dialTunnel(ctx context.Context, host string) (net.Conn, error) {
+	proxy, err := p.upstream(&url.URL{Scheme: "https", Host: host})
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", host)
+	}
+
+	addr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy %s: %w", proxy.Redacted(), err)
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		connect.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting through proxy %s: %w", proxy.Redacted(), err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting through proxy %s: %w", proxy.Redacted(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("connecting through proxy %s: %s", proxy.Redacted(), resp.Status)
+	}
+
+	return conn, nil
+}
+
+// errRefusedHosts is returned for steps which tried to connect to hosts not in
+// their proxy-allow-hosts.
+var errRefusedHosts = errors.New("connections refused by proxy-allow-hosts")
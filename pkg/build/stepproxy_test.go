@@ -0,0 +1,267 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowsHost(t *testing.T) {
+	patterns := []string{"example.com", "*.kernel.org"}
+
+	for host, want := range map[string]bool{
+		"example.com":            true,
+		"EXAMPLE.com.":           true,
+		"www.example.com":        false,
+		"cdn.kernel.org":         true,
+		"mirrors.cdn.kernel.org": true,
+		"kernel.org":             false,
+		"evilkernel.org":         false,
+	} {
+		require.Equal(t, want, allowsHost(patterns, host), host)
+	}
+}
+
+// proxiedGet gets u through the proxy configured in env, as a client honoring
+// the proxy environment variables would.
+func proxiedGet(env map[string]string, u string) (int, error) {
+	proxy, err := url.Parse(env["https_proxy"])
+	if err != nil {
+		return 0, err
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxy),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	}}
+	resp, err := c.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	return resp.StatusCode, nil
+}
+
+func TestStepProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	p, err := startStepProxy(func(host string) bool { return allowsHost([]string{"127.0.0.1"}, host) }, nil, nil)
+	require.NoError(t, err)
+	defer p.Close()
+
+	for _, u := range []string{plain.URL, tlsSrv.URL} {
+		code, err := proxiedGet(p.env(), u)
+		require.NoError(t, err, u)
+		require.Equal(t, http.StatusOK, code, u)
+	}
+
+	code, err := proxiedGet(p.env(), strings.Replace(plain.URL, "127.0.0.1", "localhost", 1))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, code)
+
+	_, err = proxiedGet(p.env(), strings.Replace(tlsSrv.URL, "127.0.0.1", "localhost", 1))
+	require.Error(t, err)
+
+	require.Equal(t, []string{"localhost"}, p.Refused())
+}
+
+func TestStepProxyUpstream(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	// The proxy of the user, which sees the connections the step proxy
+	// allowed.
+	m := &networkMonitor{}
+	user, err := startStepProxy(func(string) bool { return true }, func(host, port string, allowed bool) {
+		m.record("user", host, port, allowed)
+	}, nil)
+	require.NoError(t, err)
+	defer user.Close()
+	userURL, err := url.Parse(user.env()["http_proxy"])
+	require.NoError(t, err)
+
+	p, err := startStepProxy(func(host string) bool { return host == "127.0.0.1" }, nil, func(*url.URL) (*url.URL, error) { return userURL, nil })
+	require.NoError(t, err)
+	defer p.Close()
+
+	for _, u := range []string{plain.URL, tlsSrv.URL} {
+		code, err := proxiedGet(p.env(), u)
+		require.NoError(t, err, u)
+		require.Equal(t, http.StatusOK, code, u)
+	}
+	var seen []string
+	for _, c := range m.Connections() {
+		seen = append(seen, c.Host+":"+c.Port)
+	}
+	require.Equal(t, []string{
+		strings.TrimPrefix(plain.URL, "http://"),
+		strings.TrimPrefix(tlsSrv.URL, "https://"),
+	}, seen)
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://host-proxy:3128")
+	t.Setenv("NO_PROXY", "")
+
+	for _, tc := range []struct {
+		env  map[string]string
+		u    string
+		want string
+	}{
+		// The proxy of the host.
+		{nil, "https://example.com", "http://host-proxy:3128"},
+		{nil, "http://example.com", ""},
+		// The proxy of the step wins.
+		{map[string]string{"https_proxy": "http://step-proxy:8080"}, "https://example.com", "http://step-proxy:8080"},
+		{map[string]string{"HTTP_PROXY": "http://step-proxy:8080"}, "http://example.com", "http://step-proxy:8080"},
+		{map[string]string{"NO_PROXY": "example.com"}, "https://example.com", ""},
+		{map[string]string{"NO_PROXY": "example.com"}, "https://example.org", "http://host-proxy:3128"},
+	} {
+		u, err := url.Parse(tc.u)
+		require.NoError(t, err)
+		got, err := upstreamProxy(tc.env)(u)
+		require.NoError(t, err)
+		if tc.want == "" {
+			require.Nil(t, got, "%v %s", tc.env, tc.u)
+			continue
+		}
+		require.Equal(t, tc.want, got.String(), "%v %s", tc.env, tc.u)
+	}
+}
+
+// hostNetRunner runs the lines of scripts of the form "get <url>" by getting
+// the URL through the proxy in the environment of the step.
+type hostNetRunner struct {
+	fakeRunner
+}
+
+func (r *hostNetRunner) SharesHostNetwork() bool { return true }
+
+func (r *hostNetRunner) Run(_ context.Context, _ *container.Config, env map[string]string, cmd ...string) error {
+	for _, line := range strings.Split(cmd[len(cmd)-1], "\n") {
+		if u, ok := strings.CutPrefix(line, "get "); ok {
+			if _, err := proxiedGet(env, u); err != nil {
+				return err
+			}
+			r.scripts = append(r.scripts, line)
+		}
+	}
+	return nil
+}
+
+func TestRunPipelineAllowHosts(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") }))
+	defer srv.Close()
+	denied := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	r := &hostNetRunner{}
+	pr := &pipelineRunner{config: &container.Config{Capabilities: container.Capabilities{Networking: true}}, runner: r}
+
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		Name:            "fetch",
+		ProxyAllowHosts: []string{"127.0.0.1"},
+		Pipeline:        []config.Pipeline{{Runs: "get " + srv.URL}},
+	})
+	require.NoError(t, err)
+	require.Len(t, r.scripts, 1)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{
+		Name:            "fetch",
+		ProxyAllowHosts: []string{"127.0.0.1", "localhost"},
+		Pipeline: []config.Pipeline{{
+			// A nested allow-list cannot allow more than its parent's.
+			ProxyAllowHosts: []string{"localhost"},
+			Pipeline:        []config.Pipeline{{Runs: "get " + srv.URL}},
+		}},
+	})
+	require.ErrorIs(t, err, errRefusedHosts)
+	require.ErrorContains(t, err, "127.0.0.1")
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{
+		Name:            "fetch",
+		ProxyAllowHosts: []string{"127.0.0.1"},
+		Runs:            "get " + denied,
+	})
+	require.ErrorIs(t, err, errRefusedHosts)
+	require.ErrorContains(t, err, `step "fetch": connections refused by proxy-allow-hosts: localhost`)
+
+	pr.runner = &fakeRunner{}
+	_, err = pr.runPipeline(ctx, &config.Pipeline{ProxyAllowHosts: []string{"127.0.0.1"}})
+	require.ErrorContains(t, err, "proxy-allow-hosts is not supported")
+}
+
+func TestRunPipelineNetworkMonitor(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") }))
+	defer srv.Close()
+	port := srv.URL[strings.LastIndex(srv.URL, ":")+1:]
+	other := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	r := &hostNetRunner{}
+	m := &networkMonitor{}
+	pr := &pipelineRunner{config: &container.Config{Capabilities: container.Capabilities{Networking: true}}, runner: r, network: m}
+
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		Name: "fetch",
+		Pipeline: []config.Pipeline{
+			// Unnamed steps are attributed to their parent.
+			{Runs: "get " + srv.URL + "\nget " + srv.URL},
+			{Name: "other", Runs: "get " + other},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = pr.runPipeline(ctx, &config.Pipeline{
+		Name:            "restricted",
+		ProxyAllowHosts: []string{"127.0.0.1"},
+		Runs:            "get " + other,
+	})
+	require.ErrorIs(t, err, errRefusedHosts)
+
+	require.Equal(t, []NetworkConnection{
+		{Step: "fetch", Host: "127.0.0.1", Port: port, Count: 2},
+		{Step: "other", Host: "localhost", Port: port, Count: 1},
+		{Step: "restricted", Host: "localhost", Port: port, Refused: true, Count: 1},
+	}, m.Connections())
+
+	pr.runner = &fakeRunner{}
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Runs: "echo"})
+	require.ErrorContains(t, err, "network monitoring is not supported")
+}
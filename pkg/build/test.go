@@ -26,6 +26,7 @@ import (
 	"runtime"
 	"slices"
 	"strings"
+	"time"
 
 	"chainguard.dev/apko/pkg/apk/apk"
 	apkofs "chainguard.dev/apko/pkg/apk/fs"
@@ -49,25 +50,61 @@ type Test struct {
 	WorkspaceDir    string
 	WorkspaceIgnore string
 	// Ordered directories where to find 'uses' pipelines.
-	PipelineDirs      []string
-	SourceDir         string
-	GuestDir          string
-	Remove            bool
-	Arch              apko_types.Architecture
-	ExtraKeys         []string
-	ExtraRepos        []string
-	ExtraTestPackages []string
-	BinShOverlay      string
-	CacheDir          string
-	ApkCacheDir       string
-	CacheSource       string
-	EnvFile           string
-	Runner            container.Runner
-	Debug             bool
-	DebugRunner       bool
-	Interactive       bool
-	Auth              map[string]options.Auth
-	IgnoreSignatures  bool
+	PipelineDirs       []string
+	pipelineCache      *pipelineCache
+	SourceDir          string
+	GuestDir           string
+	Remove             bool
+	Arch               apko_types.Architecture
+	ExtraKeys          []string
+	ExtraRepos         []string
+	ExtraTestPackages  []string
+	BinShOverlay       string
+	CacheDir           string
+	ApkCacheDir        string
+	CacheSource        string
+	EnvFile            string
+	Runner             container.Runner
+	Debug              bool
+	DebugRunner        bool
+	Interactive        bool
+	Auth               map[string]options.Auth
+	IgnoreSignatures   bool
+	OnAssertionFailure AssertionFailureFunc
+	StepObserver       StepObserver
+	// Whether the test pipelines keep running past the failed ones, see
+	// WithTestKeepGoing.
+	KeepGoing bool
+	// Directory of locally built packages, as written by a build's OutDir.
+	// When set, each package under test is installed from this directory
+	// rather than from the remote repositories.
+	LocalRepo string
+	// If set, the duration of the test and of each of its phases is appended
+	// to this file, as a line of JSON.
+	MetricsFile string
+
+	// The Linux capabilities needed by the tests of each package, by name,
+	// gathered by Compile.
+	neededCapabilities map[string][]string
+}
+
+// localRepoTag is the apk repository tag under which the local repository is
+// added to the test environments.
+const localRepoTag = "@local"
+
+// withLocalPackage returns a copy of imgConfig which installs the package
+// name from the local repository, if one is configured.  The package is
+// pinned to the tagged repository, so a remote package of the same name can
+// never be selected in its place.
+func (t *Test) withLocalPackage(imgConfig apko_types.ImageConfiguration, name string) apko_types.ImageConfiguration {
+	if t.LocalRepo == "" {
+		return imgConfig
+	}
+
+	imgConfig.Contents.BuildRepositories = slices.Concat(imgConfig.Contents.BuildRepositories, []string{localRepoTag + " " + t.LocalRepo})
+	imgConfig.Contents.Packages = slices.Concat(imgConfig.Contents.Packages, []string{name + localRepoTag})
+
+	return imgConfig
 }
 
 func NewTest(ctx context.Context, opts ...TestOption) (*Test, error) {
@@ -340,6 +377,8 @@ func (t *Test) TestPackage(ctx context.Context) error {
 
 	pkg := &t.Configuration.Package
 
+	start := time.Now()
+
 	log.Infof("evaluating pipelines for package requirements")
 	if err := t.Compile(ctx); err != nil {
 		return fmt.Errorf("compiling test pipelines: %w", err)
@@ -373,11 +412,24 @@ func (t *Test) TestPackage(ctx context.Context) error {
 			break
 		}
 	}
+	if pkg.ExcludesArch(t.Arch) {
+		inarchs = false
+	}
 	if !inarchs {
 		log.Warnf("skipping test for %s on %s", pkg.Name, t.Arch)
 		return nil
 	}
 
+	phases, succeeded := &phaseTimes{}, false
+	if t.MetricsFile != "" {
+		defer func() {
+			m := phases.metrics(pkg, t.Arch.ToAPK(), "test", start, succeeded)
+			if err := appendMetrics(t.MetricsFile, m); err != nil {
+				log.Warnf("unable to write test metrics: %v", err)
+			}
+		}()
+	}
+
 	if t.GuestDir == "" {
 		guestDir, err := os.MkdirTemp(t.Runner.TempDir(), "melange-guest-*")
 		if err != nil {
@@ -400,7 +452,7 @@ func (t *Test) TestPackage(ctx context.Context) error {
 
 	// If there are no 'main' test pipelines, we can skip building the guest.
 	if !t.IsTestless() {
-		imgRef, err = t.BuildGuest(ctx, t.Configuration.Test.Environment, guestFS)
+		imgRef, err = t.BuildGuest(ctx, t.withLocalPackage(t.Configuration.Test.Environment, pkg.Name), guestFS)
 		if err != nil {
 			return fmt.Errorf("unable to build guest: %w", err)
 		}
@@ -438,16 +490,33 @@ func (t *Test) TestPackage(ctx context.Context) error {
 		return fmt.Errorf("unable to build workspace config: %w", err)
 	}
 
+	if t.Interactive && t.KeepGoing {
+		log.Warnf("not debugging failed steps interactively while keeping going")
+	}
 	pr := &pipelineRunner{
-		interactive: t.Interactive,
+		interactive: t.Interactive && !t.KeepGoing,
 		debug:       t.Debug,
 		config:      cfg,
 		runner:      t.Runner,
+
+		onAssertionFailure: t.OnAssertionFailure,
+		observer:           t.StepObserver,
+
+		phases: phases,
+		phase:  PhaseTest,
+
+		keepGoing: t.KeepGoing,
 	}
 
+	// The errors of the failed test pipelines, when keeping going.
+	var errs []error
 	if !t.IsTestless() {
 		cfg.Arch = t.Arch
 
+		if err := checkCapabilities(t.Runner, cfg); err != nil {
+			return err
+		}
+
 		if err := t.Runner.StartPod(ctx, cfg); err != nil {
 			return fmt.Errorf("unable to start pod: %w", err)
 		}
@@ -461,7 +530,10 @@ func (t *Test) TestPackage(ctx context.Context) error {
 
 		log.Infof("running the main test pipeline")
 		if err := pr.runPipelines(ctx, t.Configuration.Test.Pipeline); err != nil {
-			return fmt.Errorf("unable to run pipeline: %w", err)
+			if !t.KeepGoing {
+				return fmt.Errorf("unable to run pipeline: %w", err)
+			}
+			errs = append(errs, fmt.Errorf("unable to run main test pipeline: %w", err))
 		}
 	}
 
@@ -481,7 +553,7 @@ func (t *Test) TestPackage(ctx context.Context) error {
 			return err
 		}
 
-		spImgRef, err := t.BuildGuest(ctx, sp.Test.Environment, guestFS)
+		spImgRef, err := t.BuildGuest(ctx, t.withLocalPackage(sp.Test.Environment, sp.Name), guestFS)
 		if err != nil {
 			return fmt.Errorf("unable to build guest: %w", err)
 		}
@@ -494,11 +566,23 @@ func (t *Test) TestPackage(ctx context.Context) error {
 		}
 		subCfg.Arch = t.Arch
 
+		if err := checkCapabilities(t.Runner, subCfg); err != nil {
+			return err
+		}
+
 		pr := &pipelineRunner{
-			interactive: t.Interactive,
+			interactive: t.Interactive && !t.KeepGoing,
 			debug:       t.Debug,
 			config:      subCfg,
 			runner:      t.Runner,
+
+			onAssertionFailure: t.OnAssertionFailure,
+			observer:           t.StepObserver,
+
+			phases: phases,
+			phase:  PhaseTest,
+
+			keepGoing: t.KeepGoing,
 		}
 
 		if err := t.Runner.StartPod(ctx, subCfg); err != nil {
@@ -513,14 +597,23 @@ func (t *Test) TestPackage(ctx context.Context) error {
 		}
 
 		if err := pr.runPipelines(ctx, sp.Test.Pipeline); err != nil {
-			return fmt.Errorf("unable to run pipeline: %w", err)
+			if !t.KeepGoing {
+				return fmt.Errorf("unable to run pipeline: %w", err)
+			}
+			errs = append(errs, fmt.Errorf("unable to run subpackage %s test pipeline: %w", sp.Name, err))
 		}
 	}
 
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
 	// clean workspace dir
 	if err := os.RemoveAll(t.WorkspaceDir); err != nil {
 		log.Warnf("unable to clean workspace: %s", err)
 	}
+
+	succeeded = true
 	return nil
 }
 
@@ -563,6 +656,7 @@ func (t *Test) buildWorkspaceConfig(ctx context.Context, imgRef, pkgName string,
 	// TODO(kaniini): Disable networking capability according to the pipeline requirements.
 	caps := container.Capabilities{
 		Networking: true,
+		Add:        t.neededCapabilities[pkgName],
 	}
 
 	cfg := container.Config{
@@ -134,6 +134,26 @@ func WithTestExtraRepos(extraRepos []string) TestOption {
 	}
 }
 
+// WithTestLocalRepo installs the packages under test from the local
+// repository in dir, typically the OutDir of the build which produced them,
+// instead of from the remote repositories.
+func WithTestLocalRepo(dir string) TestOption {
+	return func(t *Test) error {
+		t.LocalRepo = dir
+		return nil
+	}
+}
+
+// WithTestMetricsFile appends the duration of the test, in total and of each
+// of its phases, to a file at the given path as a line of JSON, see
+// BuildMetrics.
+func WithTestMetricsFile(path string) TestOption {
+	return func(t *Test) error {
+		t.MetricsFile = path
+		return nil
+	}
+}
+
 // WithTestBinShOverlay sets a filename to copy from when installing /bin/sh
 // into a test environment.
 func WithTestBinShOverlay(binShOverlay string) TestOption {
@@ -204,3 +224,32 @@ func WithTestRemove(c bool) TestOption {
 		return nil
 	}
 }
+
+// WithTestAssertionFailureCallback registers a function that is called with
+// the details of any test pipeline assertion that fails. The test still fails.
+func WithTestAssertionFailureCallback(fn AssertionFailureFunc) TestOption {
+	return func(t *Test) error {
+		t.OnAssertionFailure = fn
+		return nil
+	}
+}
+
+// WithTestKeepGoing runs all the test pipelines, of the package and of its
+// subpackages, even past those which fail, and fails with the errors of all of
+// them, to see every failure in one pass.  Failed steps are not debugged
+// interactively in this mode.
+func WithTestKeepGoing(keepGoing bool) TestOption {
+	return func(t *Test) error {
+		t.KeepGoing = keepGoing
+		return nil
+	}
+}
+
+// WithTestStepObserver registers an observer which is notified when each step
+// of the test pipelines starts and finishes, e.g. to report progress.
+func WithTestStepObserver(o StepObserver) TestOption {
+	return func(t *Test) error {
+		t.StepObserver = o
+		return nil
+	}
+}
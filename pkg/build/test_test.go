@@ -302,3 +302,23 @@ func TestConfigurationLoad(t *testing.T) {
 		})
 	}
 }
+
+func TestWithLocalPackage(t *testing.T) {
+	env := apko_types.ImageConfiguration{
+		Contents: apko_types.ImageContents{
+			BuildRepositories: []string{"https://packages.wolfi.dev/os"},
+			Packages:          []string{"busybox"},
+		},
+	}
+
+	remote := &Test{}
+	require.Equal(t, env, remote.withLocalPackage(env, "foo"))
+
+	local := &Test{LocalRepo: "./packages"}
+	got := local.withLocalPackage(env, "foo")
+	require.Equal(t, []string{"https://packages.wolfi.dev/os", "@local ./packages"}, got.Contents.BuildRepositories)
+	require.Equal(t, []string{"busybox", "foo@local"}, got.Contents.Packages)
+
+	// The original configuration must not be modified.
+	require.Equal(t, []string{"busybox"}, env.Contents.Packages)
+}
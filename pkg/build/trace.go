@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/clog"
+)
+
+// A TracedStep describes a step of the pipelines the build reached, as
+// written to the trace file, in the order the steps started.
+type TracedStep struct {
+	// The step, identified as in the logs, by its name, or else the
+	// pipeline it uses.
+	ID string `json:"id"`
+	// The index in the trace of the step this step is nested in, if any.
+	Parent *int `json:"parent,omitempty"`
+	// The if-conditional of the step, if any.
+	If string `json:"if,omitempty"`
+	// Whether the step ran, rather than being skipped by its if-conditional.
+	Ran        bool  `json:"ran"`
+	DurationMs int64 `json:"durationMs"`
+	// The hex SHA-256 of the script the step ran, once its variables were
+	// substituted, if it ran.
+	ScriptSHA256 string `json:"scriptSha256,omitempty"`
+	// The error the step failed with, if any, with the values of secret
+	// inputs redacted.
+	Error string `json:"error,omitempty"`
+}
+
+// stepTrace records the steps run by a pipelineRunner, which runs them one
+// at a time.
+type stepTrace struct {
+	steps []TracedStep
+	// The indexes of the steps started but not yet finished, innermost
+	// last.
+	running []int
+}
+
+// start records that the step of pipeline started, and returns its index.
+func (t *stepTrace) start(pipeline *config.Pipeline) int {
+	step := TracedStep{ID: pipeline.Identity(), If: pipeline.If}
+	if n := len(t.running); n != 0 {
+		parent := t.running[n-1]
+		step.Parent = &parent
+	}
+	t.steps = append(t.steps, step)
+	t.running = append(t.running, len(t.steps)-1)
+	return len(t.steps) - 1
+}
+
+// script records the checksum of the script of the innermost step running.
+func (t *stepTrace) script(checksum string) {
+	t.steps[t.running[len(t.running)-1]].ScriptSHA256 = checksum
+}
+
+// finish records the outcome of the i-th step, which is the innermost one
+// running.
+func (t *stepTrace) finish(i int, ran bool, err error, dur time.Duration, secrets []string) {
+	t.running = t.running[:len(t.running)-1]
+	t.steps[i].Ran = ran
+	t.steps[i].DurationMs = dur.Milliseconds()
+	if err != nil {
+		t.steps[i].Error = redact(err.Error(), secrets)
+	}
+}
+
+// writeTrace writes the steps recorded by t, if any, as a JSON array to the
+// trace file of the build, suffixed with the architecture.
+func (b *Build) writeTrace(ctx context.Context, t *stepTrace) error {
+	steps := []TracedStep{}
+	if t != nil {
+		steps = append(steps, t.steps...)
+	}
+	data, err := json.MarshalIndent(steps, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s.%s", b.TraceFile, b.Arch.ToAPK())
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing trace: %w", err)
+	}
+	clog.FromContext(ctx).Infof("wrote the trace of the steps to %s", path)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	b := &Build{Arch: apko_types.ParseArchitecture("x86_64")}
+	require.NoError(t, WithTraceFile(filepath.Join(t.TempDir(), "trace.json"))(b))
+
+	pr := &pipelineRunner{
+		config: &container.Config{},
+		runner: &fakeRunner{},
+		trace:  &stepTrace{},
+	}
+	err := pr.runPipelines(ctx, []config.Pipeline{
+		{
+			Name: "build",
+			Pipeline: []config.Pipeline{
+				{Name: "configure", Runs: "echo configure"},
+				{Name: "docs", If: "'a' == 'b'", Runs: "echo docs"},
+				{Uses: "autoconf/make", Pipeline: []config.Pipeline{{Name: "make", Runs: "make"}}},
+			},
+		},
+		{Name: "check", Runs: "fail check"},
+		{Name: "install", Runs: "echo install"},
+	})
+	require.Error(t, err)
+
+	// The trace is written even though the build failed.
+	require.NoError(t, b.writeTrace(ctx, pr.trace))
+	data, err := os.ReadFile(b.TraceFile + ".x86_64")
+	require.NoError(t, err)
+	var steps []TracedStep
+	require.NoError(t, json.Unmarshal(data, &steps))
+
+	for i := range steps {
+		require.GreaterOrEqual(t, steps[i].DurationMs, int64(0))
+		steps[i].DurationMs = 0
+		// The checksums of the scripts are covered by TestRunPipelineScriptChecksum.
+		require.Equal(t, steps[i].If == "", steps[i].ScriptSHA256 != "", steps[i].ID)
+		steps[i].ScriptSHA256 = ""
+	}
+	parent := func(i int) *int { return &i }
+	require.Equal(t, []TracedStep{
+		{ID: "build", Ran: true},
+		{ID: "configure", Parent: parent(0), Ran: true},
+		{ID: "docs", Parent: parent(0), If: "'a' == 'b'"},
+		{ID: "autoconf/make", Parent: parent(0), Ran: true},
+		{ID: "make", Parent: parent(3), Ran: true},
+		{ID: "check", Error: "script failed"},
+	}, steps)
+
+	// A build which fails before running any step writes an empty trace.
+	require.NoError(t, b.writeTrace(ctx, nil))
+	data, err = os.ReadFile(b.TraceFile + ".x86_64")
+	require.NoError(t, err)
+	require.JSONEq(t, "[]", string(data))
+}
@@ -18,10 +18,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -45,11 +47,36 @@ const BuiltinPipelineDir = "/usr/share/melange/pipelines"
 func buildCmd() *cobra.Command {
 	var buildDate string
 	var workspaceDir string
-	var pipelineDir string
+	var pipelineDirs []string
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
 	var apkCacheDir string
+	var isolatedApkCache bool
+	var requireSubpackageLicense bool
+	var lockFile string
+	var pinLockFile string
+	var strict bool
+	var checkBuildPath bool
+	var buildPathIgnore []string
+	var scrubEnvironment bool
+	var checkLinkage bool
+	var checkInstall bool
+	var gitOverrides []string
+	var attachContainer string
+	var sbomSubpackages []string
+	var sbomExcludeSubpackages []string
+	var contentAddressableDir string
+	var goldenSBOMDir string
+	var networkReport string
+	var metricsFile string
+	var readOnlySource bool
+	var diagnosticsFile string
+	var stepTraceFile string
+	var salvageDir string
+	var noPipelineOverrides bool
+	var shell string
+	var envOverrides []string
 	var guestDir string
 	var signingKey string
 	var generateIndex bool
@@ -63,12 +90,15 @@ func buildCmd() *cobra.Command {
 	var overlayBinSh string
 	var envFile string
 	var varsFile string
+	var vars []string
 	var purlNamespace string
 	var buildOption []string
 	var createBuildLog bool
 	var debug bool
 	var debugRunner bool
 	var interactive bool
+	var debugShell string
+	var debugOnFailure bool
 	var remove bool
 	var runner string
 	var cpu, cpumodel, memory, disk string
@@ -84,6 +114,18 @@ func buildCmd() *cobra.Command {
 
 	var traceFile string
 
+	var plan bool
+	var planFormat string
+	var printSubstitutions bool
+	var dryRun bool
+	var allowedEnviron []string
+	var strictSubstitutions bool
+	var stepLogDir string
+	var keepGoing bool
+	var checkpointFile string
+	var resumeFrom int
+	var sourceBundle string
+
 	cmd := &cobra.Command{
 		Use:     "build",
 		Short:   "Build a package from a YAML configuration file",
@@ -123,7 +165,15 @@ func buildCmd() *cobra.Command {
 				ctx = tctx
 			}
 
-			r, err := getRunner(ctx, runner, remove)
+			var r container.Runner
+			var err error
+			if dryRun {
+				// The steps are not run, so no runner is needed.
+			} else if attachContainer != "" {
+				r, err = docker.NewAttachedRunner(ctx, attachContainer)
+			} else {
+				r, err = getRunner(ctx, runner, remove)
+			}
 			if err != nil {
 				return err
 			}
@@ -147,17 +197,51 @@ func buildCmd() *cobra.Command {
 				configFileGitRepoURL = "https://unknown/unknown/unknown"
 			}
 
+			envOverride := map[string]string{}
+			for _, s := range envOverrides {
+				name, value, ok := strings.Cut(s, "=")
+				if !ok || name == "" {
+					return fmt.Errorf("invalid environment variable %q, expected NAME=VALUE", s)
+				}
+				envOverride[name] = value
+			}
+
 			archs := apko_types.ParseArchitectures(archstrs)
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
 				build.WithWorkspaceDir(workspaceDir),
-				// Order matters, so add any specified pipelineDir before
-				// builtin pipelines.
-				build.WithPipelineDir(pipelineDir),
-				build.WithPipelineDir(BuiltinPipelineDir),
 				build.WithCacheDir(cacheDir),
 				build.WithCacheSource(cacheSource),
 				build.WithPackageCacheDir(apkCacheDir),
+				build.WithIsolatedPackageCache(isolatedApkCache),
+				build.WithRequireSubpackageLicense(requireSubpackageLicense),
+				build.WithLockFile(lockFile),
+				build.WithPinLockFile(pinLockFile),
+				build.WithStrict(strict),
+				build.WithBuildPathCheck(checkBuildPath, buildPathIgnore),
+				build.WithScrubEnvironment(scrubEnvironment),
+				build.WithLinkageCheck(checkLinkage),
+				build.WithInstallCheck(checkInstall),
+				build.WithGitOverrides(gitOverrides),
+				build.WithSubpackageSBOMs(sbomSubpackages, sbomExcludeSubpackages),
+				build.WithContentAddressableDir(contentAddressableDir),
+				build.WithGoldenSBOMDir(goldenSBOMDir),
+				build.WithNetworkReport(networkReport),
+				build.WithMetricsFile(metricsFile),
+				build.WithReadOnlySource(readOnlySource),
+				build.WithDiagnosticsFile(diagnosticsFile),
+				build.WithTraceFile(stepTraceFile),
+				build.WithSalvageDir(salvageDir),
+				build.WithNoPipelineOverrides(noPipelineOverrides),
+				build.WithShell(shell),
+				build.WithEnvOverride(envOverride),
+				build.WithDryRun(dryRun),
+				build.WithAllowedEnviron(allowedEnviron),
+				build.WithStrictSubstitutions(strictSubstitutions),
+				build.WithStepLogDir(stepLogDir),
+				build.WithKeepGoing(keepGoing),
+				build.WithCheckpointFile(checkpointFile),
+				build.WithResumeFrom(resumeFrom),
 				build.WithGuestDir(guestDir),
 				build.WithSigningKey(signingKey),
 				build.WithGenerateIndex(generateIndex),
@@ -171,12 +255,15 @@ func buildCmd() *cobra.Command {
 				build.WithStripOriginName(stripOriginName),
 				build.WithEnvFile(envFile),
 				build.WithVarsFile(varsFile),
+				build.WithVars(vars),
 				build.WithNamespace(purlNamespace),
 				build.WithEnabledBuildOptions(buildOption),
 				build.WithCreateBuildLog(createBuildLog),
 				build.WithDebug(debug),
 				build.WithDebugRunner(debugRunner),
 				build.WithInteractive(interactive),
+				build.WithDebugShell(strings.Fields(debugShell)),
+				build.WithDebugOnFailure(debugOnFailure),
 				build.WithRemove(remove),
 				build.WithRunner(r),
 				build.WithLintRequire(lintRequire),
@@ -193,6 +280,13 @@ func buildCmd() *cobra.Command {
 				build.WithConfigFileLicense(configFileLicense),
 			}
 
+			// Order matters, so add any specified pipeline dirs before the
+			// builtin pipelines.
+			for _, dir := range pipelineDirs {
+				options = append(options, build.WithPipelineDir(dir))
+			}
+			options = append(options, build.WithPipelineDir(BuiltinPipelineDir))
+
 			if len(args) > 0 {
 				options = append(options, build.WithConfig(buildConfigFilePath))
 
@@ -216,21 +310,68 @@ func buildCmd() *cobra.Command {
 				options = append(options, build.WithAuth(domain, user, pass))
 			}
 
+			if plan {
+				return PlanCmd(ctx, os.Stdout, planFormat, archs, options...)
+			}
+			if printSubstitutions {
+				return SubstitutionsCmd(ctx, os.Stdout, archs, options...)
+			}
+			if sourceBundle != "" {
+				return SourceBundleCmd(ctx, sourceBundle, archs, options...)
+			}
+
 			return BuildCmd(ctx, archs, options...)
 		},
 	}
 
+	cmd.Flags().BoolVar(&plan, "plan", false, "print the execution plan of the build, with its resolved steps, instead of building")
+	cmd.Flags().StringVar(&planFormat, "format", build.PlanFormatText, fmt.Sprintf("format of the --plan output, one of %q", build.PlanFormats))
+	cmd.Flags().BoolVar(&printSubstitutions, "print-substitutions", false, "print the resolved substitutions of the package, including its vars and build options, as <variable>=<value> lines, instead of building")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "log the command of each step which would run, and the result of its if-conditional, instead of running it; no runner is needed")
+	cmd.Flags().StringVar(&sourceBundle, "source-bundle", "", "write the configuration, sources and pipelines needed to rebuild offline to this directory, instead of building")
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
-	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringArrayVar(&pipelineDirs, "pipeline-dir", []string{}, "directory used to extend defined built-in pipelines, searched in order when repeated")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
 	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
+	cmd.Flags().BoolVar(&isolatedApkCache, "isolated-apk-cache", false, "use a private apk cache for this build, seeded from --apk-cache-dir, so concurrent builds do not share writes")
+	cmd.Flags().BoolVar(&requireSubpackageLicense, "require-subpackage-license", false, "fail the build if any subpackage has no license, declared or inherited from the package")
+	cmd.Flags().StringVar(&lockFile, "lockfile", "", "record the packages installed into the build environment in an apko lockfile at this path")
+	cmd.Flags().StringVar(&pinLockFile, "pin-lockfile", "", "pin the build environment to the package versions recorded in this apko lockfile")
+	cmd.Flags().BoolVar(&strict, "strict", false, "treat warnings about the build configuration and linter warnings as errors")
+	cmd.Flags().BoolVar(&checkBuildPath, "check-build-path", false, "warn about packaged files which reference the build workspace path (an error with --strict)")
+	cmd.Flags().StringSliceVar(&buildPathIgnore, "build-path-ignore", []string{}, "globs of packaged files, relative to the package root, which may reference the build workspace path")
+	cmd.Flags().BoolVar(&checkInstall, "check-install", false, "check that each package installs cleanly, with its dependencies and install scripts, into a fresh root using the runner")
+	cmd.Flags().BoolVar(&checkLinkage, "check-linkage", false, "warn about shared libraries the packages link against which their runtime dependencies do not provide (an error with --strict)")
+	cmd.Flags().BoolVar(&scrubEnvironment, "scrub-environment", false, "export a fixed locale and timezone (LANG=C, LC_ALL=C, TZ=UTC) to the pipelines, unless they set their own")
+	cmd.Flags().StringSliceVar(&sbomSubpackages, "sbom-subpackages", []string{}, "globs of the subpackages to generate an SBOM for (default all)")
+	cmd.Flags().StringSliceVar(&sbomExcludeSubpackages, "sbom-exclude-subpackages", []string{}, "globs of the subpackages not to generate an SBOM for, e.g. '*' for only the main package")
+	cmd.Flags().StringVar(&contentAddressableDir, "content-addressable-dir", "", "also write the packages and their SBOMs to this directory as blobs/sha256/<digest>, with the mapping in <arch>/<package>-<version>.json")
+	cmd.Flags().StringVar(&goldenSBOMDir, "golden-sbom-dir", "", "fail the build unless the SBOM of each package is the same as the one in this directory, at <arch>/<package>-<version>.spdx.json")
+	cmd.Flags().StringVar(&networkReport, "network-report", "", "record the network connections each step attempts through the HTTP proxy melange provides, without blocking any, in a JSON report at this path, suffixed with the architecture; partial, as clients ignoring http_proxy and https_proxy bypass the proxy")
+	cmd.Flags().BoolVar(&readOnlySource, "read-only-source", false, "mount the workspace read-only, except for the output dir, for the steps which do not fetch, check out or patch the source or set writable-source (bubblewrap runner only)")
+	cmd.Flags().StringArrayVar(&envOverrides, "env", []string{}, "set an environment variable in every step, as NAME=VALUE, overriding the environment of the configuration but not that of the steps")
+	cmd.Flags().StringSliceVar(&allowedEnviron, "allow-environ", []string{}, "names of the host environment variables the pipelines may reference as ${{environ.<name>}}")
+	cmd.Flags().BoolVar(&keepGoing, "keep-going", false, "run all the pipelines even past those which fail, and report the errors of all of them; disables --interactive")
+	cmd.Flags().StringVar(&checkpointFile, "checkpoint-file", "", "file to record how many of the pipelines of the package completed to, after each of them")
+	cmd.Flags().IntVar(&resumeFrom, "resume-from", 0, "skip this many pipelines of the package, completed as of --checkpoint-file, reusing the workspace of the previous build")
+	cmd.Flags().StringVar(&stepLogDir, "step-log-dir", "", "directory to also write the output of each step to, one <step>.log file per step")
+	cmd.Flags().BoolVar(&strictSubstitutions, "strict-substitutions", false, "fail if a ${{...}} reference is left in the script of a step once its variables are substituted; escape literal references as $${{...}}")
+	cmd.Flags().StringVar(&shell, "shell", "", "absolute path of the shell running the scripts of the steps which do not set their own shell (default /bin/sh)")
+	cmd.Flags().StringVar(&diagnosticsFile, "diagnostics-file", "", "when the build fails, write the error and the failed step, with its exit code, command, inputs and last lines of output, as JSON to this file, suffixed with the architecture")
+	cmd.Flags().StringVar(&stepTraceFile, "step-trace-file", "", "once the build finishes, whether or not it succeeds, write each step reached, with its parent step, if-conditional, whether it ran, its duration, error and the SHA-256 of its script, as a JSON array to this file, suffixed with the architecture")
+	cmd.Flags().StringVar(&salvageDir, "salvage-dir", "", "when a pipeline fails, copy the output dir of the build environment to this directory, in a directory named after the architecture, with the docker and bubblewrap runners")
+	cmd.Flags().BoolVar(&noPipelineOverrides, "no-pipeline-overrides", false, "always load the pipelines built into melange from the built-in pipelines, ignoring pipelines of the same name in --pipeline-dir")
+	cmd.Flags().StringVar(&metricsFile, "metrics-file", "", "append the duration of the build, in total and of each phase (setup, fetch, build, package, test), to this file as a line of JSON")
+	cmd.Flags().StringArrayVar(&gitOverrides, "override-git", []string{}, "check out a different ref in git-checkout steps, as <step-name-or-repository>=<commit-or-tag>")
+	cmd.Flags().StringVar(&attachContainer, "attach-container", "", "run the pipelines in this existing, running docker container instead of a fresh build environment; for debugging only, the build is not reproducible")
 	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
 	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
 	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
+	cmd.Flags().StringArrayVar(&vars, "var", []string{}, "set a build configuration variable, as name=value, overriding the configuration, --vars-file and build options")
 	cmd.Flags().BoolVar(&generateIndex, "generate-index", true, "whether to generate APKINDEX.tar.gz")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
@@ -249,6 +390,8 @@ func buildCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of build pipelines")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
 	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, attaches stdin with a tty to the pod on failure")
+	cmd.Flags().StringVar(&debugShell, "debug-shell", "", "command, with its arguments, run in the workdir of the failed step with --interactive, e.g. 'bash -l' (default /bin/sh, also used if the command is not found)")
+	cmd.Flags().BoolVar(&debugOnFailure, "debug-on-failure", false, "attaches stdin with a tty to the pod when a step fails, leaving interrupts to the build until then")
 	cmd.Flags().BoolVar(&remove, "rm", true, "clean up intermediate artifacts (e.g. container images, temp dirs)")
 	cmd.Flags().StringVar(&cpu, "cpu", "", "default CPU resources to use for builds")
 	cmd.Flags().StringVar(&cpumodel, "cpumodel", "host", "default memory resources to use for builds")
@@ -353,7 +496,7 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 
 	var errg errgroup.Group
 
-	if bcs[0].Interactive {
+	if bcs[0].Interactive || bcs[0].DebugOnFailure {
 		// Concurrent interactive debugging will break your terminal.
 		errg.SetLimit(1)
 	}
@@ -376,8 +519,126 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 
 				return fmt.Errorf("failed to build package: %w", err)
 			}
+
+			if bc.Configuration.Package.Reproducible && !bc.DryRun {
+				return build.VerifyReproducible(lctx, bc, baseOpts...)
+			}
 			return nil
 		})
 	}
 	return errg.Wait()
 }
+
+// PlanCmd writes the execution plan of the build for each of archs to w, in
+// the given format, one document per architecture.
+func PlanCmd(ctx context.Context, w io.Writer, format string, archs []apko_types.Architecture, baseOpts ...build.Option) error {
+	log := clog.FromContext(ctx)
+
+	if !slices.Contains(build.PlanFormats, format) {
+		return fmt.Errorf("unknown plan format %q, expected one of %q", format, build.PlanFormats)
+	}
+
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	// JSON documents need no separator to be decoded as a stream.
+	separator := map[string]string{
+		build.PlanFormatText: "\n",
+		build.PlanFormatYAML: "---\n",
+	}[format]
+
+	first := true
+	for _, arch := range archs {
+		bc, err := build.New(ctx, append(baseOpts, build.WithArch(arch))...)
+		if errors.Is(err, build.ErrSkipThisArch) {
+			log.Warnf("skipping arch %s", arch)
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer bc.Close(ctx)
+
+		plan, err := bc.Plan(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, separator); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if err := plan.Write(w, format); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SubstitutionsCmd writes the resolved substitutions of the package for each
+// of archs to w, separated by blank lines.
+func SubstitutionsCmd(ctx context.Context, w io.Writer, archs []apko_types.Architecture, baseOpts ...build.Option) error {
+	log := clog.FromContext(ctx)
+
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	first := true
+	for _, arch := range archs {
+		bc, err := build.New(ctx, append(baseOpts, build.WithArch(arch), build.WithPrintSubstitutions(w))...)
+		if errors.Is(err, build.ErrSkipThisArch) {
+			log.Warnf("skipping arch %s", arch)
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer bc.Close(ctx)
+
+		if !first {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if err := bc.Compile(ctx); err != nil {
+			return fmt.Errorf("compiling %s: %w", bc.Configuration.Package.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// SourceBundleCmd writes the bundle of everything needed to rebuild the
+// package offline for each of archs to dir.
+func SourceBundleCmd(ctx context.Context, dir string, archs []apko_types.Architecture, baseOpts ...build.Option) error {
+	log := clog.FromContext(ctx)
+
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	for _, arch := range archs {
+		bc, err := build.New(ctx, append(baseOpts, build.WithArch(arch))...)
+		if errors.Is(err, build.ErrSkipThisArch) {
+			log.Warnf("skipping arch %s", arch)
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer bc.Close(ctx)
+
+		bundle, err := bc.BundleSources(ctx, dir)
+		if err != nil {
+			return err
+		}
+		log.Infof("bundled %d files and %d sources of %s for %s to %s", len(bundle.Files), len(bundle.Sources), bundle.Package, bundle.Arch, dir)
+	}
+
+	return nil
+}
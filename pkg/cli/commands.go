@@ -60,6 +60,7 @@ func New() *cobra.Command {
 	cmd.AddCommand(keygen())
 	cmd.AddCommand(lint())
 	cmd.AddCommand(packageVersion())
+	cmd.AddCommand(pipelines())
 	cmd.AddCommand(query())
 	cmd.AddCommand(scan())
 	cmd.AddCommand(signCmd())
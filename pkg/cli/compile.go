@@ -32,7 +32,7 @@ import (
 func compile() *cobra.Command {
 	var buildDate string
 	var workspaceDir string
-	var pipelineDir string
+	var pipelineDirs []string
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
@@ -50,6 +50,7 @@ func compile() *cobra.Command {
 	var overlayBinSh string
 	var envFile string
 	var varsFile string
+	var vars []string
 	var purlNamespace string
 	var buildOption []string
 	var logPolicy []string
@@ -78,10 +79,6 @@ func compile() *cobra.Command {
 				build.WithArch(arch),
 				build.WithBuildDate(buildDate),
 				build.WithWorkspaceDir(workspaceDir),
-				// Order matters, so add any specified pipelineDir before
-				// builtin pipelines.
-				build.WithPipelineDir(pipelineDir),
-				build.WithPipelineDir(BuiltinPipelineDir),
 				build.WithCacheDir(cacheDir),
 				build.WithCacheSource(cacheSource),
 				build.WithPackageCacheDir(apkCacheDir),
@@ -98,6 +95,7 @@ func compile() *cobra.Command {
 				build.WithStripOriginName(stripOriginName),
 				build.WithEnvFile(envFile),
 				build.WithVarsFile(varsFile),
+				build.WithVars(vars),
 				build.WithNamespace(purlNamespace),
 				build.WithEnabledBuildOptions(buildOption),
 				build.WithCreateBuildLog(createBuildLog),
@@ -110,6 +108,13 @@ func compile() *cobra.Command {
 				build.WithTimeout(timeout),
 			}
 
+			// Order matters, so add any specified pipeline dirs before the
+			// builtin pipelines.
+			for _, dir := range pipelineDirs {
+				options = append(options, build.WithPipelineDir(dir))
+			}
+			options = append(options, build.WithPipelineDir(BuiltinPipelineDir))
+
 			if len(args) > 0 {
 				options = append(options, build.WithConfig(args[0]))
 
@@ -144,7 +149,7 @@ func compile() *cobra.Command {
 
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
-	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringArrayVar(&pipelineDirs, "pipeline-dir", []string{}, "directory used to extend defined built-in pipelines, searched in order when repeated")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
@@ -153,6 +158,7 @@ func compile() *cobra.Command {
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
 	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
 	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
+	cmd.Flags().StringArrayVar(&vars, "var", []string{}, "set a build configuration variable, as name=value, overriding the configuration, --vars-file and build options")
 	cmd.Flags().BoolVar(&generateIndex, "generate-index", true, "whether to generate APKINDEX.tar.gz")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
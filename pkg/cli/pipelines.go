@@ -0,0 +1,57 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func pipelines() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pipelines",
+		Short: "Inspect the pipelines built into melange",
+	}
+
+	cmd.AddCommand(pipelinesList())
+
+	return cmd
+}
+
+func pipelinesList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the pipelines built into melange and their inputs",
+		Long: `List the pipelines built into melange, which can be used in a build file
+with "uses", and the inputs they accept in "with", as JSON.`,
+		Example: `  melange pipelines list | jq -r '.[].uses'`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			infos, err := build.EmbeddedPipelines()
+			if err != nil {
+				return err
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(infos)
+		},
+	}
+
+	return cmd
+}
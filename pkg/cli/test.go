@@ -49,6 +49,9 @@ func test() *cobra.Command {
 	var runner string
 	var extraTestPackages []string
 	var remove bool
+	var localRepo string
+	var metricsFile string
+	var keepGoing bool
 
 	cmd := &cobra.Command{
 		Use:     "test",
@@ -80,6 +83,9 @@ func test() *cobra.Command {
 				build.WithTestDebugRunner(debugRunner),
 				build.WithTestInteractive(interactive),
 				build.WithTestRemove(remove),
+				build.WithTestLocalRepo(localRepo),
+				build.WithTestMetricsFile(metricsFile),
+				build.WithTestKeepGoing(keepGoing),
 			}
 
 			if len(args) > 0 {
@@ -129,8 +135,11 @@ func test() *cobra.Command {
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of test pipelines (sets -x for steps)")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
 	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, attaches stdin with a tty to the pod on failure")
+	cmd.Flags().BoolVar(&keepGoing, "keep-going", false, "run all the test pipelines, of the package and its subpackages, even past those which fail, and report the errors of all of them; disables --interactive")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
 	cmd.Flags().StringSliceVar(&extraTestPackages, "test-package-append", []string{}, "extra packages to install for each of the test environments")
+	cmd.Flags().StringVar(&localRepo, "local-repo", "", "directory of locally built packages (e.g. the build's --out-dir) to install the packages under test from, instead of the remote repositories")
+	cmd.Flags().StringVar(&metricsFile, "metrics-file", "", "append the duration of the test, in total and of each phase (setup, fetch, test), to this file as a line of JSON")
 	cmd.Flags().BoolVar(&remove, "rm", true, "clean up intermediate artifacts (e.g. container images, temp dirs)")
 
 	return cmd
@@ -16,6 +16,8 @@ package cond
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 
 	"github.com/ijt/goparsify"
 )
@@ -52,6 +54,79 @@ func comparisonOp(n *goparsify.Result) {
 	}
 }
 
+// matchOp returns the mapping of a regular expression match, recording the
+// first pattern which does not compile in patternErr.  Backtracking may map
+// the same match more than once.
+func matchOp(patternErr *error) func(n *goparsify.Result) {
+	return func(n *goparsify.Result) {
+		re, err := regexp.Compile(n.Child[2].Token)
+		if err != nil {
+			if *patternErr == nil {
+				*patternErr = fmt.Errorf("invalid pattern %q: %w", n.Child[2].Token, err)
+			}
+			n.Result = false
+			return
+		}
+
+		switch n.Child[1].Token {
+		case "~=":
+			n.Result = re.MatchString(n.Child[0].Token)
+		case "!~":
+			n.Result = !re.MatchString(n.Child[0].Token)
+		default:
+			panic(fmt.Errorf("unrecognized op"))
+		}
+	}
+}
+
+// anyOf is goparsify.Any, without the error of an earlier parser which failed
+// further along the input, which Any would take as its own and succeed without
+// matching anything.
+func anyOf(parsers ...goparsify.Parserish) goparsify.Parser {
+	p := goparsify.Any(parsers...)
+	return func(ps *goparsify.State, node *goparsify.Result) {
+		ps.Error = goparsify.Error{}
+		p(ps, node)
+	}
+}
+
+// patternLit parses the quoted pattern of a match.  Unlike a string value, a
+// single-quoted pattern keeps its backslashes, as in '^1\.2\.', so that they
+// escape what follows in the regular expression; a backslash also keeps the
+// quote after it from ending the pattern.  A double-quoted pattern is
+// unquoted as a Go string, as substituted values are quoted by SubstQuoted.
+var patternLit = goparsify.NewParser("pattern literal", func(ps *goparsify.State, node *goparsify.Result) {
+	ps.WS(ps)
+
+	if ps.Pos >= len(ps.Input) || (ps.Input[ps.Pos] != '\'' && ps.Input[ps.Pos] != '"') {
+		ps.ErrorHere("'\"")
+		return
+	}
+	quote := ps.Input[ps.Pos]
+
+	for end := ps.Pos + 1; end < len(ps.Input); end++ {
+		switch ps.Input[end] {
+		case '\\':
+			end++
+		case quote:
+			raw := ps.Input[ps.Pos : end+1]
+			node.Token = raw[1 : len(raw)-1]
+			if quote == '"' {
+				s, err := strconv.Unquote(raw)
+				if err != nil {
+					ps.ErrorHere("string literal")
+					return
+				}
+				node.Token = s
+			}
+			node.Result = node.Token
+			ps.Advance(end + 1 - ps.Pos)
+			return
+		}
+	}
+	ps.ErrorHere(string(quote))
+})
+
 // A VariableLookupFunction designates how variables should be
 // resolved when evaluating expressions.
 type VariableLookupFunction func(key string) (string, error)
@@ -65,7 +140,10 @@ func NullLookup(key string) (string, error) {
 
 // Evaluate evaluates an input expression.
 // Expressions are groups of string values combined with equal or unequal
-// comparators.  The order of comparison operations can be designated using
+// comparators, or matched against regular expressions with ~= or negated
+// with !~, as in ${{package.version}} ~= '^1\.2\.'.  Patterns are those of
+// the regexp package, and match anywhere in the value unless anchored.
+// The order of comparison operations can be designated using
 // groups enclosed inside parenthesis.
 // An optional VariableLookupFunction can be provided to provide variable
 // lookups.
@@ -78,7 +156,7 @@ func Evaluate(inputExpr string, lookupFns ...VariableLookupFunction) (bool, erro
 
 	equal := goparsify.Exact("==")
 	unequal := goparsify.Exact("!=")
-	comps := goparsify.Any(equal, unequal)
+	comps := anyOf(equal, unequal)
 
 	variableName := goparsify.Chars("a-zA-Z0-9.\\-_")
 	variable := goparsify.Seq("${{", variableName, "}}").Map(func(n *goparsify.Result) {
@@ -89,7 +167,14 @@ func Evaluate(inputExpr string, lookupFns ...VariableLookupFunction) (bool, erro
 	})
 
 	value := goparsify.Any(goparsify.StringLit("'\""), variable)
-	expr := goparsify.Seq(value, comps, value).Map(comparisonOp)
+	comparison := goparsify.Seq(value, comps, value).Map(comparisonOp)
+
+	var patternErr error
+	matches := anyOf(goparsify.Exact("~="), goparsify.Exact("!~"))
+	pattern := anyOf(patternLit, variable)
+	match := goparsify.Seq(value, matches, pattern).Map(matchOp(&patternErr))
+
+	expr := goparsify.Any(match, comparison)
 
 	and := goparsify.Exact("&&")
 	or := goparsify.Exact("||")
@@ -111,6 +196,10 @@ func Evaluate(inputExpr string, lookupFns ...VariableLookupFunction) (bool, erro
 		return false, err
 	}
 
+	if patternErr != nil {
+		return false, patternErr
+	}
+
 	if rbool, ok := result.(bool); ok {
 		return rbool, nil
 	}
@@ -85,3 +85,62 @@ func TestVariableLookupWhitespace(t *testing.T) {
 	require.NoErrorf(t, err, "got error: %v", err)
 	require.Equal(t, true, result, "${{ foo.bar }} definitely equals baz")
 }
+
+func TestExprMatch(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{`'1.2.3' ~= '^1\.2\..*'`, true},
+		{`'1.20.3' ~= '^1\.2\..*'`, false},
+		{`'1x2y3' ~= '^1\.2\.'`, false},
+		{`'1.2.3' !~ '^1\.2\..*'`, false},
+		{`'1.20.3' !~ '^1\.2\..*'`, true},
+		// Unanchored patterns match anywhere.
+		{`'hello-world' ~= 'lo-wo'`, true},
+		{`'hello-world' ~= 'lo-wo$'`, false},
+		{`'hello-world' !~ 'bye'`, true},
+		// A backslash keeps a quote from ending the pattern.
+		{`"it's" ~= 'it\'s'`, true},
+		// Double-quoted patterns are unquoted as Go strings.
+		{`'1.2.3' ~= "^1\\.2\\."`, true},
+		{`'1.2.3' ~= '^1\.2\.' && 'foo' == 'foo'`, true},
+		{`('1.2.3' ~= '^2\.' || 'foo' != 'bar') && 'x' !~ 'y'`, true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			result, err := Evaluate(tc.expr)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, result)
+		})
+	}
+}
+
+func TestExprMatchVariable(t *testing.T) {
+	result, err := Evaluate(`${{foo.bar}} ~= '^ba'`, placeholderLookup)
+	require.NoError(t, err)
+	require.True(t, result)
+
+	result, err = Evaluate(`${{foo.BAR_BAZ}} !~ '^bar-(baz|qux)$'`, placeholderLookup)
+	require.NoError(t, err)
+	require.False(t, result)
+
+	result, err = Evaluate(`'bazooka' ~= ${{foo.bar}}`, placeholderLookup)
+	require.NoError(t, err)
+	require.True(t, result)
+}
+
+func TestExprMatchInvalidPattern(t *testing.T) {
+	_, err := Evaluate(`'foo' ~= '(unclosed'`)
+	require.ErrorContains(t, err, `invalid pattern "(unclosed"`)
+
+	_, err = Evaluate(`'foo' == 'foo' || 'foo' !~ '[z-a]'`)
+	require.ErrorContains(t, err, `invalid pattern "[z-a]"`)
+}
+
+func TestExprMatchIncomplete(t *testing.T) {
+	_, err := Evaluate(`'foo' ~= bar`)
+	require.Error(t, err)
+
+	_, err = Evaluate(`'foo' ~= `)
+	require.Error(t, err)
+}
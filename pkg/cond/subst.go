@@ -17,12 +17,50 @@ package cond
 import (
 	"errors"
 	"fmt"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/ijt/goparsify"
 )
 
+// ErrUnresolved may be returned by a VariableLookupFunction passed to Subst
+// to leave the reference to the variable in place, to be resolved later.
+var ErrUnresolved = errors.New("variable left unresolved")
+
+// A substFunction transforms the values of its arguments into a new value.
+type substFunction struct {
+	args int
+	fn   func(args []string) string
+}
+
+// substFunctions are the functions which may be called in a substitution, as
+// in ${{replace(package.version, '.', '_')}}.  Arguments are either variables
+// or single-quoted string literals.
+var substFunctions = map[string]substFunction{
+	"upper":    {1, func(args []string) string { return strings.ToUpper(args[0]) }},
+	"lower":    {1, func(args []string) string { return strings.ToLower(args[0]) }},
+	"replace":  {3, func(args []string) string { return strings.ReplaceAll(args[0], args[1], args[2]) }},
+	"basename": {1, func(args []string) string { return path.Base(args[0]) }},
+}
+
+// literalArgument is a string literal argument to a substFunction.
+type literalArgument string
+
+// Subst replaces the ${{...}} references in inputExpr with the values of the
+// variables or functions they reference.  A reference escaped as $${{...}} is
+// left as it is, for the caller to unescape once it is done substituting.
 func Subst(inputExpr string, lookupFns ...VariableLookupFunction) (string, error) {
+	return subst(inputExpr, false, lookupFns...)
+}
+
+// SubstQuoted is like Subst, but quotes the substituted values, as needed to
+// use them as string values in an expression passed to Evaluate.
+func SubstQuoted(inputExpr string, lookupFns ...VariableLookupFunction) (string, error) {
+	return subst(inputExpr, true, lookupFns...)
+}
+
+func subst(inputExpr string, quote bool, lookupFns ...VariableLookupFunction) (string, error) {
 	lookupFn := NullLookup
 
 	if len(lookupFns) > 0 {
@@ -32,19 +70,85 @@ func Subst(inputExpr string, lookupFns ...VariableLookupFunction) (string, error
 	whiteSpace := goparsify.Many(goparsify.Exact(" "))
 	variableName := goparsify.Chars("a-zA-Z0-9.\\-_")
 	errs := []error{}
-	variable := goparsify.Seq("${{", whiteSpace, variableName, whiteSpace, "}}").Map(func(n *goparsify.Result) {
-		if resolved, err := lookupFn(n.Child[2].Token); err == nil {
-			n.Token = resolved
-			n.Result = resolved
-		} else {
+
+	// resolve sets the token of a ${{...}} reference to the substituted
+	// value, or to the reference itself if it is left unresolved.
+	resolve := func(n *goparsify.Result, value string, err error) {
+		switch {
+		case errors.Is(err, ErrUnresolved):
+			n.Token = "${{" + n.Child[2].Token + "}}"
+		case err != nil:
 			errs = append(errs, err)
 			n.Token = ""
-			n.Result = ""
+		case quote:
+			n.Token = strconv.Quote(value)
+		default:
+			n.Token = value
 		}
+		n.Result = n.Token
+	}
+
+	literal := goparsify.StringLit("'").Map(func(n *goparsify.Result) {
+		n.Result = literalArgument(n.Token)
+		n.Token = "'" + n.Token + "'"
+	})
+	call := goparsify.Seq(
+		goparsify.Chars("a-z"), whiteSpace, "(", whiteSpace,
+		goparsify.Some(goparsify.Any(literal, variableName), goparsify.Seq(whiteSpace, ",", whiteSpace)),
+		whiteSpace, ")",
+	).Map(func(n *goparsify.Result) {
+		args := make([]string, 0, len(n.Child[4].Child))
+		for _, arg := range n.Child[4].Child {
+			args = append(args, arg.Token)
+		}
+		n.Token = n.Child[0].Token + "(" + strings.Join(args, ", ") + ")"
+	})
+
+	// A failed attempt to parse a call leaves its children behind.
+	plain := variableName.Map(func(n *goparsify.Result) { n.Child = nil })
+
+	variable := goparsify.Seq("${{", whiteSpace, goparsify.Any(call, plain), whiteSpace, "}}").Map(func(n *goparsify.Result) {
+		ref := n.Child[2]
+		if len(ref.Child) == 0 {
+			value, err := lookupFn(ref.Token)
+			resolve(n, value, err)
+			return
+		}
+
+		name := ref.Child[0].Token
+		f, ok := substFunctions[name]
+		if !ok {
+			resolve(n, "", fmt.Errorf("unknown function %q", name))
+			return
+		}
+
+		args := ref.Child[4].Child
+		if len(args) != f.args {
+			resolve(n, "", fmt.Errorf("function %q takes %d arguments, got %d", name, f.args, len(args)))
+			return
+		}
+
+		values := make([]string, len(args))
+		for i, arg := range args {
+			if lit, ok := arg.Result.(literalArgument); ok {
+				values[i] = string(lit)
+				continue
+			}
+
+			value, err := lookupFn(arg.Token)
+			if err != nil {
+				resolve(n, "", err)
+				return
+			}
+			values[i] = value
+		}
+
+		resolve(n, f.fn(values), nil)
 	})
 
-	text := goparsify.Until("${{")
-	node := goparsify.Any(text, variable)
+	escaped := goparsify.Exact("$${{")
+	text := goparsify.Until("$${{", "${{")
+	node := goparsify.Any(escaped, text, variable)
 
 	document := goparsify.Many(node).Map(func(n *goparsify.Result) {
 		tokens := []string{}
@@ -15,6 +15,7 @@
 package cond
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -38,6 +39,15 @@ func TestSubstMulti(t *testing.T) {
 	require.Equal(t, expected, result, "result does not match expected result")
 }
 
+func TestSubstEscaped(t *testing.T) {
+	doc := "Hello $${{foo.bar}} $$${{foo.bar}} ${{foo.bar}}!"
+	expected := "Hello $${{foo.bar}} $$${{foo.bar}} baz!"
+	result, err := Subst(doc, placeholderLookup)
+
+	require.NoErrorf(t, err, "got error: %v", err)
+	require.Equal(t, expected, result, "result does not match expected result")
+}
+
 func TestSubstVarWhitespace(t *testing.T) {
 	doc := "Hello ${{ foo.bar }} ${{foo.bar}}!"
 	expected := "Hello baz baz!"
@@ -99,3 +109,51 @@ fi`
 
 	require.NoErrorf(t, err, "got error: %v", err)
 }
+
+func TestSubstFunctions(t *testing.T) {
+	lookup := func(key string) (string, error) {
+		switch key {
+		case "package.name":
+			return "py3-foo", nil
+		case "package.version":
+			return "1.2.3", nil
+		case "targets.destdir":
+			return "/home/build/melange-out/py3-foo", nil
+		}
+		return "", fmt.Errorf("unknown key %s", key)
+	}
+
+	for _, tc := range []struct {
+		doc, want string
+	}{
+		{"${{upper(package.name)}}", "PY3-FOO"},
+		{"${{ lower('FOO') }}", "foo"},
+		{"v${{replace(package.version, '.', '_')}}", "v1_2_3"},
+		{"${{replace(package.name,'py3-','')}}", "foo"},
+		{"${{basename(targets.destdir)}}", "py3-foo"},
+	} {
+		got, err := Subst(tc.doc, lookup)
+		require.NoError(t, err, tc.doc)
+		require.Equal(t, tc.want, got, tc.doc)
+	}
+
+	for _, doc := range []string{
+		"${{reverse(package.name)}}",
+		"${{upper(package.name, package.version)}}",
+		"${{upper(package.missing)}}",
+	} {
+		_, err := Subst(doc, lookup)
+		require.Error(t, err, doc)
+	}
+}
+
+func TestSubstQuoted(t *testing.T) {
+	got, err := SubstQuoted("${{upper(foo.bar)}} == 'BAZ' && ${{foo.bar}} == ${{ foo.steps }}", func(key string) (string, error) {
+		if key == "foo.steps" {
+			return "", ErrUnresolved
+		}
+		return placeholderLookup(key)
+	})
+	require.NoError(t, err)
+	require.Equal(t, `"BAZ" == 'BAZ' && "baz" == ${{foo.steps}}`, got)
+}
@@ -14,6 +14,12 @@
 
 package config
 
+import (
+	"maps"
+	"regexp"
+	"slices"
+)
+
 // ListOption describes an optional deviation to a list, for example, a
 // list of packages.
 type ListOption struct {
@@ -37,3 +43,69 @@ type BuildOption struct {
 	Vars        map[string]string `yaml:"vars,omitempty"`
 	Environment EnvironmentOption `yaml:"environment,omitempty"`
 }
+
+// OptionReference is a `${{options.<name>.enabled}}` reference, or an
+// option-environment key, found in a pipeline step.
+type OptionReference struct {
+	// The referenced option name.
+	Option string
+	// The step containing the reference, identified by its name or uses.
+	Step string
+}
+
+var optionReferenceRegex = regexp.MustCompile(`\$\{\{\s*options\.([^.}\s]+)\.enabled\s*\}\}`)
+
+// UndeclaredOptionReferences returns the `${{options.<name>.enabled}}`
+// references and option-environment keys in the package, subpackage and test
+// pipelines which do not correspond to an option declared in the options
+// block.  Such references silently resolve to nothing, which usually means a
+// typo.
+func (cfg Configuration) UndeclaredOptionReferences() []OptionReference {
+	var refs []OptionReference
+
+	var walk func(ps []Pipeline)
+	walk = func(ps []Pipeline) {
+		for _, p := range ps {
+			fields := []string{p.Runs, p.Post, p.If}
+			for _, v := range p.With {
+				fields = append(fields, v)
+			}
+			for _, v := range p.Environment {
+				fields = append(fields, v)
+			}
+
+			options := []string{}
+			for _, field := range fields {
+				for _, m := range optionReferenceRegex.FindAllStringSubmatch(field, -1) {
+					options = append(options, m[1])
+				}
+			}
+			options = append(options, slices.Sorted(maps.Keys(p.OptionEnvironment))...)
+
+			for _, opt := range options {
+				if _, ok := cfg.Options[opt]; ok {
+					continue
+				}
+				ref := OptionReference{Option: opt, Step: p.Identity()}
+				if !slices.Contains(refs, ref) {
+					refs = append(refs, ref)
+				}
+			}
+
+			walk(p.Pipeline)
+		}
+	}
+
+	walk(cfg.Pipeline)
+	if cfg.Test != nil {
+		walk(cfg.Test.Pipeline)
+	}
+	for _, sp := range cfg.Subpackages {
+		walk(sp.Pipeline)
+		if sp.Test != nil {
+			walk(sp.Test.Pipeline)
+		}
+	}
+
+	return refs
+}
@@ -17,6 +17,8 @@ package config
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -25,6 +27,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -104,6 +107,9 @@ type Package struct {
 	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
 	// List of target architectures for which this package should be build for
 	TargetArchitecture []string `json:"target-architecture,omitempty" yaml:"target-architecture,omitempty"`
+	// List of architectures for which this package is not built, which
+	// builds for them skip
+	ExcludeArchs []string `json:"exclude-archs,omitempty" yaml:"exclude-archs,omitempty"`
 	// The list of copyrights for this package
 	Copyright []Copyright `json:"copyright,omitempty" yaml:"copyright,omitempty"`
 	// List of packages to depends on
@@ -115,6 +121,13 @@ type Package struct {
 	Scriptlets *Scriptlets `json:"scriptlets,omitempty" yaml:"scriptlets,omitempty"`
 	// Optional: enabling, disabling, and configuration of build checks
 	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
+	// Optional: Whether the package must be built reproducibly. If set, the
+	// package is built with a build date and a scrubbed environment, and the
+	// build fails when it detects that the package is not reproducible.
+	Reproducible bool `json:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+	// Optional: The version of the pipelines embedded in melange, as reported
+	// by ${{build.pipelines-version}}, which the package must be built with.
+	PipelinesVersion string `json:"pipelines-version,omitempty" yaml:"pipelines-version,omitempty"`
 
 	// Optional: The amount of time to allow this build to take before timing out.
 	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
@@ -164,6 +177,14 @@ func (p Package) FullVersion() string {
 	return fmt.Sprintf("%s-r%d", p.Version, p.Epoch)
 }
 
+// ExcludesArch reports whether arch is one of the architectures listed in
+// exclude-archs, by any of its names.
+func (p Package) ExcludesArch(arch apko_types.Architecture) bool {
+	return slices.ContainsFunc(p.ExcludeArchs, func(a string) bool {
+		return apko_types.ParseArchitecture(a) == arch
+	})
+}
+
 func (cfg *Configuration) applySubstitutionsForProvides() error {
 	nw := buildConfigMap(cfg)
 	if err := cfg.PerformVarSubstitutions(nw); err != nil {
@@ -306,11 +327,19 @@ type Copyright struct {
 // LicenseExpression returns an SPDX license expression formed from the data in
 // the copyright structs found in the conf. It's a simple OR for now.
 func (p Package) LicenseExpression() string {
+	return licenseExpression(p.Copyright)
+}
+
+// LicenseExpression returns an SPDX license expression formed from the
+// copyright declared on the subpackage itself.  Subpackages which do not
+// declare a copyright inherit the license of the origin package.
+func (sp Subpackage) LicenseExpression() string {
+	return licenseExpression(sp.Copyright)
+}
+
+func licenseExpression(copyright []Copyright) string {
 	licenseExpression := ""
-	if p.Copyright == nil {
-		return licenseExpression
-	}
-	for _, cp := range p.Copyright {
+	for _, cp := range copyright {
 		if licenseExpression != "" {
 			licenseExpression += " OR "
 		}
@@ -352,12 +381,24 @@ func (p Package) FullCopyright() string {
 type Needs struct {
 	// A list of packages needed by this pipeline
 	Packages []string
+	// A list of the names of sibling steps which must run before this one,
+	// regardless of their order in the list
+	Steps []string `json:",omitempty" yaml:",omitempty"`
+	// A list of Linux capabilities, such as CAP_SYS_ADMIN, which the runner
+	// must grant to the build environment for this pipeline to run
+	Capabilities []string `json:",omitempty" yaml:",omitempty"`
 }
 
 type PipelineAssertions struct {
 	// The number (an int) of required steps that must complete successfully
 	// within the asserted pipeline.
 	RequiredSteps int `json:"required-steps,omitempty" yaml:"required-steps,omitempty"`
+	// The maximum number (an int) of steps that may run within the asserted
+	// pipeline.
+	MaxSteps int `json:"max-steps,omitempty" yaml:"max-steps,omitempty"`
+	// The names, or uses, of the steps within the asserted pipeline that must
+	// not run.
+	ForbiddenSteps []string `json:"forbidden-steps,omitempty" yaml:"forbidden-steps,omitempty"`
 }
 
 type Pipeline struct {
@@ -371,8 +412,20 @@ type Pipeline struct {
 	Uses string `json:"uses,omitempty" yaml:"uses,omitempty"`
 	// Optional: Arguments passed to the reusable pipelines defined in `uses`
 	With map[string]string `json:"with,omitempty" yaml:"with,omitempty"`
+	// Optional: Arguments overriding those in `with` when building for an
+	// architecture, keyed by architecture. For example:
+	//		arch-overrides:
+	//		  aarch64:
+	//		    cflags: -mbranch-protection=standard
+	ArchOverrides map[string]map[string]string `json:"arch-overrides,omitempty" yaml:"arch-overrides,omitempty"`
 	// Optional: The command to run using the builder's shell (/bin/sh)
 	Runs string `json:"runs,omitempty" yaml:"runs,omitempty"`
+	// Optional: A command always run after `runs` and the nested pipelines,
+	// whether or not they succeed, such as to unmount or kill what they
+	// leave behind.
+	//
+	// Its failure is joined with that of the pipeline, if any.
+	Post string `json:"post,omitempty" yaml:"post,omitempty"`
 	// Optional: The list of pipelines to run.
 	//
 	// Each pipeline runs in its own context that is not shared between other
@@ -392,171 +445,180 @@ type Pipeline struct {
 	Assertions *PipelineAssertions `json:"assertions,omitempty" yaml:"assertions,omitempty"`
 	// Optional: The working directory of the pipeline
 	//
-	// This defaults to the guests' build workspace (/home/build)
+	// This defaults to that of the parent pipeline, or else the guests' build
+	// workspace (/home/build), which a relative one is resolved against.
 	WorkDir string `json:"working-directory,omitempty" yaml:"working-directory,omitempty"`
 	// Optional: environment variables to override the apko environment
 	Environment map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// Optional: environment variables only exported when a build option is
+	// enabled, keyed by option name. They override environment, and are
+	// inherited by child pipelines, whose own override the inherited ones.
+	OptionEnvironment map[string]map[string]string `json:"option-environment,omitempty" yaml:"option-environment,omitempty"`
+	// Optional: The hosts the HTTP proxy melange routes the pipeline, and
+	// the pipelines it uses, to forwards requests to. A host prefixed with
+	// "*." allows all of its subdomains.
+	//
+	// When set, the proxy refuses all other hosts, and the pipeline fails if
+	// it refused any. Routing is best effort: only clients honoring the proxy
+	// environment variables use the proxy, so this restricts no network
+	// access.
+	ProxyAllowHosts []string `json:"proxy-allow-hosts,omitempty" yaml:"proxy-allow-hosts,omitempty"`
+	// Optional: The number of times to run the pipeline, to surface flaky
+	// tests. Only supported in test pipelines.
+	//
+	// Unlike a retry, all repetitions run even if some fail, and the pipeline
+	// only succeeds if all of them pass.
+	Repeat int `json:"repeat,omitempty" yaml:"repeat,omitempty"`
+	// Optional: Whether the first failing child pipeline aborts the remaining
+	// ones.
+	//
+	// This defaults to true. When false, all child pipelines are run to
+	// completion and their errors are aggregated.
+	FailFast *bool `json:"fail-fast,omitempty" yaml:"fail-fast,omitempty"`
+	// Optional: Whether the pipeline, and the pipelines it uses, may modify
+	// the source in the workspace when the build mounts it read-only.
+	//
+	// Pipelines using fetch, git-checkout or patch always may.
+	WritableSource bool `json:"writable-source,omitempty" yaml:"writable-source,omitempty"`
+	// Optional: The absolute path of the shell running the pipeline, and the
+	// pipelines it uses, unless they set their own.
+	//
+	// This defaults to that of the build, which defaults to /bin/sh.
+	Shell string `json:"shell,omitempty" yaml:"shell,omitempty"`
+	// Optional: The amount of time to allow the pipeline's own script to
+	// take before timing out, such as 30m.
+	//
+	// Nested pipelines each have their own timeout.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Optional: The number of times to retry the pipeline's own script when
+	// it fails, such as on transient network failures.
+	//
+	// Unlike a repetition, the pipeline succeeds as soon as an attempt
+	// passes. The nested pipelines, such as those of the pipeline it uses,
+	// inherit the retries and retry delay unless they set their own.
+	Retries int `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// Optional: The delay before the first retry, doubled before each
+	// following one, such as 10s.
+	//
+	// This defaults to 1s.
+	RetryDelay time.Duration `json:"retry-delay,omitempty" yaml:"retry-delay,omitempty"`
+	// Optional: Whether the build proceeds when the pipeline fails, for
+	// best-effort steps such as cleanups.
+	//
+	// The failure is logged as a warning, and the pipeline still counts as
+	// run towards the required steps of its parent.
+	ContinueOnError bool `json:"continue-on-error,omitempty" yaml:"continue-on-error,omitempty"`
+	// Optional: Whether the working directory is created if it does not
+	// exist, which the pipelines it uses inherit unless they set their own.
+	//
+	// This defaults to true. When false, the pipeline fails if its working
+	// directory does not exist, e.g. because a previous pipeline did not
+	// produce it.
+	WorkDirCreate *bool `json:"workdir-create,omitempty" yaml:"workdir-create,omitempty"`
+	// Optional: Directories added to the PATH of the pipeline, before the
+	// default ones, e.g. where a build tool installs itself.
+	//
+	// The nested pipelines inherit them, after their own.
+	PathPrepend []string `json:"path-prepend,omitempty" yaml:"path-prepend,omitempty"`
+	// Optional: Directories added to the PATH of the pipeline, after the
+	// default ones.
+	//
+	// The nested pipelines inherit them, before their own.
+	PathAppend []string `json:"path-append,omitempty" yaml:"path-append,omitempty"`
+	// Optional: The CPU and memory limits of the pipeline, overriding those
+	// of the build, on runners which can change them while the build runs.
+	//
+	// Only supported in top-level pipelines.
+	Resources *PipelineResources `json:"resources,omitempty" yaml:"resources,omitempty"`
 }
 
-// SBOMPackageForUpstreamSource returns an SBOM package for the upstream source
-// of the package, if this Pipeline step was used to bring source code from an
-// upstream project into the build. This function helps with generating SBOMs
-// for the package being built. If the pipeline step is not a fetch or
-// git-checkout step, this function returns nil and no error.
-func (p Pipeline) SBOMPackageForUpstreamSource(licenseDeclared, supplier string, uniqueID string) (*sbom.Package, error) {
-	// TODO: It'd be great to detect the license from the source code itself. Such a
-	//  feature could even eliminate the need for the package's license field in the
-	//  build configuration.
-
-	uses, with := p.Uses, p.With
-
-	switch uses {
-	case "fetch":
-		args := make(map[string]string)
-		args["download_url"] = with["uri"]
-
-		expectedSHA256 := with["expected-sha256"]
-		if len(expectedSHA256) > 0 {
-			args["checksum"] = "sha256:" + expectedSHA256
-		}
-		expectedSHA512 := with["expected-sha512"]
-		if len(expectedSHA512) > 0 {
-			args["checksum"] = "sha512:" + expectedSHA512
-		}
-
-		// These get defaulted correctly from within the fetch pipeline definition
-		// (YAML) itself.
-		pkgName := with["purl-name"]
-		pkgVersion := with["purl-version"]
-
-		pu := &purl.PackageURL{
-			Type:       "generic",
-			Name:       pkgName,
-			Version:    pkgVersion,
-			Qualifiers: purl.QualifiersFromMap(args),
-		}
-		if err := pu.Normalize(); err != nil {
-			return nil, err
-		}
-
-		idComponents := []string{pkgName, pkgVersion}
-		if uniqueID != "" {
-			idComponents = append(idComponents, uniqueID)
-		}
-
-		return &sbom.Package{
-			IDComponents: idComponents,
-			Name:         pkgName,
-			Version:      pkgVersion,
-			Namespace:    supplier,
-			PURL:         pu,
-		}, nil
-
-	case "git-checkout":
-		repo := with["repository"]
-		branch := with["branch"]
-		tag := with["tag"]
-		expectedCommit := with["expected-commit"]
-
-		// We'll use all available data to ensure our SBOM's package ID is unique, even
-		// when the same repo is git-checked out multiple times.
-		var idComponents []string
-		repoCleaned := func() string {
-			s := strings.TrimPrefix(repo, "https://")
-			s = strings.TrimPrefix(s, "http://")
-			return s
-		}()
-		for _, component := range []string{repoCleaned, branch, tag, expectedCommit} {
-			if component != "" {
-				idComponents = append(idComponents, component)
-			}
-		}
-		if uniqueID != "" {
-			idComponents = append(idComponents, uniqueID)
-		}
-
-		if strings.HasPrefix(repo, "https://github.com/") {
-			namespace, name, _ := strings.Cut(strings.TrimPrefix(repo, "https://github.com/"), "/")
-
-			// Prefer tag to commit, but use only ONE of these.
-
-			versions := []string{
-				tag,
-				expectedCommit,
-			}
-
-			for _, v := range versions {
-				if v == "" {
-					continue
-				}
+// PipelineResources are the limits of a top-level pipeline, which override
+// the resources of the build while it runs.
+type PipelineResources struct {
+	// Optional: The number of CPUs, which may be fractional, such as 1.5.
+	CPU string `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	// Optional: The amount of memory, such as 8Gi.
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+}
 
-				pu := &purl.PackageURL{
-					Type:      purl.TypeGithub,
-					Namespace: namespace,
-					Name:      name,
-					Version:   v,
-				}
-				if err := pu.Normalize(); err != nil {
-					return nil, err
-				}
+// FailsFast reports whether the first failing child pipeline should abort
+// the remaining ones.
+func (p Pipeline) FailsFast() bool {
+	return p.FailFast == nil || *p.FailFast
+}
 
-				return &sbom.Package{
-					IDComponents:    idComponents,
-					Name:            name,
-					Version:         v,
-					LicenseDeclared: licenseDeclared,
-					Namespace:       namespace,
-					PURL:            pu,
-				}, nil
-			}
+// CreatesWorkDir reports whether the working directory of the pipeline is
+// created if it does not exist.
+func (p Pipeline) CreatesWorkDir() bool {
+	return p.WorkDirCreate == nil || *p.WorkDirCreate
+}
 
-			// If we get here, we have a GitHub repo but no tag or commit. Without version
-			// information, we can't create a sensible SBOM package.
-			//
-			// TODO: Decide if this should be an error condition.
+// UsesName returns the name of the pipeline the step uses, without the
+// version it is pinned to, if any.
+func (p Pipeline) UsesName() string {
+	name, _, _ := strings.Cut(p.Uses, "@")
+	return name
+}
 
-			return nil, nil
-		}
+// UnidentifiablePipeline is the identity of a step with no name, uses or runs.
+const UnidentifiablePipeline = "???"
 
-		// Create nice looking package name, last component of uri, without .git
-		name := strings.TrimSuffix(path.Base(repo), ".git")
+// Identity returns a name for p to use in logs: its name, else what it uses,
+// else a short hash of what it runs.
+func (p Pipeline) Identity() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if p.Uses != "" {
+		return p.Uses
+	}
+	if p.Runs != "" {
+		sum := sha256.Sum256([]byte(p.Runs))
+		return "runs-" + hex.EncodeToString(sum[:4])
+	}
 
-		// Encode vcs_url with git+ prefix and @commit suffix
-		vcsUrl := "git+" + repo
+	return UnidentifiablePipeline
+}
 
-		if len(expectedCommit) > 0 {
-			vcsUrl += "@" + expectedCommit
-		}
+// GitCheckoutRepository returns the repository checked out by p, if it is a
+// git-checkout step of any version, or else "".
+func (p Pipeline) GitCheckoutRepository() string {
+	if p.UsesName() != "git-checkout" {
+		return ""
+	}
+	return p.With["repository"]
+}
 
-		// Use tag as version
-		version := ""
-		if len(tag) > 0 {
-			version = tag
-		}
+// ChildWorkDir returns the working directory of a nested pipeline of p whose
+// own is workdir: that of p if unset and absolute, or else workdir.  Relative
+// working directories are resolved against that of the parent pipeline when
+// they run, so a nested pipeline does not inherit a relative one, which would
+// resolve it twice.
+func (p Pipeline) ChildWorkDir(workdir string) string {
+	if workdir == "" && path.IsAbs(p.WorkDir) {
+		return p.WorkDir
+	}
+	return workdir
+}
 
-		pu := purl.PackageURL{
-			Type:       "generic",
-			Name:       name,
-			Version:    version,
-			Qualifiers: purl.QualifiersFromMap(map[string]string{"vcs_url": vcsUrl}),
-		}
-		if err := pu.Normalize(); err != nil {
-			return nil, err
-		}
+// SBOMPackageForUpstreamSource returns an SBOM package for the upstream source
+// of the package, if this Pipeline step was used to bring source code from an
+// upstream project into the build. This function helps with generating SBOMs
+// for the package being built. If no UpstreamSourceFunc is registered for the
+// pipeline used by the step, this function returns nil and no error.
+func (p Pipeline) SBOMPackageForUpstreamSource(licenseDeclared, supplier string, uniqueID string) (*sbom.Package, error) {
+	// TODO: It'd be great to detect the license from the source code itself. Such a
+	//  feature could even eliminate the need for the package's license field in the
+	//  build configuration.
 
-		return &sbom.Package{
-			IDComponents:    idComponents,
-			Name:            name,
-			Version:         version,
-			LicenseDeclared: licenseDeclared,
-			Namespace:       supplier,
-			PURL:            &pu,
-		}, nil
+	upstreamSourcesMu.RLock()
+	fn, ok := upstreamSources[p.UsesName()]
+	upstreamSourcesMu.RUnlock()
+	if !ok {
+		return nil, nil
 	}
 
-	// This is not a fetch or git-checkout step.
-
-	return nil, nil
+	return fn(p, licenseDeclared, supplier, uniqueID)
 }
 
 type Subpackage struct {
@@ -579,10 +641,27 @@ type Subpackage struct {
 	URL string `json:"url,omitempty" yaml:"url,omitempty"`
 	// Optional: The git commit of the subpackage build configuration
 	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// Optional: The license of the subpackage, if it differs from the license
+	// of the origin package
+	Copyright []Copyright `json:"copyright,omitempty" yaml:"copyright,omitempty"`
 	// Optional: enabling, disabling, and configuration of build checks
 	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
 	// Test section for the subpackage.
 	Test *Test `json:"test,omitempty" yaml:"test,omitempty"`
+	// Optional: The name of the directory, in the output directory, which
+	// the subpackage is installed into and packaged from, as
+	// ${{targets.subpkgdir}} and ${{targets.contextdir}}.  Defaults to the
+	// name of the subpackage.
+	DestDir string `json:"destdir,omitempty" yaml:"destdir,omitempty"`
+}
+
+// DestDirName returns the name of the directory, in the output directory,
+// the subpackage is packaged from.
+func (sp Subpackage) DestDirName() string {
+	if sp.DestDir != "" {
+		return sp.DestDir
+	}
+	return sp.Name
 }
 
 type Input struct {
@@ -592,6 +671,9 @@ type Input struct {
 	Default string `json:"default,omitempty"`
 	// Optional: A toggle denoting whether the input is required or not
 	Required bool `json:"required,omitempty"`
+	// Optional: A toggle denoting whether the input holds a secret value that
+	// should be redacted from logs
+	Secret bool `json:"secret,omitempty"`
 }
 
 // The root melange configuration
@@ -890,6 +972,7 @@ type configOptions struct {
 	commit                      string
 
 	varsFilePath string
+	vars         map[string]string
 }
 
 // include reconciles all given opts into the receiver variable, such that it is
@@ -960,6 +1043,14 @@ func WithVarsFileForParsing(path string) ConfigurationParsingOption {
 	}
 }
 
+// WithVarsForParsing sets variables which are added to the variables block,
+// overriding those of the configuration file and of the vars file.
+func WithVarsForParsing(vars map[string]string) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.vars = vars
+	}
+}
+
 // buildConfigMap builds a map used to prepare a replacer for variable substitution.
 func buildConfigMap(cfg *Configuration) map[string]string {
 	out := map[string]string{
@@ -1002,7 +1093,9 @@ func replaceNeeds(r *strings.Replacer, in *Needs) *Needs {
 		return nil
 	}
 	return &Needs{
-		Packages: replaceAll(r, in.Packages),
+		Packages:     replaceAll(r, in.Packages),
+		Steps:        replaceAll(r, in.Steps),
+		Capabilities: replaceAll(r, in.Capabilities),
 	}
 }
 
@@ -1018,6 +1111,18 @@ func replaceMap(r *strings.Replacer, in map[string]string) map[string]string {
 	return replacedWith
 }
 
+func replaceNestedMap(r *strings.Replacer, in map[string]map[string]string) map[string]map[string]string {
+	if len(in) == 0 {
+		return nil
+	}
+
+	out := make(map[string]map[string]string, len(in))
+	for key, m := range in {
+		out[key] = replaceMap(r, m)
+	}
+	return out
+}
+
 func replaceEntrypoint(r *strings.Replacer, in apko_types.ImageEntrypoint) apko_types.ImageEntrypoint {
 	return apko_types.ImageEntrypoint{
 		Type:          in.Type,
@@ -1057,18 +1162,36 @@ func replaceImageConfig(r *strings.Replacer, in apko_types.ImageConfiguration) a
 
 func replacePipeline(r *strings.Replacer, in Pipeline) Pipeline {
 	return Pipeline{
-		Name:        r.Replace(in.Name),
-		Uses:        in.Uses,
-		With:        replaceMap(r, in.With),
-		Runs:        r.Replace(in.Runs),
-		Pipeline:    replacePipelines(r, in.Pipeline),
-		Inputs:      in.Inputs,
-		Needs:       replaceNeeds(r, in.Needs),
-		Label:       in.Label,
-		If:          r.Replace(in.If),
-		Assertions:  in.Assertions,
-		WorkDir:     r.Replace(in.WorkDir),
-		Environment: replaceMap(r, in.Environment),
+		Name:            r.Replace(in.Name),
+		Uses:            in.Uses,
+		With:            replaceMap(r, in.With),
+		ArchOverrides:   replaceNestedMap(r, in.ArchOverrides),
+		Runs:            r.Replace(in.Runs),
+		Post:            r.Replace(in.Post),
+		Resources:       in.Resources,
+		Pipeline:        replacePipelines(r, in.Pipeline),
+		Inputs:          in.Inputs,
+		Needs:           replaceNeeds(r, in.Needs),
+		Label:           in.Label,
+		If:              r.Replace(in.If),
+		Assertions:      in.Assertions,
+		WorkDir:         r.Replace(in.WorkDir),
+		Environment:     replaceMap(r, in.Environment),
+		ProxyAllowHosts: replaceAll(r, in.ProxyAllowHosts),
+		Repeat:          in.Repeat,
+		FailFast:        in.FailFast,
+		Shell:           in.Shell,
+		Timeout:         in.Timeout,
+		Retries:         in.Retries,
+		RetryDelay:      in.RetryDelay,
+
+		ContinueOnError: in.ContinueOnError,
+		WorkDirCreate:   in.WorkDirCreate,
+		PathPrepend:     replaceAll(r, in.PathPrepend),
+		PathAppend:      replaceAll(r, in.PathAppend),
+
+		WritableSource:    in.WritableSource,
+		OptionEnvironment: replaceNestedMap(r, in.OptionEnvironment),
 	}
 }
 
@@ -1140,11 +1263,14 @@ func replacePackage(r *strings.Replacer, commit string, in Package) Package {
 		URL:                r.Replace(in.URL),
 		Commit:             replaceCommit(commit, in.Commit),
 		TargetArchitecture: replaceAll(r, in.TargetArchitecture),
+		ExcludeArchs:       replaceAll(r, in.ExcludeArchs),
 		Copyright:          in.Copyright,
 		Dependencies:       replaceDependencies(r, in.Dependencies),
 		Options:            in.Options,
 		Scriptlets:         replaceScriptlets(r, in.Scriptlets),
 		Checks:             in.Checks,
+		Reproducible:       in.Reproducible,
+		PipelinesVersion:   in.PipelinesVersion,
 		Timeout:            in.Timeout,
 		Resources:          in.Resources,
 	}
@@ -1161,8 +1287,10 @@ func replaceSubpackage(r *strings.Replacer, detectedCommit string, in Subpackage
 		Description:  r.Replace(in.Description),
 		URL:          r.Replace(in.URL),
 		Commit:       replaceCommit(detectedCommit, in.Commit),
+		Copyright:    in.Copyright,
 		Checks:       in.Checks,
 		Test:         replaceTest(r, in.Test),
+		DestDir:      r.Replace(in.DestDir),
 	}
 }
 
@@ -1214,9 +1342,7 @@ func replaceSubpackages(r *strings.Replacer, datas map[string]DataItems, cfg Con
 // propagateChildPipelines performs downward propagation of configuration values.
 func (p *Pipeline) propagateChildPipelines() {
 	for idx := range p.Pipeline {
-		if p.Pipeline[idx].WorkDir == "" {
-			p.Pipeline[idx].WorkDir = p.WorkDir
-		}
+		p.Pipeline[idx].WorkDir = p.ChildWorkDir(p.Pipeline[idx].WorkDir)
 
 		p.Pipeline[idx].Environment = util.RightJoinMap(p.Environment, p.Pipeline[idx].Environment)
 
@@ -1306,6 +1432,14 @@ func ParseConfiguration(_ context.Context, configurationFilePath string, opts ..
 		}
 	}
 
+	// Variables set by the caller, e.g. on the command line, win over both.
+	if len(options.vars) != 0 && cfg.Vars == nil {
+		cfg.Vars = make(map[string]string, len(options.vars))
+	}
+	for k, v := range options.vars {
+		cfg.Vars[k] = v
+	}
+
 	// Mutate config properties with substitutions.
 	configMap := buildConfigMap(&cfg)
 	if err := cfg.PerformVarSubstitutions(configMap); err != nil {
@@ -1468,6 +1602,15 @@ func (cfg Configuration) validate() error {
 	if err := validatePipelines(cfg.Pipeline); err != nil {
 		return ErrInvalidConfiguration{Problem: err}
 	}
+	if cfg.Test != nil {
+		if err := validateRequiredSteps(cfg.Test.Pipeline); err != nil {
+			return ErrInvalidConfiguration{Problem: err}
+		}
+	}
+
+	// The packages by the directory they are packaged from, which only one
+	// package may be.
+	destDirs := map[string]string{cfg.Package.Name: cfg.Package.Name}
 
 	saw := map[string]int{cfg.Package.Name: -1}
 	for i, sp := range cfg.Subpackages {
@@ -1494,6 +1637,20 @@ func (cfg Configuration) validate() error {
 		if err := validatePipelines(sp.Pipeline); err != nil {
 			return ErrInvalidConfiguration{Problem: err}
 		}
+		if sp.Test != nil {
+			if err := validateRequiredSteps(sp.Test.Pipeline); err != nil {
+				return ErrInvalidConfiguration{Problem: err}
+			}
+		}
+
+		if sp.DestDir != "" && !packageNameRegex.MatchString(sp.DestDir) {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q has destdir %q, which must match regex %q", sp.Name, sp.DestDir, packageNameRegex)}
+		}
+		dir := sp.DestDirName()
+		if other, ok := destDirs[dir]; ok {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q would be packaged from the destdir %q of %q", sp.Name, dir, other)}
+		}
+		destDirs[dir] = sp.Name
 	}
 
 	return nil
@@ -1513,10 +1670,49 @@ func validatePipelines(ps []Pipeline) error {
 			return fmt.Errorf("pipeline cannot contain both with and runs")
 		}
 
+		if p.Repeat != 0 {
+			return fmt.Errorf("pipeline cannot repeat outside of a test")
+		}
+
+		for _, c := range p.Pipeline {
+			if c.Resources != nil {
+				return fmt.Errorf("nested pipeline %q cannot set resources, only top-level pipelines can", c.Identity())
+			}
+		}
+
 		if err := validatePipelines(p.Pipeline); err != nil {
 			return err
 		}
 	}
+	return validateRequiredSteps(ps)
+}
+
+// validateRequiredSteps checks that no pipeline requires more steps to run
+// than it has, or than it allows.  The steps of a pipeline which uses another
+// are not known until it is compiled, so those are left to fail when they
+// run.
+func validateRequiredSteps(ps []Pipeline) error {
+	for i, p := range ps {
+		name := fmt.Sprintf("pipeline[%d]", i)
+		if p.Name != "" {
+			name = fmt.Sprintf("pipeline %q", p.Name)
+		}
+		if a := p.Assertions; a != nil {
+			if p.Uses == "" && a.RequiredSteps > len(p.Pipeline) {
+				return fmt.Errorf("%s requires %d steps to run but has only %d", name, a.RequiredSteps, len(p.Pipeline))
+			}
+			if a.MaxSteps != 0 && a.RequiredSteps > a.MaxSteps {
+				return fmt.Errorf("%s requires %d steps to run but allows at most %d", name, a.RequiredSteps, a.MaxSteps)
+			}
+			if a.MaxSteps < 0 {
+				return fmt.Errorf("%s allows at most %d steps to run, which must not be negative", name, a.MaxSteps)
+			}
+		}
+
+		if err := validateRequiredSteps(p.Pipeline); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1,11 +1,16 @@
 package config
 
 import (
+	"maps"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/sbom"
 	"github.com/chainguard-dev/clog/slogtest"
+	purl "github.com/package-url/packageurl-go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -263,6 +268,137 @@ subpackages:
 	require.Equal(t, map[string]string{"foo": "BAR", "bar": "BAR", "baz": "BAZ"}, cfg.Subpackages[0].Pipeline[0].Pipeline[0].Environment)
 }
 
+// parseTestConfiguration parses the build file data through
+// ParseConfiguration.
+func parseTestConfiguration(t *testing.T, data string) *Configuration {
+	t.Helper()
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(slogtest.Context(t), fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	return cfg
+}
+
+func TestParseRetries(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: retries
+  version: 0.0.1
+  epoch: 1
+
+pipeline:
+  - runs: curl https://example.com
+    retries: 3
+    retry-delay: 5s
+`)
+
+	require.Equal(t, 3, cfg.Pipeline[0].Retries)
+	require.Equal(t, 5*time.Second, cfg.Pipeline[0].RetryDelay)
+}
+
+func TestParseContinueOnError(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: continue-on-error
+  version: 0.0.1
+  epoch: 1
+
+pipeline:
+  - runs: make check
+    continue-on-error: true
+  - runs: make install
+`)
+
+	require.True(t, cfg.Pipeline[0].ContinueOnError)
+	require.False(t, cfg.Pipeline[1].ContinueOnError)
+}
+
+func TestParseWorkDirCreate(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: workdir-create
+  version: 0.0.1
+  epoch: 1
+
+pipeline:
+  - runs: make
+    working-directory: /home/build/src
+    workdir-create: false
+  - runs: make install
+    working-directory: /home/build/src
+`)
+
+	require.False(t, cfg.Pipeline[0].CreatesWorkDir())
+	require.True(t, cfg.Pipeline[1].CreatesWorkDir())
+}
+
+func TestParsePath(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: path
+  version: 0.0.1
+  epoch: 1
+
+vars:
+  go-version: "1.23"
+
+pipeline:
+  - runs: go build
+    path-prepend:
+      - /usr/lib/go-${{vars.go-version}}/bin
+    path-append:
+      - /opt/tools/bin
+`)
+
+	require.Equal(t, []string{"/usr/lib/go-1.23/bin"}, cfg.Pipeline[0].PathPrepend)
+	require.Equal(t, []string{"/opt/tools/bin"}, cfg.Pipeline[0].PathAppend)
+}
+
+func TestParseReproducible(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: reproducible
+  version: 0.0.1
+  epoch: 1
+  reproducible: true
+`)
+
+	require.True(t, cfg.Package.Reproducible)
+}
+
+func TestParsePipelinesVersion(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: pipelines-version
+  version: 0.0.1
+  epoch: 1
+  pipelines-version: "3"
+`)
+
+	require.Equal(t, "3", cfg.Package.PipelinesVersion)
+}
+
+func TestParseNeedsCapabilities(t *testing.T) {
+	cfg := parseTestConfiguration(t, `
+package:
+  name: capabilities
+  version: 0.0.1
+  epoch: 1
+
+pipeline:
+  - runs: mount -t tmpfs none /mnt
+    needs:
+      capabilities:
+        - CAP_SYS_ADMIN
+`)
+
+	require.Equal(t, []string{"CAP_SYS_ADMIN"}, cfg.Pipeline[0].Needs.Capabilities)
+}
+
 func Test_propagateWorkingDirectory(t *testing.T) {
 	ctx := slogtest.Context(t)
 	fp := filepath.Join(os.TempDir(), "melange-test-propagateWorkingDirectory")
@@ -407,6 +543,48 @@ func TestValidatePipelines(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid pipeline repeated outside of a test",
+			p: []Pipeline{
+				{Pipeline: []Pipeline{{Runs: "somescript.sh", Repeat: 3}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid pipeline requiring all of its steps",
+			p: []Pipeline{
+				{Assertions: &PipelineAssertions{RequiredSteps: 2}, Pipeline: []Pipeline{{Runs: "a"}, {Runs: "b"}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid pipeline using another requiring steps",
+			p: []Pipeline{
+				{Uses: "split/dev", Assertions: &PipelineAssertions{RequiredSteps: 2}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid pipeline requiring more steps than it has",
+			p: []Pipeline{
+				{Pipeline: []Pipeline{{Assertions: &PipelineAssertions{RequiredSteps: 3}, Pipeline: []Pipeline{{Runs: "a"}, {Runs: "b"}}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid top-level pipeline with resources",
+			p: []Pipeline{
+				{Runs: "make", Resources: &PipelineResources{CPU: "2", Memory: "16Gi"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid nested pipeline with resources",
+			p: []Pipeline{
+				{Pipeline: []Pipeline{{Runs: "make", Resources: &PipelineResources{Memory: "16Gi"}}}},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -441,3 +619,487 @@ func TestGetScheduleMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestUndeclaredOptionReferences(t *testing.T) {
+	ctx := slogtest.Context(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: option-references
+  version: 0.0.1
+  epoch: 0
+
+options:
+  fast:
+    vars:
+      speed: fast
+
+pipeline:
+  - name: declared
+    if: ${{options.fast.enabled}} == 'true'
+    runs: echo fast
+  - name: typo
+    if: ${{options.fsat.enabled}} == 'true'
+    runs: echo ${{options.fsat.enabled}}
+  - name: env
+    option-environment:
+      fast:
+        SPEED: fast
+      slow:
+        SPEED: slow
+    runs: echo $SPEED
+
+subpackages:
+  - name: option-references-sub
+    pipeline:
+      - uses: fetch
+        with:
+          uri: ${{options.missing.enabled}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+
+	require.Equal(t, []OptionReference{
+		{Option: "fsat", Step: "typo"},
+		{Option: "slow", Step: "env"},
+		{Option: "missing", Step: "fetch"},
+	}, cfg.UndeclaredOptionReferences())
+}
+
+func TestSBOMPackageForUpstreamSource_signature(t *testing.T) {
+	p := Pipeline{
+		Uses: "fetch",
+		With: map[string]string{
+			"uri":           "https://example.com/foo-1.0.tar.gz",
+			"signature-url": "https://example.com/foo-1.0.tar.gz.sig",
+			"purl-name":     "foo",
+			"purl-version":  "1.0",
+		},
+	}
+
+	pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Equal(t, "downloaded from https://example.com/foo-1.0.tar.gz and verified against the GPG signature https://example.com/foo-1.0.tar.gz.sig", pkg.SourceInfo)
+
+	delete(p.With, "signature-url")
+	pkg, err = p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Empty(t, pkg.SourceInfo)
+}
+
+func TestSBOMPackageForUpstreamSource_checksum(t *testing.T) {
+	const (
+		sha1    = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+		sha256  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		sha512  = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+		blake2b = "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"
+	)
+
+	for _, tc := range []struct {
+		name string
+		with map[string]string
+		want string
+	}{
+		{"none", map[string]string{}, ""},
+		{"sha1", map[string]string{"expected-sha1": sha1}, "sha1:" + sha1},
+		{"blake2b-256", map[string]string{"expected-blake2b-256": blake2b}, "blake2b-256:" + blake2b},
+		{"sha256", map[string]string{"expected-sha256": sha256}, "sha256:" + sha256},
+		{"sha512", map[string]string{"expected-sha512": sha512}, "sha512:" + sha512},
+		{"sha1 and blake2b-256", map[string]string{"expected-sha1": sha1, "expected-blake2b-256": blake2b}, "blake2b-256:" + blake2b},
+		{"sha1 and sha256", map[string]string{"expected-sha1": sha1, "expected-sha256": sha256}, "sha256:" + sha256},
+		{"blake2b-256 and sha256", map[string]string{"expected-blake2b-256": blake2b, "expected-sha256": sha256}, "sha256:" + sha256},
+		{"sha256 and sha512", map[string]string{"expected-sha256": sha256, "expected-sha512": sha512}, "sha512:" + sha512},
+		{"sha1 and sha512", map[string]string{"expected-sha1": sha1, "expected-sha512": sha512}, "sha512:" + sha512},
+		{"all", map[string]string{"expected-sha1": sha1, "expected-blake2b-256": blake2b, "expected-sha256": sha256, "expected-sha512": sha512}, "sha512:" + sha512},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			with := map[string]string{
+				"uri":          "https://example.com/foo-1.0.tar.gz",
+				"purl-name":    "foo",
+				"purl-version": "1.0",
+			}
+			maps.Copy(with, tc.with)
+
+			p := Pipeline{Uses: "fetch", With: with}
+			pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+			require.NoError(t, err)
+			require.Equal(t, tc.want, pkg.PURL.Qualifiers.Map()["checksum"])
+		})
+	}
+}
+
+func TestSBOMPackageForUpstreamSource_fetchURIs(t *testing.T) {
+	const checksum = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	for _, tc := range []struct {
+		name string
+		with map[string]string
+		want []string
+	}{{
+		name: "uri",
+		with: map[string]string{"uri": "https://example.com/foo-1.0.tar.gz"},
+		want: []string{"https://example.com/foo-1.0.tar.gz"},
+	}, {
+		name: "uris",
+		with: map[string]string{"uris": " https://a.example.com/foo-1.0.tar.gz,\n\nhttps://b.example.com/foo-1.0.tar.gz , "},
+		want: []string{"https://a.example.com/foo-1.0.tar.gz", "https://b.example.com/foo-1.0.tar.gz"},
+	}, {
+		name: "uri and uris",
+		with: map[string]string{
+			"uri":  "https://example.com/foo-1.0.tar.gz",
+			"uris": "https://a.example.com/foo-1.0.tar.gz\nhttps://b.example.com/foo-1.0.tar.gz\n",
+		},
+		want: []string{"https://example.com/foo-1.0.tar.gz", "https://a.example.com/foo-1.0.tar.gz", "https://b.example.com/foo-1.0.tar.gz"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			with := map[string]string{
+				"purl-name":       "foo",
+				"purl-version":    "1.0",
+				"expected-sha256": checksum[len("sha256:"):],
+			}
+			maps.Copy(with, tc.with)
+
+			p := Pipeline{Uses: "fetch", With: with}
+			pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+			require.NoError(t, err)
+
+			var got []string
+			for _, pu := range append([]*purl.PackageURL{pkg.PURL}, pkg.AlternatePURLs...) {
+				require.Equal(t, "generic", pu.Type)
+				require.Equal(t, "foo", pu.Name)
+				require.Equal(t, checksum, pu.Qualifiers.Map()["checksum"])
+				got = append(got, pu.Qualifiers.Map()["download_url"])
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSBOMPackageForUpstreamSource_fetchURIVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		with map[string]string
+		want string
+	}{{
+		name: "version in the filename",
+		with: map[string]string{"uri": "https://example.com/releases/foo-1.2.3.tar.gz?download=1"},
+		want: "1.2.3",
+	}, {
+		name: "prefixed and pre-release version",
+		with: map[string]string{"uri": "https://github.com/foo/foo/archive/refs/tags/v2.0-rc1.zip"},
+		want: "2.0-rc1",
+	}, {
+		name: "version of the first uri",
+		with: map[string]string{"uris": "https://a.example.com/foo_3.1.tgz,https://b.example.com/foo-3.2.tgz"},
+		want: "3.1",
+	}, {
+		name: "zstd tarball",
+		with: map[string]string{"uri": "https://example.com/foo-1.2.3.tzst"},
+		want: "1.2.3",
+	}, {
+		name: "no version in the filename",
+		with: map[string]string{"uri": "https://example.com/1.2.3/foo-latest.tar.gz"},
+	}, {
+		name: "single number",
+		with: map[string]string{"uri": "https://example.com/foo-2024.tar.gz"},
+	}, {
+		name: "purl-version wins",
+		with: map[string]string{"uri": "https://example.com/foo-1.2.3.tar.gz", "purl-version": "1.2.3-custom"},
+		want: "1.2.3-custom",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			with := map[string]string{"purl-name": "foo"}
+			maps.Copy(with, tc.with)
+
+			p := Pipeline{Uses: "fetch", With: with}
+			pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+			require.NoError(t, err)
+			require.Equal(t, tc.want, pkg.PURL.Version)
+			require.Equal(t, tc.want, pkg.Version)
+			for _, pu := range pkg.AlternatePURLs {
+				require.Equal(t, tc.want, pu.Version)
+			}
+		})
+	}
+}
+
+func TestSBOMPackageForUpstreamSource_pinnedVersion(t *testing.T) {
+	p := Pipeline{Uses: "fetch@v2", With: map[string]string{"uri": "https://example.com/foo-1.0.tar.gz", "purl-name": "foo"}}
+	require.Equal(t, "fetch", p.UsesName())
+
+	pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.NotNil(t, pkg)
+	require.Equal(t, "foo", pkg.PURL.Name)
+}
+
+func TestSBOMPackageForUpstreamSource_gitCheckout(t *testing.T) {
+	for _, tc := range []struct {
+		repository    string
+		want          string
+		wantNamespace string
+	}{
+		{"https://github.com/chainguard-dev/melange", "pkg:github/chainguard-dev/melange@v1.0.0", "chainguard-dev"},
+		{"https://github.com/chainguard-dev/melange.git", "pkg:github/chainguard-dev/melange@v1.0.0", "chainguard-dev"},
+		{"https://gitlab.com/gitlab-org/gitlab-runner", "pkg:gitlab/gitlab-org/gitlab-runner@v1.0.0", "gitlab-org"},
+		{"https://gitlab.com/gnutls/libtasn1.git", "pkg:gitlab/gnutls/libtasn1@v1.0.0", "gnutls"},
+		{"https://gitlab.com/group/subgroup/nested/project", "pkg:gitlab/group/subgroup/nested/project@v1.0.0", "group/subgroup/nested"},
+		{"https://bitbucket.org/Atlassian/Stash/", "pkg:bitbucket/atlassian/stash@v1.0.0", "Atlassian"},
+		{"https://gitlab.example.com/group/project", "pkg:generic/project@v1.0.0?vcs_url=git%2Bhttps%3A%2F%2Fgitlab.example.com%2Fgroup%2Fproject", "wolfi"},
+	} {
+		p := Pipeline{
+			Uses: "git-checkout",
+			With: map[string]string{"repository": tc.repository, "tag": "v1.0.0"},
+		}
+		pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+		require.NoError(t, err)
+		require.Equal(t, tc.want, pkg.PURL.String(), tc.repository)
+		require.Equal(t, tc.wantNamespace, pkg.Namespace, tc.repository)
+	}
+
+	// Without a tag or commit, a hosted repository has no version to name.
+	p := Pipeline{
+		Uses: "git-checkout",
+		With: map[string]string{"repository": "https://gitlab.com/group/subgroup/project", "branch": "main"},
+	}
+	pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+}
+
+func TestSBOMPackageForUpstreamSource_build(t *testing.T) {
+	for _, tc := range []struct {
+		uses string
+		with map[string]string
+		want string
+	}{
+		{"go/build", map[string]string{"packages": "github.com/Foo/Bar/cmd/baz"}, "pkg:golang/github.com/foo/bar/cmd/baz"},
+		{"go/build", map[string]string{"packages": "golang.org/x/tools/cmd/stringer ./cmd/foo", "modroot": "src"}, "pkg:golang/golang.org/x/tools/cmd/stringer"},
+		// Packages relative to the modroot are named by the module in its
+		// go.mod, which is unknown, rather than by their path in the
+		// workspace.
+		{"go/build", map[string]string{"packages": "./cmd/foo", "output": "foo"}, ""},
+		{"go/build", map[string]string{"packages": "cmd/foo", "modroot": "src/tool"}, ""},
+		{"go/build", map[string]string{"packages": ".", "modroot": "Tool"}, ""},
+		{"go/build", map[string]string{"packages": "../other"}, ""},
+		{"go/build", map[string]string{}, ""},
+		// cargo/build steps are named after the output they declare, not
+		// their modroot.
+		{"cargo/build", map[string]string{"output": "ripgrep"}, "pkg:cargo/ripgrep"},
+		{"cargo/build", map[string]string{"output": "rg", "modroot": "crates/ripgrep"}, "pkg:cargo/rg"},
+		{"cargo/build", map[string]string{"output": "fd_find", "opts": "--release --locked"}, "pkg:cargo/fd_find"},
+		{"cargo/build", map[string]string{"modroot": "crates/fd-find"}, ""},
+		{"cargo/build", map[string]string{"output": "../rg"}, ""},
+		{"cargo/build", map[string]string{}, ""},
+	} {
+		p := Pipeline{Uses: tc.uses, With: tc.with}
+		pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "0")
+		require.NoError(t, err)
+		if tc.want == "" {
+			require.Nil(t, pkg, "%s with %v", tc.uses, tc.with)
+			continue
+		}
+		require.NotNil(t, pkg, "%s with %v", tc.uses, tc.with)
+		require.Equal(t, tc.want, pkg.PURL.String(), "%s with %v", tc.uses, tc.with)
+		require.Empty(t, pkg.Version)
+		require.Equal(t, "MIT", pkg.LicenseDeclared)
+		require.Equal(t, "wolfi", pkg.Namespace)
+	}
+}
+
+func TestRegisterUpstreamSource(t *testing.T) {
+	p := Pipeline{
+		Uses: "test/crate",
+		With: map[string]string{"crate": "serde", "version": "1.0.0"},
+	}
+
+	pkg, err := p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+
+	RegisterUpstreamSource(p.Uses, func(p Pipeline, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error) {
+		return &sbom.Package{
+			Name:            p.With["crate"],
+			Version:         p.With["version"],
+			LicenseDeclared: licenseDeclared,
+			PURL:            &purl.PackageURL{Type: purl.TypeCargo, Name: p.With["crate"], Version: p.With["version"]},
+		}, nil
+	})
+	t.Cleanup(func() {
+		upstreamSourcesMu.Lock()
+		defer upstreamSourcesMu.Unlock()
+		delete(upstreamSources, p.Uses)
+	})
+
+	pkg, err = p.SBOMPackageForUpstreamSource("MIT", "wolfi", "")
+	require.NoError(t, err)
+	require.Equal(t, "pkg:cargo/serde@1.0.0", pkg.PURL.String())
+	require.Equal(t, "MIT", pkg.LicenseDeclared)
+}
+
+func TestExcludesArch(t *testing.T) {
+	p := Package{ExcludeArchs: []string{"amd64", "armv7"}}
+
+	require.True(t, p.ExcludesArch(apko_types.ParseArchitecture("x86_64")))
+	require.True(t, p.ExcludesArch(apko_types.ParseArchitecture("arm/v7")))
+	require.False(t, p.ExcludesArch(apko_types.ParseArchitecture("aarch64")))
+	require.False(t, Package{}.ExcludesArch(apko_types.ParseArchitecture("x86_64")))
+}
+
+func TestTriplets(t *testing.T) {
+	require.Equal(t, ArchTriplets{
+		GnuGlibc:  "aarch64-unknown-linux-gnu",
+		GnuMusl:   "aarch64-unknown-linux-musl",
+		RustGlibc: "aarch64-unknown-linux-gnu",
+		RustMusl:  "aarch64-unknown-linux-musl",
+	}, Triplets(apko_types.ParseArchitecture("aarch64")))
+
+	require.Equal(t, ArchTriplets{
+		GnuGlibc:  "x86_64-pc-linux-gnu",
+		GnuMusl:   "x86_64-pc-linux-musl",
+		RustGlibc: "x86_64-unknown-linux-gnu",
+		RustMusl:  "x86_64-unknown-linux-musl",
+	}, Triplets(apko_types.ParseArchitecture("x86_64")))
+}
+
+func TestSubpackageDestDir(t *testing.T) {
+	cfg := func(sps ...Subpackage) Configuration {
+		return Configuration{
+			Package:     Package{Name: "foo", Version: "1.0"},
+			Subpackages: sps,
+		}
+	}
+
+	require.NoError(t, cfg(
+		Subpackage{Name: "foo-dev", DestDir: "dev"},
+		Subpackage{Name: "foo-doc"},
+	).validate())
+
+	for _, tc := range []struct {
+		name string
+		sps  []Subpackage
+		err  string
+	}{{
+		name: "destdir of another subpackage",
+		sps:  []Subpackage{{Name: "foo-dev", DestDir: "shared"}, {Name: "foo-doc", DestDir: "shared"}},
+		err:  `subpackage "foo-doc" would be packaged from the destdir "shared" of "foo-dev"`,
+	}, {
+		name: "name of another subpackage",
+		sps:  []Subpackage{{Name: "foo-dev"}, {Name: "foo-doc", DestDir: "foo-dev"}},
+		err:  `subpackage "foo-doc" would be packaged from the destdir "foo-dev" of "foo-dev"`,
+	}, {
+		name: "name of the main package",
+		sps:  []Subpackage{{Name: "foo-dev", DestDir: "foo"}},
+		err:  `subpackage "foo-dev" would be packaged from the destdir "foo" of "foo"`,
+	}, {
+		name: "outside of the output dir",
+		sps:  []Subpackage{{Name: "foo-dev", DestDir: "../foo"}},
+		err:  `subpackage "foo-dev" has destdir "../foo", which must match regex`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.ErrorContains(t, cfg(tc.sps...).validate(), tc.err)
+		})
+	}
+}
+
+func TestValidateRelationships(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{
+			Name: "foo",
+			Dependencies: Dependencies{
+				Provides: []string{"foo-compat", "so:libfoo.so.1=1.2.3", "cmd:foo=1.2.3-r1"},
+			},
+		},
+		Subpackages: []Subpackage{{
+			Name:         "foo-dev",
+			Dependencies: Dependencies{Replaces: []string{"foo", "foo-old<2.0"}},
+		}},
+	}
+	require.NoError(t, cfg.ValidateRelationships())
+
+	cfg.Package.Dependencies.Provides = []string{"=1.0", "foo-compat=not a version"}
+	cfg.Package.Dependencies.Replaces = []string{"foo-doc"}
+	cfg.Subpackages = []Subpackage{{
+		Name:         "foo-dev",
+		Dependencies: Dependencies{Replaces: []string{"foo-doc", "bar baz"}},
+	}, {
+		Name:         "foo-doc",
+		Dependencies: Dependencies{Replaces: []string{"foo-dev"}},
+	}, {
+		Name:         "foo-static",
+		Dependencies: Dependencies{Replaces: []string{"foo-static"}},
+	}}
+
+	err := cfg.ValidateRelationships()
+	require.ErrorContains(t, err, `package "foo" provides "=1.0": missing package name`)
+	require.ErrorContains(t, err, `package "foo" provides "foo-compat=not a version", whose version is malformed`)
+	require.ErrorContains(t, err, `subpackage "foo-dev" replaces "bar baz": package name "bar baz" contains whitespace`)
+	require.ErrorContains(t, err, `subpackage "foo-dev" replaces packages which replace it in turn: foo-dev -> foo-doc -> foo-dev`)
+	require.ErrorContains(t, err, `subpackage "foo-static" replaces packages which replace it in turn: foo-static -> foo-static`)
+	// The cycle is reported once, and replacing a package of the cycle does
+	// not make a cycle.
+	require.NotContains(t, err.Error(), `subpackage "foo-doc" replaces packages`)
+	require.NotContains(t, err.Error(), `package "foo" replaces packages`)
+}
+
+func TestValidateRequiredSteps(t *testing.T) {
+	ps := []Pipeline{{
+		Name: "build",
+		Pipeline: []Pipeline{
+			{Runs: "a"},
+			{Name: "check", Assertions: &PipelineAssertions{RequiredSteps: 3}, Pipeline: []Pipeline{{Runs: "a"}, {Runs: "b"}}},
+		},
+	}}
+	err := validateRequiredSteps(ps)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := `pipeline "check" requires 3 steps to run but has only 2`; err.Error() != want {
+		t.Errorf("want %q, got %q", want, err)
+	}
+
+	ps[0].Pipeline[1].Name = ""
+	if err := validateRequiredSteps(ps); err == nil || err.Error() != "pipeline[1] requires 3 steps to run but has only 2" {
+		t.Errorf("unexpected error for an unnamed pipeline: %v", err)
+	}
+
+	ps[0].Pipeline[1].Assertions = &PipelineAssertions{RequiredSteps: 2, MaxSteps: 1}
+	if err := validateRequiredSteps(ps); err == nil || err.Error() != "pipeline[1] requires 2 steps to run but allows at most 1" {
+		t.Errorf("unexpected error for a pipeline requiring more steps than its maximum: %v", err)
+	}
+}
+
+func TestPipelineIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    Pipeline
+		want string
+	}{{
+		name: "named",
+		p:    Pipeline{Name: "build", Uses: "autoconf/make", Runs: "make"},
+		want: "build",
+	}, {
+		name: "uses",
+		p:    Pipeline{Uses: "autoconf/make"},
+		want: "autoconf/make",
+	}, {
+		name: "runs",
+		p:    Pipeline{Runs: "echo hi"},
+		want: "runs-56a79f3b",
+	}, {
+		name: "empty",
+		p:    Pipeline{},
+		want: UnidentifiablePipeline,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.p.Identity(); got != tc.want {
+				t.Errorf("Identity() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
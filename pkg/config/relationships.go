@@ -0,0 +1,137 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+)
+
+// The operators which may follow the name of a package in a dependency, and
+// precede a version.
+const dependencyOperators = "<>=~"
+
+// ValidateRelationships checks the provides and replaces of the packages of
+// the configuration: that each is a package name, optionally followed by a
+// well-formed version, and that the packages of the configuration do not
+// replace each other in a cycle.  It reports every problem, with the package
+// it is declared by.
+func (cfg Configuration) ValidateRelationships() error {
+	type pkg struct {
+		kind, name string
+		deps       Dependencies
+	}
+	pkgs := []pkg{{"package", cfg.Package.Name, cfg.Package.Dependencies}}
+	for _, sp := range cfg.Subpackages {
+		pkgs = append(pkgs, pkg{"subpackage", sp.Name, sp.Dependencies})
+	}
+
+	names := map[string]bool{}
+	for _, p := range pkgs {
+		names[p.name] = true
+	}
+
+	var errs []error
+	replaces := map[string][]string{}
+	for _, p := range pkgs {
+		for _, provide := range p.deps.Provides {
+			name, version, versioned := strings.Cut(provide, "=")
+			if err := checkDependencyName(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s %q provides %q: %w", p.kind, p.name, provide, err))
+				continue
+			}
+			if versioned {
+				if _, err := apk.ParseVersion(version); err != nil {
+					errs = append(errs, fmt.Errorf("%s %q provides %q, whose version is malformed: %w", p.kind, p.name, provide, err))
+				}
+			}
+		}
+
+		for _, replace := range p.deps.Replaces {
+			i := strings.IndexAny(replace, dependencyOperators)
+			if i < 0 {
+				i = len(replace)
+			}
+			name, version := replace[:i], strings.TrimLeft(replace[i:], dependencyOperators)
+			if err := checkDependencyName(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s %q replaces %q: %w", p.kind, p.name, replace, err))
+				continue
+			}
+			if i < len(replace) {
+				if _, err := apk.ParseVersion(version); err != nil {
+					errs = append(errs, fmt.Errorf("%s %q replaces %q, whose version is malformed: %w", p.kind, p.name, replace, err))
+					continue
+				}
+			}
+			if names[name] {
+				replaces[p.name] = append(replaces[p.name], name)
+			}
+		}
+	}
+
+	// Report each cycle once, from the first of its packages.
+	inCycle := map[string]bool{}
+	for _, p := range pkgs {
+		if inCycle[p.name] {
+			continue
+		}
+		if cycle := replacesCycle(p.name, replaces); cycle != nil {
+			for _, name := range cycle {
+				inCycle[name] = true
+			}
+			errs = append(errs, fmt.Errorf("%s %q replaces packages which replace it in turn: %s", p.kind, p.name, strings.Join(cycle, " -> ")))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkDependencyName checks that name is a package name, as it is given in
+// a dependency.
+func checkDependencyName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("missing package name")
+	case strings.ContainsAny(name, " \t\n"):
+		return fmt.Errorf("package name %q contains whitespace", name)
+	}
+	return nil
+}
+
+// replacesCycle returns the packages of a cycle of replaces starting and
+// ending at name, if there is one, by following the replaces of each package
+// of the configuration.
+func replacesCycle(name string, replaces map[string][]string) []string {
+	var walk func(path []string) []string
+	walk = func(path []string) []string {
+		for _, next := range replaces[path[len(path)-1]] {
+			if next == name {
+				return append(slices.Clone(path), next)
+			}
+			if slices.Contains(path, next) {
+				continue
+			}
+			if cycle := walk(append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk([]string{name})
+}
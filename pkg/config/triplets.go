@@ -0,0 +1,39 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// ArchTriplets are the target triplets of an architecture for each libc, as
+// substituted for ${{cross.triplet.<gnu|rust>.<glibc|musl>}}.
+type ArchTriplets struct {
+	GnuGlibc  string
+	GnuMusl   string
+	RustGlibc string
+	RustMusl  string
+}
+
+// Triplets returns the GNU and Rust target triplets of arch, as melange uses
+// them for cross builds, without constructing a build.
+func Triplets(arch apko_types.Architecture) ArchTriplets {
+	return ArchTriplets{
+		GnuGlibc:  arch.ToTriplet("gnu"),
+		GnuMusl:   arch.ToTriplet("musl"),
+		RustGlibc: arch.ToRustTriplet("gnu"),
+		RustMusl:  arch.ToRustTriplet("musl"),
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/pkg/sbom"
+	purl "github.com/package-url/packageurl-go"
+)
+
+// An UpstreamSourceFunc returns the SBOM package, and so the PURL, of the
+// upstream source brought into the build by a pipeline step, or nil if the
+// step does not tell us about it.
+type UpstreamSourceFunc func(p Pipeline, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error)
+
+var (
+	upstreamSourcesMu sync.RWMutex
+	upstreamSources   = map[string]UpstreamSourceFunc{
+		"fetch":        fetchUpstreamSource,
+		"git-checkout": gitCheckoutUpstreamSource,
+		"go/build":     goBuildUpstreamSource,
+		"cargo/build":  cargoBuildUpstreamSource,
+	}
+)
+
+// RegisterUpstreamSource registers the function computing the upstream source
+// of the steps using the given pipeline, replacing any previously registered
+// for it.
+func RegisterUpstreamSource(uses string, fn UpstreamSourceFunc) {
+	upstreamSourcesMu.Lock()
+	defer upstreamSourcesMu.Unlock()
+	upstreamSources[uses] = fn
+}
+
+// fetchChecksums are the inputs of fetch steps with an expected digest of the
+// downloaded artifact, and the algorithm of the checksum qualifier of its PURL,
+// from the strongest to the weakest.  The checksum is the strongest digest set:
+// SHA-512, then SHA-256, then BLAKE2b-256, of the same length as SHA-256 but
+// less widely supported, and SHA-1 last.
+var fetchChecksums = []struct {
+	input, algorithm string
+}{
+	{"expected-sha512", "sha512"},
+	{"expected-sha256", "sha256"},
+	{"expected-blake2b-256", "blake2b-256"},
+	{"expected-sha1", "sha1"},
+}
+
+// FetchURIs returns the uri of a fetch step, as is, followed by its mirror
+// uris, which are separated by commas or newlines, without blanks.
+func FetchURIs(with map[string]string) []string {
+	var uris []string
+	if uri := strings.TrimSpace(with["uri"]); uri != "" {
+		uris = append(uris, uri)
+	}
+	for _, uri := range strings.FieldsFunc(with["uris"], func(r rune) bool { return r == ',' || r == '\n' }) {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// fetchVersionRegex matches the version at the end of the basename of a
+// downloaded artifact, such as foo-1.2.3.tar.gz or v1.2.tgz, before its
+// extension, if any: at least two dot-separated numbers after a dash, an
+// underscore or nothing, optionally prefixed with v and suffixed with a
+// pre-release such as -rc1.
+var fetchVersionRegex = regexp.MustCompile(`(?:^|[-_])v?([0-9]+(?:\.[0-9]+)+(?:-?(?:alpha|beta|rc|pre)\.?[0-9]*)?)(?:\.tar(?:\.[a-z0-9]+)?|\.t[gbx]z2?|\.tzst|\.zip)?$`)
+
+// fetchURIVersion returns the version in the basename of uri, or "" if it
+// has none, see fetchVersionRegex.
+func fetchURIVersion(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	m := fetchVersionRegex.FindStringSubmatch(path.Base(u.Path))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// fetchUpstreamSource returns the upstream source downloaded by a fetch step.
+// Each of its uris gets a PURL of its own, the mirrors' being alternate ones,
+// all with the same checksum.  Without a purl-version, the version of the
+// PURLs is the one in the basename of the first uri, if any.
+func fetchUpstreamSource(p Pipeline, _, supplier, uniqueID string) (*sbom.Package, error) {
+	with := p.With
+
+	var checksum string
+	for _, c := range fetchChecksums {
+		if expected := with[c.input]; expected != "" {
+			checksum = c.algorithm + ":" + expected
+			break
+		}
+	}
+
+	// These get defaulted correctly from within the fetch pipeline definition
+	// (YAML) itself.
+	pkgName := with["purl-name"]
+	pkgVersion := with["purl-version"]
+
+	uris := FetchURIs(with)
+	if len(uris) == 0 {
+		uris = []string{""}
+	}
+
+	// The ID of the package is left as is, only described by the derived
+	// version.
+	idComponents := []string{pkgName, pkgVersion}
+	if uniqueID != "" {
+		idComponents = append(idComponents, uniqueID)
+	}
+	if pkgVersion == "" {
+		pkgVersion = fetchURIVersion(uris[0])
+	}
+
+	purls := make([]*purl.PackageURL, 0, len(uris))
+	for _, uri := range uris {
+		args := map[string]string{"download_url": uri}
+		if checksum != "" {
+			args["checksum"] = checksum
+		}
+		pu := &purl.PackageURL{
+			Type:       "generic",
+			Name:       pkgName,
+			Version:    pkgVersion,
+			Qualifiers: purl.QualifiersFromMap(args),
+		}
+		if err := pu.Normalize(); err != nil {
+			return nil, err
+		}
+		purls = append(purls, pu)
+	}
+
+	var sourceInfo string
+	if sig := with["signature-url"]; sig != "" {
+		sourceInfo = fmt.Sprintf("downloaded from %s and verified against the GPG signature %s", uris[0], sig)
+	}
+
+	return &sbom.Package{
+		IDComponents:   idComponents,
+		Name:           pkgName,
+		Version:        pkgVersion,
+		Namespace:      supplier,
+		PURL:           purls[0],
+		AlternatePURLs: purls[1:],
+		SourceInfo:     sourceInfo,
+	}, nil
+}
+
+// gitCheckoutUpstreamSource returns the upstream source checked out by a
+// git-checkout step.
+func gitCheckoutUpstreamSource(p Pipeline, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error) {
+	with := p.With
+
+	repo := p.GitCheckoutRepository()
+	branch := with["branch"]
+	tag := with["tag"]
+	expectedCommit := with["expected-commit"]
+
+	// We'll use all available data to ensure our SBOM's package ID is unique, even
+	// when the same repo is git-checked out multiple times.
+	var idComponents []string
+	repoCleaned := func() string {
+		s := strings.TrimPrefix(repo, "https://")
+		s = strings.TrimPrefix(s, "http://")
+		return s
+	}()
+	for _, component := range []string{repoCleaned, branch, tag, expectedCommit} {
+		if component != "" {
+			idComponents = append(idComponents, component)
+		}
+	}
+	if uniqueID != "" {
+		idComponents = append(idComponents, uniqueID)
+	}
+
+	if purlType, repoPath, ok := gitHostPURL(repo); ok {
+		// GitLab groups can be nested, so the namespace is everything but
+		// the last segment of the path.
+		repoPath = strings.TrimSuffix(strings.TrimSuffix(repoPath, "/"), ".git")
+		namespace, name := "", repoPath
+		if i := strings.LastIndex(repoPath, "/"); i >= 0 {
+			namespace, name = repoPath[:i], repoPath[i+1:]
+		}
+
+		// Prefer tag to commit, but use only ONE of these.
+
+		versions := []string{
+			tag,
+			expectedCommit,
+		}
+
+		for _, v := range versions {
+			if v == "" {
+				continue
+			}
+
+			pu := &purl.PackageURL{
+				Type:      purlType,
+				Namespace: namespace,
+				Name:      name,
+				Version:   v,
+			}
+			if err := pu.Normalize(); err != nil {
+				return nil, err
+			}
+
+			return &sbom.Package{
+				IDComponents:    idComponents,
+				Name:            name,
+				Version:         v,
+				LicenseDeclared: licenseDeclared,
+				Namespace:       namespace,
+				PURL:            pu,
+			}, nil
+		}
+
+		// If we get here, we have a hosted repo but no tag or commit. Without version
+		// information, we can't create a sensible SBOM package.
+		//
+		// TODO: Decide if this should be an error condition.
+
+		return nil, nil
+	}
+
+	// Create nice looking package name, last component of uri, without .git
+	name := strings.TrimSuffix(path.Base(repo), ".git")
+
+	// Encode vcs_url with git+ prefix and @commit suffix
+	vcsUrl := "git+" + repo
+
+	if len(expectedCommit) > 0 {
+		vcsUrl += "@" + expectedCommit
+	}
+
+	// Use tag as version
+	version := ""
+	if len(tag) > 0 {
+		version = tag
+	}
+
+	pu := purl.PackageURL{
+		Type:       "generic",
+		Name:       name,
+		Version:    version,
+		Qualifiers: purl.QualifiersFromMap(map[string]string{"vcs_url": vcsUrl}),
+	}
+	if err := pu.Normalize(); err != nil {
+		return nil, err
+	}
+
+	return &sbom.Package{
+		IDComponents:    idComponents,
+		Name:            name,
+		Version:         version,
+		LicenseDeclared: licenseDeclared,
+		Namespace:       supplier,
+		PURL:            &pu,
+	}, nil
+}
+
+// gitHosts are the URL prefixes of the git hosts with a PURL type of their
+// own.  Repositories elsewhere, e.g. self-hosted, get a generic PURL with
+// their vcs_url.
+var gitHosts = []struct {
+	prefix, purlType string
+}{
+	{"https://github.com/", purl.TypeGithub},
+	{"https://gitlab.com/", purl.TypeGitlab},
+	{"https://bitbucket.org/", purl.TypeBitbucket},
+}
+
+// gitHostPURL returns the PURL type of the host of repo, and the path of repo
+// on it, if it is one of gitHosts.
+func gitHostPURL(repo string) (purlType, repoPath string, ok bool) {
+	for _, h := range gitHosts {
+		if p, found := strings.CutPrefix(repo, h.prefix); found {
+			return h.purlType, p, true
+		}
+	}
+	return "", "", false
+}
+
+// goBuildUpstreamSource returns the Go package built by a go/build step, the
+// first of its packages, when it is named by its import path, e.g.
+// github.com/foo/bar/cmd/baz.  Packages relative to the modroot are named by
+// the module in its go.mod, which the build file does not tell us, so they
+// have no PURL.  Nor does the step tell us the version of the module, which is
+// left empty.
+func goBuildUpstreamSource(p Pipeline, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error) {
+	packages := strings.Fields(p.With["packages"])
+	if len(packages) == 0 {
+		return nil, nil
+	}
+
+	// Import paths start with a domain, unlike relative paths, e.g. ./cmd/foo
+	// or cmd/foo.
+	pkgPath := packages[0]
+	domain, _, _ := strings.Cut(pkgPath, "/")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") {
+		return nil, nil
+	}
+
+	namespace, name := path.Split(pkgPath)
+	pu := &purl.PackageURL{
+		Type:      purl.TypeGolang,
+		Namespace: strings.TrimSuffix(namespace, "/"),
+		Name:      name,
+	}
+	return upstreamBuildPackage(pu, pkgPath, licenseDeclared, supplier, uniqueID)
+}
+
+// cargoBuildUpstreamSource returns the crate built by a cargo/build step,
+// named after the output it declares, which is the name of the binary of the
+// crate, and usually the crate's.  Steps declaring no output, which install
+// every binary built, have no PURL.  Nor does the step tell us the version of
+// the crate, which is left empty.
+func cargoBuildUpstreamSource(p Pipeline, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error) {
+	name := strings.TrimSpace(p.With["output"])
+	if name == "" || strings.ContainsAny(name, "/.") {
+		// Without a name, we can't name the crate.
+		return nil, nil
+	}
+
+	pu := &purl.PackageURL{
+		Type: purl.TypeCargo,
+		Name: name,
+	}
+	return upstreamBuildPackage(pu, name, licenseDeclared, supplier, uniqueID)
+}
+
+// upstreamBuildPackage returns the SBOM package of the upstream source built
+// by a step, with the given PURL.
+func upstreamBuildPackage(pu *purl.PackageURL, id, licenseDeclared, supplier, uniqueID string) (*sbom.Package, error) {
+	if err := pu.Normalize(); err != nil {
+		return nil, err
+	}
+
+	idComponents := []string{id}
+	if pu.Version != "" {
+		idComponents = append(idComponents, pu.Version)
+	}
+	if uniqueID != "" {
+		idComponents = append(idComponents, uniqueID)
+	}
+
+	return &sbom.Package{
+		IDComponents:    idComponents,
+		Name:            pu.Name,
+		Version:         pu.Version,
+		LicenseDeclared: licenseDeclared,
+		Namespace:       supplier,
+		PURL:            pu,
+	}, nil
+}
@@ -27,18 +27,22 @@ const (
 	SubstitutionPackageFullVersion    = "${{package.full-version}}"
 	SubstitutionPackageEpoch          = "${{package.epoch}}"
 	SubstitutionPackageDescription    = "${{package.description}}"
+	SubstitutionPackageSubpkgCount    = "${{package.subpackage-count}}"
 	SubstitutionTargetsOutdir         = "${{targets.outdir}}"
 	SubstitutionTargetsDestdir        = "${{targets.destdir}}"
 	SubstitutionTargetsContextdir     = "${{targets.contextdir}}"
 	SubstitutionSubPkgDir             = "${{targets.subpkgdir}}"
+	SubstitutionSubPkgLicense         = "${{subpkg.license}}"
 	SubstitutionHostTripletGnu        = "${{host.triplet.gnu}}"
 	SubstitutionHostTripletRust       = "${{host.triplet.rust}}"
 	SubstitutionCrossTripletGnuGlibc  = "${{cross.triplet.gnu.glibc}}"
 	SubstitutionCrossTripletGnuMusl   = "${{cross.triplet.gnu.musl}}"
 	SubstitutionCrossTripletRustGlibc = "${{cross.triplet.rust.glibc}}"
 	SubstitutionCrossTripletRustMusl  = "${{cross.triplet.rust.musl}}"
+	SubstitutionCrossSysroot          = "${{cross.sysroot}}"
 	SubstitutionBuildArch             = "${{build.arch}}"
 	SubstitutionBuildGoArch           = "${{build.goarch}}"
+	SubstitutionBuildPipelinesVersion = "${{build.pipelines-version}}"
 )
 
 // Get variables from configuration and return them in a map
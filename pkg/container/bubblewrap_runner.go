@@ -34,6 +34,7 @@ import (
 )
 
 var _ Debugger = (*bubblewrap)(nil)
+var _ HostNetworker = (*bubblewrap)(nil)
 
 const (
 	BubblewrapName = "bubblewrap"
@@ -58,6 +59,19 @@ func (bw *bubblewrap) Name() string {
 	return BubblewrapName
 }
 
+// GrantsCapability implements CapabilityGranter.  Capabilities are added to
+// the sandbox with --cap-add, which only has an effect when its user is root,
+// that is when melange runs as root and the Config runs as no other user.
+func (bw *bubblewrap) GrantsCapability(cfg *Config, _ string) bool {
+	return cfg.RunAs == "" && os.Getuid() == 0
+}
+
+// MountsPerRun implements PerRunMounter.  Each command runs in a sandbox of
+// its own, with the mounts of its Config.
+func (bw *bubblewrap) MountsPerRun() bool {
+	return true
+}
+
 // Run runs a Bubblewrap task given a Config and command string.
 func (bw *bubblewrap) Run(ctx context.Context, cfg *Config, envOverride map[string]string, args ...string) error {
 	execCmd := bw.cmd(ctx, cfg, false, envOverride, args...)
@@ -101,6 +115,10 @@ func (bw *bubblewrap) cmd(ctx context.Context, cfg *Config, debug bool, envOverr
 	baseargs = append(baseargs, "--bind", cfg.ImgRef, "/")
 
 	for _, bind := range cfg.Mounts {
+		if bind.ReadOnly {
+			baseargs = append(baseargs, "--ro-bind", bind.Source, bind.Destination)
+			continue
+		}
 		baseargs = append(baseargs, "--bind", bind.Source, bind.Destination)
 	}
 	// add the ref of the directory
@@ -136,6 +154,10 @@ func (bw *bubblewrap) cmd(ctx context.Context, cfg *Config, debug bool, envOverr
 		baseargs = append(baseargs, "--unshare-net")
 	}
 
+	for _, c := range cfg.Capabilities.Add {
+		baseargs = append(baseargs, "--cap-add", c)
+	}
+
 	for k, v := range cfg.Environment {
 		baseargs = append(baseargs, "--setenv", k, v)
 	}
@@ -161,6 +183,12 @@ func (bw *bubblewrap) Debug(ctx context.Context, cfg *Config, envOverride map[st
 	return execCmd.Run()
 }
 
+// SharesHostNetwork reports that bubblewrap containers with networking share
+// the network namespace of the host.
+func (bw *bubblewrap) SharesHostNetwork() bool {
+	return true
+}
+
 // TestUsability determines if the Bubblewrap runner can be used
 // as a container runner.
 func (bw *bubblewrap) TestUsability(ctx context.Context) bool {
@@ -210,6 +238,12 @@ func (bw *bubblewrap) WorkspaceTar(ctx context.Context, cfg *Config) (io.ReadClo
 	return nil, nil
 }
 
+// CopyOut implements OutCopier, copying from the bind-mounted host
+// directories.
+func (bw *bubblewrap) CopyOut(ctx context.Context, cfg *Config, src, dst string) error {
+	return CopyOutMounted(cfg, src, dst)
+}
+
 type bubblewrapOCILoader struct {
 	remove   bool
 	guestDir string
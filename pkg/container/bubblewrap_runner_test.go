@@ -16,6 +16,7 @@ package container
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -38,6 +39,19 @@ func TestBubblewrapCmd(t *testing.T) {
 			config:       &Config{RunAs: "65535"},
 			expectedArgs: fmt.Sprintf("--unshare-user --uid %s --gid %s", "65535", "65535"),
 		},
+		{
+			name:         "With added capabilities",
+			config:       &Config{Capabilities: Capabilities{Add: []string{"CAP_SYS_ADMIN", "CAP_NET_ADMIN"}}},
+			expectedArgs: "--cap-add CAP_SYS_ADMIN --cap-add CAP_NET_ADMIN",
+		},
+		{
+			name: "With read-only mount",
+			config: &Config{Mounts: []BindMount{
+				{Source: "/workspace", Destination: "/home/build", ReadOnly: true},
+				{Source: "/workspace/melange-out", Destination: "/home/build/melange-out"},
+			}},
+			expectedArgs: "--ro-bind /workspace /home/build --bind /workspace/melange-out /home/build/melange-out",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -54,3 +68,17 @@ func TestBubblewrapCmd(t *testing.T) {
 		})
 	}
 }
+
+func TestBubblewrapGrantsCapability(t *testing.T) {
+	bw := new(bubblewrap)
+
+	// The sandbox user only has the capabilities added to it when it is
+	// root, which it is not when running as another user.
+	if bw.GrantsCapability(&Config{RunAs: "65535"}, "CAP_SYS_ADMIN") {
+		t.Errorf("GrantsCapability() = true for a sandbox running as 65535")
+	}
+
+	if got, want := bw.GrantsCapability(&Config{}, "CAP_SYS_ADMIN"), os.Getuid() == 0; got != want {
+		t.Errorf("GrantsCapability() = %t, want %t for uid %d", got, want, os.Getuid())
+	}
+}
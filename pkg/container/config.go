@@ -15,6 +15,8 @@
 package container
 
 import (
+	"fmt"
+	"strconv"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -36,10 +38,61 @@ const (
 type BindMount struct {
 	Source      string
 	Destination string
+	// Whether the mount is read-only, on runners that are PerRunMounters.
+	ReadOnly bool
 }
 
 type Capabilities struct {
 	Networking bool
+	// Linux capabilities, such as CAP_SYS_ADMIN, to grant to the processes
+	// run in the container, on runners that are CapabilityGranters.
+	Add []string
+}
+
+// LinuxCapabilities lists the Linux capabilities that may be listed in
+// Capabilities.Add.
+var LinuxCapabilities = []string{
+	"CAP_AUDIT_CONTROL",
+	"CAP_AUDIT_READ",
+	"CAP_AUDIT_WRITE",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_KILL",
+	"CAP_LEASE",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_MAC_ADMIN",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MKNOD",
+	"CAP_NET_ADMIN",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_RAW",
+	"CAP_PERFMON",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYSLOG",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_NICE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_WAKE_ALARM",
 }
 
 type Config struct {
@@ -59,3 +112,29 @@ type Config struct {
 	Disk                  string
 	Timeout               time.Duration
 }
+
+// NanoCPUs returns the CPU of cfg, a number of CPUs which may be
+// fractional, in billionths of a CPU, or 0 if it is unset.
+func (cfg *Config) NanoCPUs() (int64, error) {
+	if cfg.CPU == "" {
+		return 0, nil
+	}
+	cpus, err := strconv.ParseFloat(cfg.CPU, 64)
+	if err != nil || cpus <= 0 {
+		return 0, fmt.Errorf("invalid number of CPUs: %s", cfg.CPU)
+	}
+	return int64(cpus * 1e9), nil
+}
+
+// MemoryBytes returns the Memory of cfg, such as 4Gi, in bytes, or 0 if it
+// is unset.
+func (cfg *Config) MemoryBytes() (int64, error) {
+	if cfg.Memory == "" {
+		return 0, nil
+	}
+	kb, err := convertHumanToKB(cfg.Memory)
+	if err != nil {
+		return 0, err
+	}
+	return kb * 1024, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CopyOutMounted copies the directory src of a build environment which bind
+// mounts the Mounts of cfg into the directory dst of the host, from the host
+// directory mounted at src.  It is how runners whose workspace is bind
+// mounted implement OutCopier.
+func CopyOutMounted(cfg *Config, src, dst string) error {
+	src = path.Clean(src)
+
+	// Mounts may be nested, so the innermost one holds src.
+	var mount *BindMount
+	for i, m := range cfg.Mounts {
+		dest := path.Clean(m.Destination)
+		if src != dest && !strings.HasPrefix(src, strings.TrimSuffix(dest, "/")+"/") {
+			continue
+		}
+		if mount == nil || len(dest) > len(path.Clean(mount.Destination)) {
+			mount = &cfg.Mounts[i]
+		}
+	}
+	if mount == nil {
+		return fmt.Errorf("%s is not in a mounted directory", src)
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(src, path.Clean(mount.Destination)), "/")
+
+	return copyTree(filepath.Join(mount.Source, filepath.FromSlash(rel)), dst)
+}
+
+// copyTree copies the directories, regular files and symlinks under the
+// directory src into the directory dst.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		default:
+			// Devices, sockets and pipes are not worth salvaging.
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyOutMounted(t *testing.T) {
+	workspace, out := t.TempDir(), t.TempDir()
+	for name, content := range map[string]string{
+		"src/main.c":                      "int main() {}",
+		"out/hello/usr/bin/hello":         "ELF",
+		"out/hello/usr/lib/libhello.so.1": "ELF",
+	} {
+		p := filepath.Join(workspace, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("libhello.so.1", filepath.Join(workspace, "out/hello/usr/lib/libhello.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output dir is mounted within the workspace.
+	cfg := &Config{Mounts: []BindMount{
+		{Source: workspace, Destination: "/home/build"},
+		{Source: filepath.Join(workspace, "out"), Destination: "/home/build/melange-out"},
+	}}
+	dst := filepath.Join(out, "x86_64")
+	if err := CopyOutMounted(cfg, "/home/build/melange-out", dst); err != nil {
+		t.Fatalf("CopyOutMounted: %v", err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(dst, "hello/usr/bin/hello")); err != nil || string(got) != "ELF" {
+		t.Errorf("hello/usr/bin/hello: got %q, %v", got, err)
+	}
+	if got, err := os.Readlink(filepath.Join(dst, "hello/usr/lib/libhello.so")); err != nil || got != "libhello.so.1" {
+		t.Errorf("hello/usr/lib/libhello.so: got link %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "src")); !os.IsNotExist(err) {
+		t.Errorf("the source was copied too: %v", err)
+	}
+
+	// Copying again overwrites the copy.
+	if err := CopyOutMounted(cfg, "/home/build/melange-out/", dst); err != nil {
+		t.Fatalf("CopyOutMounted again: %v", err)
+	}
+
+	if err := CopyOutMounted(cfg, "/var/cache", dst); err == nil {
+		t.Errorf("CopyOutMounted of an unmounted dir: got nil error")
+	}
+}
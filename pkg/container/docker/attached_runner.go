@@ -0,0 +1,214 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	apko_build "chainguard.dev/apko/pkg/build"
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	mcontainer "chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var _ mcontainer.Debugger = (*attached)(nil)
+
+const AttachedName = "docker-attached"
+
+// attached is a Runner implementation which runs pipelines in an existing,
+// already running, docker container instead of creating one from the build
+// environment.  The container is left running when the build is done.
+//
+// Whatever state the container is in is used as is: neither the build
+// environment nor the workspace are set up in it, so builds using it are not
+// reproducible.  It is meant for debugging builds only.
+type attached struct {
+	*docker
+	containerID string
+}
+
+// NewAttachedRunner returns a Runner which runs pipelines in the running
+// docker container with the given ID or name.
+func NewAttachedRunner(ctx context.Context, containerID string) (mcontainer.Runner, error) {
+	r, err := NewRunner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attached{
+		docker:      r.(*docker),
+		containerID: containerID,
+	}, nil
+}
+
+func (a *attached) Name() string {
+	return AttachedName
+}
+
+// StartPod attaches to the existing container, which must be running.
+func (a *attached) StartPod(ctx context.Context, cfg *mcontainer.Config) error {
+	log := clog.FromContext(ctx)
+
+	info, err := a.cli.ContainerInspect(ctx, a.containerID)
+	if err != nil {
+		return fmt.Errorf("inspecting container %s: %w", a.containerID, err)
+	}
+	if info.State == nil || !info.State.Running {
+		return fmt.Errorf("container %s is not running", a.containerID)
+	}
+
+	cfg.PodID = info.ID
+	log.Warnf("attached to existing container %s, this build is not reproducible", a.containerID)
+
+	return nil
+}
+
+// TerminatePod leaves the container running, for further inspection.
+func (a *attached) TerminatePod(ctx context.Context, cfg *mcontainer.Config) error {
+	if cfg.PodID == "" {
+		return fmt.Errorf("pod not running")
+	}
+
+	clog.FromContext(ctx).Infof("detached from container %s, leaving it running", a.containerID)
+
+	return nil
+}
+
+// OCIImageLoader returns a loader which does nothing, the existing container
+// is used instead of the build environment.
+func (a *attached) OCIImageLoader() mcontainer.Loader {
+	return attachedLoader{}
+}
+
+// WorkspaceTar returns the melange-out directory of the container's workspace
+// as a gzipped tar stream, the host workspace is not mounted in it.
+func (a *attached) WorkspaceTar(ctx context.Context, cfg *mcontainer.Config) (io.ReadCloser, error) {
+	rc, _, err := a.cli.CopyFromContainer(ctx, cfg.PodID, path.Join(runnerWorkdir, "melange-out"))
+	if err != nil {
+		return nil, fmt.Errorf("copying workspace from container %s: %w", a.containerID, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, rc)
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// Attached implements mcontainer.Attacher.
+func (a *attached) Attached() bool {
+	return true
+}
+
+// GrantsCapability implements mcontainer.CapabilityGranter.  No capability
+// can be added to a container which is already running.
+func (a *attached) GrantsCapability(*mcontainer.Config, string) bool {
+	return false
+}
+
+// UpdateResources implements mcontainer.ResourceUpdater by refusing to:
+// melange does not know the limits the container was started with, so it
+// could not restore them, and would leave the container changed.
+func (a *attached) UpdateResources(context.Context, *mcontainer.Config) error {
+	return fmt.Errorf("the resources of container %s, which melange did not create, cannot be changed", a.containerID)
+}
+
+// CopyOut implements mcontainer.OutCopier, copying src out of the container
+// itself, as the host directories of the Config are not mounted in it.
+func (a *attached) CopyOut(ctx context.Context, cfg *mcontainer.Config, src, dst string) error {
+	rc, _, err := a.cli.CopyFromContainer(ctx, cfg.PodID, src)
+	if err != nil {
+		return fmt.Errorf("copying %s from container %s: %w", src, a.containerID, err)
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+
+	// The entries of the archive are under the basename of src.
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s from container %s: %w", src, a.containerID, err)
+		}
+
+		_, name, _ := strings.Cut(hdr.Name, "/")
+		if name == "" {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("copying %s from container %s: invalid path %q", src, a.containerID, hdr.Name)
+		}
+		target := filepath.Join(dst, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return fmt.Errorf("copying %s from container %s: %w", hdr.Name, a.containerID, err)
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type attachedLoader struct{}
+
+func (attachedLoader) LoadImage(context.Context, v1.Layer, apko_types.Architecture, *apko_build.Context) (string, error) {
+	return "", nil
+}
+
+func (attachedLoader) RemoveImage(context.Context, string) error {
+	return nil
+}
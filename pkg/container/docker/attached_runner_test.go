@@ -0,0 +1,87 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mcontainer "chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachedCopyOut(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dk, d := newFakeRunner(t)
+	a := &attached{docker: dk, containerID: "existing"}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "melange-out/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "melange-out/hello/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "melange-out/hello/usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0o755, Size: 5},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	d.archive = buf.Bytes()
+
+	// The host mounts of the Config are not those of the container, so they
+	// are not copied from.
+	host := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(host, "stale"), []byte("stale"), 0o644))
+	cfg := &mcontainer.Config{
+		PodID:  "existing",
+		Mounts: []mcontainer.BindMount{{Source: host, Destination: "/home/build/melange-out"}},
+	}
+
+	dst := filepath.Join(t.TempDir(), "salvaged")
+	require.NoError(t, a.CopyOut(ctx, cfg, "/home/build/melange-out", dst))
+
+	data, err := os.ReadFile(filepath.Join(dst, "hello", "usr", "bin", "hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.NoFileExists(t, filepath.Join(dst, "stale"))
+
+	// Entries escaping dst are refused.
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "melange-out/../../escaped", Typeflag: tar.TypeReg, Mode: 0o644}))
+	require.NoError(t, tw.Close())
+	d.archive = buf.Bytes()
+	require.ErrorContains(t, a.CopyOut(ctx, cfg, "/home/build/melange-out", t.TempDir()), "invalid path")
+}
+
+func TestAttachedRefusesChanges(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dk, d := newFakeRunner(t)
+	a := &attached{docker: dk, containerID: "existing"}
+
+	cfg := &mcontainer.Config{PodID: "existing", CPU: "2"}
+	require.ErrorContains(t, a.UpdateResources(ctx, cfg), "cannot be changed")
+	require.Empty(t, d.updated)
+
+	require.False(t, a.GrantsCapability(cfg, "CAP_SYS_ADMIN"))
+	require.True(t, dk.GrantsCapability(cfg, "CAP_SYS_ADMIN"))
+}
@@ -74,6 +74,12 @@ func (dk *docker) Close() error {
 	return dk.cli.Close()
 }
 
+// GrantsCapability implements mcontainer.CapabilityGranter.  Capabilities
+// are added to the container when it is created.
+func (dk *docker) GrantsCapability(*mcontainer.Config, string) bool {
+	return true
+}
+
 // StartPod starts a pod for supporting a Docker task, if
 // necessary.
 func (dk *docker) StartPod(ctx context.Context, cfg *mcontainer.Config) error {
@@ -96,8 +102,14 @@ func (dk *docker) StartPod(ctx context.Context, cfg *mcontainer.Config) error {
 		})
 	}
 
+	res, err := resources(cfg)
+	if err != nil {
+		return err
+	}
 	hostConfig := &container.HostConfig{
-		Mounts: mounts,
+		Mounts:    mounts,
+		CapAdd:    cfg.Capabilities.Add,
+		Resources: res,
 	}
 
 	platform := &image_spec.Platform{
@@ -245,7 +257,7 @@ func (dk *docker) Run(ctx context.Context, cfg *mcontainer.Config, envOverride m
 	case 0:
 		return nil
 	default:
-		return fmt.Errorf("task exited with code %d", inspectResp.ExitCode)
+		return &mcontainer.ExitError{Code: inspectResp.ExitCode}
 	}
 }
 
@@ -344,7 +356,7 @@ func (dk *docker) Debug(ctx context.Context, cfg *mcontainer.Config, envOverride
 	case 0:
 		return nil
 	default:
-		return fmt.Errorf("task exited with code %d", inspectResp.ExitCode)
+		return &mcontainer.ExitError{Code: inspectResp.ExitCode}
 	}
 }
 
@@ -354,6 +366,54 @@ func (dk *docker) WorkspaceTar(ctx context.Context, cfg *mcontainer.Config) (io.
 	return nil, nil
 }
 
+// resources returns the limits of the container for the CPU and Memory of
+// cfg, leaving those unset unlimited.
+func resources(cfg *mcontainer.Config) (container.Resources, error) {
+	cpus, err := cfg.NanoCPUs()
+	if err != nil {
+		return container.Resources{}, err
+	}
+	memory, err := cfg.MemoryBytes()
+	if err != nil {
+		return container.Resources{}, err
+	}
+	// Swapping past the memory limit would only slow the host down.
+	return container.Resources{NanoCPUs: cpus, Memory: memory, MemorySwap: memory}, nil
+}
+
+// UpdateResources implements ResourceUpdater.  Unset limits, which the
+// daemon would leave as they are, are set to the CPUs and memory of the
+// daemon's host.
+func (dk *docker) UpdateResources(ctx context.Context, cfg *mcontainer.Config) error {
+	res, err := resources(cfg)
+	if err != nil {
+		return err
+	}
+	if res.NanoCPUs == 0 || res.Memory == 0 {
+		info, err := dk.cli.Info(ctx)
+		if err != nil {
+			return fmt.Errorf("getting the resources of the docker host: %w", err)
+		}
+		if res.NanoCPUs == 0 {
+			res.NanoCPUs = int64(info.NCPU) * 1e9
+		}
+		if res.Memory == 0 {
+			res.Memory, res.MemorySwap = info.MemTotal, -1
+		}
+	}
+
+	if _, err := dk.cli.ContainerUpdate(ctx, cfg.PodID, container.UpdateConfig{Resources: res}); err != nil {
+		return fmt.Errorf("updating the resources of the container: %w", err)
+	}
+	return nil
+}
+
+// CopyOut implements OutCopier, copying from the bind-mounted host
+// directories.
+func (dk *docker) CopyOut(ctx context.Context, cfg *mcontainer.Config, src, dst string) error {
+	return mcontainer.CopyOutMounted(cfg, src, dst)
+}
+
 type dockerLoader struct {
 	cli *client.Client
 }
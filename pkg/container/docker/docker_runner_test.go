@@ -0,0 +1,123 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	mcontainer "chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon records the host config of the containers created through it,
+// and fails to start them, and the resources of the containers updated
+// through it.  Copying a path from a container copies archive.
+type fakeDaemon struct {
+	created []container.HostConfig
+	updated []container.Resources
+	archive []byte
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/containers/create"):
+		var body struct {
+			HostConfig container.HostConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.created = append(d.created, body.HostConfig)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"Id":"melange-test"}`))
+	case strings.HasSuffix(r.URL.Path, "/update"):
+		var body container.UpdateConfig
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.updated = append(d.updated, body.Resources)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(r.URL.Path, "/archive"):
+		stat, _ := json.Marshal(container.PathStat{Name: path.Base(r.URL.Query().Get("path")), Mode: os.ModeDir | 0o755})
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+		w.Header().Set("Content-Type", "application/x-tar")
+		_, _ = w.Write(d.archive)
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"NCPU":16,"MemTotal":68719476736}`))
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func newFakeRunner(t *testing.T) (*docker, *fakeDaemon) {
+	d := &fakeDaemon{}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), client.WithVersion("1.45"))
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	return &docker{cli: cli}, d
+}
+
+func TestStartPodResources(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dk, d := newFakeRunner(t)
+
+	// The fake daemon does not start containers, once they are created.
+	err := dk.StartPod(ctx, &mcontainer.Config{ImgRef: "melange:latest", CPU: "2.5", Memory: "4Gi"})
+	require.Error(t, err)
+	require.Len(t, d.created, 1)
+	require.Equal(t, int64(2_500_000_000), d.created[0].NanoCPUs)
+	require.Equal(t, int64(4<<30), d.created[0].Memory)
+	require.Equal(t, int64(4<<30), d.created[0].MemorySwap)
+
+	// Without limits, the container is not limited.
+	_ = dk.StartPod(ctx, &mcontainer.Config{ImgRef: "melange:latest"})
+	require.Len(t, d.created, 2)
+	require.Zero(t, d.created[1].NanoCPUs)
+	require.Zero(t, d.created[1].Memory)
+
+	require.ErrorContains(t, dk.StartPod(ctx, &mcontainer.Config{ImgRef: "melange:latest", CPU: "many"}), "invalid number of CPUs")
+	require.Len(t, d.created, 2)
+}
+
+func TestUpdateResources(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dk, d := newFakeRunner(t)
+
+	require.NoError(t, dk.UpdateResources(ctx, &mcontainer.Config{PodID: "melange-test", CPU: "8", Memory: "32Gi"}))
+	// Unset limits are lifted to those of the host.
+	require.NoError(t, dk.UpdateResources(ctx, &mcontainer.Config{PodID: "melange-test"}))
+	require.Equal(t, []container.Resources{
+		{NanoCPUs: 8_000_000_000, Memory: 32 << 30, MemorySwap: 32 << 30},
+		{NanoCPUs: 16_000_000_000, Memory: 64 << 30, MemorySwap: -1},
+	}, d.updated)
+}
@@ -74,6 +74,12 @@ func (bw *qemu) Name() string {
 	return QemuName
 }
 
+// GrantsCapability implements CapabilityGranter.  Commands run as root in
+// the guest have every capability, but the build user has none.
+func (bw *qemu) GrantsCapability(cfg *Config, _ string) bool {
+	return cfg.RunAs == ""
+}
+
 // Run runs a Qemu task given a Config and command string.
 func (bw *qemu) Run(ctx context.Context, cfg *Config, envOverride map[string]string, args ...string) error {
 	log := clog.FromContext(ctx)
@@ -16,6 +16,7 @@ package container
 
 import (
 	"context"
+	"fmt"
 	"io"
 
 	apko_build "chainguard.dev/apko/pkg/build"
@@ -27,6 +28,49 @@ type Debugger interface {
 	Debug(ctx context.Context, cfg *Config, envOverride map[string]string, cmd ...string) error
 }
 
+// A HostNetworker is a Runner whose containers share the network of the host,
+// so that services listening on the host's loopback interface can be reached
+// from them when networking is enabled.
+type HostNetworker interface {
+	SharesHostNetwork() bool
+}
+
+// A CapabilityGranter is a Runner that can grant the Linux capabilities listed
+// in Capabilities.Add to the processes it runs.  Runners that are not
+// CapabilityGranters grant none.
+type CapabilityGranter interface {
+	GrantsCapability(cfg *Config, capability string) bool
+}
+
+// An Attacher is a Runner which runs commands in an existing container, rather
+// than in one it creates from the build environment.
+type Attacher interface {
+	Attached() bool
+}
+
+// A PerRunMounter is a Runner which applies the Mounts of the Config it is
+// given each time it runs a command, rather than once when the pod starts,
+// so that each command may see different mounts, including read-only ones.
+type PerRunMounter interface {
+	MountsPerRun() bool
+}
+
+// A ResourceUpdater is a Runner which can change the CPU and Memory limits
+// of a running pod, such as for the pipelines which override those of the
+// build.  Unset limits are lifted.
+type ResourceUpdater interface {
+	UpdateResources(ctx context.Context, cfg *Config) error
+}
+
+// An OutCopier is a Runner which can copy a directory out of the build
+// environment to the host, such as the output of a failed build before the
+// environment is torn down.
+type OutCopier interface {
+	// CopyOut copies the directory src of the build environment into the
+	// directory dst of the host, which is created if it does not exist.
+	CopyOut(ctx context.Context, cfg *Config, src, dst string) error
+}
+
 type Runner interface {
 	Close() error
 	Name() string
@@ -46,6 +90,20 @@ type Runner interface {
 	WorkspaceTar(ctx context.Context, cfg *Config) (io.ReadCloser, error)
 }
 
+// An ExitError is returned by Run when the command exits with a non-zero
+// code.  Runners may also return errors of their own with an ExitCode method.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("task exited with code %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
 type Loader interface {
 	LoadImage(ctx context.Context, layer v1.Layer, arch apko_types.Architecture, bc *apko_build.Context) (ref string, err error)
 	RemoveImage(ctx context.Context, ref string) error
@@ -0,0 +1,163 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"github.com/chainguard-dev/clog"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// ErrNoGitCheckout is returned when a configuration has no git-checkout step
+// from which an upstream repository can be determined.
+var ErrNoGitCheckout = errors.New("no git-checkout pipeline with a repository found")
+
+// UpstreamVersion describes the newest version found upstream for a package.
+type UpstreamVersion struct {
+	// The repository whose tags were inspected.
+	Repository string
+	// The newest version found upstream, after applying the configured
+	// tag filters and prefix/suffix stripping.
+	Latest string
+	// Whether Latest is newer than the package version in the configuration.
+	UpdateAvailable bool
+}
+
+// GitCheckoutRepository returns the repository of the first git-checkout
+// step found in the main package pipelines.
+func GitCheckoutRepository(cfg *config.Configuration) (string, error) {
+	var find func(ps []config.Pipeline) string
+	find = func(ps []config.Pipeline) string {
+		for _, p := range ps {
+			if repo := p.GitCheckoutRepository(); repo != "" {
+				return repo
+			}
+			if repo := find(p.Pipeline); repo != "" {
+				return repo
+			}
+		}
+		return ""
+	}
+
+	if repo := find(cfg.Pipeline); repo != "" {
+		return repo, nil
+	}
+
+	return "", ErrNoGitCheckout
+}
+
+// LatestGitTag lists the tags of the upstream repository used by the
+// configuration's git-checkout step and determines whether a version newer
+// than `${{package.version}}` exists. The update.git block of the
+// configuration, if present, is used to filter tags and strip affixes.
+func LatestGitTag(ctx context.Context, cfg *config.Configuration) (*UpstreamVersion, error) {
+	repo, err := GitCheckoutRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repo},
+	})
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing tags of %s: %w", repo, err)
+	}
+
+	tags := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+	}
+
+	return latestVersion(ctx, cfg, repo, tags)
+}
+
+// latestVersion picks the newest version out of the given tags, honoring the
+// tag filters of the configuration's update block.
+func latestVersion(ctx context.Context, cfg *config.Configuration, repo string, tags []string) (*UpstreamVersion, error) {
+	log := clog.FromContext(ctx)
+
+	gm := cfg.Update.GitMonitor
+	if gm == nil {
+		gm = &config.GitMonitor{}
+	}
+
+	ignore := make([]*regexp.Regexp, 0, len(cfg.Update.IgnoreRegexPatterns))
+	for _, pattern := range cfg.Update.IgnoreRegexPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compiling ignore pattern %q: %w", pattern, err)
+		}
+		ignore = append(ignore, re)
+	}
+
+	current, err := apk.ParseVersion(cfg.Package.Version)
+	if err != nil {
+		return nil, fmt.Errorf("parsing package version %q: %w", cfg.Package.Version, err)
+	}
+
+	uv := &UpstreamVersion{Repository: repo}
+	var latest apk.Version
+
+tags:
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, gm.GetFilterPrefix()) || !strings.Contains(tag, gm.GetFilterContains()) {
+			continue
+		}
+
+		v := strings.TrimSuffix(strings.TrimPrefix(tag, gm.GetStripPrefix()), gm.GetStripSuffix())
+		if sep := cfg.Update.VersionSeparator; sep != "" {
+			v = strings.ReplaceAll(v, sep, ".")
+		}
+
+		for _, re := range ignore {
+			if re.MatchString(v) {
+				continue tags
+			}
+		}
+
+		parsed, err := apk.ParseVersion(v)
+		if err != nil {
+			log.Debugf("ignoring tag %q: %v", tag, err)
+			continue
+		}
+
+		if uv.Latest == "" || apk.CompareVersions(parsed, latest) > 0 {
+			uv.Latest, latest = v, parsed
+		}
+	}
+
+	if uv.Latest == "" {
+		return nil, fmt.Errorf("no version tags found in %s", repo)
+	}
+
+	uv.UpdateAvailable = apk.CompareVersions(latest, current) > 0
+
+	return uv, nil
+}
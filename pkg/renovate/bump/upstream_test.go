@@ -0,0 +1,97 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestLatestGitTag(t *testing.T) {
+	ctx := slogtest.Context(t)
+	dir := t.TempDir()
+
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	hash, err := wt.Commit("initial", &git.CommitOptions{
+		AllowEmptyCommits: true,
+		Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+	})
+	require.NoError(t, err)
+	for _, tag := range []string{"v1.0.0", "v1.2.0", "v0.9.0", "nightly"} {
+		_, err := repo.CreateTag(tag, hash, nil)
+		require.NoError(t, err)
+	}
+
+	cfg := &config.Configuration{
+		Package: config.Package{Name: "foo", Version: "1.0.0"},
+		Pipeline: []config.Pipeline{{
+			Uses: "git-checkout",
+			With: map[string]string{"repository": dir},
+		}},
+		Update: config.Update{
+			GitMonitor: &config.GitMonitor{StripPrefix: "v", TagFilterPrefix: "v"},
+		},
+	}
+
+	uv, err := LatestGitTag(ctx, cfg)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.0", uv.Latest)
+	require.True(t, uv.UpdateAvailable)
+
+	cfg.Package.Version = "1.2.0"
+	uv, err = LatestGitTag(ctx, cfg)
+	require.NoError(t, err)
+	require.False(t, uv.UpdateAvailable)
+}
+
+func TestLatestVersion_filters(t *testing.T) {
+	ctx := slogtest.Context(t)
+	cfg := &config.Configuration{
+		Package: config.Package{Name: "foo", Version: "1.0.0"},
+		Update: config.Update{
+			IgnoreRegexPatterns: []string{`rc`},
+			GitMonitor:          &config.GitMonitor{StripPrefix: "release-", TagFilterPrefix: "release-"},
+		},
+	}
+
+	uv, err := latestVersion(ctx, cfg, "repo", []string{"release-1.1.0", "release-2.0.0rc1", "v3.0.0", "release-0.1.0"})
+	require.NoError(t, err)
+	require.Equal(t, "1.1.0", uv.Latest)
+	require.True(t, uv.UpdateAvailable)
+
+	_, err = GitCheckoutRepository(cfg)
+	require.ErrorIs(t, err, ErrNoGitCheckout)
+
+	// Versioned git-checkout pipelines are found too.
+	cfg.Pipeline = []config.Pipeline{{
+		Pipeline: []config.Pipeline{{
+			Uses: "git-checkout@v2",
+			With: map[string]string{"repository": "https://github.com/foo/bar"},
+		}},
+	}}
+	repo, err := GitCheckoutRepository(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "https://github.com/foo/bar", repo)
+}
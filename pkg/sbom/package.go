@@ -80,9 +80,18 @@ type Package struct {
 	Checksums map[string]string
 
 	// The Package URL for this package, if any. If set, it will be added as the
-	// only ExternalRef of type "purl" to the SPDX package. (A package
-	// should have only one PURL external ref.)
+	// first ExternalRef of type "purl" to the SPDX package. (A package
+	// should have only one PURL external ref, but for AlternatePURLs.)
 	PURL *purl.PackageURL
+
+	// Other Package URLs of the very same package, such as those of the
+	// mirrors it was downloaded from, added as ExternalRefs of type "purl"
+	// after PURL.
+	AlternatePURLs []*purl.PackageURL
+
+	// Background information about the origin of the package, such as how its
+	// source was verified.
+	SourceInfo string
 }
 
 // ToSPDX returns the Package converted to its SPDX representation.
@@ -108,6 +117,7 @@ func (p Package) ToSPDX(ctx context.Context) spdx.Package {
 		LicenseDeclared:  p.LicenseDeclared,
 		DownloadLocation: spdx.NOASSERTION,
 		CopyrightText:    p.Copyright,
+		SourceInfo:       p.SourceInfo,
 		Checksums:        p.getChecksums(),
 		ExternalRefs:     p.getExternalRefs(),
 		Originator:       p.getSupplier(), // yes, we use this value for both fields (for now)
@@ -171,6 +181,14 @@ func (p Package) getExternalRefs() []spdx.ExternalRef {
 		})
 	}
 
+	for _, alt := range p.AlternatePURLs {
+		result = append(result, spdx.ExternalRef{
+			Category: spdx.ExtRefPackageManager,
+			Locator:  alt.ToString(),
+			Type:     spdx.ExtRefTypePurl,
+		})
+	}
+
 	return result
 }
 
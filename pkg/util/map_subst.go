@@ -16,27 +16,13 @@ package util
 
 import (
 	"fmt"
-	"strconv"
 
 	"chainguard.dev/melange/pkg/cond"
 )
 
 // Given a string and a map, replace the variables in the string with values in the map
 func MutateStringFromMap(with map[string]string, input string) (string, error) {
-	lookupWith := func(key string) (string, error) {
-		if val, ok := with[key]; ok {
-			return val, nil
-		}
-
-		nk := fmt.Sprintf("${{%s}}", key)
-		if val, ok := with[nk]; ok {
-			return val, nil
-		}
-
-		return "", fmt.Errorf("variable %s not defined", key)
-	}
-
-	return cond.Subst(input, lookupWith)
+	return cond.Subst(input, LookupFromMap(with))
 }
 
 // Given a string and a map, replace the variables in the string with quoted values in the map.
@@ -44,18 +30,22 @@ func MutateStringFromMap(with map[string]string, input string) (string, error) {
 // as comparision values with == and !=. If we want to be able to resolve an "if" that can be fed
 // back into melange, we need to maintain that requirement, so all variables get quoted once replaced.
 func MutateAndQuoteStringFromMap(with map[string]string, input string) (string, error) {
-	lookupWith := func(key string) (string, error) {
+	return cond.SubstQuoted(input, LookupFromMap(with))
+}
+
+// LookupFromMap returns a function which looks up variables in a map, keyed by
+// either the variable name or its ${{reference}}.
+func LookupFromMap(with map[string]string) cond.VariableLookupFunction {
+	return func(key string) (string, error) {
 		if val, ok := with[key]; ok {
 			return val, nil
 		}
 
 		nk := fmt.Sprintf("${{%s}}", key)
 		if val, ok := with[nk]; ok {
-			return strconv.Quote(val), nil
+			return val, nil
 		}
 
 		return "", fmt.Errorf("variable %s not defined", key)
 	}
-
-	return cond.Subst(input, lookupWith)
 }